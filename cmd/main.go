@@ -2,28 +2,71 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"nodeto/restic-csi-plugin/config"
+    "nodeto/restic-csi-plugin/internal/redact"
     "nodeto/restic-csi-plugin/internal/server"
 	"os"
 	"os/signal"
 	"syscall"
 )
 
+// versionInfo is the version printed by --version --output json.
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	TreeState string `json:"treeState"`
+}
+
+// printVersion prints the version of the driver to out, as text or json.
+func printVersion(out io.Writer, format string) error {
+	switch format {
+	case "text":
+		_, err := fmt.Fprintf(out, "%s - %s (%s)\n", server.GetVersion(), server.GetCommit(), server.GetTreeState())
+		return err
+	case "json":
+		return json.NewEncoder(out).Encode(versionInfo{
+			Version:   server.GetVersion(),
+			Commit:    server.GetCommit(),
+			TreeState: server.GetTreeState(),
+		})
+	}
+	return fmt.Errorf("unknown output format %q, expected text or json", format)
+}
+
 func main() {
+	if ran, err := runSubcommand(context.Background(), os.Args[1:]); ran {
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	var (
 		nodeId         = flag.String("node-id", "", "The Node ID")
 		endpoint       = flag.String("endpoint", "unix:///csi/csi.sock", "CSI endpoint")
 		version        = flag.Bool("version", false, "Print the version and exit.")
-		configFilePath = flag.String("config", "/local/config.toml", "Path to the configuration file")
-		secretFilePath = flag.String("secret", "/secrets/secret.toml", "Path to the secret file")
+		output         = flag.String("output", "text", "Format of --version, text or json")
+		configFilePath = flag.String("config", "/local/config.toml", "Path to the configuration file (.toml, .yaml or .yml)")
+		secretFilePath = flag.String("secret", "/secrets/secret.toml", "Path to the secret file (.toml, .yaml or .yml)")
+		resticBinary   = flag.String("restic-binary", "", "Path to the restic executable, overrides restic_binary from the configuration file")
+		healthPort     = flag.Int("health-port", 0, "Port for the HTTP liveness and readiness endpoints, 0 disables them")
+		socketMode     = flag.String("socket-mode", "", "Octal permissions of the CSI socket, ie 0660")
+		socketGroup    = flag.String("socket-group", "", "Group name or ID owning the CSI socket")
+		debug          = flag.Bool("debug", false, "Serve the /debug endpoints on the health port")
+		validateRepos  = flag.Bool("validate-repos", false, "Check that every restic repository can be opened before serving, exit if one can't")
 	)
 	flag.Parse()
 
 	if *version {
-		fmt.Printf("%s - %s (%s)\n", server.GetVersion(), server.GetCommit(), server.GetTreeState())
+		if err := printVersion(os.Stdout, *output); err != nil {
+			log.Fatalln(err)
+		}
 		os.Exit(0)
 	}
 
@@ -32,12 +75,21 @@ func main() {
 		os.Exit(1)
 	}
 
+	socketPermissions, err := server.ParseSocketPermissions(*socketMode, *socketGroup)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	config, err := config.LoadConfig(*configFilePath, *secretFilePath)
 	if err != nil {
 		// Handle the error, for example, log it and exit
 		log.Fatalf("Error loading configuration: %s", err)
 	}
 
+	if *resticBinary != "" {
+		config.ResticBinary = *resticBinary
+	}
+
 	// Log staging information
 	log.Printf("Staging path: %s\n", config.VolumeInformation.StagingPath)
 	log.Printf("Thin pool path: %s\n", config.VolumeInformation.ThinPoolName)
@@ -45,12 +97,12 @@ func main() {
 
 	// Print repositories
 	for i, destination := range config.ResticRepo {
-		log.Printf("Info: Destination %d of %d - %s", i+1, len(config.ResticRepo), destination.Repository)
+		log.Printf("Info: Destination %d of %d - %s", i+1, len(config.ResticRepo), redact.URL(destination.Repository))
 	}
 
 	log.Printf("Info: Using endpoint - %s", *endpoint)
 
-	drv, err := server.NewDriver(*endpoint, "", *nodeId, &config)
+	drv, err := server.NewDriver(*endpoint, "", *nodeId, *healthPort, socketPermissions, *debug, &config)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -58,6 +110,12 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	if *validateRepos {
+		if err := drv.ValidateDestinations(ctx); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/server"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSnapshotsArgs(t *testing.T) {
+	opts, err := parseSnapshotsArgs([]string{"--config", "/etc/restic-csi/config.yaml", "--repo", "/mnt/backup/restic", "--tag", "csi-snapshot,csi-volume=test-volume"})
+	assert.Nil(t, err)
+	assert.Equal(t, "/etc/restic-csi/config.yaml", opts.configFilePath)
+	assert.Equal(t, "/secrets/secret.toml", opts.secretFilePath)
+	assert.Equal(t, "/mnt/backup/restic", opts.repo)
+	assert.Equal(t, []string{"csi-snapshot", "csi-volume=test-volume"}, opts.tags)
+
+	_, err = parseSnapshotsArgs([]string{"extra"})
+	assert.NotNil(t, err)
+}
+
+func TestParseRestoreArgs(t *testing.T) {
+	opts, err := parseRestoreArgs([]string{"--snapshot", "4f3a2b1c", "--target", "/mnt/restore"})
+	assert.Nil(t, err)
+	assert.Equal(t, "4f3a2b1c", opts.snapshotID)
+	assert.Equal(t, "/mnt/restore", opts.target)
+	assert.Equal(t, "/local/config.toml", opts.configFilePath)
+
+	_, err = parseRestoreArgs([]string{"--target", "/mnt/restore"})
+	assert.NotNil(t, err)
+	_, err = parseRestoreArgs([]string{"--snapshot", "4f3a2b1c"})
+	assert.NotNil(t, err)
+}
+
+func TestServeFlagsAreNotSubcommands(t *testing.T) {
+	for _, args := range [][]string{nil, {"--version"}, {"-node-id", "node-1", "-endpoint", "unix:///csi/csi.sock"}} {
+		ran, err := runSubcommand(context.Background(), args)
+		assert.False(t, ran)
+		assert.Nil(t, err)
+	}
+}
+
+func TestPrintVersion(t *testing.T) {
+	var out bytes.Buffer
+	assert.Nil(t, printVersion(&out, "json"))
+	var fields map[string]string
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &fields))
+	assert.Equal(t, map[string]string{"version": server.GetVersion(), "commit": server.GetCommit(), "treeState": server.GetTreeState()}, fields)
+
+	// Text stays the default
+	out.Reset()
+	assert.Nil(t, printVersion(&out, "text"))
+	assert.Equal(t, server.GetVersion()+" - "+server.GetCommit()+" ("+server.GetTreeState()+")\n", out.String())
+
+	assert.NotNil(t, printVersion(&out, "yaml"))
+}
+
+func TestSelectDestination(t *testing.T) {
+	cfg := config.Config{ResticRepo: []config.Destination{{Repository: "s3:s3.amazonaws.com/bucket/restic"}, {Repository: "/mnt/backup/restic"}}}
+
+	dest, err := selectDestination(cfg, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "s3:s3.amazonaws.com/bucket/restic", dest.Repository)
+
+	dest, err = selectDestination(cfg, "/mnt/backup/restic")
+	assert.Nil(t, err)
+	assert.Equal(t, "/mnt/backup/restic", dest.Repository)
+
+	_, err = selectDestination(cfg, "/mnt/other")
+	assert.NotNil(t, err)
+	_, err = selectDestination(config.Config{}, "")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/ionice"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"nodeto/restic-csi-plugin/internal/restic"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// These allow mocking of the volume and restic operations of the self-test.
+var (
+	openSelftestPool = func(ctx context.Context, name string) (lvm.ThinPoolInterface, error) {
+		pool, err := lvm.NewThinPool(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return pool, nil
+	}
+	mountSelftestVolume = func(volume *lvm.Volume, ctx context.Context, mountPath string) error {
+		return volume.EnsureVolumeIsMounted(ctx, mountPath)
+	}
+	unmountSelftestVolume = lvm.Unmount
+	selftestBackup        = restic.Backup
+	selftestRestore       = restic.Restore
+	selftestForget        = restic.Forget
+)
+
+// selftestTag marks the snapshots made by the self-test.
+const selftestTag = "csi-selftest"
+
+// selftestStep is a step of the self-test. The cleanup of every step that
+// was started is run once the self-test is over, also when the step failed
+// halfway, so it must cope with what it's cleaning up being absent.
+type selftestStep struct {
+	name    string
+	run     func(ctx context.Context) error
+	cleanup func(ctx context.Context) error
+}
+
+type selftestOptions struct {
+	repositoryOptions
+	volumeName string
+	size       lvm.ByteSize
+	mountPath  string
+	restic     bool
+}
+
+func parseSelftestArgs(args []string) (selftestOptions, error) {
+	var opts selftestOptions
+	var size string
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	opts.register(fs)
+	fs.StringVar(&opts.volumeName, "volume", "csi-selftest", "Name of the test volume created in the thin pool")
+	fs.StringVar(&size, "size", "64Mi", "Size of the test volume")
+	fs.StringVar(&opts.mountPath, "mount-path", "", "Directory the test volume is mounted at, defaults to a temporary directory")
+	fs.BoolVar(&opts.restic, "restic", false, "Also back the test volume up to the repository and restore it")
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	if fs.NArg() > 0 {
+		return opts, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	parsed, err := lvm.ParseByteSize(size)
+	if err != nil {
+		return opts, fmt.Errorf("invalid --size: %w", err)
+	}
+	opts.size = parsed
+	return opts, nil
+}
+
+// runSelftest creates a volume in the configured thin pool, mounts it and
+// writes and reads back a file, optionally through a restic backup and
+// restore, to check that the node is set up to run the driver.
+func runSelftest(ctx context.Context, args []string, out io.Writer) error {
+	opts, err := parseSelftestArgs(args)
+	if err != nil {
+		return err
+	}
+	cfg, err := config.LoadConfig(opts.configFilePath, opts.secretFilePath)
+	if err != nil {
+		return fmt.Errorf("error loading configuration: %w", err)
+	}
+	for name, path := range cfg.Tools {
+		if err := lvm.SetToolPath(name, path); err != nil {
+			return err
+		}
+	}
+	if cfg.VolumeInformation.MkfsTimeout > 0 {
+		lvm.MkfsTimeout = cfg.VolumeInformation.MkfsTimeout
+	}
+	if cfg.VolumeInformation.DevicePath != "" {
+		lvm.DevicePath = cfg.VolumeInformation.DevicePath
+	}
+	// The test volume is formatted and backed up like the driver's.
+	lvm.MkfsPriority = ionice.Priority(cfg.IOPriority)
+	restic.Priority = ionice.Priority(cfg.IOPriority)
+	// The driver only sees volumes with its prefix, the test volume too.
+	if err := lvm.SetVolumeNamePrefix(cfg.VolumeInformation.LVNamePrefix); err != nil {
+		return err
+	}
+	opts.volumeName = lvm.VolumeNameFor(opts.volumeName)
+
+	var dest *config.Destination
+	if opts.restic {
+		if cfg.ResticBinary != "" {
+			restic.Binary = cfg.ResticBinary
+		}
+		if opts.resticBinary != "" {
+			restic.Binary = opts.resticBinary
+		}
+		selected, err := selectDestination(cfg, opts.repo)
+		if err != nil {
+			return err
+		}
+		dest = &selected
+	}
+
+	if opts.mountPath == "" {
+		dir, err := os.MkdirTemp("", "restic-csi-selftest-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		opts.mountPath = filepath.Join(dir, "volume")
+	}
+
+	steps := selftestSteps(cfg, opts, dest)
+	return runSelftestSteps(ctx, out, steps)
+}
+
+// selftestSteps returns the steps of the self-test, the restic round-trip is
+// only included with a destination.
+func selftestSteps(cfg config.Config, opts selftestOptions, dest *config.Destination) []selftestStep {
+	var pool lvm.ThinPoolInterface
+	var volume *lvm.Volume
+	created := false
+	content := []byte(fmt.Sprintf("restic-csi-driver self-test %s\n", time.Now().UTC().Format(time.RFC3339Nano)))
+	testFile := filepath.Join(opts.mountPath, "selftest.txt")
+
+	steps := []selftestStep{
+		{
+			name: "open thin pool " + cfg.VolumeInformation.ThinPoolName,
+			run: func(ctx context.Context) (err error) {
+				if pool, err = openSelftestPool(ctx, cfg.VolumeInformation.ThinPoolName); err != nil {
+					return err
+				}
+				if tp, ok := pool.(*lvm.ThinPool); ok {
+					tp.MkfsOptions = cfg.VolumeInformation.MkfsOptions
+				}
+				return nil
+			},
+		},
+		{
+			name: "create volume " + opts.volumeName,
+			run: func(ctx context.Context) error {
+				if pool.GetVolume(ctx, opts.volumeName) != nil {
+					return fmt.Errorf("volume %s already exists, remove it or pick another with --volume", opts.volumeName)
+				}
+				created = true
+				if err := pool.EnsureVolumeIsPresent(ctx, opts.volumeName, opts.size); err != nil {
+					return err
+				}
+				if volume = pool.GetVolume(ctx, opts.volumeName); volume == nil {
+					return fmt.Errorf("volume %s was not found after creation", opts.volumeName)
+				}
+				return nil
+			},
+			cleanup: func(ctx context.Context) error {
+				if !created {
+					return nil
+				}
+				return pool.EnsureVolumeIsAbsent(ctx, opts.volumeName)
+			},
+		},
+		{
+			name: "mount volume at " + opts.mountPath,
+			run: func(ctx context.Context) error {
+				if err := os.MkdirAll(opts.mountPath, 0750); err != nil {
+					return err
+				}
+				return mountSelftestVolume(volume, ctx, opts.mountPath)
+			},
+			cleanup: func(ctx context.Context) error {
+				if err := unmountSelftestVolume(ctx, pool.CommandRunner(), opts.mountPath); err != nil {
+					return err
+				}
+				if err := os.Remove(opts.mountPath); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				return nil
+			},
+		},
+		{
+			name: "write file",
+			run: func(ctx context.Context) error {
+				return os.WriteFile(testFile, content, 0640)
+			},
+		},
+		{
+			name: "read file",
+			run: func(ctx context.Context) error {
+				return compareFile(testFile, content)
+			},
+		},
+	}
+	if dest == nil {
+		return steps
+	}
+
+	var snapshotID string
+	restorePath := opts.mountPath + "-restore"
+	return append(steps,
+		selftestStep{
+			name: "back up volume to " + dest.Repository,
+			run: func(ctx context.Context) (err error) {
+				snapshotID, err = selftestBackup(ctx, *dest, opts.mountPath, selftestTag)
+				return err
+			},
+			cleanup: func(ctx context.Context) error {
+				if snapshotID == "" {
+					return nil
+				}
+				return selftestForget(ctx, *dest, snapshotID)
+			},
+		},
+		selftestStep{
+			name: "restore volume from " + dest.Repository,
+			run: func(ctx context.Context) error {
+				// Only the contents of the backed up path are restored, as
+				// when restoring a volume.
+				if err := selftestRestore(ctx, *dest, snapshotID+":"+opts.mountPath, restorePath); err != nil {
+					return err
+				}
+				return compareFile(filepath.Join(restorePath, filepath.Base(testFile)), content)
+			},
+			cleanup: func(ctx context.Context) error {
+				return os.RemoveAll(restorePath)
+			},
+		},
+	)
+}
+
+// compareFile checks that the file holds content.
+func compareFile(path string, content []byte) error {
+	read, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(read, content) {
+		return fmt.Errorf("%s holds %q, expected %q", path, read, content)
+	}
+	return nil
+}
+
+// runSelftestSteps runs the steps in order until one fails, then cleans up
+// the started steps in reverse order, reporting the result of each on out.
+// The cleanup runs on a fresh context so an interrupted self-test still
+// removes its volume.
+func runSelftestSteps(ctx context.Context, out io.Writer, steps []selftestStep) error {
+	var failed error
+	started := 0
+	for _, step := range steps {
+		if failed != nil {
+			fmt.Fprintf(out, "SKIP  %s\n", step.name)
+			continue
+		}
+		started++
+		if err := step.run(ctx); err != nil {
+			failed = fmt.Errorf("%s: %w", step.name, err)
+			fmt.Fprintf(out, "FAIL  %s: %s\n", step.name, err)
+			continue
+		}
+		fmt.Fprintf(out, "PASS  %s\n", step.name)
+	}
+
+	cleanupCtx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	var cleanupErrs []string
+	for i := started - 1; i >= 0; i-- {
+		step := steps[i]
+		if step.cleanup == nil {
+			continue
+		}
+		if err := step.cleanup(cleanupCtx); err != nil {
+			cleanupErrs = append(cleanupErrs, fmt.Sprintf("%s: %s", step.name, err))
+			fmt.Fprintf(out, "FAIL  clean up %s: %s\n", step.name, err)
+			continue
+		}
+		fmt.Fprintf(out, "PASS  clean up %s\n", step.name)
+	}
+
+	switch {
+	case failed != nil:
+		return fmt.Errorf("self-test failed: %w", failed)
+	case len(cleanupErrs) > 0:
+		return errors.New("self-test clean up failed: " + strings.Join(cleanupErrs, "; "))
+	}
+	fmt.Fprintln(out, "self-test passed")
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// selftestPool is a thin pool recording the calls of the self-test.
+type selftestPool struct {
+	lvm.ThinPoolInterface
+	calls     *[]string
+	volumes   map[string]bool
+	createErr error
+}
+
+func (p *selftestPool) EnsureVolumeIsPresent(ctx context.Context, volumeName string, size lvm.ByteSize, tags ...string) error {
+	*p.calls = append(*p.calls, "create "+volumeName)
+	if p.createErr != nil {
+		return p.createErr
+	}
+	p.volumes[volumeName] = true
+	return nil
+}
+
+func (p *selftestPool) EnsureVolumeIsAbsent(ctx context.Context, volumeName string) error {
+	*p.calls = append(*p.calls, "remove "+volumeName)
+	delete(p.volumes, volumeName)
+	return nil
+}
+
+func (p *selftestPool) CommandRunner() lvm.CommandRunner {
+	return nil
+}
+
+func (p *selftestPool) GetVolume(ctx context.Context, volumeName string) *lvm.Volume {
+	if !p.volumes[volumeName] {
+		return nil
+	}
+	return &lvm.Volume{VGName: "vg0", LVName: volumeName}
+}
+
+// mockSelftest mocks the volume and restic operations of the self-test,
+// unmounting drops the files written to the mount path as if the volume's
+// filesystem went away, and returns the log of calls.
+func mockSelftest(t *testing.T, pool *selftestPool) *[]string {
+	calls := []string{}
+	pool.calls = &calls
+	if pool.volumes == nil {
+		pool.volumes = map[string]bool{}
+	}
+
+	origOpen, origMount, origUnmount := openSelftestPool, mountSelftestVolume, unmountSelftestVolume
+	origBackup, origRestore, origForget := selftestBackup, selftestRestore, selftestForget
+	t.Cleanup(func() {
+		openSelftestPool, mountSelftestVolume, unmountSelftestVolume = origOpen, origMount, origUnmount
+		selftestBackup, selftestRestore, selftestForget = origBackup, origRestore, origForget
+	})
+
+	openSelftestPool = func(ctx context.Context, name string) (lvm.ThinPoolInterface, error) {
+		calls = append(calls, "open "+name)
+		return pool, nil
+	}
+	mountSelftestVolume = func(volume *lvm.Volume, ctx context.Context, mountPath string) error {
+		calls = append(calls, "mount "+volume.LVName)
+		return nil
+	}
+	unmountSelftestVolume = func(ctx context.Context, runner lvm.CommandRunner, target string) error {
+		calls = append(calls, "unmount")
+		os.Remove(filepath.Join(target, "selftest.txt"))
+		return nil
+	}
+	selftestBackup = func(ctx context.Context, dest config.Destination, path string, tags ...string) (string, error) {
+		calls = append(calls, "backup "+strings.Join(tags, ","))
+		return "4f3a2b1c", nil
+	}
+	selftestRestore = func(ctx context.Context, dest config.Destination, snapshotID string, target string) error {
+		calls = append(calls, "restore "+snapshotID)
+		// The backed up path is restored from the mount path's copy.
+		source := strings.SplitN(snapshotID, ":", 2)[1]
+		content, err := os.ReadFile(filepath.Join(source, "selftest.txt"))
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(target, 0750); err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(target, "selftest.txt"), content, 0640)
+	}
+	selftestForget = func(ctx context.Context, dest config.Destination, snapshotID string) error {
+		calls = append(calls, "forget "+snapshotID)
+		return nil
+	}
+	return &calls
+}
+
+func selftestConfig() config.Config {
+	return config.Config{VolumeInformation: config.VolumeInformation{ThinPoolName: "/dev/vg0/thinpool"}}
+}
+
+func TestParseSelftestArgs(t *testing.T) {
+	opts, err := parseSelftestArgs([]string{"--volume", "node-check", "--size", "128Mi", "--restic"})
+	assert.Nil(t, err)
+	assert.Equal(t, "node-check", opts.volumeName)
+	assert.Equal(t, lvm.ByteSize(128*1024*1024), opts.size)
+	assert.True(t, opts.restic)
+
+	opts, err = parseSelftestArgs(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "csi-selftest", opts.volumeName)
+	assert.Equal(t, lvm.ByteSize(64*1024*1024), opts.size)
+	assert.False(t, opts.restic)
+
+	_, err = parseSelftestArgs([]string{"--size", "lots"})
+	assert.NotNil(t, err)
+}
+
+func TestSelftestSteps(t *testing.T) {
+	pool := &selftestPool{}
+	calls := mockSelftest(t, pool)
+	opts := selftestOptions{volumeName: "csi-selftest", size: 64 * 1024 * 1024, mountPath: filepath.Join(t.TempDir(), "volume")}
+	dest := config.Destination{Repository: "/mnt/backup/restic"}
+
+	var out bytes.Buffer
+	err := runSelftestSteps(context.Background(), &out, selftestSteps(selftestConfig(), opts, &dest))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"open /dev/vg0/thinpool",
+		"create csi-selftest",
+		"mount csi-selftest",
+		"backup csi-selftest",
+		"restore 4f3a2b1c:" + opts.mountPath,
+		"forget 4f3a2b1c",
+		"unmount",
+		"remove csi-selftest",
+	}, *calls)
+	assert.NotContains(t, out.String(), "FAIL")
+	assert.Contains(t, out.String(), "PASS  read file")
+	assert.Contains(t, out.String(), "self-test passed")
+	assert.Empty(t, pool.volumes)
+	assert.NoDirExists(t, opts.mountPath)
+	assert.NoDirExists(t, opts.mountPath+"-restore")
+}
+
+func TestSelftestWithoutResticSkipsRoundTrip(t *testing.T) {
+	calls := mockSelftest(t, &selftestPool{})
+	opts := selftestOptions{volumeName: "csi-selftest", mountPath: filepath.Join(t.TempDir(), "volume")}
+
+	var out bytes.Buffer
+	assert.Nil(t, runSelftestSteps(context.Background(), &out, selftestSteps(selftestConfig(), opts, nil)))
+	assert.Equal(t, []string{"open /dev/vg0/thinpool", "create csi-selftest", "mount csi-selftest", "unmount", "remove csi-selftest"}, *calls)
+}
+
+func TestSelftestCleansUpAfterFailure(t *testing.T) {
+	pool := &selftestPool{}
+	calls := mockSelftest(t, pool)
+	mountSelftestVolume = func(volume *lvm.Volume, ctx context.Context, mountPath string) error {
+		*calls = append(*calls, "mount "+volume.LVName)
+		return errors.New("mount: wrong fs type")
+	}
+	opts := selftestOptions{volumeName: "csi-selftest", mountPath: filepath.Join(t.TempDir(), "volume")}
+	dest := config.Destination{Repository: "/mnt/backup/restic"}
+
+	var out bytes.Buffer
+	err := runSelftestSteps(context.Background(), &out, selftestSteps(selftestConfig(), opts, &dest))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "wrong fs type")
+	// The steps after the failed one are skipped, the volume is still
+	// unmounted and removed.
+	assert.Equal(t, []string{"open /dev/vg0/thinpool", "create csi-selftest", "mount csi-selftest", "unmount", "remove csi-selftest"}, *calls)
+	assert.Contains(t, out.String(), "FAIL  mount volume at")
+	assert.Contains(t, out.String(), "SKIP  write file")
+	assert.Contains(t, out.String(), "SKIP  back up volume to /mnt/backup/restic")
+	assert.Empty(t, pool.volumes)
+}
+
+func TestSelftestLeavesExistingVolumeAlone(t *testing.T) {
+	pool := &selftestPool{volumes: map[string]bool{"csi-selftest": true}}
+	calls := mockSelftest(t, pool)
+	opts := selftestOptions{volumeName: "csi-selftest", mountPath: filepath.Join(t.TempDir(), "volume")}
+
+	var out bytes.Buffer
+	assert.NotNil(t, runSelftestSteps(context.Background(), &out, selftestSteps(selftestConfig(), opts, nil)))
+	assert.Equal(t, []string{"open /dev/vg0/thinpool"}, *calls)
+	assert.True(t, pool.volumes["csi-selftest"])
+}
+
+func TestSelftestRemovesPartiallyCreatedVolume(t *testing.T) {
+	pool := &selftestPool{createErr: errors.New("mkfs timed out")}
+	calls := mockSelftest(t, pool)
+	opts := selftestOptions{volumeName: "csi-selftest", mountPath: filepath.Join(t.TempDir(), "volume")}
+
+	var out bytes.Buffer
+	assert.NotNil(t, runSelftestSteps(context.Background(), &out, selftestSteps(selftestConfig(), opts, nil)))
+	assert.Equal(t, []string{"open /dev/vg0/thinpool", "create csi-selftest", "remove csi-selftest"}, *calls)
+	assert.Contains(t, out.String(), "PASS  clean up create volume csi-selftest")
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/restic"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// subcommands run against the configured restic repositories out of band,
+// with the same configuration and secrets as the driver.
+var subcommands = map[string]func(ctx context.Context, args []string, out io.Writer) error{
+	"snapshots": runSnapshots,
+	"restore":   runRestore,
+	"selftest":  runSelftest,
+}
+
+// repositoryOptions are the flags shared by all subcommands.
+type repositoryOptions struct {
+	configFilePath string
+	secretFilePath string
+	resticBinary   string
+	repo           string
+}
+
+func (opts *repositoryOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&opts.configFilePath, "config", "/local/config.toml", "Path to the configuration file (.toml, .yaml or .yml)")
+	fs.StringVar(&opts.secretFilePath, "secret", "/secrets/secret.toml", "Path to the secret file (.toml, .yaml or .yml)")
+	fs.StringVar(&opts.resticBinary, "restic-binary", "", "Path to the restic executable, overrides restic_binary from the configuration file")
+	fs.StringVar(&opts.repo, "repo", "", "Repository to use as configured in restic_repo, defaults to the first one")
+}
+
+// destination loads the configuration and returns the selected repository.
+func (opts *repositoryOptions) destination() (config.Destination, error) {
+	cfg, err := config.LoadConfig(opts.configFilePath, opts.secretFilePath)
+	if err != nil {
+		return config.Destination{}, fmt.Errorf("error loading configuration: %w", err)
+	}
+
+	restic.Binary = "restic"
+	if cfg.ResticBinary != "" {
+		restic.Binary = cfg.ResticBinary
+	}
+	if opts.resticBinary != "" {
+		restic.Binary = opts.resticBinary
+	}
+
+	return selectDestination(cfg, opts.repo)
+}
+
+// selectDestination returns the destination with the given repository, or
+// the first one if repo is empty.
+func selectDestination(cfg config.Config, repo string) (config.Destination, error) {
+	if len(cfg.ResticRepo) == 0 {
+		return config.Destination{}, errors.New("no restic repository is configured")
+	}
+	if repo == "" {
+		return cfg.ResticRepo[0], nil
+	}
+	for _, dest := range cfg.ResticRepo {
+		if dest.Repository == repo {
+			return dest, nil
+		}
+	}
+	return config.Destination{}, fmt.Errorf("repository %s is not configured", repo)
+}
+
+type snapshotsOptions struct {
+	repositoryOptions
+	tags []string
+}
+
+func parseSnapshotsArgs(args []string) (snapshotsOptions, error) {
+	var opts snapshotsOptions
+	var tags string
+	fs := flag.NewFlagSet("snapshots", flag.ContinueOnError)
+	opts.register(fs)
+	fs.StringVar(&tags, "tag", "", "Only list snapshots with all of these comma separated tags")
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	if fs.NArg() > 0 {
+		return opts, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if tags != "" {
+		opts.tags = strings.Split(tags, ",")
+	}
+	return opts, nil
+}
+
+// runSnapshots lists the snapshots in a repository.
+func runSnapshots(ctx context.Context, args []string, out io.Writer) error {
+	opts, err := parseSnapshotsArgs(args)
+	if err != nil {
+		return err
+	}
+	dest, err := opts.destination()
+	if err != nil {
+		return err
+	}
+
+	snapshots, err := restic.Snapshots(ctx, dest, opts.tags...)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTIME\tPATHS\tTAGS")
+	for _, snapshot := range snapshots {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", snapshot.ID, snapshot.Time.Format("2006-01-02 15:04:05"), strings.Join(snapshot.Paths, ","), strings.Join(snapshot.Tags, ","))
+	}
+	return w.Flush()
+}
+
+type restoreOptions struct {
+	repositoryOptions
+	snapshotID string
+	target     string
+}
+
+func parseRestoreArgs(args []string) (restoreOptions, error) {
+	var opts restoreOptions
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	opts.register(fs)
+	fs.StringVar(&opts.snapshotID, "snapshot", "", "ID of the snapshot to restore")
+	fs.StringVar(&opts.target, "target", "", "Directory to restore the snapshot into")
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	if fs.NArg() > 0 {
+		return opts, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if opts.snapshotID == "" {
+		return opts, errors.New("--snapshot is required")
+	}
+	if opts.target == "" {
+		return opts, errors.New("--target is required")
+	}
+	return opts, nil
+}
+
+// runRestore restores a snapshot into a directory.
+func runRestore(ctx context.Context, args []string, out io.Writer) error {
+	opts, err := parseRestoreArgs(args)
+	if err != nil {
+		return err
+	}
+	dest, err := opts.destination()
+	if err != nil {
+		return err
+	}
+
+	if err := restic.Restore(ctx, dest, opts.snapshotID, opts.target); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "restored snapshot %s to %s\n", opts.snapshotID, opts.target)
+	return nil
+}
+
+// runSubcommand runs the subcommand named by the first argument, if any, and
+// reports whether there was one. The driver is served otherwise.
+func runSubcommand(ctx context.Context, args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	subcommand, ok := subcommands[args[0]]
+	if !ok {
+		return false, nil
+	}
+	return true, subcommand(ctx, args[1:], os.Stdout)
+}
@@ -1,31 +1,334 @@
 package config
 
 import (
+	"fmt"
+	"nodeto/restic-csi-plugin/internal/ionice"
+	"nodeto/restic-csi-plugin/internal/lvm"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
 )
 
 // Secret represents the structure of the secrets file
 type Secret map[string]string
 
+// Snapshot backends CSI snapshots can be taken with.
+const (
+	SnapshotBackendLVM    = "lvm"
+	SnapshotBackendRestic = "restic"
+)
+
+// Policies for applying the fsGroup of a published volume.
+const (
+	FSGroupPolicyTopLevel  = "top-level"
+	FSGroupPolicyRecursive = "recursive"
+)
+
+// Ways XFS clones are mounted next to their origin.
+const (
+	CloneUUIDGenerate = "generate"
+	CloneUUIDNouuid   = "nouuid"
+)
+
+// Device paths volumes are used through.
+const (
+	DevicePathLVM    = "lvm"
+	DevicePathMapper = "mapper"
+	DevicePathAuto   = "auto"
+)
+
 // Volume Information
 type VolumeInformation struct {
-	StagingPath  string `toml:"staging_path"`
-	ThinPoolName string `toml:"thin_pool_name"`
+	// StagingPath is where the driver keeps its metadata and mounts, it may
+	// be a template like "/mnt/{{.NodeID}}" rendered at startup, see
+	// StagingPathData.
+	StagingPath  string `toml:"staging_path" yaml:"staging_path"`
+	ThinPoolName string `toml:"thin_pool_name" yaml:"thin_pool_name"`
+	// PoolWaitTimeout is how long startup keeps retrying to open the thin
+	// pool, ie while the volume group is still being activated on boot.
+	// Zero fails on the first attempt.
+	PoolWaitTimeout time.Duration `toml:"pool_wait_timeout" yaml:"pool_wait_timeout"`
+	// LVNamePrefix starts the names of the LVs the driver creates, ie
+	// "csi-". The driver ignores the LVs of the thin pool without it, so
+	// it can share the pool with other tools.
+	LVNamePrefix string `toml:"lv_name_prefix" yaml:"lv_name_prefix"`
+	// SnapshotSizePercent sizes backup snapshots relative to their origin,
+	// zero uses the full origin size.
+	SnapshotSizePercent int64 `toml:"snapshot_size_percent" yaml:"snapshot_size_percent"`
+	// TopologyKey is the topology segment key volumes are bound to nodes
+	// with, the driver's default is used when empty.
+	TopologyKey string `toml:"topology_key" yaml:"topology_key"`
+	// MaxVolumesPerNode limits the volumes the CO schedules onto the node,
+	// zero is unlimited.
+	MaxVolumesPerNode int64 `toml:"max_volumes_per_node" yaml:"max_volumes_per_node"`
+	// MkfsOptions are extra mkfs arguments by filesystem type, ie
+	// xfs = ["-d", "su=64k,sw=4"]. The device is always appended.
+	MkfsOptions map[string][]string `toml:"mkfs_options" yaml:"mkfs_options"`
+	// MkfsTimeout is how long formatting a new volume may take before mkfs
+	// is killed and the volume removed. Defaults to 10 minutes.
+	MkfsTimeout time.Duration `toml:"mkfs_timeout" yaml:"mkfs_timeout"`
+	// BackupByDefault decides whether volumes without a backup parameter are
+	// backed up, unset backs them up.
+	BackupByDefault *bool `toml:"backup_by_default" yaml:"backup_by_default"`
+	// BackupInterval is how often mounted volumes are backed up, volumes
+	// override it with the backup_interval parameter. Zero only backs up the
+	// volumes with a parameter.
+	BackupInterval time.Duration `toml:"backup_interval" yaml:"backup_interval"`
+	// PruneBackupsOnDelete forgets and prunes the snapshots of a volume from
+	// every destination which isn't append-only when the volume is deleted.
+	PruneBackupsOnDelete bool `toml:"prune_backups_on_delete" yaml:"prune_backups_on_delete"`
+	// LayoutBackupInterval is how often the LVM layout of the volume group,
+	// with the thin pool and its volumes, is backed up to the primary
+	// destinations so a node can be rebuilt before restoring the volumes.
+	// Zero never backs it up.
+	LayoutBackupInterval time.Duration `toml:"layout_backup_interval" yaml:"layout_backup_interval"`
+	// BackupOnUnstage backs volumes up one last time before they're
+	// unstaged, volumes override it with the backup_on_unstage parameter.
+	BackupOnUnstage bool `toml:"backup_on_unstage" yaml:"backup_on_unstage"`
+	// UnstageBackupTimeout is how long the backup before unstaging may take
+	// before the volume is unstaged without it. Defaults to 10 minutes.
+	UnstageBackupTimeout time.Duration `toml:"unstage_backup_timeout" yaml:"unstage_backup_timeout"`
+	// UnstageBackupRequired fails unstaging a volume whose backup failed, so
+	// the CO retries it, instead of only logging the failure.
+	UnstageBackupRequired bool `toml:"unstage_backup_required" yaml:"unstage_backup_required"`
+	// SnapshotBackend is where CSI snapshots are taken, either "lvm" or
+	// "restic" for offsite snapshots in the first restic repository.
+	// Defaults to "lvm".
+	SnapshotBackend string `toml:"snapshot_backend" yaml:"snapshot_backend"`
+	// KubeletPath is kubelet's root directory, whose CSI target and staging
+	// paths are reconciled on startup. Defaults to "/var/lib/kubelet".
+	KubeletPath string `toml:"kubelet_path" yaml:"kubelet_path"`
+	// FSGroupPolicy is how the fsGroup of a published volume is applied,
+	// "top-level" changes only the volume root and "recursive" every file
+	// in the volume. Defaults to "top-level" to avoid chowning large
+	// filesystems on every publish.
+	FSGroupPolicy string `toml:"fs_group_policy" yaml:"fs_group_policy"`
+	// Discard mounts volumes without a discard parameter with online
+	// discard, so blocks freed by the filesystem return to the thin pool.
+	Discard bool `toml:"discard" yaml:"discard"`
+	// FstrimInterval is how often the mounted volumes are trimmed with
+	// fstrim instead, zero disables it.
+	FstrimInterval time.Duration `toml:"fstrim_interval" yaml:"fstrim_interval"`
+	// Encrypted creates volumes without an encrypted parameter with a LUKS
+	// device under their filesystem.
+	Encrypted bool `toml:"encrypted" yaml:"encrypted"`
+	// EncryptionKey is the passphrase of encrypted volumes, usually a
+	// "secret:" placeholder for a key of the secret file.
+	EncryptionKey string `toml:"encryption_key" yaml:"encryption_key"`
+	// CloneUUID is how XFS clones, which share the filesystem UUID of their
+	// origin, can be mounted next to it. "generate" gives new clones a fresh
+	// UUID and "nouuid" mounts them with nouuid. Defaults to "generate".
+	CloneUUID string `toml:"clone_uuid" yaml:"clone_uuid"`
+	// DevicePath is which path volume devices are used through, "lvm" for
+	// /dev/<vg>/<lv>, "mapper" for /dev/mapper/<vg>-<lv> where the LVM udev
+	// rules don't create the former, or "auto" to pick the one which exists.
+	// Defaults to "lvm".
+	DevicePath string `toml:"device_path" yaml:"device_path"`
+	// DisableZeroing creates new volumes without zeroing their first blocks.
+	// It's faster, but unless the thin pool zeroes new blocks a volume may
+	// expose data left behind by removed volumes.
+	DisableZeroing bool `toml:"disable_zeroing" yaml:"disable_zeroing"`
+	// MountDirMode is the octal mode of the staging and target directories
+	// created for volumes, ie "0700", volumes can override it with the
+	// mountDirMode volume context attribute. Defaults to "0755".
+	MountDirMode string `toml:"mount_dir_mode" yaml:"mount_dir_mode"`
+	// PoolAutoExtend grows the thin pool before it runs out of space.
+	PoolAutoExtend PoolAutoExtend `toml:"pool_autoextend" yaml:"pool_autoextend"`
+	// PoolFull is how the driver reacts to the thin pool running out of data
+	// space, writing to a full pool corrupts XFS.
+	PoolFull PoolFull `toml:"pool_full" yaml:"pool_full"`
+	// SnapshotAutoExtend grows the COW space of backup snapshots before a
+	// long backup of a busy volume fills and invalidates them.
+	SnapshotAutoExtend SnapshotAutoExtend `toml:"snapshot_autoextend" yaml:"snapshot_autoextend"`
+}
+
+// Policies for a thin pool which is running out of data space.
+const (
+	PoolFullFail    = "fail"
+	PoolFullProtect = "protect"
+)
+
+// PoolFull describes how the driver protects the volumes of a thin pool
+// which is running out of data space.
+type PoolFull struct {
+	// Policy is "fail" to keep creating and mounting volumes until LVM
+	// fails, or "protect" to refuse new volumes and mounts while the pool is
+	// above the critical threshold. Defaults to "fail".
+	Policy string `toml:"policy" yaml:"policy"`
+	// CriticalThreshold is the data percentage above which the pool is
+	// protected, zero uses the driver's default.
+	CriticalThreshold float64 `toml:"critical_threshold" yaml:"critical_threshold"`
+	// RemountReadOnly also remounts the mounted volumes read-only once the
+	// pool crosses the critical threshold.
+	RemountReadOnly bool `toml:"remount_read_only" yaml:"remount_read_only"`
+	// Interval is how often the pool's fullness is polled, zero uses the
+	// driver's default.
+	Interval time.Duration `toml:"interval" yaml:"interval"`
+}
+
+// PoolAutoExtend describes when and by how much the thin pool is extended
+// from the free space of its volume group.
+type PoolAutoExtend struct {
+	// Interval is how often the pool's fullness is polled, zero disables it.
+	Interval time.Duration `toml:"interval" yaml:"interval"`
+	// Threshold is the data or metadata percentage at which that part of
+	// the pool is extended, zero uses the driver's default.
+	Threshold float64 `toml:"threshold" yaml:"threshold"`
+	// DataIncrement and MetadataIncrement are how much the pool is extended
+	// by, ie "10Gi", zero grows it by a fifth of its current size.
+	DataIncrement     lvm.ByteSize `toml:"data_increment" yaml:"data_increment"`
+	MetadataIncrement lvm.ByteSize `toml:"metadata_increment" yaml:"metadata_increment"`
+	// MetadataWarningThreshold is the metadata percentage above which a
+	// warning is logged on every poll, since a thin pool with exhausted
+	// metadata can corrupt its volumes. Zero uses the driver's default. The
+	// metadata is still polled every minute with autoextend disabled.
+	MetadataWarningThreshold float64 `toml:"metadata_warning_threshold" yaml:"metadata_warning_threshold"`
+}
+
+// SnapshotAutoExtend describes when and by how much the backup snapshots are
+// extended while they're backed up.
+type SnapshotAutoExtend struct {
+	// Interval is how often a snapshot's fullness is polled, zero disables it.
+	Interval time.Duration `toml:"interval" yaml:"interval"`
+	// Threshold is the data percentage at which the snapshot is extended,
+	// zero uses the driver's default.
+	Threshold float64 `toml:"threshold" yaml:"threshold"`
+	// Increment is how much the snapshot is extended by, ie "1Gi", zero
+	// grows it by a fifth of its current size.
+	Increment lvm.ByteSize `toml:"increment" yaml:"increment"`
+	// MaxSize caps the size of the snapshot, the backup is aborted once it
+	// can't grow any more. Zero caps it at the size of the volume.
+	MaxSize lvm.ByteSize `toml:"max_size" yaml:"max_size"`
+}
+
+// BackupEnabledByDefault reports whether volumes are backed up unless their
+// StorageClass opts out.
+func (info VolumeInformation) BackupEnabledByDefault() bool {
+	return info.BackupByDefault == nil || *info.BackupByDefault
+}
+
+// RetentionPolicy describes which snapshots are kept by restic forget
+type RetentionPolicy struct {
+	KeepDaily   int  `toml:"keep_daily" yaml:"keep_daily"`
+	KeepWeekly  int  `toml:"keep_weekly" yaml:"keep_weekly"`
+	KeepMonthly int  `toml:"keep_monthly" yaml:"keep_monthly"`
+	Prune       bool `toml:"prune" yaml:"prune"`
+	// Interval is how often the driver applies the policy, zero disables it.
+	Interval time.Duration `toml:"interval" yaml:"interval"`
 }
 
+// Enabled reports whether the policy keeps anything, restic refuses to
+// forget snapshots without at least one keep option.
+func (policy RetentionPolicy) Enabled() bool {
+	return policy.KeepDaily > 0 || policy.KeepWeekly > 0 || policy.KeepMonthly > 0
+}
+
+// CheckPolicy describes how often restic check verifies a repository
+type CheckPolicy struct {
+	// Interval is how often the driver checks the repository, zero disables it.
+	Interval time.Duration `toml:"interval" yaml:"interval"`
+	// ReadData also verifies the pack files, limited to ReadDataSubset if
+	// set, ie "10%" or "1/5".
+	ReadData       bool   `toml:"read_data" yaml:"read_data"`
+	ReadDataSubset string `toml:"read_data_subset" yaml:"read_data_subset"`
+}
+
+// Roles of a destination.
+const (
+	// RolePrimary destinations are backed up to directly.
+	RolePrimary = "primary"
+	// RoleCopy destinations receive the snapshots of a primary destination
+	// with restic copy, so the source data isn't read twice.
+	RoleCopy = "copy"
+)
+
 // Destination represents a Restic repository destination
 type Destination struct {
-	Environment map[string]string `toml:"environment"`
-	Repository  string            `toml:"repo"`
+	// Environment is passed to restic, values can be "secret:" placeholders
+	// for a key of the secret file or "file:" ones for the contents of a
+	// file, ie a mounted credential.
+	Environment map[string]string `toml:"environment" yaml:"environment"`
+	Repository  string            `toml:"repo" yaml:"repo"`
+	// PasswordFile is passed to restic as RESTIC_PASSWORD_FILE, for
+	// repository passwords mounted as a file.
+	PasswordFile string          `toml:"password_file" yaml:"password_file"`
+	Retention    RetentionPolicy `toml:"retention" yaml:"retention"`
+	Check        CheckPolicy     `toml:"check" yaml:"check"`
+	// ForceUnlockAfter is the age after which a lock is considered stale and
+	// removed with `restic unlock`, zero never unlocks.
+	ForceUnlockAfter time.Duration `toml:"force_unlock_after" yaml:"force_unlock_after"`
+	// LimitUpload and LimitDownload limit restic's bandwidth to the
+	// repository in KiB/s, zero is unlimited.
+	LimitUpload   int `toml:"limit_upload" yaml:"limit_upload"`
+	LimitDownload int `toml:"limit_download" yaml:"limit_download"`
+	// Exclude are patterns of files left out of backups, in the syntax of
+	// restic's --exclude. ExcludeFile is a file with more patterns.
+	Exclude     []string `toml:"exclude" yaml:"exclude"`
+	ExcludeFile string   `toml:"exclude_file" yaml:"exclude_file"`
+	// OneFileSystem keeps backups from crossing into other mounted filesystems.
+	OneFileSystem bool `toml:"one_file_system" yaml:"one_file_system"`
+	// Role is either "primary", the default, or "copy".
+	Role string `toml:"role" yaml:"role"`
+	// CopyFrom is the repository of the primary destination a copy
+	// destination copies from, defaults to the first primary.
+	CopyFrom string `toml:"copy_from" yaml:"copy_from"`
+	// AppendOnly keeps the driver from ever forgetting, pruning or
+	// force-unlocking the repository, so a compromised node can't delete
+	// its backups. Retention has to be run elsewhere.
+	AppendOnly bool `toml:"append_only" yaml:"append_only"`
+}
+
+// IsCopy reports whether the destination receives copies of another
+// destination's snapshots instead of being backed up to.
+func (dest Destination) IsCopy() bool {
+	return dest.Role == RoleCopy
 }
 
 // Config represents the configuration structure
 type Config struct {
-	VolumeInformation VolumeInformation `toml:"volume_info"`
-	ResticRepo        []Destination     `toml:"restic_repo"`
+	VolumeInformation VolumeInformation `toml:"volume_info" yaml:"volume_info"`
+	ResticRepo        []Destination     `toml:"restic_repo" yaml:"restic_repo"`
+	// ResticBinary is the restic executable, looked up on PATH when it
+	// isn't absolute. Defaults to "restic".
+	ResticBinary string `toml:"restic_binary" yaml:"restic_binary"`
+	// Tools overrides the paths of the LVM and mount tools by name, ie
+	// lvs = "/sbin/lvs".
+	Tools map[string]string `toml:"tools" yaml:"tools"`
+	// ShutdownTimeout is how long the driver waits for in-flight backups to
+	// finish when it is stopped, before interrupting them. Defaults to 30s.
+	ShutdownTimeout time.Duration `toml:"shutdown_timeout" yaml:"shutdown_timeout"`
+	// RPCTimeout bounds CSI calls arriving without a deadline. Defaults to
+	// 2m.
+	RPCTimeout time.Duration `toml:"rpc_timeout" yaml:"rpc_timeout"`
+	// RPCTimeouts overrides RPCTimeout by method name, ie
+	// CreateSnapshot = "2h".
+	RPCTimeouts map[string]time.Duration `toml:"rpc_timeouts" yaml:"rpc_timeouts"`
+	// BackupParallelism is how many destinations a volume is backed up to at
+	// once. Defaults to 2.
+	BackupParallelism int `toml:"backup_parallelism" yaml:"backup_parallelism"`
+	// ResticConcurrency is how many restic operations run at once across
+	// all volumes and destinations, the others wait. Zero doesn't limit them.
+	ResticConcurrency int `toml:"restic_concurrency" yaml:"restic_concurrency"`
+	// AuditLog is a file the audit events of volume mutations are appended
+	// to as JSON lines. Without it they're logged with the other logs.
+	AuditLog string `toml:"audit_log" yaml:"audit_log"`
+	// IOPriority lowers the I/O and CPU priority of mkfs and restic, so
+	// they don't starve the workloads on the node. Unset runs them as before.
+	IOPriority IOPriority `toml:"io_priority" yaml:"io_priority"`
+}
+
+// IOPriority is the priority mkfs and restic run with, see ionice.Priority.
+type IOPriority struct {
+	// Class is the I/O scheduling class, "best-effort" or "idle".
+	Class string `toml:"class" yaml:"class"`
+	// Level is the priority within the best-effort class, 0 to 7.
+	Level int `toml:"level" yaml:"level"`
+	// Nice is the niceness, 1 to 19.
+	Nice int `toml:"nice" yaml:"nice"`
 }
 
 func LoadConfig(configFilePath, secretFilePath string) (Config, error) {
@@ -33,24 +336,21 @@ func LoadConfig(configFilePath, secretFilePath string) (Config, error) {
 	var secret Secret
 
 	// Load and parse the secret file
-	secretData, err := os.ReadFile(secretFilePath)
-	if err != nil {
-		return config, err
-	}
-	if _, err := toml.Decode(string(secretData), &secret); err != nil {
+	if err := decodeFile(secretFilePath, &secret); err != nil {
 		return config, err
 	}
 
 	// Load and parse the configuration file
-	configData, err := os.ReadFile(configFilePath)
-	if err != nil {
+	if err := decodeFile(configFilePath, &config); err != nil {
 		return config, err
 	}
-	if _, err := toml.Decode(string(configData), &config); err != nil {
+
+	if err := config.validate(); err != nil {
 		return config, err
 	}
 
-	// Replace 'secret:' placeholders with actual values
+	// Replace 'secret:' placeholders with actual values and 'file:' ones
+	// with the contents of the file
 	for i, repo := range config.ResticRepo {
 		for key, val := range repo.Environment {
 			if strings.HasPrefix(val, "secret:") {
@@ -58,9 +358,218 @@ func LoadConfig(configFilePath, secretFilePath string) (Config, error) {
 				if secretVal, ok := secret[secretKey]; ok {
 					config.ResticRepo[i].Environment[key] = secretVal
 				}
+			} else if strings.HasPrefix(val, "file:") {
+				fileVal, err := readValueFile(val[5:])
+				if err != nil {
+					return config, fmt.Errorf("restic_repo %s: environment %s: %w", repo.Repository, key, err)
+				}
+				config.ResticRepo[i].Environment[key] = fileVal
+			}
+		}
+		if repo.PasswordFile != "" {
+			if _, err := os.Stat(repo.PasswordFile); err != nil {
+				return config, fmt.Errorf("restic_repo %s: password_file: %w", repo.Repository, err)
+			}
+			if config.ResticRepo[i].Environment == nil {
+				config.ResticRepo[i].Environment = map[string]string{}
 			}
+			config.ResticRepo[i].Environment["RESTIC_PASSWORD_FILE"] = repo.PasswordFile
+		}
+	}
+
+	if key := config.VolumeInformation.EncryptionKey; strings.HasPrefix(key, "secret:") {
+		if secretVal, ok := secret[key[7:]]; ok {
+			config.VolumeInformation.EncryptionKey = secretVal
 		}
 	}
 
 	return config, nil
 }
+
+// readValueFile reads a value from a file mounted by the secret management,
+// without the trailing newline most of them end with.
+func readValueFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// CopySource returns the index of the primary destination the copy
+// destination dest copies from.
+func (config *Config) CopySource(dest Destination) (int, bool) {
+	for i, repo := range config.ResticRepo {
+		if repo.IsCopy() {
+			continue
+		}
+		if dest.CopyFrom == "" || dest.CopyFrom == repo.Repository {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// validate checks the configuration for values that can't be acted upon.
+func (config *Config) validate() error {
+	if percent := config.VolumeInformation.SnapshotSizePercent; percent < 0 || percent > 100 {
+		return fmt.Errorf("volume_info: snapshot_size_percent must be between 0 and 100, got %d", percent)
+	}
+	if config.VolumeInformation.MaxVolumesPerNode < 0 {
+		return fmt.Errorf("volume_info: max_volumes_per_node must not be negative, got %d", config.VolumeInformation.MaxVolumesPerNode)
+	}
+	if config.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown_timeout must not be negative, got %s", config.ShutdownTimeout)
+	}
+	if config.RPCTimeout < 0 {
+		return fmt.Errorf("rpc_timeout must not be negative, got %s", config.RPCTimeout)
+	}
+	if err := ionice.Priority(config.IOPriority).Validate(); err != nil {
+		return fmt.Errorf("io_priority: %w", err)
+	}
+	if config.BackupParallelism < 0 {
+		return fmt.Errorf("backup_parallelism must not be negative, got %d", config.BackupParallelism)
+	}
+	if config.ResticConcurrency < 0 {
+		return fmt.Errorf("restic_concurrency must not be negative, got %d", config.ResticConcurrency)
+	}
+	for method, timeout := range config.RPCTimeouts {
+		if timeout <= 0 {
+			return fmt.Errorf("rpc_timeouts: timeout of %s must be positive, got %s", method, timeout)
+		}
+	}
+	switch config.VolumeInformation.SnapshotBackend {
+	case "", SnapshotBackendLVM:
+	case SnapshotBackendRestic:
+		if len(config.ResticRepo) == 0 {
+			return fmt.Errorf("volume_info: snapshot_backend %s requires a restic_repo", SnapshotBackendRestic)
+		}
+	default:
+		return fmt.Errorf("volume_info: snapshot_backend must be %s or %s, got %q", SnapshotBackendLVM, SnapshotBackendRestic, config.VolumeInformation.SnapshotBackend)
+	}
+	if config.VolumeInformation.FstrimInterval < 0 {
+		return fmt.Errorf("volume_info: fstrim_interval must not be negative, got %s", config.VolumeInformation.FstrimInterval)
+	}
+	if autoExtend := config.VolumeInformation.PoolAutoExtend; autoExtend.Interval < 0 || autoExtend.Threshold < 0 || autoExtend.Threshold > 100 {
+		return fmt.Errorf("volume_info: pool_autoextend interval must not be negative and threshold must be between 0 and 100")
+	} else if autoExtend.DataIncrement < 0 || autoExtend.MetadataIncrement < 0 {
+		return fmt.Errorf("volume_info: pool_autoextend increments must not be negative")
+	} else if autoExtend.MetadataWarningThreshold < 0 || autoExtend.MetadataWarningThreshold > 100 {
+		return fmt.Errorf("volume_info: pool_autoextend metadata_warning_threshold must be between 0 and 100")
+	}
+	switch poolFull := config.VolumeInformation.PoolFull; {
+	case poolFull.Policy != "" && poolFull.Policy != PoolFullFail && poolFull.Policy != PoolFullProtect:
+		return fmt.Errorf("volume_info: pool_full policy must be %s or %s, got %q", PoolFullFail, PoolFullProtect, poolFull.Policy)
+	case poolFull.Interval < 0 || poolFull.CriticalThreshold < 0 || poolFull.CriticalThreshold > 100:
+		return fmt.Errorf("volume_info: pool_full interval must not be negative and critical_threshold must be between 0 and 100")
+	case poolFull.RemountReadOnly && poolFull.Policy != PoolFullProtect:
+		return fmt.Errorf("volume_info: pool_full remount_read_only needs the %s policy", PoolFullProtect)
+	}
+	if autoExtend := config.VolumeInformation.SnapshotAutoExtend; autoExtend.Interval < 0 || autoExtend.Threshold < 0 || autoExtend.Threshold > 100 {
+		return fmt.Errorf("volume_info: snapshot_autoextend interval must not be negative and threshold must be between 0 and 100")
+	} else if autoExtend.Increment < 0 || autoExtend.MaxSize < 0 {
+		return fmt.Errorf("volume_info: snapshot_autoextend increment and max_size must not be negative")
+	}
+	switch config.VolumeInformation.FSGroupPolicy {
+	case "", FSGroupPolicyTopLevel, FSGroupPolicyRecursive:
+	default:
+		return fmt.Errorf("volume_info: fs_group_policy must be %s or %s, got %q", FSGroupPolicyTopLevel, FSGroupPolicyRecursive, config.VolumeInformation.FSGroupPolicy)
+	}
+	switch config.VolumeInformation.DevicePath {
+	case "", DevicePathLVM, DevicePathMapper, DevicePathAuto:
+	default:
+		return fmt.Errorf("volume_info: device_path must be %s, %s or %s, got %q", DevicePathLVM, DevicePathMapper, DevicePathAuto, config.VolumeInformation.DevicePath)
+	}
+	if config.VolumeInformation.MountDirMode != "" {
+		if _, err := lvm.ParseDirMode(config.VolumeInformation.MountDirMode); err != nil {
+			return fmt.Errorf("volume_info: mount_dir_mode: %w", err)
+		}
+	}
+	switch config.VolumeInformation.CloneUUID {
+	case "", CloneUUIDGenerate, CloneUUIDNouuid:
+	default:
+		return fmt.Errorf("volume_info: clone_uuid must be %s or %s, got %q", CloneUUIDGenerate, CloneUUIDNouuid, config.VolumeInformation.CloneUUID)
+	}
+	if config.VolumeInformation.Encrypted && config.VolumeInformation.EncryptionKey == "" {
+		return fmt.Errorf("volume_info: encrypted volumes need an encryption_key")
+	}
+	if config.VolumeInformation.BackupInterval < 0 {
+		return fmt.Errorf("volume_info: backup_interval must not be negative, got %s", config.VolumeInformation.BackupInterval)
+	}
+	if config.VolumeInformation.LayoutBackupInterval < 0 {
+		return fmt.Errorf("volume_info: layout_backup_interval must not be negative, got %s", config.VolumeInformation.LayoutBackupInterval)
+	}
+	if config.VolumeInformation.UnstageBackupTimeout < 0 {
+		return fmt.Errorf("volume_info: unstage_backup_timeout must not be negative, got %s", config.VolumeInformation.UnstageBackupTimeout)
+	}
+	if config.VolumeInformation.PoolWaitTimeout < 0 {
+		return fmt.Errorf("volume_info: pool_wait_timeout must not be negative, got %s", config.VolumeInformation.PoolWaitTimeout)
+	}
+	if config.VolumeInformation.MkfsTimeout < 0 {
+		return fmt.Errorf("volume_info: mkfs_timeout must not be negative, got %s", config.VolumeInformation.MkfsTimeout)
+	}
+	for fsType, options := range config.VolumeInformation.MkfsOptions {
+		for _, option := range options {
+			if strings.HasPrefix(option, "/dev/") {
+				return fmt.Errorf("volume_info: mkfs_options for %s must not contain a device, got %q", fsType, option)
+			}
+		}
+	}
+	for i, repo := range config.ResticRepo {
+		retention := repo.Retention
+		if retention.KeepDaily < 0 || retention.KeepWeekly < 0 || retention.KeepMonthly < 0 {
+			return fmt.Errorf("restic_repo %d: retention keep values must not be negative", i)
+		}
+		if retention.Interval < 0 {
+			return fmt.Errorf("restic_repo %d: retention interval must not be negative", i)
+		}
+		if repo.Check.Interval < 0 {
+			return fmt.Errorf("restic_repo %d: check interval must not be negative", i)
+		}
+		if repo.ForceUnlockAfter < 0 {
+			return fmt.Errorf("restic_repo %d: force_unlock_after must not be negative", i)
+		}
+		if repo.LimitUpload < 0 || repo.LimitDownload < 0 {
+			return fmt.Errorf("restic_repo %d: limit_upload and limit_download must not be negative", i)
+		}
+		switch repo.Role {
+		case "", RolePrimary:
+			if repo.CopyFrom != "" {
+				return fmt.Errorf("restic_repo %d: copy_from requires role %s", i, RoleCopy)
+			}
+		case RoleCopy:
+			if _, ok := config.CopySource(repo); !ok {
+				return fmt.Errorf("restic_repo %d: no primary destination to copy from", i)
+			}
+		default:
+			return fmt.Errorf("restic_repo %d: role must be %s or %s, got %q", i, RolePrimary, RoleCopy, repo.Role)
+		}
+		for _, pattern := range repo.Exclude {
+			if pattern == "" {
+				return fmt.Errorf("restic_repo %d: exclude patterns must not be empty", i)
+			}
+		}
+	}
+	return nil
+}
+
+// decodeFile parses the file at path into v, choosing the format from the
+// file extension. Anything other than ".yaml" or ".yml" is parsed as TOML.
+func decodeFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, v); err != nil {
+			return fmt.Errorf("failed to parse yaml file %s: %w", path, err)
+		}
+	default:
+		if _, err := toml.Decode(string(data), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfigYAMLMatchesTOML(t *testing.T) {
+	tomlConfig, err := LoadConfig("testdata/config.toml", "testdata/secret.toml")
+	if err != nil {
+		t.Fatalf("LoadConfig failed for toml: %v", err)
+	}
+
+	yamlConfig, err := LoadConfig("testdata/config.yaml", "testdata/secret.yaml")
+	if err != nil {
+		t.Fatalf("LoadConfig failed for yaml: %v", err)
+	}
+
+	assert.Equal(t, tomlConfig, yamlConfig)
+
+	// Check the secret placeholders were substituted
+	assert.Equal(t, "/dev/vg0/thinpool", yamlConfig.VolumeInformation.ThinPoolName)
+	assert.Equal(t, "/usr/local/bin/restic", yamlConfig.ResticBinary)
+	assert.Equal(t, map[string]string{"lvs": "/sbin/lvs", "lvcreate": "/sbin/lvcreate"}, yamlConfig.Tools)
+	assert.Len(t, yamlConfig.ResticRepo, 2)
+	assert.Equal(t, "AKIAEXAMPLE", yamlConfig.ResticRepo[0].Environment["AWS_ACCESS_KEY_ID"])
+	assert.Equal(t, "correct horse battery staple", yamlConfig.ResticRepo[1].Environment["RESTIC_PASSWORD"])
+	assert.Equal(t, "correct horse battery staple", yamlConfig.VolumeInformation.EncryptionKey)
+	assert.Equal(t, RetentionPolicy{KeepDaily: 7, KeepWeekly: 4, KeepMonthly: 6, Prune: true, Interval: 24 * time.Hour}, yamlConfig.ResticRepo[1].Retention)
+	assert.False(t, yamlConfig.ResticRepo[0].Retention.Enabled())
+	assert.Equal(t, PoolAutoExtend{Interval: time.Minute, Threshold: 80, DataIncrement: 10 * 1024 * 1024 * 1024}, yamlConfig.VolumeInformation.PoolAutoExtend)
+}
+
+func TestLoadConfigMixedFormats(t *testing.T) {
+	// The secret and config files are detected independently
+	config, err := LoadConfig("testdata/config.yaml", "testdata/secret.toml")
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	assert.Equal(t, "correct horse battery staple", config.ResticRepo[0].Environment["RESTIC_PASSWORD"])
+}
+
+// writeFileConfig writes a config with a destination whose environment is
+// read from files under dir.
+func writeFileConfig(t *testing.T, dir string) string {
+	path := filepath.Join(dir, "config.toml")
+	content := `[[restic_repo]]
+repo = "s3:s3.amazonaws.com/bucket/restic"
+password_file = "` + filepath.Join(dir, "password") + `"
+[restic_repo.environment]
+AWS_ACCESS_KEY_ID = "file:` + filepath.Join(dir, "access_key_id") + `"
+AWS_SHARED_CREDENTIALS_FILE = "` + filepath.Join(dir, "credentials") + `"
+`
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfigReadsEnvironmentFiles(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "access_key_id"), []byte("AKIAFROMFILE\n"), 0600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "password"), []byte("hunter2\n"), 0600))
+
+	config, err := LoadConfig(writeFileConfig(t, dir), "testdata/secret.toml")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"AWS_ACCESS_KEY_ID":           "AKIAFROMFILE",
+		"AWS_SHARED_CREDENTIALS_FILE": filepath.Join(dir, "credentials"),
+		// The password file is left for restic to read
+		"RESTIC_PASSWORD_FILE": filepath.Join(dir, "password"),
+	}, config.ResticRepo[0].Environment)
+}
+
+func TestLoadConfigFailsOnMissingEnvironmentFile(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "password"), []byte("hunter2"), 0600))
+
+	_, err := LoadConfig(writeFileConfig(t, dir), "testdata/secret.toml")
+	assert.NotNil(t, err)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	assert.Contains(t, err.Error(), "AWS_ACCESS_KEY_ID")
+
+	// A missing password file fails too
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "access_key_id"), []byte("AKIAFROMFILE"), 0600))
+	assert.Nil(t, os.Remove(filepath.Join(dir, "password")))
+	_, err = LoadConfig(writeFileConfig(t, dir), "testdata/secret.toml")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	assert.Contains(t, err.Error(), "password_file")
+}
+
+func TestValidateRejectsNegativeRetention(t *testing.T) {
+	config := Config{ResticRepo: []Destination{{Retention: RetentionPolicy{KeepDaily: -1}}}}
+	assert.Error(t, config.validate())
+}
+
+func TestValidateRejectsNegativeMaxVolumes(t *testing.T) {
+	config := Config{VolumeInformation: VolumeInformation{MaxVolumesPerNode: -1}}
+	assert.Error(t, config.validate())
+
+	config.VolumeInformation.MaxVolumesPerNode = 0
+	assert.Nil(t, config.validate())
+}
+
+func TestValidateRejectsDeviceInMkfsOptions(t *testing.T) {
+	config := Config{VolumeInformation: VolumeInformation{MkfsOptions: map[string][]string{"xfs": {"-f", "/dev/vg0/test-volume"}}}}
+	assert.Error(t, config.validate())
+
+	config.VolumeInformation.MkfsOptions["xfs"] = []string{"-d", "su=64k,sw=4"}
+	assert.Nil(t, config.validate())
+}
+
+func TestValidateRejectsNegativeBackupInterval(t *testing.T) {
+	config := Config{VolumeInformation: VolumeInformation{BackupInterval: -time.Hour}}
+	assert.Error(t, config.validate())
+}
+
+func TestValidateRejectsNegativePoolWaitTimeout(t *testing.T) {
+	config := Config{VolumeInformation: VolumeInformation{PoolWaitTimeout: -time.Minute}}
+	assert.Error(t, config.validate())
+}
+
+func TestValidateRejectsNegativeMkfsTimeout(t *testing.T) {
+	config := Config{VolumeInformation: VolumeInformation{MkfsTimeout: -time.Minute}}
+	assert.Error(t, config.validate())
+}
+
+func TestValidateCloneUUID(t *testing.T) {
+	for _, mode := range []string{"", CloneUUIDGenerate, CloneUUIDNouuid} {
+		config := Config{VolumeInformation: VolumeInformation{CloneUUID: mode}}
+		assert.Nil(t, config.validate())
+	}
+	config := Config{VolumeInformation: VolumeInformation{CloneUUID: "keep"}}
+	assert.Error(t, config.validate())
+}
+
+func TestValidateMountDirMode(t *testing.T) {
+	config := Config{VolumeInformation: VolumeInformation{MountDirMode: "0700"}}
+	assert.Nil(t, config.validate())
+
+	for _, mode := range []string{"700a", "0800", "01777"} {
+		config.VolumeInformation.MountDirMode = mode
+		assert.Error(t, config.validate())
+	}
+}
+
+func TestValidateEncryptionNeedsKey(t *testing.T) {
+	config := Config{VolumeInformation: VolumeInformation{Encrypted: true}}
+	assert.Error(t, config.validate())
+
+	config.VolumeInformation.EncryptionKey = "secret:luks_key"
+	assert.Nil(t, config.validate())
+}
+
+func TestValidateSnapshotBackend(t *testing.T) {
+	config := Config{VolumeInformation: VolumeInformation{SnapshotBackend: "zfs"}}
+	assert.Error(t, config.validate())
+
+	config.VolumeInformation.SnapshotBackend = SnapshotBackendRestic
+	assert.Error(t, config.validate())
+
+	config.ResticRepo = []Destination{{Repository: "/mnt/backup/restic"}}
+	assert.Nil(t, config.validate())
+
+	config.VolumeInformation.SnapshotBackend = ""
+	assert.Nil(t, config.validate())
+}
+
+func TestValidateFSGroupPolicy(t *testing.T) {
+	config := Config{VolumeInformation: VolumeInformation{FSGroupPolicy: "sometimes"}}
+	assert.Error(t, config.validate())
+
+	config.VolumeInformation.FSGroupPolicy = FSGroupPolicyRecursive
+	assert.Nil(t, config.validate())
+}
+
+func TestValidateRejectsNegativeFstrimInterval(t *testing.T) {
+	config := Config{VolumeInformation: VolumeInformation{FstrimInterval: -time.Hour}}
+	assert.Error(t, config.validate())
+
+	config.VolumeInformation.FstrimInterval = 24 * time.Hour
+	assert.Nil(t, config.validate())
+}
+
+func TestValidatePoolAutoExtend(t *testing.T) {
+	config := Config{VolumeInformation: VolumeInformation{PoolAutoExtend: PoolAutoExtend{Interval: time.Minute, Threshold: 120}}}
+	assert.Error(t, config.validate())
+
+	config.VolumeInformation.PoolAutoExtend.Threshold = 80
+	config.VolumeInformation.PoolAutoExtend.DataIncrement = -1
+	assert.Error(t, config.validate())
+
+	config.VolumeInformation.PoolAutoExtend.DataIncrement = 10 * 1024 * 1024 * 1024
+	assert.Nil(t, config.validate())
+
+	config.VolumeInformation.PoolAutoExtend.MetadataWarningThreshold = 101
+	assert.Error(t, config.validate())
+}
+
+func TestValidatePoolFull(t *testing.T) {
+	config := Config{VolumeInformation: VolumeInformation{PoolFull: PoolFull{Policy: "abandon"}}}
+	assert.Error(t, config.validate())
+
+	config.VolumeInformation.PoolFull = PoolFull{RemountReadOnly: true}
+	assert.Error(t, config.validate())
+
+	config.VolumeInformation.PoolFull.Policy = PoolFullProtect
+	assert.Nil(t, config.validate())
+
+	config.VolumeInformation.PoolFull.CriticalThreshold = 101
+	assert.Error(t, config.validate())
+}
+
+func TestValidateSnapshotAutoExtend(t *testing.T) {
+	config := Config{VolumeInformation: VolumeInformation{SnapshotAutoExtend: SnapshotAutoExtend{Interval: time.Second, Threshold: 80, Increment: 1024 * 1024 * 1024}}}
+	assert.Nil(t, config.validate())
+
+	config.VolumeInformation.SnapshotAutoExtend.Threshold = 120
+	assert.Error(t, config.validate())
+
+	config.VolumeInformation.SnapshotAutoExtend = SnapshotAutoExtend{MaxSize: -1}
+	assert.Error(t, config.validate())
+}
+
+func TestValidateRejectsNegativeRateLimits(t *testing.T) {
+	config := Config{ResticRepo: []Destination{{LimitUpload: -1}}}
+	assert.Error(t, config.validate())
+
+	config.ResticRepo[0] = Destination{LimitDownload: -1}
+	assert.Error(t, config.validate())
+
+	config.ResticRepo[0] = Destination{LimitUpload: 1024, LimitDownload: 2048}
+	assert.Nil(t, config.validate())
+}
+
+func TestValidateRejectsEmptyExclude(t *testing.T) {
+	config := Config{ResticRepo: []Destination{{Exclude: []string{"cache", ""}}}}
+	assert.Error(t, config.validate())
+}
+
+func TestValidateRejectsNegativeCheckInterval(t *testing.T) {
+	config := Config{ResticRepo: []Destination{{Check: CheckPolicy{Interval: -time.Hour}}}}
+	assert.Error(t, config.validate())
+}
+
+func TestValidateRejectsNegativeShutdownTimeout(t *testing.T) {
+	config := Config{ShutdownTimeout: -time.Second}
+	assert.Error(t, config.validate())
+}
+
+func TestValidateRejectsInvalidRPCTimeouts(t *testing.T) {
+	config := Config{RPCTimeout: -time.Second}
+	assert.Error(t, config.validate())
+
+	config = Config{RPCTimeouts: map[string]time.Duration{"CreateSnapshot": 0}}
+	assert.Error(t, config.validate())
+}
+
+func TestValidateIOPriority(t *testing.T) {
+	config := Config{IOPriority: IOPriority{Class: "best-effort", Level: 7, Nice: 10}}
+	assert.Nil(t, config.validate())
+
+	config.IOPriority.Class = "realtime"
+	assert.Error(t, config.validate())
+}
+
+func TestValidateRejectsNegativeBackupParallelism(t *testing.T) {
+	config := Config{BackupParallelism: -1}
+	assert.Error(t, config.validate())
+}
+
+func TestValidateRejectsNegativeResticConcurrency(t *testing.T) {
+	config := Config{ResticConcurrency: -1}
+	assert.Error(t, config.validate())
+}
+
+func TestValidateDestinationRoles(t *testing.T) {
+	config := Config{ResticRepo: []Destination{{Repository: "/mnt/backup/restic"}, {Repository: "sftp:offsite:/srv/restic", Role: RoleCopy}}}
+	assert.Nil(t, config.validate())
+	source, ok := config.CopySource(config.ResticRepo[1])
+	assert.True(t, ok)
+	assert.Equal(t, 0, source)
+
+	config = Config{ResticRepo: []Destination{{Repository: "sftp:offsite:/srv/restic", Role: RoleCopy}}}
+	assert.Error(t, config.validate())
+
+	config = Config{ResticRepo: []Destination{{Repository: "/mnt/backup/restic"}, {Role: RoleCopy, CopyFrom: "/mnt/other/restic"}}}
+	assert.Error(t, config.validate())
+
+	config = Config{ResticRepo: []Destination{{Repository: "/mnt/backup/restic", CopyFrom: "/mnt/other/restic"}}}
+	assert.Error(t, config.validate())
+
+	config = Config{ResticRepo: []Destination{{Repository: "/mnt/backup/restic", Role: "replica"}}}
+	assert.Error(t, config.validate())
+}
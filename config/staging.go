@@ -0,0 +1,67 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// hostname allows mocking of the host name staging paths are rendered with.
+var hostname = os.Hostname
+
+// StagingPathData is what a staging_path template can refer to, ie
+// "/mnt/{{.NodeID}}/staging".
+type StagingPathData struct {
+	NodeID   string
+	Hostname string
+}
+
+// ResolveStagingPath renders the staging path template for the node and
+// checks the resulting directory exists and is writable. An empty staging
+// path is left as is.
+func (info *VolumeInformation) ResolveStagingPath(nodeID string) error {
+	if info.StagingPath == "" {
+		return nil
+	}
+
+	path := info.StagingPath
+	if strings.Contains(path, "{{") {
+		tmpl, err := template.New("staging_path").Parse(path)
+		if err != nil {
+			return fmt.Errorf("volume_info: staging_path is not a valid template: %w", err)
+		}
+		host, err := hostname()
+		if err != nil {
+			return fmt.Errorf("volume_info: failed to get the hostname for staging_path: %w", err)
+		}
+		var rendered strings.Builder
+		if err := tmpl.Execute(&rendered, StagingPathData{NodeID: nodeID, Hostname: host}); err != nil {
+			return fmt.Errorf("volume_info: failed to render staging_path: %w", err)
+		}
+		path = rendered.String()
+	}
+
+	if err := checkWritableDir(path); err != nil {
+		return fmt.Errorf("volume_info: staging_path %s: %w", path, err)
+	}
+	info.StagingPath = path
+	return nil
+}
+
+// checkWritableDir checks that path is a directory files can be created in.
+func checkWritableDir(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("not a directory")
+	}
+	file, err := os.CreateTemp(path, ".write-test-")
+	if err != nil {
+		return fmt.Errorf("not writable: %w", err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveStagingPath(t *testing.T) {
+	hostname = func() (string, error) { return "bouba", nil }
+	t.Cleanup(func() { hostname = os.Hostname })
+	root := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "node-1", "bouba"), 0755))
+
+	info := VolumeInformation{StagingPath: root + "/{{.NodeID}}/{{.Hostname}}"}
+	assert.Nil(t, info.ResolveStagingPath("node-1"))
+	assert.Equal(t, filepath.Join(root, "node-1", "bouba"), info.StagingPath)
+
+	// Static paths are only checked
+	info = VolumeInformation{StagingPath: root}
+	assert.Nil(t, info.ResolveStagingPath("node-1"))
+	assert.Equal(t, root, info.StagingPath)
+
+	info = VolumeInformation{}
+	assert.Nil(t, info.ResolveStagingPath("node-1"))
+	assert.Equal(t, "", info.StagingPath)
+}
+
+func TestResolveStagingPathErrors(t *testing.T) {
+	root := t.TempDir()
+
+	// The rendered directory must exist
+	info := VolumeInformation{StagingPath: root + "/{{.NodeID}}"}
+	assert.NotNil(t, info.ResolveStagingPath("node-2"))
+	assert.Equal(t, root+"/{{.NodeID}}", info.StagingPath)
+
+	info = VolumeInformation{StagingPath: root + "/{{.NodeID"}
+	assert.NotNil(t, info.ResolveStagingPath("node-2"))
+
+	info = VolumeInformation{StagingPath: root + "/{{.Zone}}"}
+	assert.NotNil(t, info.ResolveStagingPath("node-2"))
+
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "file"), nil, 0644))
+	info = VolumeInformation{StagingPath: filepath.Join(root, "file")}
+	assert.NotNil(t, info.ResolveStagingPath("node-2"))
+}
@@ -0,0 +1,19 @@
+// Package filemode parses the octal permissions of the files and directories
+// the driver creates.
+package filemode
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Parse parses an octal permission between 0000 and 0777, ie "0660". The
+// error names what the mode is of, ie "socket mode".
+func Parse(what string, value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("%s must be an octal permission between 0000 and 0777, got %q", what, value)
+	}
+	return os.FileMode(mode), nil
+}
@@ -0,0 +1,21 @@
+package filemode
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	for value, expected := range map[string]os.FileMode{"0660": 0660, "700": 0700, "0": 0, "0777": 0777} {
+		mode, err := Parse("socket mode", value)
+		assert.Nil(t, err, value)
+		assert.Equal(t, expected, mode, value)
+	}
+
+	for _, value := range []string{"", "0999", "1777", "rw-r--r--", "-1"} {
+		_, err := Parse("socket mode", value)
+		assert.EqualError(t, err, `socket mode must be an octal permission between 0000 and 0777, got "`+value+`"`)
+	}
+}
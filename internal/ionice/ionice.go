@@ -0,0 +1,75 @@
+// Package ionice runs commands at a lower I/O and CPU priority, so formatting
+// and backing up volumes doesn't starve the workloads on the node.
+package ionice
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// The wrappers commands are run with, looked up on PATH when they aren't
+// absolute.
+var (
+	IoniceBinary = "ionice"
+	NiceBinary   = "nice"
+)
+
+// I/O scheduling classes commands can be run in.
+const (
+	ClassBestEffort = "best-effort"
+	ClassIdle       = "idle"
+)
+
+// classNumbers are the ionice -c values of the classes.
+var classNumbers = map[string]string{
+	ClassBestEffort: "2",
+	ClassIdle:       "3",
+}
+
+// Priority is the priority commands are run with. The zero Priority runs them
+// as they are.
+type Priority struct {
+	// Class is the I/O scheduling class, "best-effort" or "idle". Empty
+	// keeps the class of the driver.
+	Class string
+	// Level is the priority within the best-effort class, from 0, the
+	// highest, to 7.
+	Level int
+	// Nice is the niceness, from 1 to 19. Zero keeps the niceness of the
+	// driver.
+	Nice int
+}
+
+// Validate checks that the class, level and niceness are in range.
+func (p Priority) Validate() error {
+	if _, ok := classNumbers[p.Class]; p.Class != "" && !ok {
+		return fmt.Errorf("class must be %s or %s, got %q", ClassBestEffort, ClassIdle, p.Class)
+	}
+	if p.Level < 0 || p.Level > 7 {
+		return fmt.Errorf("level must be between 0 and 7, got %d", p.Level)
+	}
+	if p.Nice < 0 || p.Nice > 19 {
+		return fmt.Errorf("nice must be between 0 and 19, got %d", p.Nice)
+	}
+	return nil
+}
+
+// Wrap returns the command running name with args at the priority, ie
+// "ionice -c 2 -n 7 nice -n 10 name args...".
+func (p Priority) Wrap(name string, args ...string) (string, []string) {
+	var prefix []string
+	if p.Class != "" {
+		prefix = append(prefix, IoniceBinary, "-c", classNumbers[p.Class])
+		// The idle class has no levels.
+		if p.Class == ClassBestEffort {
+			prefix = append(prefix, "-n", strconv.Itoa(p.Level))
+		}
+	}
+	if p.Nice != 0 {
+		prefix = append(prefix, NiceBinary, "-n", strconv.Itoa(p.Nice))
+	}
+	if len(prefix) == 0 {
+		return name, args
+	}
+	return prefix[0], append(append(prefix[1:], name), args...)
+}
@@ -0,0 +1,33 @@
+package ionice
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrap(t *testing.T) {
+	name, args := Priority{}.Wrap("/usr/sbin/mkfs.xfs", "/dev/vg0/test-volume")
+	assert.Equal(t, "/usr/sbin/mkfs.xfs", name)
+	assert.Equal(t, []string{"/dev/vg0/test-volume"}, args)
+
+	name, args = Priority{Class: ClassBestEffort, Level: 7, Nice: 10}.Wrap("/usr/sbin/mkfs.xfs", "/dev/vg0/test-volume")
+	assert.Equal(t, "ionice", name)
+	assert.Equal(t, []string{"-c", "2", "-n", "7", "nice", "-n", "10", "/usr/sbin/mkfs.xfs", "/dev/vg0/test-volume"}, args)
+
+	name, args = Priority{Class: ClassIdle}.Wrap("restic", "backup")
+	assert.Equal(t, "ionice", name)
+	assert.Equal(t, []string{"-c", "3", "restic", "backup"}, args)
+
+	name, args = Priority{Nice: 19}.Wrap("restic", "backup")
+	assert.Equal(t, "nice", name)
+	assert.Equal(t, []string{"-n", "19", "restic", "backup"}, args)
+}
+
+func TestValidate(t *testing.T) {
+	assert.Nil(t, Priority{}.Validate())
+	assert.Nil(t, Priority{Class: ClassBestEffort, Level: 7, Nice: 19}.Validate())
+	assert.Error(t, Priority{Class: "realtime"}.Validate())
+	assert.Error(t, Priority{Class: ClassBestEffort, Level: 8}.Validate())
+	assert.Error(t, Priority{Nice: -5}.Validate())
+}
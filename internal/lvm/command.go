@@ -0,0 +1,135 @@
+package lvm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"nodeto/restic-csi-plugin/internal/ionice"
+	"os/exec"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ToolPaths are the paths of the commands run by the package, by tool name.
+// Tools missing from the map are looked up on PATH.
+var ToolPaths = map[string]string{
+	"lvs":         "/usr/sbin/lvs",
+	"vgs":         "/usr/sbin/vgs",
+	"vgcfgbackup": "/usr/sbin/vgcfgbackup",
+	"lvcreate":    "/usr/sbin/lvcreate",
+	"lvextend":    "/usr/sbin/lvextend",
+	"lvremove":    "/usr/sbin/lvremove",
+	"mkfs.xfs":    "/usr/sbin/mkfs.xfs",
+	"xfs_growfs":  "/usr/sbin/xfs_growfs",
+	"xfs_admin":   "/usr/sbin/xfs_admin",
+	"mount":       "/usr/bin/mount",
+	"umount":      "/usr/bin/umount",
+	"findmnt":     "/usr/bin/findmnt",
+	"fstrim":      "/usr/sbin/fstrim",
+	"cryptsetup":  "/usr/sbin/cryptsetup",
+}
+
+// SetToolPath overrides the path of a tool, ie when the host's tools are
+// bind mounted at a different prefix.
+func SetToolPath(name string, path string) error {
+	if _, ok := ToolPaths[name]; !ok {
+		return fmt.Errorf("unknown tool %q", name)
+	}
+	if path == "" {
+		return fmt.Errorf("path of tool %q must not be empty", name)
+	}
+	ToolPaths[name] = path
+	return nil
+}
+
+// ToolPath returns the path a tool is run from.
+func ToolPath(name string) string {
+	if path, ok := ToolPaths[name]; ok {
+		return path
+	}
+	return name
+}
+
+// CommandRunner runs the commands of a ThinPool and its Volumes, ie to log,
+// time or wrap them. Name is the path of the command, see ToolPath.
+type CommandRunner interface {
+	// Run runs the command and returns its stdout and stderr, a nonzero exit
+	// is returned as an error.
+	Run(ctx context.Context, name string, args ...string) (stdout []byte, stderr []byte, err error)
+	// RunWithInput is Run passing input to the command on stdin.
+	RunWithInput(ctx context.Context, input []byte, name string, args ...string) (stdout []byte, stderr []byte, err error)
+}
+
+// DefaultRunner runs the commands of the pools and volumes without a runner
+// of their own, and those of the package's functions given a nil runner.
+var DefaultRunner CommandRunner = execRunner{}
+
+// execRunner runs the commands as processes.
+type execRunner struct{}
+
+func (runner execRunner) Run(ctx context.Context, name string, args ...string) (stdout []byte, stderr []byte, err error) {
+	return runner.RunWithInput(ctx, nil, name, args...)
+}
+
+func (execRunner) RunWithInput(ctx context.Context, input []byte, name string, args ...string) (stdout []byte, stderr []byte, err error) {
+	return runCmd(exec.CommandContext(ctx, name, args...), input)
+}
+
+// runCmd runs cmd, passing input on stdin unless it's nil.
+func runCmd(cmd *exec.Cmd, input []byte) (stdout []byte, stderr []byte, err error) {
+	var stdoutBuf, stderrBuf bytes.Buffer
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+	cmd.Stdout = &stdoutBuf
+	cmd.Stderr = &stderrBuf
+	err = cmd.Run()
+	return stdoutBuf.Bytes(), stderrBuf.Bytes(), err
+}
+
+// orDefaultRunner returns runner, or DefaultRunner when it's nil.
+func orDefaultRunner(runner CommandRunner) CommandRunner {
+	if runner == nil {
+		return DefaultRunner
+	}
+	return runner
+}
+
+// runCommand runs a tool with the runner and returns its stdout and stderr
+// separately. A nonzero exit is returned as an error, anything printed on
+// stderr by a successful command is only logged as a warning since the LVM
+// tools print benign messages there, ie leaked file descriptors.
+func runCommand(ctx context.Context, runner CommandRunner, name string, args ...string) (stdout []byte, stderr []byte, err error) {
+	return runCommandWithInput(ctx, runner, nil, name, args...)
+}
+
+// runCommandWithInput is runCommand passing input to the tool on stdin, ie
+// a passphrase which mustn't show up in its arguments.
+func runCommandWithInput(ctx context.Context, runner CommandRunner, input []byte, name string, args ...string) (stdout []byte, stderr []byte, err error) {
+	return runPath(ctx, runner, input, ToolPath(name), args...)
+}
+
+// runCommandAtPriority is runCommand running the tool at the priority.
+func runCommandAtPriority(ctx context.Context, runner CommandRunner, priority ionice.Priority, name string, args ...string) (stdout []byte, stderr []byte, err error) {
+	path, args := priority.Wrap(ToolPath(name), args...)
+	return runPath(ctx, runner, nil, path, args...)
+}
+
+// runPath runs the command at path, see runCommandWithInput.
+func runPath(ctx context.Context, runner CommandRunner, input []byte, path string, args ...string) (stdout []byte, stderr []byte, err error) {
+	runner = orDefaultRunner(runner)
+	if input != nil {
+		stdout, stderr, err = runner.RunWithInput(ctx, input, path, args...)
+	} else {
+		stdout, stderr, err = runner.Run(ctx, path, args...)
+	}
+
+	if err == nil && len(stderr) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"command": path,
+			"args":    strings.Join(args, " "),
+		}).Warn(strings.TrimSpace(string(stderr)))
+	}
+	return stdout, stderr, err
+}
@@ -0,0 +1,89 @@
+package lvm
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunCommandWarnsOnBenignStderr(t *testing.T) {
+	mockVolumeCommands(t)
+	hook := test.NewGlobal()
+	t.Cleanup(hook.Reset)
+
+	// lvs reports leaked file descriptors on stderr but exits zero.
+	stdout, stderr, err := runCommand(context.Background(), nil, "lvs", "--units", "B", "-o", "+lv_tags", "--select", "pool_lv=existing_thin_pool&&vg_name=vg0", "--reportformat", "json")
+	assert.Nil(t, err)
+	assert.Contains(t, string(stdout), `"report"`)
+	assert.NotContains(t, string(stdout), "leaked")
+	assert.Contains(t, string(stderr), "leaked")
+
+	entry := hook.LastEntry()
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, logrus.WarnLevel, entry.Level)
+		assert.True(t, strings.HasPrefix(entry.Message, "File descriptor 34 (/dev/ptmx) leaked"))
+		assert.Equal(t, "/usr/sbin/lvs", entry.Data["command"])
+	}
+}
+
+func TestRunCommandFailsOnNonzeroExit(t *testing.T) {
+	mockVolumeCommands(t)
+	hook := test.NewGlobal()
+	t.Cleanup(hook.Reset)
+
+	_, stderr, err := runCommand(context.Background(), nil, "lvs", "/dev/vg0/missing_thin_pool")
+	assert.NotNil(t, err)
+	assert.Equal(t, "Command not mocked or returns an error.", string(stderr))
+	// The failure is reported by the caller, not logged as a warning.
+	assert.Nil(t, hook.LastEntry())
+}
+
+// recordingRunner records the commands it runs with fakeRunner.
+type recordingRunner struct {
+	fakeRunner
+	names *[]string
+}
+
+func (runner recordingRunner) Run(ctx context.Context, name string, args ...string) (stdout []byte, stderr []byte, err error) {
+	*runner.names = append(*runner.names, name)
+	return runner.fakeRunner.Run(ctx, name, args...)
+}
+
+func TestThinPoolRunsCommandsWithItsRunner(t *testing.T) {
+	mockVolumeCommands(t)
+	volumeExists = true
+	var names []string
+	runner := recordingRunner{fakeRunner{fakeExecCommand}, &names}
+	// Nothing is left to the default runner
+	DefaultRunner = fakeRunner{func(ctx context.Context, command string, args ...string) *exec.Cmd {
+		t.Errorf("%s was run with the default runner", command)
+		return fakeExecCommand(ctx, command, args...)
+	}}
+
+	ctx := context.Background()
+	thinPool, err := NewThinPoolWithRunner(ctx, "/dev/vg0/existing_thin_pool", runner)
+	assert.Nil(t, err)
+	volume := thinPool.GetVolume(ctx, "test-volume")
+	if assert.NotNil(t, volume) {
+		assert.Nil(t, volume.EnsureVolumeIsMounted(ctx, "/mnt/test"))
+	}
+	assert.Equal(t, len(commandLog), len(names))
+	assert.Equal(t, "/usr/bin/mount", names[len(names)-1])
+}
+
+func TestSetToolPath(t *testing.T) {
+	mockVolumeCommands(t)
+	t.Cleanup(func() { ToolPaths["lvs"] = "/usr/sbin/lvs" })
+
+	assert.Nil(t, SetToolPath("lvs", "/sbin/lvs"))
+	checkThinPool(context.Background(), nil, "/dev/vg0/existing_thin_pool")
+	assert.Equal(t, []string{"/sbin/lvs", "/dev/vg0/existing_thin_pool", "--noheadings", "-o", "lv_attr"}, commandLog[0])
+
+	assert.NotNil(t, SetToolPath("lvm", "/sbin/lvm"))
+	assert.NotNil(t, SetToolPath("lvs", ""))
+}
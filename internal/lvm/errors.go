@@ -0,0 +1,57 @@
+package lvm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrVolumeNotFound is returned when a logical volume doesn't exist.
+	ErrVolumeNotFound = errors.New("volume not found")
+	// ErrPoolFull is returned when there isn't enough space to create or
+	// grow a volume.
+	ErrPoolFull = errors.New("pool is full")
+	// ErrDeviceBusy is returned when a volume is still in use, ie mounted or open.
+	ErrDeviceBusy = errors.New("device is busy")
+	// ErrThinPoolMissing is returned when the configured thin pool doesn't exist.
+	ErrThinPoolMissing = errors.New("thin pool does not exist")
+	// ErrWrongPoolType is returned when the configured thin pool is a
+	// logical volume of another type, ie a plain linear LV.
+	ErrWrongPoolType = errors.New("logical volume is not a thin pool")
+	// ErrMkfsTimeout is returned when formatting a volume took longer than
+	// MkfsTimeout.
+	ErrMkfsTimeout = errors.New("mkfs timed out")
+	// ErrVolumeExists is returned when creating a logical volume which
+	// already exists.
+	ErrVolumeExists = errors.New("volume already exists")
+)
+
+// outputErrors maps messages printed by the LVM and mount tools to the error
+// they indicate.
+var outputErrors = []struct {
+	message string
+	err     error
+}{
+	{"Failed to find logical volume", ErrVolumeNotFound},
+	{"not found", ErrVolumeNotFound},
+	{"insufficient free space", ErrPoolFull},
+	{"Insufficient free space", ErrPoolFull},
+	{"reached threshold", ErrPoolFull},
+	{"out of data space", ErrPoolFull},
+	{"in use", ErrDeviceBusy},
+	{"used by another device", ErrDeviceBusy},
+	{"is busy", ErrDeviceBusy},
+	{"already exists", ErrVolumeExists},
+}
+
+// commandError formats a failed command with its stderr, wrapping the sentinel
+// error matching stderr if there is one so callers can use errors.Is.
+func commandError(message string, err error, stderr []byte) error {
+	for _, known := range outputErrors {
+		if strings.Contains(string(stderr), known.message) {
+			return fmt.Errorf("%s: %w: %v, output: %s", message, known.err, err, string(stderr))
+		}
+	}
+	return fmt.Errorf("%s: %v, output: %s", message, err, string(stderr))
+}
@@ -0,0 +1,101 @@
+package lvm
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandErrorsWrapSentinels(t *testing.T) {
+	mockVolumeCommands(t)
+	ctx := context.Background()
+
+	volume := testVolume
+	volume.LVName = "missing-volume"
+	volumeExists = true
+	err := volume.Remove(ctx, volume.LVName)
+	assert.True(t, errors.Is(err, ErrVolumeNotFound), err)
+
+	volume = testVolume
+	volumeExists = false
+	_, err = volume.CreateSnapshot(ctx, "full-snapshot", 0)
+	assert.True(t, errors.Is(err, ErrPoolFull), err)
+	assert.Contains(t, err.Error(), "insufficient free space")
+
+	volume = testVolume
+	volume.LVName = "busy-volume"
+	volume.Mounted = true
+	err = volume.EnsureVolumeIsUnmounted(ctx)
+	assert.True(t, errors.Is(err, ErrDeviceBusy), err)
+	assert.True(t, volume.Mounted)
+}
+
+func TestRemoveBusyVolume(t *testing.T) {
+	mockVolumeCommands(t)
+	volumeExists = true
+
+	// The volume is unmounted first, lvremove still fails while another
+	// device holds it open.
+	volume := testVolume
+	volume.LVName = "held-volume"
+	volume.Mounted = true
+	err := volume.Remove(context.Background(), volume.LVName)
+	assert.True(t, errors.Is(err, ErrDeviceBusy), err)
+	assert.Equal(t, [][]string{
+		{"/usr/bin/umount", "/dev/vg0/held-volume"},
+		{"/usr/sbin/lvremove", "-f", "/dev/vg0/held-volume"},
+	}, commandLog)
+	assert.False(t, volume.Mounted)
+
+	// A volume that can't be unmounted isn't removed
+	commandLog = nil
+	volume.LVName = "busy-volume"
+	volume.Mounted = true
+	err = volume.Remove(context.Background(), volume.LVName)
+	assert.True(t, errors.Is(err, ErrDeviceBusy), err)
+	assert.Equal(t, [][]string{{"/usr/bin/umount", "/dev/vg0/busy-volume"}}, commandLog)
+}
+
+func TestUnknownCommandErrorsAreNotClassified(t *testing.T) {
+	err := commandError("failed to extend volume", errors.New("exit status 1"), []byte("something went wrong"))
+	for _, sentinel := range []error{ErrVolumeNotFound, ErrPoolFull, ErrDeviceBusy, ErrThinPoolMissing, ErrWrongPoolType} {
+		assert.False(t, errors.Is(err, sentinel))
+	}
+	assert.Equal(t, "failed to extend volume: exit status 1, output: something went wrong", err.Error())
+}
+
+func TestNewThinPoolMissing(t *testing.T) {
+	mockVolumeCommands(t)
+
+	_, err := NewThinPool(context.Background(), "/dev/vg0/missing_thin_pool")
+	assert.True(t, errors.Is(err, ErrThinPoolMissing))
+	assert.False(t, errors.Is(err, ErrWrongPoolType))
+}
+
+func TestNewThinPoolWrongPoolType(t *testing.T) {
+	mockVolumeCommands(t)
+
+	_, err := NewThinPool(context.Background(), "/dev/vg0/linear_volume")
+	assert.True(t, errors.Is(err, ErrWrongPoolType))
+	assert.False(t, errors.Is(err, ErrThinPoolMissing))
+	assert.Contains(t, err.Error(), "-wi-a-----")
+}
+
+func TestNewThinPoolReadOnly(t *testing.T) {
+	mockVolumeCommands(t)
+
+	_, err := NewThinPool(context.Background(), "/dev/vg0/readonly_thin_pool")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "not writable")
+}
+
+func TestNewThinPoolValid(t *testing.T) {
+	mockVolumeCommands(t)
+
+	thinPool, err := NewThinPool(context.Background(), "/dev/vg0/existing_thin_pool")
+	assert.Nil(t, err)
+	assert.Equal(t, "existing_thin_pool", thinPool.Name)
+	assert.Equal(t, "vg0", thinPool.VGName)
+}
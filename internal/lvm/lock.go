@@ -0,0 +1,26 @@
+package lvm
+
+import "sync"
+
+// vgLocks serializes the commands which modify LVM metadata per volume group.
+// The lock is shared by every ThinPool and Volume in the process, since CSI
+// handlers may work on different instances referring to the same VG.
+var vgLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: map[string]*sync.Mutex{}}
+
+// lockVG locks the volume group for a mutating command and returns the
+// function releasing it. Read-only commands such as lvs don't need it.
+func lockVG(vgName string) func() {
+	vgLocks.Lock()
+	lock, ok := vgLocks.locks[vgName]
+	if !ok {
+		lock = &sync.Mutex{}
+		vgLocks.locks[vgName] = lock
+	}
+	vgLocks.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
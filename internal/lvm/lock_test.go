@@ -0,0 +1,86 @@
+package lvm
+
+import (
+	"context"
+	"os/exec"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMutationsWaitForVGLock(t *testing.T) {
+	mockVolumeCommands(t)
+	volumeExists = true
+
+	unlock := lockVG("vg0")
+	done := make(chan error)
+	go func() {
+		volume := testVolume
+		done <- volume.Extend(context.Background(), 2*1024*1024*1024)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("lvextend ran while the volume group was locked")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Len(t, commandLog, 0)
+
+	unlock()
+	assert.Nil(t, <-done)
+	assert.Len(t, commandLog, 1)
+}
+
+func TestConcurrentMutationsDoNotInterleave(t *testing.T) {
+	mockVolumeCommands(t)
+	volumeExists = true
+	commandDelay = 50 * time.Millisecond
+	defer func() { commandDelay = 0 }()
+
+	var mu sync.Mutex
+	var starts []time.Time
+	DefaultRunner = fakeRunner{func(ctx context.Context, command string, args ...string) *exec.Cmd {
+		mu.Lock()
+		starts = append(starts, time.Now())
+		mu.Unlock()
+		return fakeExecCommand(ctx, command, args...)
+	}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Each handler works on its own copy of the volume.
+			volume := testVolume
+			assert.Nil(t, volume.Extend(context.Background(), 2*1024*1024*1024))
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, starts, 4)
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	for i := 1; i < len(starts); i++ {
+		assert.GreaterOrEqual(t, starts[i].Sub(starts[i-1]), commandDelay)
+	}
+}
+
+func TestLocksAreIndependentPerVG(t *testing.T) {
+	unlock := lockVG("vg0")
+	defer unlock()
+
+	locked := make(chan struct{})
+	go func() {
+		lockVG("vg1")()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("locking vg1 waited for vg0")
+	}
+}
@@ -0,0 +1,85 @@
+package lvm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// EncryptionKey is the passphrase encrypted volumes are formatted and opened
+// with, it's passed to cryptsetup on stdin.
+var EncryptionKey []byte
+
+// ErrNoEncryptionKey is returned when an encrypted volume is created or
+// opened without an EncryptionKey.
+var ErrNoEncryptionKey = errors.New("no encryption key is configured")
+
+// cryptName returns the device-mapper name the LUKS device of the volume is
+// opened as, the volume's mapper name with a "-luks" layer suffix which
+// can't collide with another LV.
+func (volume *Volume) cryptName() string {
+	return strings.TrimPrefix(volume.mapperDeviceName(), "/dev/mapper/") + "-luks"
+}
+
+// FilesystemDevice returns the device holding the filesystem of the volume,
+// the opened LUKS device of encrypted volumes and the LV of others.
+func (volume *Volume) FilesystemDevice() string {
+	if volume.Encrypted {
+		return "/dev/mapper/" + volume.cryptName()
+	}
+	return volume.DeviceName()
+}
+
+// filesystemDevices returns the paths the filesystem of the volume may be
+// mounted from.
+func (volume *Volume) filesystemDevices() []string {
+	if volume.Encrypted {
+		return []string{volume.FilesystemDevice()}
+	}
+	return []string{volume.lvmDeviceName(), volume.mapperDeviceName()}
+}
+
+// formatLUKS initializes a LUKS header on the volume.
+func (volume *Volume) formatLUKS(ctx context.Context) error {
+	if len(EncryptionKey) == 0 {
+		return ErrNoEncryptionKey
+	}
+	_, stderr, err := runCommandWithInput(ctx, volume.Runner, EncryptionKey, "cryptsetup", "luksFormat", "--batch-mode", "--key-file", "-", volume.DeviceName())
+	if err != nil {
+		return commandError("failed to format LUKS device", err, stderr)
+	}
+	return nil
+}
+
+// OpenLUKS opens the LUKS device of the encrypted volume at its
+// FilesystemDevice. A device which is already open is left as is.
+func (volume *Volume) OpenLUKS(ctx context.Context) error {
+	if len(EncryptionKey) == 0 {
+		return ErrNoEncryptionKey
+	}
+	_, stderr, err := runCommandWithInput(ctx, volume.Runner, EncryptionKey, "cryptsetup", "open", "--type", "luks", "--key-file", "-", volume.DeviceName(), volume.cryptName())
+	if err != nil && !strings.Contains(string(stderr), "already exists") {
+		return commandError("failed to open LUKS device", err, stderr)
+	}
+	return nil
+}
+
+// CloseLUKS closes the LUKS device of the encrypted volume. A device which
+// isn't open is left as is.
+func (volume *Volume) CloseLUKS(ctx context.Context) error {
+	_, stderr, err := runCommand(ctx, volume.Runner, "cryptsetup", "close", volume.cryptName())
+	if err != nil && !strings.Contains(string(stderr), "is not active") {
+		return commandError(fmt.Sprintf("failed to close LUKS device %s", volume.cryptName()), err, stderr)
+	}
+	return nil
+}
+
+// resizeLUKS grows the open LUKS device of the volume to the size of the LV.
+func (volume *Volume) resizeLUKS(ctx context.Context) error {
+	_, stderr, err := runCommandWithInput(ctx, volume.Runner, EncryptionKey, "cryptsetup", "resize", "--key-file", "-", volume.cryptName())
+	if err != nil {
+		return commandError("failed to resize LUKS device", err, stderr)
+	}
+	return nil
+}
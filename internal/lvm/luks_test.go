@@ -0,0 +1,84 @@
+package lvm
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mockEncryptionKey configures the key of encrypted volumes for a test.
+func mockEncryptionKey(t *testing.T) {
+	EncryptionKey = []byte("correct horse battery staple")
+	t.Cleanup(func() { EncryptionKey = nil })
+}
+
+func TestCreateEncryptedVolume(t *testing.T) {
+	mockVolumeCommands(t)
+	mockEncryptionKey(t)
+	var cmds []*exec.Cmd
+	DefaultRunner = fakeRunner{func(ctx context.Context, command string, args ...string) *exec.Cmd {
+		cmd := fakeExecCommand(ctx, command, args...)
+		cmds = append(cmds, cmd)
+		return cmd
+	}}
+
+	volume, err := CreateThinVolume(context.Background(), nil, "test-volume", "/dev/vg0/existing_thin_pool", 1024*1024*1024, nil, true)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{
+		{"/usr/sbin/lvcreate", "-V", "1073741824B", "-T", "/dev/vg0/existing_thin_pool", "-n", "test-volume"},
+		{"/usr/sbin/cryptsetup", "luksFormat", "--batch-mode", "--key-file", "-", "/dev/vg0/test-volume"},
+		{"/usr/sbin/cryptsetup", "open", "--type", "luks", "--key-file", "-", "/dev/vg0/test-volume", "vg0-test--volume-luks"},
+		{"/usr/sbin/mkfs.xfs", "/dev/mapper/vg0-test--volume-luks"},
+		{"/usr/sbin/cryptsetup", "close", "vg0-test--volume-luks"},
+	}, commandLog)
+
+	// The key is passed on stdin, never in the arguments
+	assert.NotNil(t, cmds[1].Stdin)
+	assert.NotNil(t, cmds[2].Stdin)
+	assert.Nil(t, cmds[3].Stdin)
+	assert.Equal(t, "/dev/mapper/vg0-test--volume-luks", volume.FilesystemDevice())
+}
+
+func TestCreateEncryptedVolumeNeedsKey(t *testing.T) {
+	mockVolumeCommands(t)
+
+	_, err := CreateThinVolume(context.Background(), nil, "test-volume", "/dev/vg0/existing_thin_pool", 1024*1024*1024, nil, true)
+	assert.True(t, errors.Is(err, ErrNoEncryptionKey), err)
+	// The volume without a LUKS device is removed again
+	assert.Equal(t, []string{"/usr/sbin/lvremove", "-f", "/dev/vg0/test-volume"}, commandLog[len(commandLog)-1])
+}
+
+func TestEncryptedVolumeLifecycle(t *testing.T) {
+	mockVolumeCommands(t)
+	mockEncryptionKey(t)
+	ctx := context.Background()
+
+	volume := testVolume
+	volume.Encrypted = true
+	assert.Nil(t, volume.OpenLUKS(ctx))
+	assert.Nil(t, volume.EnsureVolumeIsMounted(ctx, "/mnt/test"))
+	assert.Nil(t, volume.CloseLUKS(ctx))
+	assert.Equal(t, [][]string{
+		{"/usr/sbin/cryptsetup", "open", "--type", "luks", "--key-file", "-", "/dev/vg0/test-volume", "vg0-test--volume-luks"},
+		{"/usr/bin/mount", "/dev/mapper/vg0-test--volume-luks", "/mnt/test"},
+		{"/usr/sbin/cryptsetup", "close", "vg0-test--volume-luks"},
+	}, commandLog)
+}
+
+func TestOpenAndCloseLUKSAreIdempotent(t *testing.T) {
+	mockVolumeCommands(t)
+	mockEncryptionKey(t)
+	ctx := context.Background()
+
+	volume := Volume{VGName: "vg0", LVName: "open-volume", Encrypted: true}
+	assert.Nil(t, volume.OpenLUKS(ctx))
+	assert.Nil(t, volume.CloseLUKS(ctx))
+
+	// Other failures are returned
+	other := Volume{VGName: "vg0", LVName: "other-volume", Encrypted: true}
+	assert.NotNil(t, other.OpenLUKS(ctx))
+	assert.NotNil(t, other.CloseLUKS(ctx))
+}
@@ -0,0 +1,277 @@
+package lvm
+
+import (
+	"context"
+	"fmt"
+	"nodeto/restic-csi-plugin/internal/filemode"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// readProcMounts allows mocking of reading the kernel's mount table.
+var readProcMounts = func() ([]byte, error) {
+	return os.ReadFile("/proc/mounts")
+}
+
+// mapperDeviceName returns the device-mapper path of the volume, ie
+// '/dev/mapper/vg0-test--volume'. Hyphens in the names are doubled.
+func (volume *Volume) mapperDeviceName() string {
+	return fmt.Sprintf("/dev/mapper/%s-%s",
+		strings.ReplaceAll(volume.VGName, "-", "--"),
+		strings.ReplaceAll(volume.LVName, "-", "--"))
+}
+
+// updateMountStatusFromProc updates the mount status from /proc/mounts, used
+// when findmnt isn't available.
+func (volume *Volume) updateMountStatusFromProc() error {
+	data, err := readProcMounts()
+	if err != nil {
+		return fmt.Errorf("failed to read mount table: %w", err)
+	}
+
+	volume.setTargets(parseProcMounts(string(data), volume.filesystemDevices()...))
+	return nil
+}
+
+// mountedFilesystem returns the first mount point of the volume and the type
+// of its filesystem from the kernel's mount table, empty if it isn't mounted.
+func (volume *Volume) mountedFilesystem() (target string, fsType string) {
+	data, err := readProcMounts()
+	if err != nil {
+		return "", ""
+	}
+	devices := volume.filesystemDevices()
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		source := unescapeMountField(fields[0])
+		for _, device := range devices {
+			if source == device {
+				return unescapeMountField(fields[1]), fields[2]
+			}
+		}
+	}
+	return "", ""
+}
+
+// parseProcMounts returns the mount points of any of the devices, in the
+// order they appear in the mount table.
+func parseProcMounts(data string, devices ...string) []string {
+	var targets []string
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		source := unescapeMountField(fields[0])
+		for _, device := range devices {
+			if source == device {
+				targets = append(targets, unescapeMountField(fields[1]))
+				break
+			}
+		}
+	}
+	return targets
+}
+
+// IsMountPoint tells whether anything is mounted at target according to the
+// kernel's mount table, bind mounts of directories and device files included.
+func IsMountPoint(target string) (bool, error) {
+	data, err := readProcMounts()
+	if err != nil {
+		return false, fmt.Errorf("failed to read mount table: %w", err)
+	}
+	target = filepath.Clean(target)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && unescapeMountField(fields[1]) == target {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// unescapeMountField decodes the octal escapes (ie '\040' for a space) the
+// kernel uses in /proc/mounts.
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, "\\") {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if c, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
+
+// MountDirMode is the mode of the mount point directories created for
+// volumes, see ParseDirMode.
+var MountDirMode os.FileMode = 0755
+
+// ParseDirMode parses an octal directory mode, ie "0700".
+func ParseDirMode(value string) (os.FileMode, error) {
+	return filemode.Parse("directory mode", value)
+}
+
+// CreateMountPoint creates the directory path and its parents with mode, a
+// directory which already exists is left as is. The mode is set explicitly as
+// MkdirAll is subject to the umask.
+func CreateMountPoint(path string, mode os.FileMode) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := MkdirAll(path, mode); err != nil {
+		return fmt.Errorf("error creating mount point directory: %w", err)
+	}
+	return os.Chmod(path, mode)
+}
+
+// BindMount bind mounts the source directory at target, creating target if it
+// doesn't exist.
+func BindMount(ctx context.Context, runner CommandRunner, source string, target string, readOnly bool) error {
+	if err := MkdirAll(target, MountDirMode); err != nil {
+		return fmt.Errorf("error creating mount point directory: %w", err)
+	}
+
+	args := []string{"--bind", source, target}
+	if readOnly {
+		args = append([]string{"-o", "ro"}, args...)
+	}
+	if _, stderr, err := runCommand(ctx, runner, "mount", args...); err != nil {
+		return commandError("bind mount error", err, stderr)
+	}
+	return nil
+}
+
+// Mount propagation modes of published volumes, see SetMountPropagation.
+const (
+	PropagationPrivate = "private"
+	PropagationRShared = "rshared"
+	PropagationRSlave  = "rslave"
+)
+
+// ValidatePropagation checks that mode is a supported propagation mode, empty
+// is private.
+func ValidatePropagation(mode string) error {
+	switch mode {
+	case "", PropagationPrivate, PropagationRShared, PropagationRSlave:
+		return nil
+	}
+	return fmt.Errorf("mount propagation must be %s, %s or %s, got %q", PropagationPrivate, PropagationRShared, PropagationRSlave, mode)
+}
+
+// SetMountPropagation changes the propagation of the mount at target, ie to
+// share mounts made below it with the host. Private mounts are left as they
+// were mounted.
+func SetMountPropagation(ctx context.Context, runner CommandRunner, target string, mode string) error {
+	if err := ValidatePropagation(mode); err != nil {
+		return err
+	}
+	if mode == "" || mode == PropagationPrivate {
+		return nil
+	}
+	if _, stderr, err := runCommand(ctx, runner, "mount", "--make-"+mode, target); err != nil {
+		return commandError("error setting mount propagation", err, stderr)
+	}
+	return nil
+}
+
+// RemountReadOnly remounts the filesystem mounted at target read-only, ie to
+// stop the writes to a thin pool which is running out of space.
+func RemountReadOnly(ctx context.Context, runner CommandRunner, target string) error {
+	if _, stderr, err := runCommand(ctx, runner, "mount", "-o", "remount,ro", target); err != nil {
+		return commandError("error remounting read-only", err, stderr)
+	}
+	return nil
+}
+
+// BindMountDevice bind mounts the device node at target, a file created if it
+// doesn't exist, to publish a raw block volume.
+func BindMountDevice(ctx context.Context, runner CommandRunner, device string, target string, readOnly bool) error {
+	if err := MkdirAll(filepath.Dir(target), MountDirMode); err != nil {
+		return fmt.Errorf("error creating the directory of the device file: %w", err)
+	}
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_RDONLY, 0660)
+	if err != nil {
+		return fmt.Errorf("error creating device file: %w", err)
+	}
+	file.Close()
+
+	args := []string{"--bind", device, target}
+	if readOnly {
+		args = append([]string{"-o", "ro"}, args...)
+	}
+	if _, stderr, err := runCommand(ctx, runner, "mount", args...); err != nil {
+		return commandError("bind mount error", err, stderr)
+	}
+	return nil
+}
+
+// Unmount unmounts target. A target that isn't mounted is not an error.
+func Unmount(ctx context.Context, runner CommandRunner, target string) error {
+	_, stderr, err := runCommand(ctx, runner, "umount", target)
+	if err != nil && !strings.Contains(string(stderr), "not mounted") && !strings.Contains(string(stderr), "no mount point specified") {
+		return commandError("umount error", err, stderr)
+	}
+	return nil
+}
+
+// Fstrim discards the unused blocks of the filesystem mounted at mountPoint,
+// returning them to the thin pool.
+func Fstrim(ctx context.Context, runner CommandRunner, mountPoint string) error {
+	if _, stderr, err := runCommand(ctx, runner, "fstrim", mountPoint); err != nil {
+		return commandError("fstrim error", err, stderr)
+	}
+	return nil
+}
+
+// GrowFilesystem grows the XFS filesystem mounted at mountPoint to the size of
+// its device. XFS is grown online, a filesystem which already fills its
+// device is left as is.
+func GrowFilesystem(ctx context.Context, runner CommandRunner, mountPoint string) error {
+	if _, stderr, err := runCommand(ctx, runner, "xfs_growfs", mountPoint); err != nil {
+		return commandError("failed to grow filesystem", err, stderr)
+	}
+	return nil
+}
+
+// FilesystemStats is the usage of a mounted filesystem in bytes and inodes.
+type FilesystemStats struct {
+	TotalBytes     int64
+	AvailableBytes int64
+	UsedBytes      int64
+	TotalInodes    int64
+	FreeInodes     int64
+	UsedInodes     int64
+}
+
+// StatFilesystem returns the usage of the filesystem mounted at path. The
+// available bytes are the ones unprivileged users can write, without the
+// blocks reserved for root.
+func StatFilesystem(path string) (FilesystemStats, error) {
+	var statfs syscall.Statfs_t
+	if err := syscall.Statfs(path, &statfs); err != nil {
+		return FilesystemStats{}, fmt.Errorf("failed to stat filesystem at %s: %w", path, err)
+	}
+	blockSize := int64(statfs.Bsize)
+	return FilesystemStats{
+		TotalBytes:     int64(statfs.Blocks) * blockSize,
+		AvailableBytes: int64(statfs.Bavail) * blockSize,
+		UsedBytes:      int64(statfs.Blocks-statfs.Bfree) * blockSize,
+		TotalInodes:    int64(statfs.Files),
+		FreeInodes:     int64(statfs.Ffree),
+		UsedInodes:     int64(statfs.Files - statfs.Ffree),
+	}, nil
+}
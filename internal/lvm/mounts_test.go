@@ -0,0 +1,287 @@
+package lvm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const procMountsFixture = `sysfs /sys sysfs rw,nosuid,nodev,noexec,relatime 0 0
+/dev/sda1 / ext4 rw,relatime 0 0
+/dev/mapper/vg0-test--volume /mnt/with\040space xfs rw,relatime,attr2,inode64 0 0
+/dev/vg0/other /mnt/other xfs rw,relatime 0 0
+`
+
+// blockDeviceTarget is where TestBindMountDevice publishes a device, the
+// helper process mocks the bind mount to it.
+func blockDeviceTarget() string {
+	return filepath.Join(os.TempDir(), "restic-csi-test-block-device")
+}
+
+// mockMissingFindmnt makes findmnt look uninstalled and serves the fixture as /proc/mounts.
+func mockMissingFindmnt(t *testing.T, mounts string) {
+	mockVolumeCommands(t)
+	DefaultRunner = fakeRunner{func(ctx context.Context, command string, args ...string) *exec.Cmd {
+		if command == "/usr/bin/findmnt" {
+			return exec.CommandContext(ctx, "/nonexistent/findmnt", args...)
+		}
+		return fakeExecCommand(ctx, command, args...)
+	}}
+	readProcMounts = func() ([]byte, error) {
+		return []byte(mounts), nil
+	}
+	t.Cleanup(func() {
+		readProcMounts = func() ([]byte, error) {
+			return os.ReadFile("/proc/mounts")
+		}
+	})
+}
+
+func TestUpdateMountStatusFallsBackToProcMounts(t *testing.T) {
+	mockMissingFindmnt(t, procMountsFixture)
+	ctx := context.Background()
+
+	volume := testVolume
+	assert.Nil(t, volume.UpdateMountStatus(ctx))
+	assert.True(t, volume.Mounted)
+	assert.Equal(t, "/mnt/with space", volume.Target)
+
+	other := Volume{VGName: "vg0", LVName: "other"}
+	assert.Nil(t, other.UpdateMountStatus(ctx))
+	assert.True(t, other.Mounted)
+	assert.Equal(t, "/mnt/other", other.Target)
+
+	unmounted := Volume{VGName: "vg0", LVName: "unmounted", Mounted: true, Target: "/mnt/stale"}
+	assert.Nil(t, unmounted.UpdateMountStatus(ctx))
+	assert.False(t, unmounted.Mounted)
+	assert.Equal(t, "", unmounted.Target)
+}
+
+func TestExtendGrowsMountedXFSWithXfsGrowfs(t *testing.T) {
+	mockMissingFindmnt(t, procMountsFixture)
+	volumeExists = true
+
+	volume := testVolume
+	assert.Nil(t, volume.Extend(context.Background(), 2*1024*1024*1024))
+	assert.Equal(t, [][]string{
+		{"/usr/sbin/lvextend", "--size", "2147483648B", "/dev/vg0/test-volume"},
+		{"/usr/sbin/xfs_growfs", "/mnt/with space"},
+	}, commandLog)
+}
+
+func TestExtendResizesUnmountedVolumesWithLvextend(t *testing.T) {
+	mockMissingFindmnt(t, "/dev/sda1 / ext4 rw,relatime 0 0\n")
+	volumeExists = true
+
+	volume := testVolume
+	assert.Nil(t, volume.Extend(context.Background(), 2*1024*1024*1024))
+	assert.Equal(t, [][]string{{"/usr/sbin/lvextend", "--size", "2147483648B", "--resizefs", "/dev/vg0/test-volume"}}, commandLog)
+}
+
+func TestMapperDeviceName(t *testing.T) {
+	volume := Volume{VGName: "vg-data", LVName: "test-volume"}
+	assert.Equal(t, "/dev/mapper/vg--data-test--volume", volume.mapperDeviceName())
+}
+
+// mockDevicePath sets DevicePath for a test, with the devices which exist.
+func mockDevicePath(t *testing.T, mode string, devices ...string) {
+	DevicePath = mode
+	deviceExists = func(path string) bool {
+		for _, device := range devices {
+			if path == device {
+				return true
+			}
+		}
+		return false
+	}
+	t.Cleanup(func() {
+		DevicePath = DevicePathLVM
+		deviceExists = func(path string) bool {
+			_, err := os.Stat(path)
+			return err == nil
+		}
+	})
+}
+
+func TestDeviceNameWithMapperPath(t *testing.T) {
+	mockDevicePath(t, DevicePathMapper)
+	volume := Volume{VGName: "vg-data", LVName: "my-test-volume"}
+	assert.Equal(t, "/dev/mapper/vg--data-my--test--volume", volume.DeviceName())
+
+	// The volume is found by either path
+	thinPool := ThinPool{Volumes: []Volume{volume}}
+	assert.Equal(t, "my-test-volume", thinPool.GetVolumeByDevice("/dev/mapper/vg--data-my--test--volume").LVName)
+	assert.Equal(t, "my-test-volume", thinPool.GetVolumeByDevice("/dev/vg-data/my-test-volume").LVName)
+}
+
+func TestDeviceNameWithAutoPath(t *testing.T) {
+	volume := Volume{VGName: "vg-data", LVName: "test-volume"}
+
+	// Without the LVM symlink the device-mapper node is used
+	mockDevicePath(t, DevicePathAuto, "/dev/mapper/vg--data-test--volume")
+	assert.Equal(t, "/dev/mapper/vg--data-test--volume", volume.DeviceName())
+
+	mockDevicePath(t, DevicePathAuto, "/dev/vg-data/test-volume", "/dev/mapper/vg--data-test--volume")
+	assert.Equal(t, "/dev/vg-data/test-volume", volume.DeviceName())
+
+	// Neither exists yet while the volume is created
+	mockDevicePath(t, DevicePathAuto)
+	assert.Equal(t, "/dev/vg-data/test-volume", volume.DeviceName())
+}
+
+func TestUpdateMountStatusWithMultipleTargets(t *testing.T) {
+	mockVolumeCommands(t)
+	ctx := context.Background()
+
+	volume := Volume{VGName: "vg0", LVName: "multi-volume"}
+	assert.Nil(t, volume.UpdateMountStatus(ctx))
+	assert.True(t, volume.Mounted)
+	assert.Equal(t, "/mnt/first", volume.Target)
+	assert.Equal(t, []string{"/mnt/second"}, volume.AdditionalTargets)
+
+	// A single target, with findmnt's leading blank line.
+	volumeMounted = true
+	single := testVolume
+	assert.Nil(t, single.UpdateMountStatus(ctx))
+	assert.Equal(t, "/mnt/test", single.Target)
+	assert.Nil(t, single.AdditionalTargets)
+}
+
+func TestProcMountsFallbackWithMultipleTargets(t *testing.T) {
+	mockMissingFindmnt(t, procMountsFixture+"/dev/vg0/test-volume /mnt/second xfs rw 0 0\n")
+
+	volume := testVolume
+	assert.Nil(t, volume.UpdateMountStatus(context.Background()))
+	assert.Equal(t, "/mnt/with space", volume.Target)
+	assert.Equal(t, []string{"/mnt/second"}, volume.AdditionalTargets)
+}
+
+func TestIsMountPoint(t *testing.T) {
+	mockMissingFindmnt(t, procMountsFixture)
+
+	for target, expected := range map[string]bool{"/mnt/with space": true, "/mnt/other/": true, "/mnt": false, "/mnt/unmounted": false} {
+		mounted, err := IsMountPoint(target)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, mounted, target)
+	}
+}
+
+func TestUnmountTarget(t *testing.T) {
+	mockVolumeCommands(t)
+	ctx := context.Background()
+
+	volume := Volume{VGName: "vg0", LVName: "multi-volume"}
+	assert.Nil(t, volume.UpdateMountStatus(ctx))
+	assert.Equal(t, []string{"/mnt/first", "/mnt/second"}, volume.Targets())
+
+	// Only the target is unmounted
+	assert.Nil(t, volume.UnmountTarget(ctx, "/mnt/second"))
+	assert.Equal(t, []string{"/usr/bin/umount", "/mnt/second"}, commandLog[len(commandLog)-1])
+	assert.Equal(t, []string{"/mnt/first"}, volume.Targets())
+	assert.True(t, volume.Mounted)
+}
+
+func TestBindMount(t *testing.T) {
+	mockVolumeCommands(t)
+	ctx := context.Background()
+
+	assert.Nil(t, BindMount(ctx, nil, "/mnt/staging/data", "/mnt/target", false))
+	assert.Equal(t, []string{"/usr/bin/mount", "--bind", "/mnt/staging/data", "/mnt/target"}, commandLog[len(commandLog)-1])
+
+	assert.Nil(t, BindMount(ctx, nil, "/mnt/staging/data", "/mnt/target", true))
+	assert.Equal(t, []string{"/usr/bin/mount", "-o", "ro", "--bind", "/mnt/staging/data", "/mnt/target"}, commandLog[len(commandLog)-1])
+}
+
+func TestSetMountPropagation(t *testing.T) {
+	mockVolumeCommands(t)
+	ctx := context.Background()
+
+	assert.Nil(t, SetMountPropagation(ctx, nil, "/mnt/target", PropagationRShared))
+	assert.Equal(t, [][]string{{"/usr/bin/mount", "--make-rshared", "/mnt/target"}}, commandLog)
+
+	// Private mounts are left alone
+	commandLog = nil
+	assert.Nil(t, SetMountPropagation(ctx, nil, "/mnt/target", PropagationPrivate))
+	assert.Nil(t, SetMountPropagation(ctx, nil, "/mnt/target", ""))
+	assert.Empty(t, commandLog)
+
+	assert.NotNil(t, SetMountPropagation(ctx, nil, "/mnt/target", "shared"))
+}
+
+func TestRemountReadOnly(t *testing.T) {
+	mockVolumeCommands(t)
+
+	assert.Nil(t, RemountReadOnly(context.Background(), nil, "/mnt/staging/test-volume"))
+	assert.Equal(t, [][]string{{"/usr/bin/mount", "-o", "remount,ro", "/mnt/staging/test-volume"}}, commandLog)
+	// The remount of an unmocked target fails
+	assert.NotNil(t, RemountReadOnly(context.Background(), nil, "/mnt/elsewhere"))
+}
+
+func TestBindMountDevice(t *testing.T) {
+	mockVolumeCommands(t)
+	target := blockDeviceTarget()
+	t.Cleanup(func() { os.Remove(target) })
+
+	// The target is a file for the device node to be bind mounted over
+	assert.Nil(t, BindMountDevice(context.Background(), nil, "/dev/vg0/test-volume", target, false))
+	assert.Equal(t, []string{"/usr/bin/mount", "--bind", "/dev/vg0/test-volume", target}, commandLog[len(commandLog)-1])
+	info, err := os.Stat(target)
+	assert.Nil(t, err)
+	assert.True(t, info.Mode().IsRegular())
+}
+
+func TestUnmount(t *testing.T) {
+	mockVolumeCommands(t)
+	ctx := context.Background()
+
+	assert.Nil(t, Unmount(ctx, nil, "/mnt/target"))
+	// A target that isn't mounted is already unmounted
+	assert.Nil(t, Unmount(ctx, nil, "/mnt/unmounted"))
+
+	// The default runner is only used without a runner of the caller
+	var names []string
+	assert.Nil(t, Unmount(ctx, recordingRunner{fakeRunner{fakeExecCommand}, &names}, "/mnt/target"))
+	assert.Equal(t, []string{"/usr/bin/umount"}, names)
+}
+
+func TestEnsureVolumeIsMountedWithOptions(t *testing.T) {
+	mockVolumeCommands(t)
+	ctx := context.Background()
+
+	volume := Volume{VGName: "vg0", LVName: "test-volume"}
+	assert.Nil(t, volume.EnsureVolumeIsMounted(ctx, "/mnt/test", "discard"))
+	assert.Equal(t, []string{"/usr/bin/mount", "-o", "discard", "/dev/vg0/test-volume", "/mnt/test"}, commandLog[len(commandLog)-1])
+	assert.Equal(t, "/mnt/test", volume.Target)
+}
+
+func TestFstrim(t *testing.T) {
+	mockVolumeCommands(t)
+
+	assert.Nil(t, Fstrim(context.Background(), nil, "/mnt/test"))
+	assert.Equal(t, []string{"/usr/sbin/fstrim", "/mnt/test"}, commandLog[len(commandLog)-1])
+	assert.NotNil(t, Fstrim(context.Background(), nil, "/mnt/missing"))
+}
+
+func TestGrowFilesystem(t *testing.T) {
+	mockVolumeCommands(t)
+
+	assert.Nil(t, GrowFilesystem(context.Background(), nil, "/mnt/with space"))
+	assert.Equal(t, [][]string{{"/usr/sbin/xfs_growfs", "/mnt/with space"}}, commandLog)
+	assert.NotNil(t, GrowFilesystem(context.Background(), nil, "/mnt/missing"))
+}
+
+func TestStatFilesystem(t *testing.T) {
+	stats, err := StatFilesystem(t.TempDir())
+	assert.Nil(t, err)
+	assert.Greater(t, stats.TotalBytes, int64(0))
+	assert.Equal(t, stats.TotalInodes-stats.FreeInodes, stats.UsedInodes)
+	assert.LessOrEqual(t, stats.AvailableBytes+stats.UsedBytes, stats.TotalBytes)
+
+	_, err = StatFilesystem(filepath.Join(t.TempDir(), "missing"))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
@@ -0,0 +1,113 @@
+package lvm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxVolumeNameLength is the longest LV name LVM accepts.
+const maxVolumeNameLength = 127
+
+var volumeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9+_.][a-zA-Z0-9+_.-]*$`)
+
+// reservedVolumeNameParts are used by LVM for its internal volumes.
+var reservedVolumeNameParts = []string{
+	"_cdata", "_cmeta", "_corig", "_mlog", "_mimage", "_pmspare",
+	"_rimage", "_rmeta", "_tdata", "_tmeta", "_vorigin", "_vdata",
+}
+
+// maxEncodedNameLength leaves room in names from VolumeNameFor for suffixes
+// such as "-backup" of the snapshots taken of the volume.
+const maxEncodedNameLength = 100
+
+// encodedNamePrefix starts names from VolumeNameFor which aren't the volume
+// ID itself, which also keeps them clear of the prefixes LVM reserves.
+const encodedNamePrefix = "csi-"
+
+// maxVolumeNamePrefixLength leaves room in names from VolumeNameFor for the
+// hash and part of the volume ID after the prefix.
+const maxVolumeNamePrefixLength = 32
+
+// VolumeNamePrefix starts the names of the LVs of the driver, when set the
+// driver only sees and manages the LVs of the thin pool with the prefix.
+// Set it with SetVolumeNamePrefix.
+var VolumeNamePrefix string
+
+// SetVolumeNamePrefix sets the VolumeNamePrefix, which must be the start of a
+// valid LV name.
+func SetVolumeNamePrefix(prefix string) error {
+	if prefix != "" {
+		if len(prefix) > maxVolumeNamePrefixLength {
+			return fmt.Errorf("volume name prefix %q is longer than %d characters", prefix, maxVolumeNamePrefixLength)
+		}
+		if err := validateVolumeName(prefix); err != nil {
+			return fmt.Errorf("invalid volume name prefix: %w", err)
+		}
+	}
+	VolumeNamePrefix = prefix
+	return nil
+}
+
+// IsManagedVolume reports whether the LV carries the VolumeNamePrefix.
+func IsManagedVolume(volumeName string) bool {
+	return strings.HasPrefix(volumeName, VolumeNamePrefix)
+}
+
+// invalidNameChars are the characters replaced in names from VolumeNameFor.
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// VolumeNameFor returns the LV name of the CSI volume ID. IDs which are
+// valid LV names are used as is after the VolumeNamePrefix, any other ID is
+// mapped to "<prefix><hash>-<name>", where the prefix defaults to "csi-",
+// name is a truncated lower case version of the ID and hash identifies the
+// full ID.
+func VolumeNameFor(volumeID string) string {
+	if name := VolumeNamePrefix + volumeID; len(name) <= maxEncodedNameLength && validateVolumeName(name) == nil {
+		return name
+	}
+
+	prefix := VolumeNamePrefix
+	if prefix == "" {
+		prefix = encodedNamePrefix
+	}
+	sum := sha256.Sum256([]byte(volumeID))
+	name := prefix + hex.EncodeToString(sum[:])[:16]
+	readable := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(volumeID), "-"), "-")
+	if readable == "" {
+		return name
+	}
+	name += "-" + readable
+	if len(name) > maxEncodedNameLength {
+		name = strings.TrimRight(name[:maxEncodedNameLength], "-")
+	}
+	return name
+}
+
+// validateVolumeName checks the name is a legal LV name before it is passed
+// to a command or used in a device path.
+func validateVolumeName(volumeName string) error {
+	if volumeName == "" {
+		return status.Error(codes.InvalidArgument, "volume name must not be empty")
+	}
+	if len(volumeName) > maxVolumeNameLength {
+		return status.Errorf(codes.InvalidArgument, "volume name %q is longer than %d characters", volumeName, maxVolumeNameLength)
+	}
+	if !volumeNamePattern.MatchString(volumeName) || volumeName == "." || volumeName == ".." {
+		return status.Errorf(codes.InvalidArgument, "volume name %q may only contain a-z, A-Z, 0-9, '+', '_', '.' and '-' and must not start with '-'", volumeName)
+	}
+	if strings.HasPrefix(volumeName, "snapshot") || strings.HasPrefix(volumeName, "pvmove") {
+		return status.Errorf(codes.InvalidArgument, "volume name %q uses a prefix reserved by LVM", volumeName)
+	}
+	for _, part := range reservedVolumeNameParts {
+		if strings.Contains(volumeName, part) {
+			return status.Errorf(codes.InvalidArgument, "volume name %q contains %q which is reserved by LVM", volumeName, part)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package lvm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidateVolumeName(t *testing.T) {
+	for _, name := range []string{"test-volume", "pvc-1234_a.b+c", "a"} {
+		assert.Nil(t, validateVolumeName(name), name)
+	}
+
+	for _, name := range []string{
+		"",
+		"../vg1/other",
+		"..",
+		".",
+		"vg0/test-volume",
+		"-test-volume",
+		"test volume",
+		"test;rm -rf",
+		"snapshot-1",
+		"pvmove0",
+		"pool_tmeta",
+		strings.Repeat("a", maxVolumeNameLength+1),
+	} {
+		err := validateVolumeName(name)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), name)
+	}
+}
+
+func TestVolumeNameFor(t *testing.T) {
+	// Valid names are used as is
+	assert.Equal(t, "pvc-0a1b2c3d", VolumeNameFor("pvc-0a1b2c3d"))
+
+	long := "pvc-" + strings.Repeat("my-very-long-application-name-", 6) + "data"
+	for _, volumeID := range []string{long, "Team/Database Volume #1", "snapshot-restore", "..", "pool_tmeta", "ü"} {
+		name := VolumeNameFor(volumeID)
+		assert.Nil(t, validateVolumeName(name), volumeID)
+		assert.LessOrEqual(t, len(name), maxEncodedNameLength, volumeID)
+		assert.True(t, strings.HasPrefix(name, encodedNamePrefix), volumeID)
+		// The mapping is stable across calls
+		assert.Equal(t, name, VolumeNameFor(volumeID), volumeID)
+	}
+	assert.True(t, strings.HasSuffix(VolumeNameFor("Team/Database Volume #1"), "-team-database-volume-1"))
+	assert.Regexp(t, `^csi-[0-9a-f]{16}$`, VolumeNameFor("ü"))
+
+	// IDs truncated to the same name are told apart by the hash
+	assert.NotEqual(t, VolumeNameFor(long+"-1"), VolumeNameFor(long+"-2"))
+}
+
+// mockVolumeNamePrefix sets the VolumeNamePrefix for a test.
+func mockVolumeNamePrefix(t *testing.T, prefix string) {
+	assert.Nil(t, SetVolumeNamePrefix(prefix))
+	t.Cleanup(func() { VolumeNamePrefix = "" })
+}
+
+func TestVolumeNameForWithPrefix(t *testing.T) {
+	mockVolumeNamePrefix(t, "k8s-")
+
+	assert.Equal(t, "k8s-pvc-0a1b2c3d", VolumeNameFor("pvc-0a1b2c3d"))
+	// The prefix also makes IDs with reserved prefixes valid names
+	assert.Equal(t, "k8s-snapshot-restore", VolumeNameFor("snapshot-restore"))
+	assert.Regexp(t, `^k8s-[0-9a-f]{16}-team-database-volume-1$`, VolumeNameFor("Team/Database Volume #1"))
+
+	long := "pvc-" + strings.Repeat("my-very-long-application-name-", 6) + "data"
+	assert.LessOrEqual(t, len(VolumeNameFor(long)), maxEncodedNameLength)
+	assert.True(t, strings.HasPrefix(VolumeNameFor(long), "k8s-"))
+}
+
+func TestSetVolumeNamePrefix(t *testing.T) {
+	t.Cleanup(func() { VolumeNamePrefix = "" })
+	for _, prefix := range []string{"-csi", "snapshot-", "csi/", strings.Repeat("a", maxVolumeNamePrefixLength+1)} {
+		assert.NotNil(t, SetVolumeNamePrefix(prefix), prefix)
+	}
+	assert.Nil(t, SetVolumeNamePrefix("csi-"))
+	assert.Nil(t, SetVolumeNamePrefix(""))
+	assert.True(t, IsManagedVolume("home"))
+}
+
+func TestInvalidNamesDoNotRunCommands(t *testing.T) {
+	mockVolumeCommands(t)
+	ctx := context.Background()
+
+	_, err := CreateThinVolume(ctx, nil, "../test-volume", "/dev/vg0/existing_thin_pool", 1024, nil, false)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	volume := testVolume
+	_, err = volume.CreateSnapshot(ctx, "", 1024)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	volume.LVName = "../other"
+	assert.Equal(t, codes.InvalidArgument, status.Code(volume.Remove(ctx, volume.LVName)))
+
+	assert.Len(t, commandLog, 0)
+}
@@ -0,0 +1,93 @@
+package lvm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// PoolStatus is the fullness of a thin pool and the free space of its volume
+// group.
+type PoolStatus struct {
+	Size            ByteSize `json:"lv_size"`
+	MetadataSize    ByteSize `json:"lv_metadata_size"`
+	DataPercent     Percent  `json:"data_percent"`
+	MetadataPercent Percent  `json:"metadata_percent"`
+	VGFree          ByteSize `json:"vg_free"`
+}
+
+// Status reports how full the thin pool's data and metadata are.
+func (tp *ThinPool) Status(ctx context.Context) (PoolStatus, error) {
+	output, stderr, err := runCommand(ctx, tp.Runner, "lvs", "--units", "B", "--reportformat", "json", "-o", "lv_size,lv_metadata_size,data_percent,metadata_percent,vg_free", tp.VGName+"/"+tp.Name)
+	if err != nil {
+		return PoolStatus{}, commandError("failed to get thin pool status", err, stderr)
+	}
+
+	var result struct {
+		Report []struct {
+			LV []PoolStatus `json:"lv"`
+		} `json:"report"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return PoolStatus{}, fmt.Errorf("failed to parse thin pool status: %w", err)
+	}
+	if len(result.Report) == 0 || len(result.Report[0].LV) == 0 {
+		return PoolStatus{}, errors.New("lvs did not report the thin pool")
+	}
+	return result.Report[0].LV[0], nil
+}
+
+// BackupLayout writes the LVM metadata of the thin pool's volume group to
+// path with vgcfgbackup. vgcfgrestore recreates the thin pool and its volumes
+// from it on a new node, before the data of the volumes is restored.
+func (tp *ThinPool) BackupLayout(ctx context.Context, path string) error {
+	if _, stderr, err := runCommand(ctx, tp.Runner, "vgcfgbackup", "-f", path, tp.VGName); err != nil {
+		return commandError("failed to back up volume group layout", err, stderr)
+	}
+	return nil
+}
+
+// GetVGFreeBytes returns the free space of the volume group, which thin pools
+// and volumes outside of them are allocated from. Status reports it for the
+// volume group of a thin pool along with the pool's fullness.
+func GetVGFreeBytes(ctx context.Context, runner CommandRunner, vgName string) (ByteSize, error) {
+	output, stderr, err := runCommand(ctx, runner, "vgs", "--units", "B", "-o", "vg_free", "--reportformat", "json", vgName)
+	if err != nil {
+		return 0, commandError("failed to get volume group free space", err, stderr)
+	}
+
+	var result struct {
+		Report []struct {
+			VG []struct {
+				Free ByteSize `json:"vg_free"`
+			} `json:"vg"`
+		} `json:"report"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return 0, fmt.Errorf("failed to parse volume group free space: %w", err)
+	}
+	if len(result.Report) == 0 || len(result.Report[0].VG) == 0 {
+		return 0, fmt.Errorf("vgs did not report volume group %s", vgName)
+	}
+	return result.Report[0].VG[0].Free, nil
+}
+
+// ExtendPool grows the thin pool's data and metadata by the given sizes from
+// the free space of the volume group, a zero size leaves that part as is.
+func (tp *ThinPool) ExtendPool(ctx context.Context, data ByteSize, metadata ByteSize) error {
+	defer lockVG(tp.VGName)()
+
+	pool := tp.VGName + "/" + tp.Name
+	if data > 0 {
+		if _, stderr, err := runCommand(ctx, tp.Runner, "lvextend", "--size", "+"+data.AsString(), pool); err != nil {
+			return commandError("failed to extend thin pool", err, stderr)
+		}
+	}
+	if metadata > 0 {
+		if _, stderr, err := runCommand(ctx, tp.Runner, "lvextend", "--poolmetadatasize", "+"+metadata.AsString(), pool); err != nil {
+			return commandError("failed to extend thin pool metadata", err, stderr)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package lvm
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolStatus(t *testing.T) {
+	mockVolumeCommands(t)
+	thinPool := ThinPool{LongName: "/dev/vg0/existing_thin_pool", Name: "existing_thin_pool", VGName: "vg0"}
+
+	status, err := thinPool.Status(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, PoolStatus{
+		Size:            10 * 1024 * 1024 * 1024,
+		MetadataSize:    16 * 1024 * 1024,
+		DataPercent:     91.5,
+		MetadataPercent: 12,
+		VGFree:          2 * 1024 * 1024 * 1024,
+	}, status)
+}
+
+func TestPoolStatusWithoutMetadataPercent(t *testing.T) {
+	mockVolumeCommands(t)
+	// Some LVM versions report an empty metadata_percent
+	thinPool := ThinPool{LongName: "/dev/vg0/legacy_thin_pool", Name: "legacy_thin_pool", VGName: "vg0"}
+
+	status, err := thinPool.Status(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, Percent(91.5), status.DataPercent)
+	assert.Equal(t, Percent(0), status.MetadataPercent)
+}
+
+func TestExtendPool(t *testing.T) {
+	mockVolumeCommands(t)
+	ctx := context.Background()
+	thinPool := ThinPool{LongName: "/dev/vg0/existing_thin_pool", Name: "existing_thin_pool", VGName: "vg0"}
+
+	assert.Nil(t, thinPool.ExtendPool(ctx, 1024*1024*1024, 8*1024*1024))
+	assert.Equal(t, [][]string{
+		{"/usr/sbin/lvextend", "--size", "+1073741824B", "vg0/existing_thin_pool"},
+		{"/usr/sbin/lvextend", "--poolmetadatasize", "+8388608B", "vg0/existing_thin_pool"},
+	}, commandLog)
+
+	// Only the metadata is extended
+	commandLog = nil
+	assert.Nil(t, thinPool.ExtendPool(ctx, 0, 8*1024*1024))
+	assert.Len(t, commandLog, 1)
+
+	err := thinPool.ExtendPool(ctx, 4*1024*1024*1024, 0)
+	assert.True(t, errors.Is(err, ErrPoolFull))
+}
+
+func TestBackupLayout(t *testing.T) {
+	mockVolumeCommands(t)
+	thinPool := ThinPool{LongName: "/dev/vg0/existing_thin_pool", Name: "existing_thin_pool", VGName: "vg0"}
+
+	assert.Nil(t, thinPool.BackupLayout(context.Background(), "/mnt/staging/layout/vg0.vg"))
+	assert.Equal(t, [][]string{{"/usr/sbin/vgcfgbackup", "-f", "/mnt/staging/layout/vg0.vg", "vg0"}}, commandLog)
+
+	assert.NotNil(t, thinPool.BackupLayout(context.Background(), "/mnt/elsewhere/vg0.vg"))
+}
+
+func TestGetVGFreeBytes(t *testing.T) {
+	mockVolumeCommands(t)
+	ctx := context.Background()
+
+	free, err := GetVGFreeBytes(ctx, nil, "vg0")
+	assert.Nil(t, err)
+	assert.Equal(t, ByteSize(5*1024*1024*1024), free)
+	assert.Equal(t, [][]string{{"/usr/sbin/vgs", "--units", "B", "-o", "vg_free", "--reportformat", "json", "vg0"}}, commandLog)
+
+	_, err = GetVGFreeBytes(ctx, nil, "vg_empty")
+	assert.NotNil(t, err)
+	_, err = GetVGFreeBytes(ctx, nil, "missing_vg")
+	assert.NotNil(t, err)
+
+	// The caller's runner is used when given
+	var names []string
+	_, err = GetVGFreeBytes(ctx, recordingRunner{fakeRunner{fakeExecCommand}, &names}, "vg0")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/usr/sbin/vgs"}, names)
+}
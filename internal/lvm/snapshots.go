@@ -0,0 +1,134 @@
+package lvm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultSnapshotExtendThreshold is the data percentage at which a snapshot
+// is extended when SnapshotAutoExtend has no threshold.
+const DefaultSnapshotExtendThreshold = 80
+
+// ErrSnapshotFull is returned by WithSnapshot when its snapshot was about to
+// run out of COW space and couldn't be extended, a full snapshot is invalid.
+var ErrSnapshotFull = errors.New("snapshot is running out of space")
+
+// SnapshotAutoExtendPolicy describes how the COW space of the snapshots taken
+// by WithSnapshot is grown while they're in use.
+type SnapshotAutoExtendPolicy struct {
+	// Interval is how often the snapshot's fullness is polled, zero disables
+	// it.
+	Interval time.Duration
+	// Threshold is the data percentage at which the snapshot is extended,
+	// zero uses DefaultSnapshotExtendThreshold.
+	Threshold Percent
+	// Increment is how much the snapshot is extended by, zero grows it by a
+	// fifth of its current size.
+	Increment ByteSize
+	// MaxSize caps the size the snapshot is extended to, zero caps it at
+	// the size of its origin.
+	MaxSize ByteSize
+}
+
+// SnapshotAutoExtend is the policy of the snapshots taken by WithSnapshot.
+var SnapshotAutoExtend SnapshotAutoExtendPolicy
+
+// snapshotStatus is the size and fullness of a snapshot.
+type snapshotStatus struct {
+	Size        ByteSize `json:"lv_size"`
+	DataPercent Percent  `json:"data_percent"`
+}
+
+// status reports the size of the snapshot and how full its COW space is.
+func (volume *Volume) status(ctx context.Context) (snapshotStatus, error) {
+	output, stderr, err := runCommand(ctx, volume.Runner, "lvs", "--units", "B", "--reportformat", "json", "-o", "lv_size,data_percent", volume.VGName+"/"+volume.LVName)
+	if err != nil {
+		return snapshotStatus{}, commandError("failed to get snapshot status", err, stderr)
+	}
+
+	var result struct {
+		Report []struct {
+			LV []snapshotStatus `json:"lv"`
+		} `json:"report"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return snapshotStatus{}, fmt.Errorf("failed to parse snapshot status: %w", err)
+	}
+	if len(result.Report) == 0 || len(result.Report[0].LV) == 0 {
+		return snapshotStatus{}, errors.New("lvs did not report the snapshot")
+	}
+	return result.Report[0].LV[0], nil
+}
+
+// extendSnapshot grows the COW space of the snapshot to size.
+func (volume *Volume) extendSnapshot(ctx context.Context, size ByteSize) error {
+	defer lockVG(volume.VGName)()
+	if _, stderr, err := runCommand(ctx, volume.Runner, "lvextend", "--size", size.AsString(), volume.DeviceName()); err != nil {
+		return commandError("failed to extend snapshot", err, stderr)
+	}
+	return nil
+}
+
+// autoExtend polls the fullness of the snapshot of origin until the context
+// is cancelled, extending it at the threshold. A snapshot at the threshold
+// which can't be extended, because of the cap or lvextend failing, calls
+// abort and its error is returned.
+func (volume *Volume) autoExtend(ctx context.Context, policy SnapshotAutoExtendPolicy, origin ByteSize, abort func()) error {
+	threshold := policy.Threshold
+	if threshold == 0 {
+		threshold = DefaultSnapshotExtendThreshold
+	}
+	maxSize := policy.MaxSize
+	if maxSize == 0 {
+		maxSize = origin
+	}
+	log := logrus.WithField("snapshot", volume.LVName)
+
+	ticker := time.NewTicker(policy.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		status, err := volume.status(ctx)
+		if err != nil {
+			// The snapshot is removed once the context is done.
+			if ctx.Err() == nil {
+				log.WithError(err).Warn("failed to get snapshot status")
+			}
+			continue
+		}
+		if status.DataPercent < threshold {
+			continue
+		}
+
+		increment := policy.Increment
+		if increment == 0 {
+			increment = status.Size / 5
+		}
+		size := status.Size + increment
+		if size > maxSize {
+			size = maxSize
+		}
+		if size <= status.Size {
+			abort()
+			return fmt.Errorf("%w: %s is %.1f%% full at its maximum size of %s", ErrSnapshotFull, volume.LVName, float64(status.DataPercent), maxSize.Human())
+		}
+		if err := volume.extendSnapshot(ctx, size); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			abort()
+			return fmt.Errorf("%w: %s is %.1f%% full: %v", ErrSnapshotFull, volume.LVName, float64(status.DataPercent), err)
+		}
+		log.WithFields(logrus.Fields{"data_percent": status.DataPercent, "size": size}).Info("snapshot is extended")
+	}
+}
@@ -0,0 +1,108 @@
+package lvm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fillingSnapshotRunner reports the snapshot filling up, one data percentage
+// per lvs poll with the last one repeated, and grows it on lvextend. The
+// other commands succeed.
+type fillingSnapshotRunner struct {
+	mu       sync.Mutex
+	percents []float64
+	size     ByteSize
+	// extended records the sizes the snapshot was extended to.
+	extended []string
+	commands []string
+}
+
+func (runner *fillingSnapshotRunner) Run(ctx context.Context, name string, args ...string) (stdout []byte, stderr []byte, err error) {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	runner.commands = append(runner.commands, name+" "+strings.Join(args, " "))
+
+	switch {
+	case name == "/usr/sbin/lvs":
+		percent := runner.percents[0]
+		if len(runner.percents) > 1 {
+			runner.percents = runner.percents[1:]
+		}
+		return []byte(fmt.Sprintf(`{"report": [{"lv": [{"lv_size": "%dB", "data_percent": "%.2f"}]}]}`, runner.size, percent)), nil, nil
+	case name == "/usr/sbin/lvextend":
+		runner.extended = append(runner.extended, args[1])
+		if err := runner.size.UnmarshalText([]byte(args[1])); err != nil {
+			return nil, nil, err
+		}
+		runner.percents = []float64{40}
+	}
+	return nil, nil, nil
+}
+
+func (runner *fillingSnapshotRunner) RunWithInput(ctx context.Context, input []byte, name string, args ...string) (stdout []byte, stderr []byte, err error) {
+	return runner.Run(ctx, name, args...)
+}
+
+func (runner *fillingSnapshotRunner) extensions() []string {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	return append([]string{}, runner.extended...)
+}
+
+// mockSnapshotAutoExtend sets SnapshotAutoExtend for a test.
+func mockSnapshotAutoExtend(t *testing.T, policy SnapshotAutoExtendPolicy) {
+	SnapshotAutoExtend = policy
+	t.Cleanup(func() { SnapshotAutoExtend = SnapshotAutoExtendPolicy{} })
+}
+
+func TestWithSnapshotExtendsFillingSnapshot(t *testing.T) {
+	mockVolumeCommands(t)
+	mockSnapshotAutoExtend(t, SnapshotAutoExtendPolicy{Interval: time.Millisecond, Increment: 1024 * 1024 * 1024})
+	runner := &fillingSnapshotRunner{percents: []float64{50, 70, 85}, size: 1024 * 1024 * 1024}
+	volume := Volume{VGName: "vg0", LVName: "test-volume", LVSize: 4 * 1024 * 1024 * 1024, Runner: runner}
+
+	err := volume.WithSnapshot(context.Background(), "test-snapshot", 1024*1024*1024, "/mnt/snapshot", func(ctx context.Context, path string) error {
+		// The backup runs until the snapshot was extended once
+		for len(runner.extensions()) == 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Millisecond):
+			}
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"2147483648B"}, runner.extensions())
+	assert.Contains(t, runner.commands, "/usr/sbin/lvextend --size 2147483648B /dev/vg0/test-snapshot")
+	assert.Equal(t, "/usr/sbin/lvremove -f /dev/vg0/test-snapshot", runner.commands[len(runner.commands)-1])
+}
+
+func TestWithSnapshotAbortsAtMaximumSize(t *testing.T) {
+	mockVolumeCommands(t)
+	mockSnapshotAutoExtend(t, SnapshotAutoExtendPolicy{Interval: time.Millisecond, MaxSize: 1024 * 1024 * 1024})
+	runner := &fillingSnapshotRunner{percents: []float64{95}, size: 1024 * 1024 * 1024}
+	volume := Volume{VGName: "vg0", LVName: "test-volume", LVSize: 4 * 1024 * 1024 * 1024, Runner: runner}
+
+	var backupErr error
+	err := volume.WithSnapshot(context.Background(), "test-snapshot", 1024*1024*1024, "/mnt/snapshot", func(ctx context.Context, path string) error {
+		select {
+		case <-ctx.Done():
+			backupErr = ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+		return backupErr
+	})
+	assert.True(t, errors.Is(err, ErrSnapshotFull), err)
+	assert.Equal(t, context.Canceled, backupErr)
+	assert.Empty(t, runner.extensions())
+	// The snapshot is still removed
+	assert.Equal(t, "/usr/sbin/lvremove -f /dev/vg0/test-snapshot", runner.commands[len(runner.commands)-1])
+}
@@ -0,0 +1,56 @@
+package lvm
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Tags are the LVM tags of a logical volume, lvs reports them as a comma
+// separated list.
+type Tags []string
+
+// UnmarshalJSON parses the lv_tags field of lvs.
+func (tags *Tags) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	*tags = nil
+	if s != "" {
+		*tags = strings.Split(s, ",")
+	}
+	return nil
+}
+
+// Value returns the value of the "key=value" tag, ie the volume ID of
+// "csi-volume-id=pvc-1234", and whether the volume has the tag.
+func (tags Tags) Value(key string) (string, bool) {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, key+"=") {
+			return strings.TrimPrefix(tag, key+"="), true
+		}
+	}
+	return "", false
+}
+
+// NewTag returns the "key=value" tag. LVM only allows letters, digits and
+// "_+.-/=!:&#" in tags, other characters of the value are replaced with '_'.
+func NewTag(key string, value string) string {
+	valid := func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune("_+.-/=!:&#", r):
+			return r
+		}
+		return '_'
+	}
+	return key + "=" + strings.Map(valid, value)
+}
+
+// addTagArgs are the lvcreate arguments adding the tags to a new LV.
+func addTagArgs(tags []string) []string {
+	var args []string
+	for _, tag := range tags {
+		args = append(args, "--addtag", tag)
+	}
+	return args
+}
@@ -0,0 +1,47 @@
+package lvm
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTagsFromLvs(t *testing.T) {
+	var result struct {
+		Report []struct {
+			LV []Volume `json:"lv"`
+		} `json:"report"`
+	}
+	output := `{"report": [{"lv": [
+		{"lv_name":"pvc-1234", "vg_name":"vg0", "lv_size":"1073741824B", "lv_tags":"csi-volume-id=pvc-1234,csi-pvc-name=data,csi-pvc-namespace=default,csi-created=2024-03-01T10:00:00Z"},
+		{"lv_name":"untagged", "vg_name":"vg0", "lv_size":"1073741824B", "lv_tags":""}
+	]}]}`
+	assert.Nil(t, json.Unmarshal([]byte(output), &result))
+
+	volumes := result.Report[0].LV
+	assert.Equal(t, Tags{"csi-volume-id=pvc-1234", "csi-pvc-name=data", "csi-pvc-namespace=default", "csi-created=2024-03-01T10:00:00Z"}, volumes[0].Tags)
+	namespace, ok := volumes[0].Tags.Value("csi-pvc-namespace")
+	assert.True(t, ok)
+	assert.Equal(t, "default", namespace)
+	assert.Nil(t, volumes[1].Tags)
+	_, ok = volumes[1].Tags.Value("csi-volume-id")
+	assert.False(t, ok)
+}
+
+func TestNewTag(t *testing.T) {
+	assert.Equal(t, "csi-volume-id=pvc-1234", NewTag("csi-volume-id", "pvc-1234"))
+	assert.Equal(t, "csi-created=2024-03-01T10:00:00Z", NewTag("csi-created", "2024-03-01T10:00:00Z"))
+	// Characters LVM doesn't allow in tags are replaced
+	assert.Equal(t, "csi-pvc-name=my_data_volume_", NewTag("csi-pvc-name", "my data,volume@"))
+}
+
+func TestCreateVolumeWithTags(t *testing.T) {
+	mockVolumeCommands(t)
+
+	volume, err := CreateBlockVolume(context.Background(), nil, "tagged-volume", "/dev/vg0/existing_thin_pool", 1024*1024*1024, "csi-volume-id=pvc-1234", "csi-pvc-name=data")
+	assert.Nil(t, err)
+	assert.Equal(t, Tags{"csi-volume-id=pvc-1234", "csi-pvc-name=data"}, volume.Tags)
+	assert.Equal(t, [][]string{{"/usr/sbin/lvcreate", "-V", "1073741824B", "-T", "/dev/vg0/existing_thin_pool", "-n", "tagged-volume", "--addtag", "csi-volume-id=pvc-1234", "--addtag", "csi-pvc-name=data"}}, commandLog)
+}
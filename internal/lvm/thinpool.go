@@ -1,29 +1,52 @@
 package lvm
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 )
 
-// execCommand allows mocking of the exec.Command function.
-var execCommand = exec.Command
 var MkdirAll = os.MkdirAll
 
 // ThinPoolIface ...
 type ThinPoolInterface interface {
-	// EnsureVolumeIsPresent ensures that a volume is present in the thin pool.
-	EnsureVolumeIsPresent(volumeName, size string) error
+	// EnsureVolumeIsPresent ensures that a volume is present in the thin
+	// pool, a missing volume is created with the tags.
+	EnsureVolumeIsPresent(ctx context.Context, volumeName string, size ByteSize, tags ...string) error
+	// EnsureEncryptedVolumeIsPresent also creates a missing volume with a LUKS device.
+	EnsureEncryptedVolumeIsPresent(ctx context.Context, volumeName string, size ByteSize, tags ...string) error
+	// EnsureBlockVolumeIsPresent also creates a missing volume without a filesystem.
+	EnsureBlockVolumeIsPresent(ctx context.Context, volumeName string, size ByteSize, tags ...string) error
 	// ensure_absent ensures that a volume is absent in the thin pool.
-	EnsureVolumeIsAbsent(volumeName string) error
+	EnsureVolumeIsAbsent(ctx context.Context, volumeName string) error
 	// GetVolume gets a volume from the thin pool.
-	GetVolume(volumeName string) (*Volume, error)
+	GetVolume(ctx context.Context, volumeName string) *Volume
+	// ListVolumes returns the volumes in the thin pool sorted by name.
+	ListVolumes(ctx context.Context) []Volume
+	// UnmountVolumeTarget unmounts a volume from one of its mount points.
+	UnmountVolumeTarget(ctx context.Context, volumeName string, target string) error
+	// CloneVolume creates a volume with a copy of the data of another volume.
+	CloneVolume(ctx context.Context, sourceName string, volumeName string, size ByteSize, encrypted bool, block bool, tags ...string) error
+	// Status reports how full the thin pool is.
+	Status(ctx context.Context) (PoolStatus, error)
+	// ExtendPool grows the thin pool's data and metadata.
+	ExtendPool(ctx context.Context, data ByteSize, metadata ByteSize) error
+	// BackupLayout writes the LVM metadata of the volume group to path.
+	BackupLayout(ctx context.Context, path string) error
+	// CommandRunner returns the runner of the pool's commands, the mounts of
+	// its volumes are run with it too.
+	CommandRunner() CommandRunner
 }
 
+var _ ThinPoolInterface = (*ThinPool)(nil)
+
 // ThinPool represents a thin pool with its volumes.
 type ThinPool struct {
 	sync.Mutex
@@ -31,56 +54,126 @@ type ThinPool struct {
 	Name     string
 	VGName   string
 	Volumes  []Volume
+	// MkfsOptions are extra mkfs arguments for new volumes, by filesystem type.
+	MkfsOptions map[string][]string
+	// Runner runs the commands of the pool and its volumes, DefaultRunner
+	// when nil.
+	Runner CommandRunner
+}
+
+// NewThinPool creates a new ThinPool instance with the os path to the thin pool,
+// either "/dev/vg0/thinpool" or the device-mapper path "/dev/mapper/vg0-thinpool".
+// LongName is always the "/dev/<vg>/<lv>" form the LVM tools are run with.
+func NewThinPool(ctx context.Context, longName string) (*ThinPool, error) {
+	return NewThinPoolWithRunner(ctx, longName, nil)
 }
 
-// NewThinPool creates a new ThinPool instance with the os path to the thin pool.
-// For example: "/dev/mapper/vg0-thinpool"
-func NewThinPool(longName string) (*ThinPool, error) {
+// NewThinPoolWithRunner is NewThinPool running the commands of the pool and
+// its volumes with runner.
+func NewThinPoolWithRunner(ctx context.Context, longName string, runner CommandRunner) (*ThinPool, error) {
+	thinPool, err := NewUncheckedThinPool(longName, runner)
+	if err != nil {
+		return nil, err
+	}
+
 	// Check if the thin pool exists. If not, return an error.
-	success := isThinPool(longName)
-	if !success {
-		return nil, errors.New("thin pool does not exist")
-	}
-	// Split the string by "/"
-	parts := strings.Split(longName, "/")
-
-	// Assuming the structure is always "/dev/VGName/Name"
-	// and checking if the slice has at least 3 elements
-	var thinPool ThinPool
-	if len(parts) >= 3 {
-		thinPool = ThinPool{LongName: longName,
-			Name:   parts[3],
-			VGName: parts[2],
+	if err := checkThinPool(ctx, runner, thinPool.LongName); err != nil {
+		return nil, err
+	}
+
+	thinPool.refreshVolumes(ctx)
+	return thinPool, nil
+}
+
+// NewUncheckedThinPool is NewThinPoolWithRunner without checking that the
+// thin pool exists, for a pool that may only be activated later. Its volumes
+// are listed by the first call needing them.
+func NewUncheckedThinPool(longName string, runner CommandRunner) (*ThinPool, error) {
+	vgName, name, err := parsePoolPath(longName)
+	if err != nil {
+		return nil, err
+	}
+	return &ThinPool{LongName: "/dev/" + vgName + "/" + name,
+		Name:   name,
+		VGName: vgName,
+		Runner: runner,
+	}, nil
+}
+
+// parsePoolPath returns the VG and LV names of a "/dev/<vg>/<lv>" or
+// "/dev/mapper/<vg>-<lv>" path. Device-mapper names double the hyphens in
+// the VG and LV names, ie "/dev/mapper/my--vg-thin--pool".
+func parsePoolPath(path string) (vgName string, name string, err error) {
+	if mapperName := strings.TrimPrefix(path, "/dev/mapper/"); mapperName != path {
+		// The VG and LV are separated by the first hyphen that isn't doubled.
+		for i := 0; i < len(mapperName); i++ {
+			if mapperName[i] != '-' {
+				continue
+			}
+			if i+1 < len(mapperName) && mapperName[i+1] == '-' {
+				i++
+				continue
+			}
+			vgName = strings.ReplaceAll(mapperName[:i], "--", "-")
+			name = strings.ReplaceAll(mapperName[i+1:], "--", "-")
+			break
 		}
-	} else {
-		return nil, errors.New("invalid thin pool path")
+	} else if parts := strings.Split(path, "/"); len(parts) == 4 && parts[0] == "" && parts[1] == "dev" {
+		vgName, name = parts[2], parts[3]
 	}
+	if vgName == "" || name == "" {
+		return "", "", fmt.Errorf("invalid thin pool path %q, expected /dev/<vg>/<lv> or /dev/mapper/<vg>-<lv>", path)
+	}
+	return vgName, name, nil
+}
+
+// EnsurePresent ensures that a volume is present in the thin pool. A missing
+// volume is created with the tags, those of an existing one are left as is.
+func (tp *ThinPool) EnsureVolumeIsPresent(ctx context.Context, volumeName string, size ByteSize, tags ...string) error {
+	return tp.ensureVolumeIsPresent(ctx, volumeName, size, false, false, tags)
+}
 
-	thinPool.refreshVolumes()
-	return &thinPool, nil
+// EnsureEncryptedVolumeIsPresent is EnsureVolumeIsPresent for encrypted
+// volumes, a missing volume is created with a LUKS device, see
+// CreateThinVolume, and the LUKS device of an existing one is grown with it.
+func (tp *ThinPool) EnsureEncryptedVolumeIsPresent(ctx context.Context, volumeName string, size ByteSize, tags ...string) error {
+	return tp.ensureVolumeIsPresent(ctx, volumeName, size, true, false, tags)
 }
 
-// EnsurePresent ensures that a volume is present in the thin pool.
-func (tp *ThinPool) EnsureVolumeIsPresent(volumeName string, size ByteSize) error {
+// EnsureBlockVolumeIsPresent is EnsureVolumeIsPresent for raw block volumes,
+// a missing volume is created without a filesystem, see CreateBlockVolume,
+// and only the LV of an existing one is grown.
+func (tp *ThinPool) EnsureBlockVolumeIsPresent(ctx context.Context, volumeName string, size ByteSize, tags ...string) error {
+	return tp.ensureVolumeIsPresent(ctx, volumeName, size, false, true, tags)
+}
+
+func (tp *ThinPool) ensureVolumeIsPresent(ctx context.Context, volumeName string, size ByteSize, encrypted bool, block bool, tags []string) error {
 	tp.Lock()
 	defer tp.Unlock()
 
 	// Check if the volume already exists.
-	volume := tp.GetVolume(volumeName)
+	volume := tp.GetVolume(ctx, volumeName)
 	if volume == nil {
 		// Create the volume
-		_, err := CreateThinVolume(volumeName, tp.LongName, size)
+		var err error
+		if block {
+			_, err = CreateBlockVolume(ctx, tp.Runner, volumeName, tp.LongName, size, tags...)
+		} else {
+			_, err = CreateThinVolume(ctx, tp.Runner, volumeName, tp.LongName, size, tp.MkfsOptions[DefaultFsType], encrypted, tags...)
+		}
 		if err == nil {
-			tp.refreshVolumes()
+			tp.refreshVolumes(ctx)
 		}
 		return err
 	}
 	// If the size is smaller than the configured size, do nothnig since there is no practical way to shrink it.
 	// If the size is bigger than the configured size, extend the volume.
 	if size != 0 && volume.LVSize < size {
-		err := volume.Extend(size)
+		volume.Encrypted = encrypted
+		volume.Block = block
+		err := volume.Extend(ctx, size)
 		if err == nil {
-            tp.refreshVolumes()
+            tp.refreshVolumes(ctx)
         }
 		return err
 	}
@@ -89,38 +182,144 @@ func (tp *ThinPool) EnsureVolumeIsPresent(volumeName string, size ByteSize) erro
 }
 
 // ensure_absent ensures that a volume is absent in the thin pool.
-func (tp *ThinPool) EnsureVolumeIsAbsent(volumeName string) error {
+func (tp *ThinPool) EnsureVolumeIsAbsent(ctx context.Context, volumeName string) error {
 	tp.Lock()
 	defer tp.Unlock()
 
 	// Check if the volume exists.
-	volume := tp.GetVolume(volumeName)
+	volume := tp.GetVolume(ctx, volumeName)
 	if volume == nil {
 		return nil // Volume already absent, cool beans.
 	}
 
 	// Remove the volume.
-	result := volume.Remove(volumeName)
+	result := volume.Remove(ctx, volumeName)
 	if result == nil {
-		tp.refreshVolumes()
+		tp.refreshVolumes(ctx)
 	}
 	return result
 }
 
+// CloneVolume creates volumeName as a thin snapshot of sourceName. Thin
+// snapshots share the unchanged blocks of their origin but are otherwise
+// independent volumes, the origin can be written to or removed. XFS clones
+// get a fresh UUID unless CloneUUIDMode is CloneUUIDNouuid, then the clone is
+// extended if size is larger than the source. The clone is removed again if
+// either fails. encrypted tells whether the source has a LUKS device, block
+// whether it's a raw block volume, whose data is left as is. The clone is
+// created with the tags.
+func (tp *ThinPool) CloneVolume(ctx context.Context, sourceName string, volumeName string, size ByteSize, encrypted bool, block bool, tags ...string) error {
+	tp.Lock()
+	defer tp.Unlock()
+
+	if err := validateVolumeName(volumeName); err != nil {
+		return err
+	}
+	source := tp.GetVolume(ctx, sourceName)
+	if source == nil {
+		return fmt.Errorf("%w: %s", ErrVolumeNotFound, sourceName)
+	}
+
+	// Thin snapshots skip activation by default, the clone is used like
+	// any other volume so it's activated.
+	unlock := lockVG(tp.VGName)
+	args := append([]string{"--snapshot", "--setactivationskip", "n", "--activate", "y", "--name", volumeName}, addTagArgs(tags)...)
+	_, stderr, err := runCommand(ctx, tp.Runner, "lvcreate", append(args, tp.VGName+"/"+sourceName)...)
+	unlock()
+	if err != nil {
+		return commandError("failed to clone volume", err, stderr)
+	}
+
+	clone := Volume{VGName: tp.VGName, LVName: volumeName, Origin: sourceName, Encrypted: encrypted, Block: block, Runner: tp.Runner}
+	// The data of a block clone is the user's own, its UUID is left alone.
+	if !block && CloneUUIDMode == CloneUUIDGenerate {
+		if err := clone.RegenerateUUID(ctx); err != nil {
+			if removeErr := clone.Remove(ctx, volumeName); removeErr != nil {
+				return fmt.Errorf("%w, removing the clone failed: %v", err, removeErr)
+			}
+			return err
+		}
+	}
+
+	if size > source.LVSize {
+		if err := clone.Extend(ctx, size); err != nil {
+			if removeErr := clone.Remove(ctx, volumeName); removeErr != nil {
+				return fmt.Errorf("%w, removing the clone failed: %v", err, removeErr)
+			}
+			return err
+		}
+	}
+	tp.refreshVolumes(ctx)
+	return nil
+}
+
 // GetVolume checks if a volume exists in the thin pool.
-func (tp *ThinPool) GetVolume(volumeName string) *Volume {
-	tp.refreshVolumes()
-	for _, v := range tp.Volumes {
-		if v.LVName == volumeName {
-			return &v
+func (tp *ThinPool) GetVolume(ctx context.Context, volumeName string) *Volume {
+	tp.refreshVolumes(ctx)
+	for i := range tp.Volumes {
+		if tp.Volumes[i].LVName == volumeName {
+			return &tp.Volumes[i]
+		}
+	}
+	return nil
+}
+
+// ListVolumes returns a copy of the volumes in the thin pool sorted by name.
+func (tp *ThinPool) ListVolumes(ctx context.Context) []Volume {
+	tp.refreshVolumes(ctx)
+	volumes := append([]Volume{}, tp.Volumes...)
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].LVName < volumes[j].LVName
+	})
+	return volumes
+}
+
+// UnmountVolumeTarget unmounts a volume from one of its mount points, a
+// volume which no longer exists is left alone.
+func (tp *ThinPool) UnmountVolumeTarget(ctx context.Context, volumeName string, target string) error {
+	tp.Lock()
+	defer tp.Unlock()
+
+	volume := tp.GetVolume(ctx, volumeName)
+	if volume == nil {
+		return nil
+	}
+	return volume.UnmountTarget(ctx, target)
+}
+
+// GetVolumeByDevice returns the volume with the device path, ie
+// "/dev/vg0/test-volume" or "/dev/mapper/vg0-test--volume", from the volumes
+// as of the last refresh.
+func (tp *ThinPool) GetVolumeByDevice(devPath string) *Volume {
+	devPath = filepath.Clean(devPath)
+	for i := range tp.Volumes {
+		if tp.Volumes[i].lvmDeviceName() == devPath || tp.Volumes[i].mapperDeviceName() == devPath {
+			return &tp.Volumes[i]
 		}
 	}
 	return nil
 }
 
+// CommandRunner returns the runner the commands of the pool are run with.
+func (tp *ThinPool) CommandRunner() CommandRunner {
+	return orDefaultRunner(tp.Runner)
+}
+
+// GetMountedVolumes returns the volumes which were mounted as of the last
+// refresh.
+func (tp *ThinPool) GetMountedVolumes() []*Volume {
+	var mounted []*Volume
+	for i := range tp.Volumes {
+		if tp.Volumes[i].Mounted {
+			mounted = append(mounted, &tp.Volumes[i])
+		}
+	}
+	return mounted
+}
+
 // refreshVolumes refreshes the list of volumes from the thin pool.
-func (tp *ThinPool) refreshVolumes() error {
-	output, err := execCommand("/usr/sbin/lvs", "--units", "B", "--select", "pool_lv="+tp.Name+"&&vg_name="+tp.VGName, "--reportformat", "json").Output()
+func (tp *ThinPool) refreshVolumes(ctx context.Context) error {
+	output, _, err := runCommand(ctx, tp.Runner, "lvs", "--units", "B", "-o", "+lv_tags", "--select", "pool_lv="+tp.Name+"&&vg_name="+tp.VGName, "--reportformat", "json")
 	if err != nil {
 		// Handle error.
 		return err
@@ -137,25 +336,46 @@ func (tp *ThinPool) refreshVolumes() error {
 		return err
 	}
 
-	tp.Volumes = result.Report[0].LV
+	// LVs without the prefix belong to other tools sharing the pool.
+	var volumes []Volume
+	for _, volume := range result.Report[0].LV {
+		if IsManagedVolume(volume.LVName) {
+			volume.Runner = tp.Runner
+			volumes = append(volumes, volume)
+		}
+	}
+	tp.Volumes = volumes
 	for i := range tp.Volumes {
-		tp.Volumes[i].UpdateMountStatus()
+		tp.Volumes[i].UpdateMountStatus(ctx)
 	}
 
 	return nil
 }
 
-// isThinPool checks if the specified pool name is a valid thin pool.
-func isThinPool(poolName string) bool {
+// checkThinPool checks that the specified pool name is a writable thin pool,
+// returning ErrThinPoolMissing if there's no such LV and ErrWrongPoolType if
+// it's another type of LV.
+func checkThinPool(ctx context.Context, runner CommandRunner, poolName string) error {
 	// Execute the /usr/sbin/lvs command to check that the volume exsits and get its attrs.
-	cmd := execCommand("/usr/sbin/lvs", poolName, "--noheadings", "-o", "lv_attr")
-	output, err := cmd.Output()
+	output, stderr, err := runCommand(ctx, runner, "lvs", poolName, "--noheadings", "-o", "lv_attr")
 	if err != nil {
-		return false
+		err = commandError("failed to look up thin pool", err, stderr)
+		if errors.Is(err, ErrVolumeNotFound) {
+			return fmt.Errorf("%w: %s", ErrThinPoolMissing, poolName)
+		}
+		return err
 	}
 
-	// Check if the specified pool is a thin pool.
-	return strings.HasPrefix(strings.TrimSpace(string(output)), "t")
+	// The first lv_attr character is the volume type, 't' for thin pools,
+	// and the second its permissions.
+	attr := strings.TrimSpace(string(output))
+	if !strings.HasPrefix(attr, "t") {
+		return fmt.Errorf("%w: %s has attributes %q", ErrWrongPoolType, poolName, attr)
+	}
+	if len(attr) > 1 && attr[1] != 'w' {
+		return fmt.Errorf("thin pool %s is not writable, it has attributes %q", poolName, attr)
+	}
+	return nil
 }
 
 // root@bouba:/# findmnt -n -o TARGET --source /dev/vg0/test-volume
@@ -1,12 +1,16 @@
 package lvm
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -16,25 +20,60 @@ var volumeFormatted bool = false
 var volumeSize int64 = 1024 * 1024 * 1024
 var volumeMounted bool = false
 
+// commandHangs makes the faked commands hang until they are killed.
+var commandHangs bool = false
 
-// fakeExecCommand allows mocking of the exec.Command function.
-func fakeExecCommand(command string, args ...string) *exec.Cmd {
+// hangingCommand makes only this faked command hang until it is killed.
+var hangingCommand string
+
+// commandDelay makes the faked commands take at least this long.
+var commandDelay time.Duration = 0
+
+// commandLog records every command line passed to fakeExecCommand.
+var commandLog [][]string
+
+// fakeExecMu serializes fakeExecCommand, for tests running commands from
+// several goroutines.
+var fakeExecMu sync.Mutex
+
+// fakeRunner runs the commands as the processes built by command, ie the
+// helper process of fakeExecCommand.
+type fakeRunner struct {
+	command func(ctx context.Context, name string, args ...string) *exec.Cmd
+}
+
+func (runner fakeRunner) Run(ctx context.Context, name string, args ...string) (stdout []byte, stderr []byte, err error) {
+	return runner.RunWithInput(ctx, nil, name, args...)
+}
+
+func (runner fakeRunner) RunWithInput(ctx context.Context, input []byte, name string, args ...string) (stdout []byte, stderr []byte, err error) {
+	return runCmd(runner.command(ctx, name, args...), input)
+}
+
+// fakeExecCommand allows mocking of the exec.CommandContext function.
+func fakeExecCommand(ctx context.Context, command string, args ...string) *exec.Cmd {
+	fakeExecMu.Lock()
+	defer fakeExecMu.Unlock()
+
+	commandLog = append(commandLog, append([]string{command}, args...))
+	createsExisting, removesMissing := false, false
 	if command == "/usr/sbin/lvremove" {
 		if volumeExists {
 			volumeExists = false
 			volumeFormatted = false
 		} else {
-			// Trigger an error
-			panic("Error: Attempted to remove a non-existing volume.")
+			// lvremove fails like it does for a missing LV
+			removesMissing = true
 		}
 	}
-	if command == "/usr/sbin/lvcreate" {
+	// Clones are thin snapshots of the existing test-volume, they don't create it.
+	if command == "/usr/sbin/lvcreate" && !(len(args) > 1 && args[1] == "--setactivationskip") {
 		if !volumeExists {
 			volumeExists = true
 			volumeFormatted = false
 		} else {
-			// Trigger an error
-			panic("Error: Attempted to create an existing volume.")
+			// lvcreate fails like it does for an existing LV
+			createsExisting = true
 		}
 	}
 	if command == "/usr/sbin/mkfs.xfs" {
@@ -48,7 +87,8 @@ func fakeExecCommand(command string, args ...string) *exec.Cmd {
 			panic("Error: Attempted to format an non-existing volume.")
 		}
 	}
-	if command == "/usr/sbin/lvextend" {
+	// Volumes are extended by device, thin pools by VG/LV name.
+	if command == "/usr/sbin/lvextend" && strings.HasPrefix(args[len(args)-1], "/dev/") {
 		if !volumeExists {
 			panic("Error: Attempted to extend an non-existing volume.")
 		}
@@ -62,12 +102,16 @@ func fakeExecCommand(command string, args ...string) *exec.Cmd {
 	// Run TestHelperProcess with the specified command and arguments after the -- flag.
 	cs := []string{"-test.run=TestHelperProcess", "--", command}
 	cs = append(cs, args...)
-	cmd := exec.Command(os.Args[0], cs...)
+	cmd := exec.CommandContext(ctx, os.Args[0], cs...)
 	cmd.Env = []string{
 		"GO_WANT_HELPER_PROCESS=1",
 		"GO_HELPER_PROCESS_VOLUME_PRESENT=" + fmt.Sprintf("%v", volumeExists),
 		"GO_HELPER_PROCESS_VOLUME_SIZE=" + strconv.FormatInt(volumeSize, 10) + "B",
 		"GO_HELPER_PROCESS_VOLUME_MOUNTED=" + fmt.Sprintf("%v", volumeMounted),
+		"GO_HELPER_PROCESS_HANG=" + fmt.Sprintf("%v", commandHangs || command == hangingCommand),
+		"GO_HELPER_PROCESS_DELAY=" + commandDelay.String(),
+		"GO_HELPER_PROCESS_CREATES_EXISTING=" + fmt.Sprintf("%v", createsExisting),
+		"GO_HELPER_PROCESS_REMOVES_MISSING=" + fmt.Sprintf("%v", removesMissing),
 	}
 
 	// The volume state affects the output so change it after the command is 'run'.
@@ -86,14 +130,15 @@ func fakeMkdirAll(path string, perm os.FileMode) error {
 }
 
 func TestNewThinPool(t *testing.T) {
-	execCommand = fakeExecCommand
+	DefaultRunner = fakeRunner{fakeExecCommand}
 	MkdirAll = fakeMkdirAll
 
-	defer func() { execCommand = exec.Command }()
+	defer func() { DefaultRunner = execRunner{} }()
 	defer func() { MkdirAll = os.MkdirAll }()
 
+	ctx := context.Background()
 	// Test for creating a new ThinPool struct with an existing thin pool.
-	thinPool, err := NewThinPool("/dev/vg0/existing_thin_pool")
+	thinPool, err := NewThinPool(ctx, "/dev/vg0/existing_thin_pool")
 	if err != nil {
 		t.Fatalf("NewThinPool failed, expected thin pool to exist: %v", err)
 	}
@@ -110,6 +155,7 @@ func TestNewThinPool(t *testing.T) {
 		VGName:          "vg0",
 		LVAttr:          "Vwi-a-tz--",
 		LVSize:          1024 * 1024 * 1024,
+		Tags:            Tags{"csi-volume-id=test-volume", "csi-pvc-namespace=default"},
 	}
 
 	// Assert that the Volume struct is created correctly.
@@ -117,63 +163,63 @@ func TestNewThinPool(t *testing.T) {
 	assert.Len(t, thinPool.Volumes, 1)
 
 	// Test for creating a new ThinPool struct with a non-existing thin pool.
-	_, err = NewThinPool("/dev/vg0/non_existing_thin_pool")
+	_, err = NewThinPool(ctx, "/dev/vg0/non_existing_thin_pool")
 	if err == nil {
 		t.Errorf("NewThinPool succeeded, expected failure for non-existent thin pool")
 
 	}
 	// Test EnsureVolumeIsPresent / no change
-	assert.Nil(t, thinPool.EnsureVolumeIsPresent("test-volume", 1024*1024*1024))
+	assert.Nil(t, thinPool.EnsureVolumeIsPresent(ctx, "test-volume", 1024*1024*1024))
 
 	// Assert that the Volume struct remains the same.
 	assert.Equal(t, thinPool.Volumes[0], test_volume_fixture)
 	assert.Len(t, thinPool.Volumes, 1)
 
 	// Test EnsureVolumeIsAbsent / removes volume
-	assert.Nil(t, thinPool.EnsureVolumeIsAbsent("test-volume"))
+	assert.Nil(t, thinPool.EnsureVolumeIsAbsent(ctx, "test-volume"))
 	assert.Len(t, thinPool.Volumes, 0)
 	// Ensure no effect
-	assert.Nil(t, thinPool.EnsureVolumeIsAbsent("test-volume"))
+	assert.Nil(t, thinPool.EnsureVolumeIsAbsent(ctx, "test-volume"))
 	assert.Len(t, thinPool.Volumes, 0)
 	// Add it back
-	assert.Nil(t, thinPool.EnsureVolumeIsPresent("test-volume", 1024*1024*1024))
+	assert.Nil(t, thinPool.EnsureVolumeIsPresent(ctx, "test-volume", 1024*1024*1024))
 	assert.Len(t, thinPool.Volumes, 1)
 	assert.True(t, volumeFormatted)
 	// Make it bigger
-	assert.Nil(t, thinPool.EnsureVolumeIsPresent("test-volume", 1024*1024*1024*2))
+	assert.Nil(t, thinPool.EnsureVolumeIsPresent(ctx, "test-volume", 1024*1024*1024*2))
 	assert.Len(t, thinPool.Volumes, 1)
 	assert.Equal(t, thinPool.Volumes[0].LVSize, ByteSize(1024*1024*1024*2))
-	assert.Nil(t, thinPool.EnsureVolumeIsPresent("test-volume", 1024*1024*1024))
+	assert.Nil(t, thinPool.EnsureVolumeIsPresent(ctx, "test-volume", 1024*1024*1024))
 	assert.Equal(t, thinPool.Volumes[0].LVSize, ByteSize(1024*1024*1024*2))
 
 	// Mount the volume
-	volume := thinPool.GetVolume("test-volume")
-	volume.EnsureVolumeIsMounted("/mnt/test")
+	volume := thinPool.GetVolume(ctx, "test-volume")
+	volume.EnsureVolumeIsMounted(ctx, "/mnt/test")
 	assert.Equal(t, "/mnt/test", volume.Target)
 	assert.Equal(t, true, volume.Mounted)
 
 	// Check volume retrieval reports correct state
-	volume = thinPool.GetVolume("test-volume")
+	volume = thinPool.GetVolume(ctx, "test-volume")
 	assert.Equal(t, "/mnt/test", volume.Target)
 	assert.Equal(t, true, volume.Mounted)
 
 	// Check idempotency
-	assert.Nil(t, volume.EnsureVolumeIsMounted("/mnt/test"))
+	assert.Nil(t, volume.EnsureVolumeIsMounted(ctx, "/mnt/test"))
 	assert.Equal(t, "/mnt/test", volume.Target)
 	assert.Equal(t, true, volume.Mounted)
 
 	// Unmount the volume
-	assert.Nil(t, volume.EnsureVolumeIsUnmounted())
+	assert.Nil(t, volume.EnsureVolumeIsUnmounted(ctx))
 	assert.Equal(t, "", volume.Target)
 	assert.Equal(t, false, volume.Mounted)
 
 	// Check volume retrieval does not alter state
-	volume = thinPool.GetVolume("test-volume")
+	volume = thinPool.GetVolume(ctx, "test-volume")
 	assert.Equal(t, "", volume.Target)
 	assert.Equal(t, false, volume.Mounted)
 
 	// Check idempotency
-	assert.Nil(t, volume.EnsureVolumeIsUnmounted())
+	assert.Nil(t, volume.EnsureVolumeIsUnmounted(ctx))
 	assert.Equal(t, "", volume.Target)
 	assert.Equal(t, false, volume.Mounted)
 
@@ -181,13 +227,95 @@ func TestNewThinPool(t *testing.T) {
 
 	// reset volumeExists to prevent lvcreate failure
 	volumeExists = false
-	snapshotVolume, err := (volume.CreateSnapshot("test-snapshot", ByteSize(1024 * 1024)))
+	snapshotVolume, err := (volume.CreateSnapshot(ctx, "test-snapshot", ByteSize(1024 * 1024)))
 	assert.Nil(t, err)
 	assert.Equal(t, snapshotVolume.LVName, "test-snapshot")
 	assert.Equal(t, snapshotVolume.LVSize, ByteSize(1024 * 1024))
 	assert.Equal(t, snapshotVolume.VGName, "vg0")
 }
 
+func TestConcurrentEnsureVolumeIsPresent(t *testing.T) {
+	mockVolumeCommands(t)
+	ctx := context.Background()
+	// Two requests for the same volume race through separate pools, as they
+	// would in two driver processes.
+	pools := []*ThinPool{
+		{LongName: "/dev/vg0/existing_thin_pool", Name: "existing_thin_pool", VGName: "vg0"},
+		{LongName: "/dev/vg0/existing_thin_pool", Name: "existing_thin_pool", VGName: "vg0"},
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(pools))
+	for i, pool := range pools {
+		wg.Add(1)
+		go func(i int, pool *ThinPool) {
+			defer wg.Done()
+			errs[i] = pool.EnsureVolumeIsPresent(ctx, "test-volume", 1024*1024*1024)
+		}(i, pool)
+	}
+	wg.Wait()
+
+	assert.Nil(t, errs[0])
+	assert.Nil(t, errs[1])
+	// However they interleave the volume is formatted exactly once
+	formatted := 0
+	for _, command := range commandLog {
+		if command[0] == "/usr/sbin/mkfs.xfs" {
+			formatted++
+		}
+	}
+	assert.Equal(t, 1, formatted)
+}
+
+func TestGetVolumeReturnsPoolElement(t *testing.T) {
+	DefaultRunner = fakeRunner{fakeExecCommand}
+	MkdirAll = fakeMkdirAll
+	volumeExists = true
+	volumeMounted = false
+
+	defer func() { DefaultRunner = execRunner{} }()
+	defer func() { MkdirAll = os.MkdirAll }()
+
+	ctx := context.Background()
+	thinPool, err := NewThinPool(ctx, "/dev/vg0/existing_thin_pool")
+	assert.Nil(t, err)
+
+	// Mounting through the returned pointer updates the pool's volume.
+	volume := thinPool.GetVolume(ctx, "test-volume")
+	assert.Nil(t, volume.EnsureVolumeIsMounted(ctx, "/mnt/test"))
+	assert.Same(t, &thinPool.Volumes[0], volume)
+	assert.True(t, thinPool.Volumes[0].Mounted)
+	assert.Equal(t, "/mnt/test", thinPool.Volumes[0].Target)
+
+	assert.Nil(t, volume.EnsureVolumeIsUnmounted(ctx))
+	assert.False(t, thinPool.Volumes[0].Mounted)
+}
+
+func TestGetVolumeByDevice(t *testing.T) {
+	thinPool := &ThinPool{VGName: "vg0", Name: "existing_thin_pool", Volumes: []Volume{
+		{VGName: "vg0", LVName: "test-volume", Mounted: true, Target: "/mnt/test"},
+		{VGName: "vg0", LVName: "other-volume"},
+	}}
+
+	assert.Same(t, &thinPool.Volumes[0], thinPool.GetVolumeByDevice("/dev/vg0/test-volume"))
+	assert.Same(t, &thinPool.Volumes[1], thinPool.GetVolumeByDevice("/dev//vg0/other-volume/"))
+	assert.Nil(t, thinPool.GetVolumeByDevice("/dev/vg1/test-volume"))
+	assert.Nil(t, thinPool.GetVolumeByDevice("/dev/sda1"))
+}
+
+func TestGetMountedVolumes(t *testing.T) {
+	thinPool := &ThinPool{VGName: "vg0", Name: "existing_thin_pool", Volumes: []Volume{
+		{VGName: "vg0", LVName: "test-volume", Mounted: true, Target: "/mnt/test"},
+		{VGName: "vg0", LVName: "other-volume"},
+	}}
+
+	mounted := thinPool.GetMountedVolumes()
+	assert.Len(t, mounted, 1)
+	assert.Same(t, &thinPool.Volumes[0], mounted[0])
+
+	thinPool.Volumes[0].Mounted = false
+	assert.Empty(t, thinPool.GetMountedVolumes())
+}
 
 // TestHelperProcess simulates the behavior of the command being mocked.
 func TestHelperProcess(t *testing.T) {
@@ -195,6 +323,13 @@ func TestHelperProcess(t *testing.T) {
 		return
 	}
 
+	if os.Getenv("GO_HELPER_PROCESS_HANG") == "true" {
+		time.Sleep(time.Minute)
+	}
+	if delay, err := time.ParseDuration(os.Getenv("GO_HELPER_PROCESS_DELAY")); err == nil {
+		time.Sleep(delay)
+	}
+
 	type mockCommandResult struct {
 		stdout   string
 		stderr   string
@@ -202,6 +337,21 @@ func TestHelperProcess(t *testing.T) {
 	}
 
 	argv := os.Args[3:]
+	if os.Getenv("GO_HELPER_PROCESS_CREATES_EXISTING") == "true" {
+		name := ""
+		for i := range argv[:len(argv)-1] {
+			if argv[i] == "-n" {
+				name = argv[i+1]
+			}
+		}
+		fmt.Fprintf(os.Stderr, "  Logical Volume %q already exists in volume group \"vg0\"\n", name)
+		os.Exit(5)
+	}
+	if os.Getenv("GO_HELPER_PROCESS_REMOVES_MISSING") == "true" {
+		device := argv[len(argv)-1]
+		fmt.Fprintf(os.Stderr, "  Failed to find logical volume \"vg0/%s\"\n", device[strings.LastIndex(device, "/")+1:])
+		os.Exit(5)
+	}
 	// mockCommands is a map of command names to their expected as an array with stdout and stderr.
 	if argv[0] == "/usr/sbin/lvextend" && argv[1] == "--size" && argv[3] == "--resizefs" && argv[4] == "/dev/vg0/test-volume" {
 		os.Exit(0)
@@ -215,6 +365,21 @@ func TestHelperProcess(t *testing.T) {
 			stderr:   "A warning was given, but it doesn't matter.\n",
 			exitCode: 0,
 		},
+		sliceToStringKey([]string{"/usr/sbin/lvs", "/dev/vg0/missing_thin_pool", "--noheadings", "-o", "lv_attr"}): {
+			stdout:   "",
+			stderr:   "  Failed to find logical volume \"vg0/missing_thin_pool\"\n",
+			exitCode: 5,
+		},
+		sliceToStringKey([]string{"/usr/sbin/lvs", "/dev/vg0/readonly_thin_pool", "--noheadings", "-o", "lv_attr"}): {
+			stdout:   "  tri-a-tz--\n",
+			stderr:   "",
+			exitCode: 0,
+		},
+		sliceToStringKey([]string{"/usr/sbin/lvs", "/dev/vg0/linear_volume", "--noheadings", "-o", "lv_attr"}): {
+			stdout:   "  -wi-a-----\n",
+			stderr:   "",
+			exitCode: 0,
+		},
 		sliceToStringKey([]string{"/usr/sbin/lvcreate", "-V", "1073741824B", "-T", "/dev/vg0/existing_thin_pool", "-n", "test-volume"}): {
 			stdout:   "Volume successfully created.\n",
 			stderr:   "A warning was given, but it doesn't matter.\n",
@@ -225,16 +390,157 @@ func TestHelperProcess(t *testing.T) {
 			stderr:   "A warning was given, but it doesn't matter.\n",
 			exitCode: 0,
 		},
-		sliceToStringKey([]string{"/usr/sbin/mkfs.xfs", "/dev/vg0/existing_thin_pool"}): {
+		sliceToStringKey([]string{"/usr/sbin/mkfs.xfs", "/dev/vg0/test-volume"}): {
 			stdout:   "Filesystem successfully formatted.\n",
 			stderr:   "A warning was given, but it doesn't matter.\n",
 			exitCode: 0,
 		},
+		sliceToStringKey([]string{"/usr/sbin/mkfs.xfs", "-d", "su=64k,sw=4", "-l", "size=128m", "/dev/vg0/test-volume"}): {
+			stdout:   "Filesystem successfully formatted.\n",
+			stderr:   "",
+			exitCode: 0,
+		},
 		sliceToStringKey([]string{"/usr/sbin/lvcreate", "--snapshot", "--name", "test-snapshot", "-L", "1048576B", "/dev/vg0/test-volume"}): {
 			stdout:   "Snapshot successfully created.\n",
             stderr:   "A warning was given, but it doesn't matter.\n",
             exitCode: 0,
         },
+		sliceToStringKey([]string{"/usr/sbin/lvcreate", "--snapshot", "--name", "test-snapshot", "-L", "1073741824B", "/dev/vg0/test-volume"}): {
+			stdout:   "Snapshot successfully created.\n",
+			stderr:   "",
+			exitCode: 0,
+		},
+		sliceToStringKey([]string{"/usr/bin/mount", "-o", "ro,nouuid", "/dev/vg0/test-snapshot", "/mnt/snapshot"}): {
+			stdout:   "",
+			stderr:   "",
+			exitCode: 0,
+		},
+		sliceToStringKey([]string{"/usr/bin/umount", "/dev/vg0/test-snapshot"}): {
+			stdout:   "",
+			stderr:   "",
+			exitCode: 0,
+		},
+		sliceToStringKey([]string{"/usr/sbin/lvremove", "-f", "/dev/vg0/test-snapshot"}): {
+			stdout:   "Snapshot successfully removed.\n",
+			stderr:   "",
+			exitCode: 0,
+		},
+		sliceToStringKey([]string{"/usr/sbin/lvremove", "-f", "/dev/vg0/missing-volume"}): {
+			stdout:   "",
+			stderr:   "  Failed to find logical volume \"vg0/missing-volume\"\n",
+			exitCode: 5,
+		},
+		sliceToStringKey([]string{"/usr/sbin/lvcreate", "--snapshot", "--name", "full-snapshot", "-L", "1073741824B", "/dev/vg0/test-volume"}): {
+			stdout:   "",
+			stderr:   "  Volume group \"vg0\" has insufficient free space (10 extents): 256 required.\n",
+			exitCode: 5,
+		},
+		sliceToStringKey([]string{"/usr/bin/umount", "/dev/vg0/busy-volume"}): {
+			stdout:   "",
+			stderr:   "umount: /mnt/busy: target is busy.\n",
+			exitCode: 32,
+		},
+		sliceToStringKey([]string{"/usr/bin/umount", "/dev/vg0/held-volume"}): {
+			stdout:   "",
+			stderr:   "",
+			exitCode: 0,
+		},
+		sliceToStringKey([]string{"/usr/sbin/lvremove", "-f", "/dev/vg0/held-volume"}): {
+			stdout:   "",
+			stderr:   "  Logical volume vg0/held-volume is used by another device.\n",
+			exitCode: 5,
+		},
+	}
+
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/lvcreate", "--snapshot", "--setactivationskip", "n", "--activate", "y", "--name", "clone-volume", "vg0/test-volume"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/lvextend", "--size", "2147483648B", "--resizefs", "/dev/vg0/clone-volume"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/lvextend", "--size", "2147483648B", "/dev/vg0/clone-volume"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/lvremove", "-f", "/dev/vg0/clone-volume"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/xfs_admin", "-U", "generate", "/dev/vg0/clone-volume"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/xfs_admin", "-U", "generate", "/dev/mapper/vg0-test--volume-luks"})] = mockCommandResult{}
+	// xfs_admin fails on bad-clone.
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/lvcreate", "--snapshot", "--setactivationskip", "n", "--activate", "y", "--name", "bad-clone", "vg0/test-volume"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/lvremove", "-f", "/dev/vg0/bad-clone"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"ionice", "-c", "2", "-n", "7", "/usr/sbin/mkfs.xfs", "/dev/vg0/test-volume"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/bin/mount", "/dev/vg0/clone-volume", "/mnt/clone"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/bin/mount", "-o", "nouuid", "/dev/vg0/clone-volume", "/mnt/clone"})] = mockCommandResult{}
+
+	// The status of the thin pool, whose VG can fit 2GiB more.
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/lvs", "--units", "B", "--reportformat", "json", "-o", "lv_size,lv_metadata_size,data_percent,metadata_percent,vg_free", "vg0/existing_thin_pool"})] = mockCommandResult{
+		stdout: `{"report": [{"lv": [{"lv_size":"10737418240B", "lv_metadata_size":"16777216B", "data_percent":"91.50", "metadata_percent":"12.00", "vg_free":"2147483648B"}]}]}`,
+	}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/lvs", "--units", "B", "--reportformat", "json", "-o", "lv_size,lv_metadata_size,data_percent,metadata_percent,vg_free", "vg0/legacy_thin_pool"})] = mockCommandResult{
+		stdout: `{"report": [{"lv": [{"lv_size":"10737418240B", "lv_metadata_size":"16777216B", "data_percent":"91.50", "metadata_percent":"", "vg_free":"2147483648B"}]}]}`,
+	}
+	// A block volume created with tags.
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/lvcreate", "-V", "1073741824B", "-T", "/dev/vg0/existing_thin_pool", "-n", "tagged-volume", "--addtag", "csi-volume-id=pvc-1234", "--addtag", "csi-pvc-name=data"})] = mockCommandResult{}
+	// A block volume created without zeroing.
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/lvcreate", "-V", "1073741824B", "-T", "/dev/vg0/existing_thin_pool", "-n", "unzeroed-volume", "--zero", "n"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/vgcfgbackup", "-f", "/mnt/staging/layout/vg0.vg", "vg0"})] = mockCommandResult{
+		stdout: "  Volume group \"vg0\" successfully backed up.\n",
+	}
+	// The free space of vg0, with the header vgs prints.
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/vgs", "--units", "B", "-o", "vg_free", "--reportformat", "json", "vg0"})] = mockCommandResult{
+		stdout: `  {
+      "report": [
+          {
+              "vg": [
+                  {"vg_free":"5368709120B"}
+              ]
+          }
+      ]
+  }`,
+	}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/vgs", "--units", "B", "-o", "vg_free", "--reportformat", "json", "vg_empty"})] = mockCommandResult{
+		stdout: `{"report": [{"vg": []}]}`,
+	}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/lvextend", "--size", "+1073741824B", "vg0/existing_thin_pool"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/lvextend", "--poolmetadatasize", "+8388608B", "vg0/existing_thin_pool"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/lvextend", "--size", "+4294967296B", "vg0/existing_thin_pool"})] = mockCommandResult{
+		stderr:   "  Insufficient free space: 1024 extents needed, but only 512 available\n",
+		exitCode: 5,
+	}
+
+	// The LUKS devices of encrypted volumes.
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/cryptsetup", "luksFormat", "--batch-mode", "--key-file", "-", "/dev/vg0/test-volume"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/cryptsetup", "open", "--type", "luks", "--key-file", "-", "/dev/vg0/test-volume", "vg0-test--volume-luks"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/cryptsetup", "close", "vg0-test--volume-luks"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/mkfs.xfs", "/dev/mapper/vg0-test--volume-luks"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/bin/mount", "/dev/mapper/vg0-test--volume-luks", "/mnt/test"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/cryptsetup", "open", "--type", "luks", "--key-file", "-", "/dev/vg0/open-volume", "vg0-open--volume-luks"})] = mockCommandResult{
+		stderr:   "Device vg0-open--volume-luks already exists.\n",
+		exitCode: 5,
+	}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/cryptsetup", "close", "vg0-open--volume-luks"})] = mockCommandResult{
+		stderr:   "Device vg0-open--volume-luks is not active.\n",
+		exitCode: 4,
+	}
+
+	// Mounted XFS volumes are grown without fsadm.
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/lvextend", "--size", "2147483648B", "/dev/vg0/test-volume"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/xfs_growfs", "/mnt/with space"})] = mockCommandResult{}
+
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/bin/mount", "-o", "discard", "/dev/vg0/test-volume", "/mnt/test"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/fstrim", "/mnt/test"})] = mockCommandResult{}
+
+	// Bind mounts of published volumes.
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/bin/mount", "--bind", "/mnt/staging/data", "/mnt/target"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/bin/mount", "--bind", "/dev/vg0/test-volume", blockDeviceTarget()})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/bin/mount", "-o", "ro", "--bind", "/mnt/staging/data", "/mnt/target"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/bin/mount", "--make-rshared", "/mnt/target"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/bin/mount", "-o", "remount,ro", "/mnt/staging/test-volume"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/bin/umount", "/mnt/target"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/bin/umount", "/mnt/unmounted"})] = mockCommandResult{
+		stderr:   "umount: /mnt/unmounted: not mounted.\n",
+		exitCode: 32,
+	}
+
+	// multi-volume is always mounted at two targets.
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/bin/umount", "/mnt/second"})] = mockCommandResult{}
+	mockSuccessfulCommands[sliceToStringKey([]string{"/usr/bin/findmnt", "-n", "-o", "TARGET", "--source", "/dev/vg0/multi-volume"})] = mockCommandResult{
+		stdout:   "\n/mnt/first\n/mnt/second\n",
+		stderr:   "",
+		exitCode: 0,
 	}
 
 	// Return exit codes depending on if the volume is mounted or not.
@@ -277,7 +583,10 @@ func TestHelperProcess(t *testing.T) {
 
 	// Return output depending on if the volume is in the pool
 	if os.Getenv("GO_HELPER_PROCESS_VOLUME_PRESENT") == "true" {
-		mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/lvs", "--units", "B", "--select", "pool_lv=existing_thin_pool&&vg_name=vg0", "--reportformat", "json"})] = mockCommandResult{
+		mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/lvs", "--noheadings", "-o", "lv_name", "vg0/test-volume"})] = mockCommandResult{
+			stdout: "  test-volume\n",
+		}
+		mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/lvs", "--units", "B", "-o", "+lv_tags", "--select", "pool_lv=existing_thin_pool&&vg_name=vg0", "--reportformat", "json"})] = mockCommandResult{
 			stdout: `  
     {
         "report": [
@@ -285,7 +594,7 @@ func TestHelperProcess(t *testing.T) {
                 "lv": [
                     {"lv_name":"test-volume", "vg_name":"vg0", "lv_attr":"Vwi-a-tz--", "lv_size":"` +
 				os.Getenv("GO_HELPER_PROCESS_VOLUME_SIZE") +
-				`", "pool_lv":"existing_thin_pool", "origin":"", "data_percent":"0.00", "metadata_percent":"", "move_pv":"", "mirror_log":"", "copy_percent":"", "convert_lv":""}
+				`", "pool_lv":"existing_thin_pool", "origin":"", "data_percent":"0.00", "metadata_percent":"", "move_pv":"", "mirror_log":"", "copy_percent":"", "convert_lv":"", "lv_tags":"csi-volume-id=test-volume,csi-pvc-namespace=default"}
                 ]
             }
         ]
@@ -295,7 +604,7 @@ func TestHelperProcess(t *testing.T) {
 			exitCode: 0,
 		}
 	} else if os.Getenv(("GO_HELPER_PROCESS_VOLUME_PRESENT")) == "false" {
-		mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/lvs", "--units", "B", "--select", "pool_lv=existing_thin_pool&&vg_name=vg0", "--reportformat", "json"})] = mockCommandResult{
+		mockSuccessfulCommands[sliceToStringKey([]string{"/usr/sbin/lvs", "--units", "B", "-o", "+lv_tags", "--select", "pool_lv=existing_thin_pool&&vg_name=vg0", "--reportformat", "json"})] = mockCommandResult{
 			stdout: `
 	{
 		"report": [
@@ -330,3 +639,84 @@ func TestHelperProcess(t *testing.T) {
 func sliceToStringKey(slice []string) string {
 	return strings.Join(slice, "🍕")
 }
+
+func TestParsePoolPath(t *testing.T) {
+	for path, expected := range map[string][2]string{
+		"/dev/vg0/thinpool":              {"vg0", "thinpool"},
+		"/dev/my-vg/thin-pool":           {"my-vg", "thin-pool"},
+		"/dev/mapper/vg0-thinpool":       {"vg0", "thinpool"},
+		"/dev/mapper/my--vg-thin--pool":  {"my-vg", "thin-pool"},
+		"/dev/mapper/vg0-thin--pool--x":  {"vg0", "thin-pool-x"},
+		"/dev/mapper/my----vg-thin-pool": {"my--vg", "thin-pool"},
+	} {
+		vgName, name, err := parsePoolPath(path)
+		assert.Nil(t, err, path)
+		assert.Equal(t, expected, [2]string{vgName, name}, path)
+	}
+
+	for _, path := range []string{"", "thinpool", "/dev/vg0", "/dev/vg0/thinpool/extra", "/dev/mapper/thinpool", "/dev/mapper/vg0-", "/dev/mapper/-thinpool"} {
+		_, _, err := parsePoolPath(path)
+		assert.NotNil(t, err, path)
+	}
+}
+
+func TestNewThinPoolWithMapperPath(t *testing.T) {
+	mockVolumeCommands(t)
+
+	thinPool, err := NewThinPool(context.Background(), "/dev/mapper/vg0-existing_thin_pool")
+	assert.Nil(t, err)
+	assert.Equal(t, "vg0", thinPool.VGName)
+	assert.Equal(t, "existing_thin_pool", thinPool.Name)
+	// The LVM tools are run with the /dev/<vg>/<lv> path
+	assert.Equal(t, "/dev/vg0/existing_thin_pool", thinPool.LongName)
+}
+
+func TestVolumesWithoutPrefixAreIgnored(t *testing.T) {
+	mockVolumeCommands(t)
+	volumeExists = true
+	ctx := context.Background()
+	thinPool := ThinPool{LongName: "/dev/vg0/existing_thin_pool", Name: "existing_thin_pool", VGName: "vg0"}
+	assert.Len(t, thinPool.ListVolumes(ctx), 1)
+
+	// test-volume belongs to another tool once the driver uses a prefix
+	mockVolumeNamePrefix(t, "csi-")
+	assert.Empty(t, thinPool.ListVolumes(ctx))
+	assert.Nil(t, thinPool.GetVolume(ctx, "test-volume"))
+	assert.Nil(t, thinPool.EnsureVolumeIsAbsent(ctx, "test-volume"))
+	for _, command := range commandLog {
+		assert.NotEqual(t, "/usr/sbin/lvremove", command[0])
+	}
+	assert.True(t, volumeExists)
+}
+
+func TestCloneVolume(t *testing.T) {
+	mockVolumeCommands(t)
+	volumeExists = true
+	ctx := context.Background()
+	thinPool := ThinPool{LongName: "/dev/vg0/existing_thin_pool", Name: "existing_thin_pool", VGName: "vg0"}
+
+	assert.Nil(t, thinPool.CloneVolume(ctx, "test-volume", "clone-volume", 1024*1024*1024, false, false))
+	assert.Contains(t, commandLog, []string{"/usr/sbin/lvcreate", "--snapshot", "--setactivationskip", "n", "--activate", "y", "--name", "clone-volume", "vg0/test-volume"})
+	assert.NotContains(t, commandLog, []string{"/usr/sbin/lvextend", "--size", "2147483648B", "--resizefs", "/dev/vg0/clone-volume"})
+
+	// A larger clone is extended
+	assert.Nil(t, thinPool.CloneVolume(ctx, "test-volume", "clone-volume", 2*1024*1024*1024, false, false))
+	assert.Contains(t, commandLog, []string{"/usr/sbin/lvextend", "--size", "2147483648B", "--resizefs", "/dev/vg0/clone-volume"})
+
+	err := thinPool.CloneVolume(ctx, "missing-volume", "clone-volume", 0, false, false)
+	assert.True(t, errors.Is(err, ErrVolumeNotFound))
+}
+
+func TestNewUncheckedThinPool(t *testing.T) {
+	// No commands are run, the pool needn't exist yet
+	var names []string
+	thinPool, err := NewUncheckedThinPool("/dev/mapper/vg0-missing--pool", recordingRunner{fakeRunner{fakeExecCommand}, &names})
+	assert.Nil(t, err)
+	assert.Empty(t, names)
+	assert.Equal(t, "/dev/vg0/missing-pool", thinPool.LongName)
+	assert.Equal(t, "vg0", thinPool.VGName)
+	assert.Empty(t, thinPool.Volumes)
+
+	_, err = NewUncheckedThinPool("thinpool", nil)
+	assert.NotNil(t, err)
+}
@@ -3,24 +3,102 @@
 package lvm
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"math"
+	"nodeto/restic-csi-plugin/internal/ionice"
+	"os"
 	"os/exec"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// DefaultFsType is the filesystem volumes are formatted with.
+const DefaultFsType = "xfs"
+
+// SnapshotSizePercent is the share of the origin's size used for snapshots
+// created without an explicit size.
+var SnapshotSizePercent int64 = 100
+
+// DefaultMkfsTimeout is how long formatting a new volume may take before mkfs
+// is killed.
+const DefaultMkfsTimeout = 10 * time.Minute
+
+// MkfsTimeout is how long formatting a new volume may take before mkfs is
+// killed, zero waits for it indefinitely.
+var MkfsTimeout = DefaultMkfsTimeout
+
+// DisableZeroing creates new volumes with --zero n, so lvcreate doesn't wipe
+// their start. The chunk size always comes from the thin pool. Only turn
+// zeroing off when the pool itself zeroes new blocks or every tenant of the
+// pool is trusted: otherwise a new volume may expose data of volumes which
+// were removed before.
+var DisableZeroing = false
+
+// lvcreateArgs are the arguments creating a thin volume with tags in the thin
+// pool.
+func lvcreateArgs(volumeName string, thinPoolLongName string, size ByteSize, tags []string) []string {
+	args := []string{"-V", size.AsString(), "-T", thinPoolLongName, "-n", volumeName}
+	if DisableZeroing {
+		args = append(args, "--zero", "n")
+	}
+	return append(args, addTagArgs(tags)...)
+}
+
 // ByteSize is a custom type to hold the size in bytes as int64
 type ByteSize int64
 
+// byteSizeUnits are the suffixes ParseByteSize accepts, IEC suffixes are
+// powers of 1024 and SI suffixes powers of 1000.
+var byteSizeUnits = map[string]int64{
+	"":   1,
+	"B":  1,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+	"K":  1000,
+	"M":  1000 * 1000,
+	"G":  1000 * 1000 * 1000,
+	"T":  1000 * 1000 * 1000 * 1000,
+}
+
+// ParseByteSize parses a size such as "10Gi", "500M", LVM's "1024B" or a
+// plain byte count.
+func ParseByteSize(s string) (ByteSize, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(s)
+	}
+	unit, ok := byteSizeUnits[s[i:]]
+	if i == 0 || !ok {
+		return 0, fmt.Errorf("invalid size %q, expected a number of bytes with an optional Ki, Mi, Gi, Ti, K, M, G, T or B suffix", s)
+	}
+	val, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil || val > math.MaxInt64/unit {
+		return 0, fmt.Errorf("invalid size %q: out of range", s)
+	}
+	return ByteSize(val * unit), nil
+}
+
 // UnmarshalJSON is a custom unmarshaler for ByteSize
 func (bs *ByteSize) UnmarshalJSON(b []byte) error {
-	s := strings.Trim(string(b), "\"")
-	s = strings.TrimSuffix(s, "B")
-	val, err := strconv.ParseInt(s, 10, 64)
+	return bs.UnmarshalText([]byte(strings.Trim(string(b), "\"")))
+}
+
+// UnmarshalText parses the size with ParseByteSize, so sizes in the
+// configuration can be written as ie "10Gi".
+func (bs *ByteSize) UnmarshalText(b []byte) error {
+	val, err := ParseByteSize(string(b))
 	if err != nil {
 		return err
 	}
-	*bs = ByteSize(val)
+	*bs = val
 	return nil
 }
 
@@ -28,114 +106,506 @@ func (bs *ByteSize) AsString() string {
 	return strconv.FormatInt(int64(*bs), 10) + "B"
 }
 
+// iecUnits are the IEC suffixes from the largest down.
+var iecUnits = []string{"Ti", "Gi", "Mi", "Ki"}
+
+// Human returns the size in the largest IEC unit it reaches, rounded to two
+// decimals, ie "2Gi" or "1.46Gi". Use AsString for LVM arguments.
+func (bs ByteSize) Human() string {
+	for _, unit := range iecUnits {
+		if size := byteSizeUnits[unit]; int64(bs) >= size {
+			value := strconv.FormatFloat(float64(bs)/float64(size), 'f', 2, 64)
+			return strings.TrimSuffix(strings.TrimRight(value, "0"), ".") + unit
+		}
+	}
+	return strconv.FormatInt(int64(bs), 10) + "B"
+}
+
+// String returns the size for logs, see Human.
+func (bs ByteSize) String() string {
+	return bs.Human()
+}
+
+// MarshalJSON writes the size in the largest IEC unit it is a whole multiple
+// of, ie "1536Mi", which ParseByteSize reads back exactly.
+func (bs ByteSize) MarshalJSON() ([]byte, error) {
+	for _, unit := range iecUnits {
+		if size := byteSizeUnits[unit]; bs != 0 && int64(bs)%size == 0 {
+			return json.Marshal(strconv.FormatInt(int64(bs)/size, 10) + unit)
+		}
+	}
+	return json.Marshal(strconv.FormatInt(int64(bs), 10) + "B")
+}
+
+// Percent is a percentage as reported by lvs, ie "12.34". lvs reports an
+// empty string when the value doesn't apply, which is parsed as zero.
+type Percent float64
+
+// UnmarshalJSON is a custom unmarshaler for Percent
+func (p *Percent) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), "\"")
+	if s == "" {
+		*p = 0
+		return nil
+	}
+	val, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*p = Percent(val)
+	return nil
+}
+
 // Volume represents a logical volume.
 type Volume struct {
 	VGName          string   `json:"vg_name"`
 	LVName          string   `json:"lv_name"`
 	LVAttr          string   `json:"lv_attr"`
 	LVSize          ByteSize `json:"lv_size"`
-	Mounted         bool
-	Target          string
+	DataPercent     Percent  `json:"data_percent"`
+	MetadataPercent Percent  `json:"metadata_percent"`
+	// Origin is the LV a snapshot was taken of, empty for other volumes.
+	Origin string `json:"origin"`
+	// Tags are the LVM tags of the volume, see NewTag.
+	Tags    Tags `json:"lv_tags"`
+	Mounted bool
+	Target  string
+	// AdditionalTargets holds any mount points besides Target.
+	AdditionalTargets []string
+	// Encrypted volumes hold a LUKS device with the filesystem, see
+	// FilesystemDevice. LVM doesn't know about it so it's set by the caller.
+	Encrypted bool `json:"-"`
+	// Block volumes are raw devices without a filesystem, set by the caller
+	// like Encrypted.
+	Block bool `json:"-"`
+	// Runner runs the commands of the volume, DefaultRunner when nil. The
+	// volumes of a ThinPool get its runner.
+	Runner CommandRunner `json:"-"`
 }
 
-// CreateVolume creates a new volume in the thin pool with the specified size.
-func CreateThinVolume(volumeName string, thinPoolLongName string, size ByteSize) (*Volume, error) {
-	cmd := execCommand("/usr/sbin/lvcreate", "-V", size.AsString(), "-T", thinPoolLongName, "-n", volumeName)
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create volume: %v, output: %s", err, string(output))
+// UsedBytes estimates the bytes allocated to the volume in the thin pool from DataPercent.
+func (volume *Volume) UsedBytes() ByteSize {
+	return ByteSize(float64(volume.LVSize) * float64(volume.DataPercent) / 100)
+}
+
+// IsSnapshot reports whether the volume is a COW snapshot, ie of a backup.
+// Clones are thin snapshots and have an origin too, but lvs reports them as
+// thin volumes, "V" rather than "s" or "S" for an invalid snapshot.
+func (volume *Volume) IsSnapshot() bool {
+	return strings.HasPrefix(volume.LVAttr, "s") || strings.HasPrefix(volume.LVAttr, "S")
+}
+
+// CreateVolume creates a new volume in the thin pool with the specified size
+// and tags and formats it with DefaultFsType, passing mkfsOptions to mkfs. An encrypted
+// volume gets a LUKS device first, which holds the filesystem and is closed
+// again afterwards. A volume that fails to format is removed again so a retry
+// starts from a clean volume. A volume created by a racing request is
+// returned as is, see createLV.
+func CreateThinVolume(ctx context.Context, runner CommandRunner, volumeName string, thinPoolLongName string, size ByteSize, mkfsOptions []string, encrypted bool, tags ...string) (*Volume, error) {
+	if err := validateVolumeName(volumeName); err != nil {
+		return nil, err
+	}
+	volume := &Volume{
+		VGName:    strings.Split(thinPoolLongName, "/")[2],
+		LVName:    volumeName,
+		LVSize:    size,
+		Encrypted: encrypted,
+		Tags:      tags,
+		Runner:    runner,
+	}
+	if err := validateMkfsOptions(mkfsOptions, volume.DeviceName()); err != nil {
+		return nil, err
 	}
-	cmd = execCommand("/usr/sbin/mkfs.xfs", thinPoolLongName)
-	output, err = cmd.Output()
+
+	created, err := createLV(ctx, volume, thinPoolLongName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create filesystem: %v, output: %s", err, string(output))
+		return nil, err
 	}
-	return &Volume{
-		VGName: strings.Split(thinPoolLongName, "/")[1],
+	if !created {
+		return volume, nil
+	}
+	if err := volume.formatFilesystem(ctx, mkfsOptions); err != nil {
+		if removeErr := volume.Remove(ctx, volumeName); removeErr != nil {
+			return nil, fmt.Errorf("%w, removing the volume failed: %v", err, removeErr)
+		}
+		return nil, err
+	}
+	return volume, nil
+}
+
+// CreateBlockVolume creates a new raw block volume in the thin pool with the
+// specified size and tags, it's left unformatted for the consumer to use as is.
+func CreateBlockVolume(ctx context.Context, runner CommandRunner, volumeName string, thinPoolLongName string, size ByteSize, tags ...string) (*Volume, error) {
+	if err := validateVolumeName(volumeName); err != nil {
+		return nil, err
+	}
+	volume := &Volume{
+		VGName: strings.Split(thinPoolLongName, "/")[2],
 		LVName: volumeName,
 		LVSize: size,
-	}, nil
+		Block:  true,
+		Tags:   tags,
+		Runner: runner,
+	}
+
+	if _, err := createLV(ctx, volume, thinPoolLongName); err != nil {
+		return nil, err
+	}
+	return volume, nil
+}
+
+// createLV creates the thin LV of a new volume. A request racing this one may
+// have created the LV in the meantime, lvcreate failing because it already
+// exists isn't an error then and created is false: the volume is left to be
+// set up by the request which created it.
+func createLV(ctx context.Context, volume *Volume, thinPoolLongName string) (created bool, err error) {
+	unlock := lockVG(volume.VGName)
+	_, stderr, err := runCommand(ctx, volume.Runner, "lvcreate", lvcreateArgs(volume.LVName, thinPoolLongName, volume.LVSize, volume.Tags)...)
+	unlock()
+	if err == nil {
+		return true, nil
+	}
+	err = commandError("failed to create volume", err, stderr)
+	if errors.Is(err, ErrVolumeExists) && lvExists(ctx, volume.Runner, volume.VGName, volume.LVName) {
+		return false, nil
+	}
+	return false, err
+}
+
+// lvExists checks with lvs that the logical volume exists in the volume group.
+func lvExists(ctx context.Context, runner CommandRunner, vgName string, lvName string) bool {
+	output, _, err := runCommand(ctx, runner, "lvs", "--noheadings", "-o", "lv_name", vgName+"/"+lvName)
+	return err == nil && strings.TrimSpace(string(output)) == lvName
+}
+
+// formatFilesystem creates the filesystem of a new volume, on a new LUKS
+// device if the volume is encrypted.
+func (volume *Volume) formatFilesystem(ctx context.Context, mkfsOptions []string) (err error) {
+	if !volume.Encrypted {
+		return volume.format(ctx, DefaultFsType, mkfsOptions)
+	}
+	if err := volume.formatLUKS(ctx); err != nil {
+		return err
+	}
+	if err := volume.OpenLUKS(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := volume.CloseLUKS(ctx); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+	return volume.format(ctx, DefaultFsType, mkfsOptions)
+}
+
+// MkfsPriority is the priority mkfs runs at, formatting a large volume
+// mustn't starve the workloads on the node of I/O.
+var MkfsPriority ionice.Priority
+
+// format creates a filesystem of the given type on the volume, killing mkfs
+// after MkfsTimeout.
+func (volume *Volume) format(ctx context.Context, fsType string, mkfsOptions []string) error {
+	mkfsCtx := ctx
+	if MkfsTimeout > 0 {
+		var cancel context.CancelFunc
+		mkfsCtx, cancel = context.WithTimeout(ctx, MkfsTimeout)
+		defer cancel()
+	}
+	args := append(append([]string{}, mkfsOptions...), volume.FilesystemDevice())
+	_, stderr, err := runCommandAtPriority(mkfsCtx, volume.Runner, MkfsPriority, "mkfs."+fsType, args...)
+	if err != nil && ctx.Err() == nil && mkfsCtx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("failed to create filesystem: %w: mkfs.%s did not finish within %s", ErrMkfsTimeout, fsType, MkfsTimeout)
+	}
+	if err != nil {
+		return commandError("failed to create filesystem", err, stderr)
+	}
+	return nil
 }
 
-// DeviceName returns the device name of the volume, ie '/dev/vg0/test-volume'.
+// validateMkfsOptions makes sure the device isn't passed in the options, it
+// is always appended by format.
+func validateMkfsOptions(mkfsOptions []string, device string) error {
+	for _, option := range mkfsOptions {
+		if option == device {
+			return fmt.Errorf("mkfs options must not contain the device %s", device)
+		}
+	}
+	return nil
+}
+
+// Device paths volumes are used through, see DevicePath.
+const (
+	DevicePathLVM    = "lvm"
+	DevicePathMapper = "mapper"
+	DevicePathAuto   = "auto"
+)
+
+// DevicePath is which path the devices of volumes are used through. "lvm" is
+// the /dev/<vg>/<lv> symlink created by the LVM udev rules, "mapper" is the
+// /dev/mapper/<vg>-<lv> device-mapper node which exists without them, and
+// "auto" uses the symlink when it exists and the node otherwise.
+var DevicePath = DevicePathLVM
+
+// deviceExists allows mocking of the device lookup of DevicePathAuto.
+var deviceExists = func(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// DeviceName returns the device name of the volume, ie '/dev/vg0/test-volume'
+// or '/dev/mapper/vg0-test--volume', see DevicePath.
 func (volume *Volume) DeviceName() string {
+	switch DevicePath {
+	case DevicePathMapper:
+		return volume.mapperDeviceName()
+	case DevicePathAuto:
+		if device := volume.lvmDeviceName(); deviceExists(device) {
+			return device
+		}
+		if device := volume.mapperDeviceName(); deviceExists(device) {
+			return device
+		}
+	}
+	return volume.lvmDeviceName()
+}
+
+// lvmDeviceName returns the LVM symlink of the volume, ie
+// '/dev/vg0/test-volume'.
+func (volume *Volume) lvmDeviceName() string {
 	return fmt.Sprintf("/dev/%s/%s", volume.VGName, volume.LVName)
 }
 
 // CreateVolumeSnapshot creates a new snapshot volume with the specified size.
-func (volume *Volume) CreateSnapshot(snapshotName string, size ByteSize) (*Volume, error) {
-	cmd := execCommand("/usr/sbin/lvcreate", "--snapshot", "--name", snapshotName, "-L", size.AsString(), volume.DeviceName())
-	output, err := cmd.Output()
+// A zero size sizes the snapshot from the origin, see SnapshotSizePercent.
+func (volume *Volume) CreateSnapshot(ctx context.Context, snapshotName string, size ByteSize) (*Volume, error) {
+	if err := validateVolumeName(snapshotName); err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		size = volume.LVSize * ByteSize(SnapshotSizePercent) / 100
+	}
+	defer lockVG(volume.VGName)()
+	_, stderr, err := runCommand(ctx, volume.Runner, "lvcreate", "--snapshot", "--name", snapshotName, "-L", size.AsString(), volume.DeviceName())
 	if err != nil {
-		return nil, fmt.Errorf("failed to create volume snapshot: %v, output: %s", err, string(output))
+		return nil, commandError("failed to create volume snapshot", err, stderr)
 	}
 	return &Volume{
-		VGName: volume.VGName,
-		LVName: snapshotName,
-		LVSize: size,
+		VGName:    volume.VGName,
+		LVName:    snapshotName,
+		LVSize:    size,
+		LVAttr:    "swi-a-s---",
+		Origin:    volume.LVName,
+		Encrypted: volume.Encrypted,
+		Runner:    volume.Runner,
 	}, nil
 }
 
-func (volume *Volume) Extend(size ByteSize) error {
-	cmd := execCommand("/usr/sbin/lvextend", "--size", size.AsString(), "--resizefs", volume.DeviceName())
-	output, err := cmd.Output()
+// WithSnapshot creates a snapshot of the volume, mounts it read-only at mountPath
+// and calls fn with the mount path. The snapshot is always unmounted and removed
+// afterwards, even if fn fails. The snapshot is extended while fn runs, see
+// SnapshotAutoExtend, the context of fn is cancelled and ErrSnapshotFull
+// returned if it can't be.
+func (volume *Volume) WithSnapshot(ctx context.Context, snapshotName string, size ByteSize, mountPath string, fn func(ctx context.Context, path string) error) (err error) {
+	snapshot, err := volume.CreateSnapshot(ctx, snapshotName, size)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if removeErr := snapshot.RemoveSnapshot(ctx); removeErr != nil && err == nil {
+			err = removeErr
+		}
+	}()
+
+	if snapshot.Encrypted {
+		if err := snapshot.OpenLUKS(ctx); err != nil {
+			return err
+		}
+		defer func() {
+			if closeErr := snapshot.CloseLUKS(ctx); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}()
+	}
+
+	if err := snapshot.MountReadOnly(ctx, mountPath); err != nil {
+		return err
+	}
+	defer func() {
+		if unmountErr := snapshot.EnsureVolumeIsUnmounted(ctx); unmountErr != nil && err == nil {
+			err = unmountErr
+		}
+	}()
+
+	if SnapshotAutoExtend.Interval <= 0 {
+		return fn(ctx, mountPath)
+	}
+	fnCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	extendErr := make(chan error, 1)
+	go func() { extendErr <- snapshot.autoExtend(fnCtx, SnapshotAutoExtend, volume.LVSize, cancel) }()
+
+	err = fn(fnCtx, mountPath)
+	cancel()
+	// fn failed because of the cancelled context then.
+	if snapshotErr := <-extendErr; snapshotErr != nil {
+		return snapshotErr
+	}
+	return err
+}
+
+// Extend grows the volume and its filesystem, if any, to size. lvextend --resizefs
+// needs fsadm, which stripped images lack, so mounted XFS volumes are grown
+// with xfs_growfs instead. XFS can only grow while mounted, fsadm mounts
+// unmounted volumes temporarily.
+func (volume *Volume) Extend(ctx context.Context, size ByteSize) error {
+	// Block volumes have no filesystem to resize.
+	if volume.Block {
+		defer lockVG(volume.VGName)()
+		if _, stderr, err := runCommand(ctx, volume.Runner, "lvextend", "--size", size.AsString(), volume.DeviceName()); err != nil {
+			return commandError("failed to extend volume", err, stderr)
+		}
+		return nil
+	}
+	if target, fsType := volume.mountedFilesystem(); fsType == "xfs" {
+		return volume.extendXFS(ctx, size, target)
+	}
+
+	defer lockVG(volume.VGName)()
+	_, stderr, err := runCommand(ctx, volume.Runner, "lvextend", "--size", size.AsString(), "--resizefs", volume.DeviceName())
+	if err != nil {
+		return commandError("failed to extend volume", err, stderr)
+	}
+	return nil
+}
+
+// extendXFS grows the XFS volume mounted at target to size, then its LUKS
+// device if it's encrypted and its filesystem.
+func (volume *Volume) extendXFS(ctx context.Context, size ByteSize, target string) error {
+	unlock := lockVG(volume.VGName)
+	_, stderr, err := runCommand(ctx, volume.Runner, "lvextend", "--size", size.AsString(), volume.DeviceName())
+	unlock()
 	if err != nil {
-		return fmt.Errorf("failed to extend volume: %v, output: %s", err, string(output))
+		return commandError("failed to extend volume", err, stderr)
+	}
+	if volume.Encrypted {
+		if err := volume.resizeLUKS(ctx); err != nil {
+			return err
+		}
+	}
+	if _, stderr, err := runCommand(ctx, volume.Runner, "xfs_growfs", target); err != nil {
+		return commandError("failed to grow filesystem", err, stderr)
 	}
 	return nil
 }
 
-// RemoveVolume removes a volume from the thin pool.
-func (volume *Volume) Remove(volumeName string) error {
-	cmd := execCommand("/usr/sbin/lvremove", "-f", volume.DeviceName())
-	output, err := cmd.Output()
+// RemoveVolume removes a volume from the thin pool, unmounting it first. A
+// volume which is still held open, ie by a process or another device, can't
+// be removed and returns ErrDeviceBusy.
+func (volume *Volume) Remove(ctx context.Context, volumeName string) error {
+	if err := validateVolumeName(volume.LVName); err != nil {
+		return err
+	}
+	if err := volume.EnsureVolumeIsUnmounted(ctx); err != nil {
+		return fmt.Errorf("failed to unmount volume before removing it: %w", err)
+	}
+	defer lockVG(volume.VGName)()
+	_, stderr, err := runCommand(ctx, volume.Runner, "lvremove", "-f", volume.DeviceName())
 	if err != nil {
-		return fmt.Errorf("failed to remove volume: %v, output: %s", err, string(output))
+		return commandError("failed to remove volume", err, stderr)
+	}
+	return nil
+}
+
+// RemoveSnapshot removes the snapshot like Remove. A snapshot which is already
+// gone is removed, so removing it again succeeds.
+func (volume *Volume) RemoveSnapshot(ctx context.Context) error {
+	if err := volume.Remove(ctx, volume.LVName); err != nil && !errors.Is(err, ErrVolumeNotFound) {
+		return err
 	}
 	return nil
 }
-func (volume *Volume) EnsureVolumeIsMounted(mountPath string) error {
+
+// EnsureVolumeIsMounted mounts the volume at mountPath with the mount options
+// unless it's already mounted. Clones get nouuid too, see CloneUUIDMode.
+func (volume *Volume) EnsureVolumeIsMounted(ctx context.Context, mountPath string, options ...string) error {
 	if volume.Mounted {
 		return nil
 	}
-	return volume.mountVolume(mountPath)
+	return volume.mountVolume(ctx, mountPath, volume.readWriteMountOptions(options)...)
+}
+
+// MountReadOnly mounts the volume read-only at mountPath. XFS snapshots are
+// mounted with nouuid, since they share the filesystem UUID of their origin
+// and XFS refuses to mount duplicate UUIDs.
+func (volume *Volume) MountReadOnly(ctx context.Context, mountPath string) error {
+	options := []string{"ro"}
+	if volume.Origin != "" && DefaultFsType == "xfs" {
+		options = append(options, "nouuid")
+	}
+	return volume.mountVolume(ctx, mountPath, options...)
 }
 
-func (volume *Volume) UpdateMountStatus() error {
-	output, err := execCommand("/usr/bin/findmnt", "-n", "-o", "TARGET", "--source", volume.DeviceName()).Output()
+func (volume *Volume) UpdateMountStatus(ctx context.Context) error {
+	// Only stdout is used as it holds the mount targets.
+	output, _, err := runCommand(ctx, volume.Runner, "findmnt", "-n", "-o", "TARGET", "--source", volume.FilesystemDevice())
 	if exitError, ok := err.(*exec.ExitError); ok {
 		if exitError.ExitCode() == 1 {
 			// Exit code 1 means the volume is not mounted
 			volume.Mounted = false
 			volume.Target = ""
+			volume.AdditionalTargets = nil
 		} else {
 			// Handle other non-zero exit codes if necessary
 			fmt.Printf("Error executing findmnt for volume %s: %s\n", volume.LVName, err)
 			return err
 		}
+	} else if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		// findmnt isn't installed, fall back to the kernel's mount table
+		return volume.updateMountStatusFromProc()
 	} else if err != nil {
 		// Handle other errors
 		fmt.Printf("Error executing findmnt for volume %s: %s\n", volume.LVName, err)
 		return err
 	} else {
-		// No error, command executed successfully
-		volume.Mounted = true
-		trimmedTarget := strings.TrimSpace(string(output))
-		volume.Target = trimmedTarget
+		// No error, command executed successfully. findmnt prints one
+		// target per line, and may start with a blank line.
+		var targets []string
+		for _, line := range strings.Split(string(output), "\n") {
+			if target := strings.TrimSpace(line); target != "" {
+				targets = append(targets, target)
+			}
+		}
+		volume.setTargets(targets)
 	}
 	return nil
 }
 
-func (volume *Volume) mountVolume(mountPoint string) error {
+// setTargets records the mount points of the volume, the first one is its Target.
+func (volume *Volume) setTargets(targets []string) {
+	volume.Mounted = len(targets) > 0
+	volume.Target = ""
+	volume.AdditionalTargets = nil
+	if volume.Mounted {
+		volume.Target = targets[0]
+	}
+	if len(targets) > 1 {
+		volume.AdditionalTargets = targets[1:]
+	}
+}
+
+func (volume *Volume) mountVolume(ctx context.Context, mountPoint string, options ...string) error {
 	// Create the mount point directory if it doesn't exist
-	if err := MkdirAll(mountPoint, 0755); err != nil {
+	if err := MkdirAll(mountPoint, MountDirMode); err != nil {
 		return fmt.Errorf("error creating mount point directory: %w", err)
 	}
 
 	// Execute the mount command
-	cmd := execCommand("/usr/bin/mount", volume.DeviceName(), mountPoint)
-	if output, err := cmd.Output(); err != nil {
-		return fmt.Errorf("mount error: %s, output: %s", err, output)
+	args := []string{volume.FilesystemDevice(), mountPoint}
+	if len(options) > 0 {
+		args = append([]string{"-o", strings.Join(options, ",")}, args...)
+	}
+	if _, stderr, err := runCommand(ctx, volume.Runner, "mount", args...); err != nil {
+		return commandError("mount error", err, stderr)
 	}
 
 	volume.Mounted = true
@@ -143,21 +613,45 @@ func (volume *Volume) mountVolume(mountPoint string) error {
 	return nil
 }
 
-func (volume *Volume) EnsureVolumeIsUnmounted() error {
+func (volume *Volume) EnsureVolumeIsUnmounted(ctx context.Context) error {
+	if !volume.Mounted {
+		return nil
+	}
+	return volume.unmountVolume(ctx)
+}
+
+// UnmountTarget unmounts the volume from one of its mount points, leaving
+// the others mounted.
+func (volume *Volume) UnmountTarget(ctx context.Context, target string) error {
+	if _, stderr, err := runCommand(ctx, volume.Runner, "umount", target); err != nil {
+		return commandError("umount error", err, stderr)
+	}
+	var targets []string
+	for _, mounted := range volume.Targets() {
+		if mounted != target {
+			targets = append(targets, mounted)
+		}
+	}
+	volume.setTargets(targets)
+	return nil
+}
+
+// Targets returns every mount point of the volume, Target first.
+func (volume *Volume) Targets() []string {
 	if !volume.Mounted {
 		return nil
 	}
-	return volume.unmountVolume()
+	return append([]string{volume.Target}, volume.AdditionalTargets...)
 }
 
-func (volume *Volume) unmountVolume() error {
+func (volume *Volume) unmountVolume(ctx context.Context) error {
 	// Execute the umount command
-	cmd := execCommand("/usr/bin/umount", volume.DeviceName())
-	if output, err := cmd.Output(); err != nil {
-		return fmt.Errorf("umount error: %s, output: %s", err, output)
+	if _, stderr, err := runCommand(ctx, volume.Runner, "umount", volume.FilesystemDevice()); err != nil {
+		return commandError("umount error", err, stderr)
 	}
 
 	volume.Mounted = false
 	volume.Target = ""
+	volume.AdditionalTargets = nil
 	return nil
 }
@@ -0,0 +1,388 @@
+package lvm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"nodeto/restic-csi-plugin/internal/ionice"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockVolumeCommands swaps in the fake commands for a test, starting with no
+// existing volume so snapshots can be created.
+func mockVolumeCommands(t *testing.T) {
+	DefaultRunner = fakeRunner{fakeExecCommand}
+	MkdirAll = fakeMkdirAll
+	volumeExists = false
+	volumeMounted = false
+	commandLog = nil
+	t.Cleanup(func() {
+		DefaultRunner = execRunner{}
+		MkdirAll = os.MkdirAll
+		commandLog = nil
+		// Restore the initial state expected by TestNewThinPool.
+		volumeExists = true
+		volumeFormatted = false
+		volumeSize = 1024 * 1024 * 1024
+		volumeMounted = false
+	})
+}
+
+var testVolume = Volume{VGName: "vg0", LVName: "test-volume", LVSize: 1024 * 1024 * 1024}
+
+func TestWithSnapshot(t *testing.T) {
+	mockVolumeCommands(t)
+	volume := testVolume
+
+	var backedUp string
+	err := volume.WithSnapshot(context.Background(), "test-snapshot", ByteSize(1024*1024), "/mnt/snapshot", func(ctx context.Context, path string) error {
+		backedUp = path
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "/mnt/snapshot", backedUp)
+	assert.Equal(t, [][]string{
+		{"/usr/sbin/lvcreate", "--snapshot", "--name", "test-snapshot", "-L", "1048576B", "/dev/vg0/test-volume"},
+		{"/usr/bin/mount", "-o", "ro,nouuid", "/dev/vg0/test-snapshot", "/mnt/snapshot"},
+		{"/usr/bin/umount", "/dev/vg0/test-snapshot"},
+		{"/usr/sbin/lvremove", "-f", "/dev/vg0/test-snapshot"},
+	}, commandLog)
+}
+
+func TestWithSnapshotCleansUpOnBackupError(t *testing.T) {
+	mockVolumeCommands(t)
+	volume := testVolume
+
+	backupErr := errors.New("backup failed")
+	err := volume.WithSnapshot(context.Background(), "test-snapshot", ByteSize(1024*1024), "/mnt/snapshot", func(ctx context.Context, path string) error {
+		return backupErr
+	})
+	assert.Equal(t, backupErr, err)
+	assert.Equal(t, []string{"/usr/bin/umount", "/dev/vg0/test-snapshot"}, commandLog[2])
+	assert.Equal(t, []string{"/usr/sbin/lvremove", "-f", "/dev/vg0/test-snapshot"}, commandLog[3])
+}
+
+func TestWithSnapshotCleansUpOnMountError(t *testing.T) {
+	mockVolumeCommands(t)
+	volume := testVolume
+
+	called := false
+	// The mount of /mnt/elsewhere isn't mocked so it fails.
+	err := volume.WithSnapshot(context.Background(), "test-snapshot", ByteSize(1024*1024), "/mnt/elsewhere", func(ctx context.Context, path string) error {
+		called = true
+		return nil
+	})
+	assert.NotNil(t, err)
+	assert.False(t, called)
+	assert.Len(t, commandLog, 3)
+	assert.Equal(t, []string{"/usr/sbin/lvremove", "-f", "/dev/vg0/test-snapshot"}, commandLog[2])
+}
+
+func TestRemoveSnapshotTwice(t *testing.T) {
+	mockVolumeCommands(t)
+	volumeExists = true
+	snapshot := Volume{VGName: "vg0", LVName: "test-snapshot", Origin: "test-volume"}
+
+	assert.Nil(t, snapshot.RemoveSnapshot(context.Background()))
+	// The second lvremove fails as the snapshot is gone
+	assert.Nil(t, snapshot.RemoveSnapshot(context.Background()))
+	assert.Equal(t, [][]string{
+		{"/usr/sbin/lvremove", "-f", "/dev/vg0/test-snapshot"},
+		{"/usr/sbin/lvremove", "-f", "/dev/vg0/test-snapshot"},
+	}, commandLog)
+
+	// Other failures are still returned
+	volumeExists = true
+	held := Volume{VGName: "vg0", LVName: "held-volume"}
+	assert.NotNil(t, held.RemoveSnapshot(context.Background()))
+}
+
+func TestCreateSnapshotDefaultsToOriginSize(t *testing.T) {
+	mockVolumeCommands(t)
+	volume := testVolume
+
+	snapshot, err := volume.CreateSnapshot(context.Background(), "test-snapshot", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, volume.LVSize, snapshot.LVSize)
+	assert.Equal(t, [][]string{
+		{"/usr/sbin/lvcreate", "--snapshot", "--name", "test-snapshot", "-L", "1073741824B", "/dev/vg0/test-volume"},
+	}, commandLog)
+}
+
+func TestCreateSnapshotDefaultsToOriginPercentage(t *testing.T) {
+	mockVolumeCommands(t)
+	SnapshotSizePercent = 25
+	defer func() { SnapshotSizePercent = 100 }()
+	volume := testVolume
+
+	// The command isn't mocked, only the requested size matters here.
+	volume.CreateSnapshot(context.Background(), "test-snapshot", 0)
+	assert.Equal(t, []string{"/usr/sbin/lvcreate", "--snapshot", "--name", "test-snapshot", "-L", "268435456B", "/dev/vg0/test-volume"}, commandLog[0])
+}
+
+func TestVolumeParsesPercentages(t *testing.T) {
+	var volume Volume
+	err := json.Unmarshal([]byte(`{"lv_name":"test-volume", "vg_name":"vg0", "lv_attr":"Vwi-aotz--", "lv_size":"1073741824B", "pool_lv":"existing_thin_pool", "data_percent":"42.50", "metadata_percent":""}`), &volume)
+	assert.Nil(t, err)
+	assert.Equal(t, Percent(42.5), volume.DataPercent)
+	assert.Equal(t, Percent(0), volume.MetadataPercent)
+	assert.Equal(t, ByteSize(456340275), volume.UsedBytes())
+
+	assert.NotNil(t, json.Unmarshal([]byte(`{"data_percent":"lots"}`), &volume))
+}
+
+func TestCommandIsKilledAtDeadline(t *testing.T) {
+	mockVolumeCommands(t)
+	commandHangs = true
+	defer func() { commandHangs = false }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	volume := testVolume
+	start := time.Now()
+	err := volume.UpdateMountStatus(ctx)
+	assert.NotNil(t, err)
+	assert.Equal(t, context.DeadlineExceeded, ctx.Err())
+	assert.Less(t, time.Since(start), 10*time.Second)
+}
+
+func TestCommandErrorsIncludeStderr(t *testing.T) {
+	mockVolumeCommands(t)
+	volumeExists = true
+	ctx := context.Background()
+
+	// Commands for other-volume aren't mocked and fail with a message on stderr.
+	volume := testVolume
+	volume.LVName = "other-volume"
+
+	err := volume.Extend(ctx, 2*1024*1024*1024)
+	assert.Contains(t, err.Error(), "Command not mocked or returns an error.")
+
+	err = volume.EnsureVolumeIsMounted(ctx, "/mnt/other")
+	assert.Contains(t, err.Error(), "Command not mocked or returns an error.")
+}
+
+func TestSuccessfulCommandsIgnoreStderr(t *testing.T) {
+	mockVolumeCommands(t)
+	volume := testVolume
+
+	// lvcreate writes a warning to stderr but succeeds.
+	_, err := volume.CreateSnapshot(context.Background(), "test-snapshot", ByteSize(1024*1024))
+	assert.Nil(t, err)
+}
+
+func TestCreateThinVolumeMkfsOptions(t *testing.T) {
+	mockVolumeCommands(t)
+	ctx := context.Background()
+
+	volume, err := CreateThinVolume(ctx, nil, "test-volume", "/dev/vg0/existing_thin_pool", 1024*1024*1024, []string{"-d", "su=64k,sw=4", "-l", "size=128m"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "vg0", volume.VGName)
+	assert.Equal(t, []string{"/usr/sbin/mkfs.xfs", "-d", "su=64k,sw=4", "-l", "size=128m", "/dev/vg0/test-volume"}, commandLog[1])
+}
+
+func TestCreateThinVolumeWithoutMkfsOptions(t *testing.T) {
+	mockVolumeCommands(t)
+
+	_, err := CreateThinVolume(context.Background(), nil, "test-volume", "/dev/vg0/existing_thin_pool", 1024*1024*1024, nil, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/usr/sbin/mkfs.xfs", "/dev/vg0/test-volume"}, commandLog[1])
+}
+
+func TestCreateThinVolumeRejectsDeviceInMkfsOptions(t *testing.T) {
+	mockVolumeCommands(t)
+
+	_, err := CreateThinVolume(context.Background(), nil, "test-volume", "/dev/vg0/existing_thin_pool", 1024*1024*1024, []string{"-f", "/dev/vg0/test-volume"}, false)
+	assert.NotNil(t, err)
+	assert.Len(t, commandLog, 0)
+}
+
+func TestCreateThinVolumeRemovesVolumeAfterMkfsTimeout(t *testing.T) {
+	mockVolumeCommands(t)
+	hangingCommand = "/usr/sbin/mkfs.xfs"
+	MkfsTimeout = 200 * time.Millisecond
+	defer func() {
+		hangingCommand = ""
+		MkfsTimeout = DefaultMkfsTimeout
+	}()
+
+	start := time.Now()
+	_, err := CreateThinVolume(context.Background(), nil, "test-volume", "/dev/vg0/existing_thin_pool", 1024*1024*1024, nil, false)
+	assert.True(t, errors.Is(err, ErrMkfsTimeout), err)
+	assert.Less(t, time.Since(start), 10*time.Second)
+
+	// The half-formatted volume is removed so a retry starts clean
+	assert.Equal(t, []string{"/usr/sbin/lvremove", "-f", "/dev/vg0/test-volume"}, commandLog[len(commandLog)-1])
+	assert.False(t, volumeExists)
+}
+
+func TestMountReadOnly(t *testing.T) {
+	mockVolumeCommands(t)
+	ctx := context.Background()
+	volume := testVolume
+
+	snapshot, err := volume.CreateSnapshot(ctx, "test-snapshot", ByteSize(1024*1024))
+	assert.Nil(t, err)
+	assert.Equal(t, "test-volume", snapshot.Origin)
+
+	// XFS snapshots need nouuid
+	assert.Nil(t, snapshot.MountReadOnly(ctx, "/mnt/snapshot"))
+	assert.Equal(t, []string{"/usr/bin/mount", "-o", "ro,nouuid", "/dev/vg0/test-snapshot", "/mnt/snapshot"}, commandLog[1])
+	assert.True(t, snapshot.Mounted)
+
+	// Other volumes are only mounted read-only
+	volume.MountReadOnly(ctx, "/mnt/test")
+	assert.Equal(t, []string{"/usr/bin/mount", "-o", "ro", "/dev/vg0/test-volume", "/mnt/test"}, commandLog[2])
+}
+
+func TestParseByteSize(t *testing.T) {
+	for input, expected := range map[string]ByteSize{
+		"1024":       1024,
+		"1024B":      1024,
+		"0":          0,
+		"1Ki":        1024,
+		"500Mi":      500 * 1024 * 1024,
+		"10Gi":       10 * 1024 * 1024 * 1024,
+		"2Ti":        2 * 1024 * 1024 * 1024 * 1024,
+		"1K":         1000,
+		"500M":       500 * 1000 * 1000,
+		"10G":        10 * 1000 * 1000 * 1000,
+		"2T":         2 * 1000 * 1000 * 1000 * 1000,
+		" 10Gi ":     10 * 1024 * 1024 * 1024,
+		"1073741824": 1024 * 1024 * 1024,
+	} {
+		size, err := ParseByteSize(input)
+		assert.Nil(t, err, input)
+		assert.Equal(t, expected, size, input)
+	}
+}
+
+func TestParseByteSizeRejectsInvalidSizes(t *testing.T) {
+	for _, input := range []string{"", "Gi", "10gi", "10GB", "1.5Gi", "-1Gi", "10 Gi", "ten", "9223372036854775807Ki"} {
+		_, err := ParseByteSize(input)
+		assert.NotNil(t, err, input)
+	}
+}
+
+func TestByteSizeUnmarshalText(t *testing.T) {
+	var config struct {
+		Size ByteSize `toml:"size"`
+	}
+	_, err := toml.Decode(`size = "10Gi"`, &config)
+	assert.Nil(t, err)
+	assert.Equal(t, ByteSize(10*1024*1024*1024), config.Size)
+
+	_, err = toml.Decode(`size = "10 gigabytes"`, &config)
+	assert.NotNil(t, err)
+}
+
+func TestByteSizeHuman(t *testing.T) {
+	for size, expected := range map[ByteSize]string{
+		0:                         "0B",
+		512:                       "512B",
+		1024:                      "1Ki",
+		2 * 1024 * 1024 * 1024:    "2Gi",
+		1024 * 1024 * 1024 * 1024: "1Ti",
+		1536 * 1024 * 1024:        "1.5Gi",
+		1000 * 1000 * 1000:        "953.67Mi",
+		1073741823:                "1024Mi",
+		456340275:                 "435.2Mi",
+	} {
+		assert.Equal(t, expected, size.Human(), int64(size))
+		assert.Equal(t, expected, size.String(), int64(size))
+	}
+	// AsString is kept exact for LVM
+	size := ByteSize(2 * 1024 * 1024 * 1024)
+	assert.Equal(t, "2147483648B", size.AsString())
+}
+
+func TestByteSizeMarshalJSON(t *testing.T) {
+	for size, expected := range map[ByteSize]string{
+		0:                      `"0B"`,
+		1000:                   `"1000B"`,
+		2 * 1024 * 1024 * 1024: `"2Gi"`,
+		1536 * 1024 * 1024:     `"1536Mi"`,
+	} {
+		data, err := json.Marshal(size)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(data))
+
+		// The value is read back exactly
+		var parsed ByteSize
+		assert.Nil(t, json.Unmarshal(data, &parsed))
+		assert.Equal(t, size, parsed)
+	}
+}
+
+func TestCreateBlockVolume(t *testing.T) {
+	mockVolumeCommands(t)
+	thinPool := ThinPool{LongName: "/dev/vg0/existing_thin_pool", Name: "existing_thin_pool", VGName: "vg0"}
+
+	assert.Nil(t, thinPool.EnsureBlockVolumeIsPresent(context.Background(), "test-volume", 1024*1024*1024))
+	assert.Contains(t, commandLog, []string{"/usr/sbin/lvcreate", "-V", "1073741824B", "-T", "/dev/vg0/existing_thin_pool", "-n", "test-volume"})
+	for _, command := range commandLog {
+		assert.NotEqual(t, "/usr/sbin/mkfs.xfs", command[0])
+	}
+
+	// Only the LV is grown
+	commandLog = nil
+	assert.Nil(t, thinPool.EnsureBlockVolumeIsPresent(context.Background(), "test-volume", 2*1024*1024*1024))
+	assert.Contains(t, commandLog, []string{"/usr/sbin/lvextend", "--size", "2147483648B", "/dev/vg0/test-volume"})
+	for _, command := range commandLog {
+		assert.NotContains(t, command, "--resizefs")
+	}
+}
+
+func TestCreateVolumeWithoutZeroing(t *testing.T) {
+	mockVolumeCommands(t)
+	DisableZeroing = true
+	t.Cleanup(func() { DisableZeroing = false })
+
+	_, err := CreateBlockVolume(context.Background(), nil, "unzeroed-volume", "/dev/vg0/existing_thin_pool", 1024*1024*1024)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"/usr/sbin/lvcreate", "-V", "1073741824B", "-T", "/dev/vg0/existing_thin_pool", "-n", "unzeroed-volume", "--zero", "n"}}, commandLog)
+}
+
+func TestCreateVolumeFormatsAtMkfsPriority(t *testing.T) {
+	mockVolumeCommands(t)
+	MkfsPriority = ionice.Priority{Class: ionice.ClassBestEffort, Level: 7}
+	t.Cleanup(func() { MkfsPriority = ionice.Priority{} })
+
+	_, err := CreateThinVolume(context.Background(), nil, "test-volume", "/dev/vg0/existing_thin_pool", 1024*1024*1024, nil, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ionice", "-c", "2", "-n", "7", "/usr/sbin/mkfs.xfs", "/dev/vg0/test-volume"}, commandLog[1])
+}
+
+func TestCreateVolumeCreatedByRacingRequest(t *testing.T) {
+	mockVolumeCommands(t)
+	// Another request created and formatted the LV first
+	volumeExists = true
+	volumeFormatted = true
+
+	volume, err := CreateThinVolume(context.Background(), nil, "test-volume", "/dev/vg0/existing_thin_pool", 1024*1024*1024, nil, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "test-volume", volume.LVName)
+	assert.Equal(t, [][]string{
+		{"/usr/sbin/lvcreate", "-V", "1073741824B", "-T", "/dev/vg0/existing_thin_pool", "-n", "test-volume"},
+		{"/usr/sbin/lvs", "--noheadings", "-o", "lv_name", "vg0/test-volume"},
+	}, commandLog)
+
+	// An LV which isn't there after all is still an error
+	commandLog = nil
+	_, err = CreateBlockVolume(context.Background(), nil, "unzeroed-volume", "/dev/vg0/existing_thin_pool", 1024*1024*1024)
+	assert.NotNil(t, err)
+}
+
+func TestIsSnapshot(t *testing.T) {
+	assert.True(t, (&Volume{LVAttr: "swi-aos---", Origin: "test-volume"}).IsSnapshot())
+	assert.True(t, (&Volume{LVAttr: "Swi-I-s---", Origin: "test-volume"}).IsSnapshot())
+	// A clone has an origin but is a thin volume
+	assert.False(t, (&Volume{LVAttr: "Vwi-aotz--", Origin: "test-volume"}).IsSnapshot())
+	assert.False(t, (&Volume{LVAttr: "Vwi-a-tz--"}).IsSnapshot())
+}
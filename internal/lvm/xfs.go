@@ -0,0 +1,51 @@
+package lvm
+
+import (
+	"context"
+	"fmt"
+)
+
+// Ways XFS clones are told apart from their origin, see CloneUUIDMode.
+const (
+	// CloneUUIDGenerate gives new clones a fresh filesystem UUID.
+	CloneUUIDGenerate = "generate"
+	// CloneUUIDNouuid keeps the origin's UUID and mounts clones with nouuid.
+	CloneUUIDNouuid = "nouuid"
+)
+
+// CloneUUIDMode is how clones, which start out with the filesystem UUID of
+// their origin, are mounted read-write next to it, since XFS refuses to mount
+// duplicate UUIDs. Read-only backup snapshots are always mounted with nouuid,
+// they're short-lived and must not be written to.
+var CloneUUIDMode = CloneUUIDGenerate
+
+// RegenerateUUID gives the unmounted XFS filesystem of the volume a fresh
+// UUID. Other filesystems are left alone, they don't refuse duplicates.
+func (volume *Volume) RegenerateUUID(ctx context.Context) (err error) {
+	if DefaultFsType != "xfs" {
+		return nil
+	}
+	if volume.Encrypted {
+		if err := volume.OpenLUKS(ctx); err != nil {
+			return err
+		}
+		defer func() {
+			if closeErr := volume.CloseLUKS(ctx); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}()
+	}
+	if _, stderr, err := runCommand(ctx, volume.Runner, "xfs_admin", "-U", "generate", volume.FilesystemDevice()); err != nil {
+		return commandError(fmt.Sprintf("failed to regenerate the filesystem UUID of %s", volume.LVName), err, stderr)
+	}
+	return nil
+}
+
+// readWriteMountOptions adds nouuid to the options of clones which kept the
+// UUID of their origin.
+func (volume *Volume) readWriteMountOptions(options []string) []string {
+	if volume.Origin != "" && DefaultFsType == "xfs" && CloneUUIDMode == CloneUUIDNouuid {
+		return append(options, "nouuid")
+	}
+	return options
+}
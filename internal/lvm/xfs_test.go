@@ -0,0 +1,131 @@
+package lvm
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mockCloneUUIDMode sets CloneUUIDMode for a test.
+func mockCloneUUIDMode(t *testing.T, mode string) {
+	CloneUUIDMode = mode
+	t.Cleanup(func() { CloneUUIDMode = CloneUUIDGenerate })
+}
+
+func testPoolWithVolume(t *testing.T) ThinPool {
+	mockVolumeCommands(t)
+	volumeExists = true
+	return ThinPool{LongName: "/dev/vg0/existing_thin_pool", Name: "existing_thin_pool", VGName: "vg0"}
+}
+
+func TestCloneVolumeRegeneratesXFSUUID(t *testing.T) {
+	thinPool := testPoolWithVolume(t)
+
+	assert.Nil(t, thinPool.CloneVolume(context.Background(), "test-volume", "clone-volume", 2*1024*1024*1024, false, false))
+	// The UUID is regenerated before the clone is grown, fsadm mounts it
+	// to grow XFS and would trip over the duplicate.
+	regenerate, extend := -1, -1
+	for i, command := range commandLog {
+		switch command[0] {
+		case "/usr/sbin/xfs_admin":
+			assert.Equal(t, []string{"/usr/sbin/xfs_admin", "-U", "generate", "/dev/vg0/clone-volume"}, command)
+			regenerate = i
+		case "/usr/sbin/lvextend":
+			extend = i
+		}
+	}
+	assert.NotEqual(t, -1, regenerate)
+	assert.Greater(t, extend, regenerate)
+}
+
+func TestCloneVolumeIsRemovedWhenUUIDRegenerationFails(t *testing.T) {
+	thinPool := testPoolWithVolume(t)
+
+	assert.NotNil(t, thinPool.CloneVolume(context.Background(), "test-volume", "bad-clone", 0, false, false))
+	assert.Equal(t, []string{"/usr/sbin/lvremove", "-f", "/dev/vg0/bad-clone"}, commandLog[len(commandLog)-1])
+}
+
+// extendFailingRunner fails lvextend and runs everything else with the
+// mocked commands.
+type extendFailingRunner struct {
+	fakeRunner
+}
+
+func (runner extendFailingRunner) Run(ctx context.Context, name string, args ...string) (stdout []byte, stderr []byte, err error) {
+	if name == "/usr/sbin/lvextend" {
+		return nil, []byte("  Insufficient free space\n"), errors.New("exit status 5")
+	}
+	return runner.fakeRunner.Run(ctx, name, args...)
+}
+
+func TestCloneVolumeIsRemovedWhenExtendFails(t *testing.T) {
+	thinPool := testPoolWithVolume(t)
+	thinPool.Runner = extendFailingRunner{fakeRunner{fakeExecCommand}}
+
+	assert.NotNil(t, thinPool.CloneVolume(context.Background(), "test-volume", "clone-volume", 2*1024*1024*1024, false, false))
+	assert.Equal(t, []string{"/usr/sbin/lvremove", "-f", "/dev/vg0/clone-volume"}, commandLog[len(commandLog)-1])
+}
+
+func TestCloneVolumeWithNouuidKeepsUUID(t *testing.T) {
+	mockCloneUUIDMode(t, CloneUUIDNouuid)
+	thinPool := testPoolWithVolume(t)
+
+	assert.Nil(t, thinPool.CloneVolume(context.Background(), "test-volume", "clone-volume", 0, false, false))
+	for _, command := range commandLog {
+		assert.NotEqual(t, "/usr/sbin/xfs_admin", command[0])
+	}
+
+	// The clone is mounted read-write with nouuid instead
+	clone := Volume{VGName: "vg0", LVName: "clone-volume", Origin: "test-volume"}
+	assert.Nil(t, clone.EnsureVolumeIsMounted(context.Background(), "/mnt/clone"))
+	assert.Equal(t, []string{"/usr/bin/mount", "-o", "nouuid", "/dev/vg0/clone-volume", "/mnt/clone"}, commandLog[len(commandLog)-1])
+}
+
+func TestBlockCloneKeepsUUID(t *testing.T) {
+	thinPool := testPoolWithVolume(t)
+
+	assert.Nil(t, thinPool.CloneVolume(context.Background(), "test-volume", "clone-volume", 2*1024*1024*1024, false, true))
+	for _, command := range commandLog {
+		assert.NotEqual(t, "/usr/sbin/xfs_admin", command[0])
+	}
+	// Without a filesystem to resize, only the LV is grown
+	assert.Contains(t, commandLog, []string{"/usr/sbin/lvextend", "--size", "2147483648B", "/dev/vg0/clone-volume"})
+}
+
+func TestBackupSnapshotAndCloneMounts(t *testing.T) {
+	thinPool := testPoolWithVolume(t)
+	ctx := context.Background()
+
+	// An independent clone with a fresh UUID is mounted read-write as is
+	assert.Nil(t, thinPool.CloneVolume(ctx, "test-volume", "clone-volume", 0, false, false))
+	clone := Volume{VGName: "vg0", LVName: "clone-volume", Origin: "test-volume"}
+	assert.Nil(t, clone.EnsureVolumeIsMounted(ctx, "/mnt/clone"))
+	assert.Equal(t, []string{"/usr/bin/mount", "/dev/vg0/clone-volume", "/mnt/clone"}, commandLog[len(commandLog)-1])
+
+	// A backup snapshot keeps its origin's UUID and is mounted read-only
+	// with nouuid
+	commandLog = nil
+	volumeExists = false
+	volume := testVolume
+	assert.Nil(t, volume.WithSnapshot(ctx, "test-snapshot", ByteSize(1024*1024), "/mnt/snapshot", func(ctx context.Context, path string) error { return nil }))
+	assert.Contains(t, commandLog, []string{"/usr/bin/mount", "-o", "ro,nouuid", "/dev/vg0/test-snapshot", "/mnt/snapshot"})
+	for _, command := range commandLog {
+		assert.NotEqual(t, "/usr/sbin/xfs_admin", command[0])
+	}
+}
+
+func TestRegenerateUUIDOfEncryptedVolume(t *testing.T) {
+	mockVolumeCommands(t)
+	mockEncryptionKey(t)
+
+	volume := testVolume
+	volume.Encrypted = true
+	assert.Nil(t, volume.RegenerateUUID(context.Background()))
+	assert.Equal(t, [][]string{
+		{"/usr/sbin/cryptsetup", "open", "--type", "luks", "--key-file", "-", "/dev/vg0/test-volume", "vg0-test--volume-luks"},
+		{"/usr/sbin/xfs_admin", "-U", "generate", "/dev/mapper/vg0-test--volume-luks"},
+		{"/usr/sbin/cryptsetup", "close", "vg0-test--volume-luks"},
+	}, commandLog)
+}
@@ -0,0 +1,159 @@
+package metadata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Volume is the metadata recorded for a volume that can't be derived from LVM.
+type Volume struct {
+	FsType string `json:"fs_type"`
+	Backup bool   `json:"backup"`
+	// LastSnapshotID is the restic snapshot of the latest backup.
+	LastSnapshotID string `json:"last_snapshot_id,omitempty"`
+	// BackupFailures counts the backups which failed since the last one
+	// which succeeded, LastBackupError is why the latest of them failed.
+	BackupFailures  int    `json:"backup_failures,omitempty"`
+	LastBackupError string `json:"last_backup_error,omitempty"`
+	// LVName is the logical volume of the volume, see lvm.VolumeNameFor.
+	// Empty for volumes whose LV is named after their ID.
+	LVName string `json:"lv_name,omitempty"`
+	// Encrypted volumes hold a LUKS device, see lvm.Volume.Encrypted.
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Block volumes are raw devices without a filesystem.
+	Block bool `json:"block,omitempty"`
+	// BackupInterval overrides how often the volume is backed up, ie "1h".
+	// Empty uses the configured interval.
+	BackupInterval string `json:"backup_interval,omitempty"`
+	// BackupOnUnstage overrides whether the volume is backed up before it's
+	// unstaged. Nil uses the configured default.
+	BackupOnUnstage *bool `json:"backup_on_unstage,omitempty"`
+	// StageOptions are the mount options the volume is staged with, nil
+	// while it isn't staged.
+	StageOptions []string `json:"stage_options,omitempty"`
+}
+
+// Store keeps volume metadata keyed by volume ID in a JSON file, so it
+// survives restarts of the driver. Every change is written to disk.
+type Store struct {
+	sync.Mutex
+	path    string
+	volumes map[string]Volume
+}
+
+// storeFile is the on disk format of the store.
+type storeFile struct {
+	Volumes map[string]Volume `json:"volumes"`
+}
+
+// Open loads the store from path, a missing file is an empty store. An empty
+// path keeps the metadata in memory only.
+func Open(path string) (*Store, error) {
+	store := &Store{path: path, volumes: map[string]Volume{}}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read metadata from %s: %w", path, err)
+	}
+
+	var file storeFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata from %s: %w", path, err)
+	}
+	if file.Volumes != nil {
+		store.volumes = file.Volumes
+	}
+	return store, nil
+}
+
+// Get returns the metadata of a volume and whether it exists.
+func (s *Store) Get(volumeID string) (Volume, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	volume, ok := s.volumes[volumeID]
+	return volume, ok
+}
+
+// VolumeIDOf returns the ID of the volume stored in the LV, if recorded.
+func (s *Store) VolumeIDOf(lvName string) (string, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	for volumeID, volume := range s.volumes {
+		if volume.LVName == lvName {
+			return volumeID, true
+		}
+	}
+	return "", false
+}
+
+// Put records the metadata of a volume.
+func (s *Store) Put(volumeID string, volume Volume) error {
+	s.Lock()
+	defer s.Unlock()
+
+	previous, existed := s.volumes[volumeID]
+	s.volumes[volumeID] = volume
+	if err := s.save(); err != nil {
+		if existed {
+			s.volumes[volumeID] = previous
+		} else {
+			delete(s.volumes, volumeID)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes the metadata of a volume, deleting a missing volume is not
+// an error.
+func (s *Store) Delete(volumeID string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	previous, existed := s.volumes[volumeID]
+	if !existed {
+		return nil
+	}
+	delete(s.volumes, volumeID)
+	if err := s.save(); err != nil {
+		s.volumes[volumeID] = previous
+		return err
+	}
+	return nil
+}
+
+// save writes the store to a temporary file and renames it over the store,
+// so a crash never leaves a partially written file behind.
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(storeFile{Volumes: s.volumes}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create metadata directory: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package metadata
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "staging", "metadata.json")
+
+	store, err := Open(path)
+	assert.Nil(t, err)
+	assert.Nil(t, store.Put("test-volume", Volume{FsType: "xfs", Backup: true, LastSnapshotID: "4f3a2b1c"}))
+	assert.Nil(t, store.Put("scratch-volume", Volume{FsType: "xfs", Backup: false}))
+
+	// Simulate a restart by opening the file again
+	store, err = Open(path)
+	assert.Nil(t, err)
+	volume, ok := store.Get("test-volume")
+	assert.True(t, ok)
+	assert.Equal(t, Volume{FsType: "xfs", Backup: true, LastSnapshotID: "4f3a2b1c"}, volume)
+	volume, ok = store.Get("scratch-volume")
+	assert.True(t, ok)
+	assert.False(t, volume.Backup)
+
+	assert.Nil(t, store.Delete("test-volume"))
+	assert.Nil(t, store.Delete("test-volume"))
+
+	store, err = Open(path)
+	assert.Nil(t, err)
+	_, ok = store.Get("test-volume")
+	assert.False(t, ok)
+	_, ok = store.Get("scratch-volume")
+	assert.True(t, ok)
+}
+
+func TestOpenMissingStore(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "metadata.json"))
+	assert.Nil(t, err)
+	_, ok := store.Get("test-volume")
+	assert.False(t, ok)
+}
+
+func TestOpenCorruptStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	assert.Nil(t, os.WriteFile(path, []byte("{not json"), 0600))
+
+	_, err := Open(path)
+	assert.NotNil(t, err)
+}
+
+func TestInMemoryStore(t *testing.T) {
+	store, err := Open("")
+	assert.Nil(t, err)
+	assert.Nil(t, store.Put("test-volume", Volume{FsType: "xfs"}))
+	_, ok := store.Get("test-volume")
+	assert.True(t, ok)
+}
+
+func TestVolumeIDOf(t *testing.T) {
+	store, err := Open("")
+	assert.Nil(t, err)
+	assert.Nil(t, store.Put("Team/Database Volume", Volume{FsType: "xfs", LVName: "csi-0a1b2c3d4e5f6a7b-team-database-volume"}))
+	assert.Nil(t, store.Put("test-volume", Volume{FsType: "xfs"}))
+
+	volumeID, ok := store.VolumeIDOf("csi-0a1b2c3d4e5f6a7b-team-database-volume")
+	assert.True(t, ok)
+	assert.Equal(t, "Team/Database Volume", volumeID)
+
+	_, ok = store.VolumeIDOf("test-volume")
+	assert.False(t, ok)
+}
@@ -0,0 +1,120 @@
+// Package metrics exposes the driver's gauges and counters in the Prometheus
+// text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// metric is a single value with the metadata to expose it.
+type metric struct {
+	name  string
+	help  string
+	kind  string
+	mu    sync.Mutex
+	value float64
+}
+
+func (m *metric) get() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.value
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct{ metric }
+
+// Set sets the value of the gauge.
+func (g *Gauge) Set(value float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.value = value
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() float64 { return g.get() }
+
+// Counter is a value that only goes up.
+type Counter struct{ metric }
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.value++
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() float64 { return c.get() }
+
+var registry = struct {
+	sync.Mutex
+	metrics map[string]*metric
+}{metrics: map[string]*metric{}}
+
+func register(m *metric) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.metrics[m.name]; ok {
+		panic(fmt.Sprintf("metric %s is already registered", m.name))
+	}
+	registry.metrics[m.name] = m
+}
+
+// NewGauge registers a gauge, it panics if the name is already registered.
+func NewGauge(name string, help string) *Gauge {
+	g := &Gauge{metric{name: name, help: help, kind: "gauge"}}
+	register(&g.metric)
+	return g
+}
+
+// NewCounter registers a counter, it panics if the name is already registered.
+func NewCounter(name string, help string) *Counter {
+	c := &Counter{metric{name: name, help: help, kind: "counter"}}
+	register(&c.metric)
+	return c
+}
+
+// Write writes every registered metric sorted by name.
+func Write(w io.Writer) error {
+	registry.Lock()
+	metrics := make([]*metric, 0, len(registry.metrics))
+	for _, m := range registry.metrics {
+		metrics = append(metrics, m)
+	}
+	registry.Unlock()
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", m.name, m.help, m.name, m.kind, m.name, formatValue(m.get())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatValue formats a value the way Prometheus parses it.
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return fmt.Sprint(value)
+}
+
+// Handler serves the registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Write(w)
+	})
+}
@@ -0,0 +1,27 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	gauge := NewGauge("test_gauge", "A test gauge.")
+	counter := NewCounter("test_counter_total", "A test counter.")
+	gauge.Set(12.5)
+	counter.Inc()
+	counter.Inc()
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, "# HELP test_counter_total A test counter.\n"+
+		"# TYPE test_counter_total counter\n"+
+		"test_counter_total 2\n"+
+		"# HELP test_gauge A test gauge.\n"+
+		"# TYPE test_gauge gauge\n"+
+		"test_gauge 12.5\n", recorder.Body.String())
+
+	assert.Panics(t, func() { NewGauge("test_gauge", "Registered twice.") })
+}
@@ -0,0 +1,156 @@
+package restic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/redact"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ProgressLogInterval is how often the progress of a running backup is logged.
+var ProgressLogInterval = time.Minute
+
+// Progress is the state of a running backup, as reported by restic.
+type Progress struct {
+	PercentDone    float64
+	TotalFiles     uint64
+	FilesDone      uint64
+	TotalBytes     uint64
+	BytesDone      uint64
+	SecondsElapsed uint64
+}
+
+// ProgressFunc is called with every progress update of a backup.
+type ProgressFunc func(Progress)
+
+// backupMessage is one line of the `restic backup --json` output, either a
+// status or the final summary.
+type backupMessage struct {
+	MessageType    string  `json:"message_type"`
+	PercentDone    float64 `json:"percent_done"`
+	TotalFiles     uint64  `json:"total_files"`
+	FilesDone      uint64  `json:"files_done"`
+	TotalBytes     uint64  `json:"total_bytes"`
+	BytesDone      uint64  `json:"bytes_done"`
+	SecondsElapsed uint64  `json:"seconds_elapsed"`
+	SnapshotID     string  `json:"snapshot_id"`
+}
+
+// Backup backs up path to the destination and returns the new snapshot ID.
+// The snapshot is tagged with tags.
+func Backup(ctx context.Context, dest config.Destination, path string, tags ...string) (string, error) {
+	return BackupWithProgress(ctx, dest, path, nil, tags...)
+}
+
+// BackupWithProgress is Backup calling progress, if not nil, for every
+// status update of restic. Progress is also logged every ProgressLogInterval.
+func BackupWithProgress(ctx context.Context, dest config.Destination, path string, progress ProgressFunc, tags ...string) (string, error) {
+	log := logrus.WithFields(logrus.Fields{
+		"repository": redact.URL(dest.Repository),
+		"path":       path,
+		"method":     "backup",
+	})
+	log.Info("starting backup")
+
+	args := append([]string{"backup", "--json"}, backupArgs(dest)...)
+	for _, tag := range tags {
+		args = append(args, "--tag", tag)
+	}
+	output := &backupOutput{log: log, progress: progress, lastLog: time.Now()}
+	if _, err := runWithOutput(ctx, dest, output, append(args, path)...); err != nil {
+		return "", err
+	}
+	output.flush()
+
+	if output.snapshotID == "" {
+		return "", errors.New("restic backup output has no summary")
+	}
+	log.WithField("snapshot_id", output.snapshotID).Info("backup finished")
+	return output.snapshotID, nil
+}
+
+// backupArgs returns the backup flags configured for the destination.
+func backupArgs(dest config.Destination) []string {
+	var args []string
+	for _, pattern := range dest.Exclude {
+		args = append(args, "--exclude", pattern)
+	}
+	if dest.ExcludeFile != "" {
+		args = append(args, "--exclude-file", dest.ExcludeFile)
+	}
+	if dest.OneFileSystem {
+		args = append(args, "--one-file-system")
+	}
+	return args
+}
+
+// backupOutput parses the `restic backup --json` output as it is written,
+// so progress is reported while the backup runs.
+type backupOutput struct {
+	log      *logrus.Entry
+	progress ProgressFunc
+	lastLog  time.Time
+
+	// partial holds the start of a line that wasn't fully written yet.
+	partial    []byte
+	snapshotID string
+}
+
+func (o *backupOutput) Write(p []byte) (int, error) {
+	o.partial = append(o.partial, p...)
+	for {
+		i := bytes.IndexByte(o.partial, '\n')
+		if i < 0 {
+			break
+		}
+		o.handleLine(o.partial[:i])
+		o.partial = o.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush handles a last line without a trailing newline.
+func (o *backupOutput) flush() {
+	if len(o.partial) > 0 {
+		o.handleLine(o.partial)
+		o.partial = nil
+	}
+}
+
+func (o *backupOutput) handleLine(line []byte) {
+	var message backupMessage
+	if err := json.Unmarshal(line, &message); err != nil {
+		// Not every line is a JSON message, ie warnings.
+		return
+	}
+
+	switch message.MessageType {
+	case "status":
+		progress := Progress{
+			PercentDone:    message.PercentDone,
+			TotalFiles:     message.TotalFiles,
+			FilesDone:      message.FilesDone,
+			TotalBytes:     message.TotalBytes,
+			BytesDone:      message.BytesDone,
+			SecondsElapsed: message.SecondsElapsed,
+		}
+		if o.progress != nil {
+			o.progress(progress)
+		}
+		if time.Since(o.lastLog) >= ProgressLogInterval {
+			o.lastLog = time.Now()
+			o.log.WithFields(logrus.Fields{
+				"percent_done": progress.PercentDone * 100,
+				"bytes_done":   progress.BytesDone,
+				"total_bytes":  progress.TotalBytes,
+			}).Info("backup in progress")
+		}
+	case "summary":
+		o.snapshotID = message.SnapshotID
+	}
+}
@@ -0,0 +1,63 @@
+package restic
+
+import (
+	"context"
+	"fmt"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/redact"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Check verifies the integrity of the destination's repository. With readData
+// the pack files are read as well, limited to the destination's
+// ReadDataSubset if set. Any problem found is returned as an error.
+func Check(ctx context.Context, dest config.Destination, readData bool) error {
+	log := logrus.WithFields(logrus.Fields{
+		"repository": redact.URL(dest.Repository),
+		"read_data":  readData,
+		"method":     "check",
+	})
+	log.Info("checking repository")
+
+	args := []string{"check"}
+	if readData && dest.Check.ReadDataSubset != "" {
+		args = append(args, "--read-data-subset", dest.Check.ReadDataSubset)
+	} else if readData {
+		args = append(args, "--read-data")
+	}
+
+	output, err := run(ctx, dest, args...)
+	if err != nil {
+		problems := checkProblems(string(output) + "\n" + err.Error())
+		for _, problem := range problems {
+			log.WithField("problem", problem).Error("repository check found a problem")
+		}
+		return fmt.Errorf("restic check of %s failed: %w", redact.URL(dest.Repository), err)
+	}
+	log.Info("repository check passed")
+	return nil
+}
+
+// Validate checks that the destination's repository can be opened with its
+// credentials by reading the repository config, which is quick unlike Check.
+func Validate(ctx context.Context, dest config.Destination) error {
+	if _, err := run(ctx, dest, "cat", "config"); err != nil {
+		return fmt.Errorf("failed to open restic repository %s: %w", redact.URL(dest.Repository), err)
+	}
+	return nil
+}
+
+// checkProblems returns the lines of restic check output reporting a problem.
+func checkProblems(output string) []string {
+	var problems []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		lower := strings.ToLower(line)
+		if strings.Contains(lower, "error") || strings.Contains(lower, "damaged") || strings.Contains(lower, "fatal") {
+			problems = append(problems, line)
+		}
+	}
+	return problems
+}
@@ -0,0 +1,48 @@
+package restic
+
+import (
+	"context"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/redact"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Copy copies a snapshot from the repository of from to the one of to with
+// restic copy. The credentials of from are passed as restic's RESTIC_FROM_*
+// variables, its other variables are passed as is unless to sets them too.
+func Copy(ctx context.Context, from config.Destination, to config.Destination, snapshotID string) error {
+	log := logrus.WithFields(logrus.Fields{
+		"from_repository": redact.URL(from.Repository),
+		"repository":      redact.URL(to.Repository),
+		"snapshot_id":     snapshotID,
+		"method":          "copy",
+	})
+	log.Info("starting copy")
+
+	dest := to
+	dest.Environment = copyEnvironment(from, to)
+	if _, err := run(ctx, dest, "copy", "--from-repo", from.Repository, snapshotID); err != nil {
+		return err
+	}
+	log.Info("copy finished")
+	return nil
+}
+
+// copyEnvironment merges the environment of the destination copied from into
+// the one of the destination copied to.
+func copyEnvironment(from config.Destination, to config.Destination) map[string]string {
+	env := make(map[string]string, len(from.Environment)+len(to.Environment))
+	for key, val := range from.Environment {
+		// ie RESTIC_PASSWORD becomes RESTIC_FROM_PASSWORD
+		if strings.HasPrefix(key, "RESTIC_") {
+			key = "RESTIC_FROM_" + strings.TrimPrefix(key, "RESTIC_")
+		}
+		env[key] = val
+	}
+	for key, val := range to.Environment {
+		env[key] = val
+	}
+	return env
+}
@@ -0,0 +1,278 @@
+package restic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/ionice"
+	"nodeto/restic-csi-plugin/internal/redact"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// execCommand allows mocking of the exec.CommandContext function.
+var execCommand = exec.CommandContext
+
+// Binary is the restic executable every command is run with.
+var Binary = "restic"
+
+// Priority is the priority every command is run at, so backups, restores and
+// copies don't starve the workloads on the node of I/O.
+var Priority ionice.Priority
+
+// slots holds a token per running restic operation, nil doesn't limit them.
+var slots chan struct{}
+
+// SetConcurrency limits how many restic operations run at once driver-wide,
+// further operations wait for one to finish. Zero doesn't limit them. It
+// must be called before any operation is started.
+func SetConcurrency(limit int) {
+	if limit <= 0 {
+		slots = nil
+		return
+	}
+	slots = make(chan struct{}, limit)
+}
+
+// acquireSlot waits until fewer than the limit of operations run, or until
+// ctx is done. The returned function releases the slot.
+func acquireSlot(ctx context.Context) (func(), error) {
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ErrRepositoryLocked is returned when restic could not acquire the repository lock.
+var ErrRepositoryLocked = errors.New("restic repository is locked")
+
+// ErrAppendOnly is returned when a command removing data is run against an
+// append-only destination.
+var ErrAppendOnly = errors.New("restic repository is append-only")
+
+// checkAppendOnly refuses the commands removing snapshots, data or active
+// locks from an append-only destination.
+func checkAppendOnly(dest config.Destination, args []string) error {
+	if !dest.AppendOnly || len(args) == 0 {
+		return nil
+	}
+	switch args[0] {
+	case "forget", "prune":
+		return fmt.Errorf("%w, refusing to run restic %s", ErrAppendOnly, args[0])
+	}
+	for _, arg := range args {
+		if arg == "--remove-all" {
+			return fmt.Errorf("%w, refusing to run restic %s --remove-all", ErrAppendOnly, args[0])
+		}
+	}
+	return nil
+}
+
+// environment returns the environment restic should run with for the destination.
+func environment(dest config.Destination) []string {
+	env := []string{"RESTIC_REPOSITORY=" + dest.Repository}
+	for key, val := range dest.Environment {
+		env = append(env, key+"="+val)
+	}
+	return env
+}
+
+// globalArgs returns the restic flags applying to every command against the
+// destination.
+func globalArgs(dest config.Destination) []string {
+	var args []string
+	if dest.LimitUpload > 0 {
+		args = append(args, "--limit-upload", strconv.Itoa(dest.LimitUpload))
+	}
+	if dest.LimitDownload > 0 {
+		args = append(args, "--limit-download", strconv.Itoa(dest.LimitDownload))
+	}
+	return args
+}
+
+// command builds a restic command against the destination's repository.
+func command(ctx context.Context, dest config.Destination, args ...string) *exec.Cmd {
+	name, args := Priority.Wrap(Binary, append(globalArgs(dest), args...)...)
+	cmd := execCommand(ctx, name, args...)
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, environment(dest)...)
+	return cmd
+}
+
+// run executes restic against the destination and returns its stdout.
+// If the repository is locked by a lock older than the destination's
+// ForceUnlockAfter, stale locks are removed and the command is retried once.
+func run(ctx context.Context, dest config.Destination, args ...string) ([]byte, error) {
+	return runWithOutput(ctx, dest, nil, args...)
+}
+
+// runWithOutput is run streaming restic's stdout to w instead of returning
+// it, when w isn't nil. It waits for a slot first, see SetConcurrency.
+func runWithOutput(ctx context.Context, dest config.Destination, w io.Writer, args ...string) ([]byte, error) {
+	// The unlock and retry of a locked repository are part of the operation
+	// and run in its slot.
+	release, err := acquireSlot(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("restic %s was interrupted while waiting for other restic operations: %w", args[0], err)
+	}
+	defer release()
+
+	output, err := runOnce(ctx, dest, w, args...)
+	if err != nil && ctx.Err() != nil {
+		unlockAfterInterrupt(dest)
+		return output, err
+	}
+	var lockErr *lockError
+	if !errors.As(err, &lockErr) || dest.ForceUnlockAfter <= 0 {
+		return output, err
+	}
+
+	log := logrus.WithFields(logrus.Fields{
+		"repository": redact.URL(dest.Repository),
+		"lock_age":   lockErr.age,
+	})
+	if lockErr.age < dest.ForceUnlockAfter {
+		log.Info("repository lock is not stale, not unlocking")
+		return output, err
+	}
+
+	// Without --remove-all restic only removes locks whose process is gone
+	// or which have timed out, so a lock held by an active process is kept.
+	log.Warn("removing stale repository locks")
+	if _, unlockErr := runOnce(ctx, dest, nil, "unlock"); unlockErr != nil {
+		return output, fmt.Errorf("%w (unlock failed: %v)", err, unlockErr)
+	}
+	return runOnce(ctx, dest, w, args...)
+}
+
+// lockError carries the age of the lock reported by restic, if known.
+type lockError struct {
+	age    time.Duration
+	output string
+}
+
+func (e *lockError) Error() string {
+	return ErrRepositoryLocked.Error() + ": " + e.output
+}
+
+func (e *lockError) Unwrap() error {
+	return ErrRepositoryLocked
+}
+
+// runOnce executes restic against the destination and returns its stdout,
+// or writes it to w if w isn't nil. stderr is included in the returned error
+// when restic exits non-zero.
+func runOnce(ctx context.Context, dest config.Destination, w io.Writer, args ...string) ([]byte, error) {
+	if err := checkAppendOnly(dest, args); err != nil {
+		return nil, err
+	}
+	var stdout, stderr bytes.Buffer
+	// restic is interrupted rather than killed when ctx is done, see
+	// interruptOnDone, so it isn't tied to ctx here.
+	cmd := command(context.Background(), dest, args...)
+	cmd.Stdout = &stdout
+	if w != nil {
+		cmd.Stdout = w
+	}
+	cmd.Stderr = &stderr
+
+	err := cmd.Start()
+	if err == nil {
+		stop := interruptOnDone(ctx, cmd)
+		err = cmd.Wait()
+		stop()
+	}
+	if err != nil && ctx.Err() != nil {
+		return stdout.Bytes(), fmt.Errorf("restic %s was interrupted: %w", args[0], ctx.Err())
+	}
+	if err != nil {
+		output := strings.TrimSpace(stderr.String())
+		if isLockError(output) {
+			return stdout.Bytes(), &lockError{age: lockAge(output), output: output}
+		}
+		return stdout.Bytes(), fmt.Errorf("restic %s failed: %v, output: %s", args[0], err, output)
+	}
+	return stdout.Bytes(), nil
+}
+
+// InterruptGracePeriod is how long an interrupted restic gets to exit and
+// remove its lock before it is killed.
+var InterruptGracePeriod = 30 * time.Second
+
+// interruptOnDone interrupts cmd once ctx is done, killing it if it doesn't
+// exit within InterruptGracePeriod. restic removes its repository lock when
+// interrupted, but leaves it behind when killed. The returned function must
+// be called once cmd exited.
+func interruptOnDone(ctx context.Context, cmd *exec.Cmd) func() {
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-exited:
+			return
+		case <-ctx.Done():
+		}
+		cmd.Process.Signal(os.Interrupt)
+
+		timer := time.NewTimer(InterruptGracePeriod)
+		defer timer.Stop()
+		select {
+		case <-exited:
+		case <-timer.C:
+			cmd.Process.Kill()
+		}
+	}()
+	return func() { close(exited) }
+}
+
+// unlockAfterInterrupt removes locks an interrupted restic may have left
+// behind. Without --remove-all only stale locks are removed.
+func unlockAfterInterrupt(dest config.Destination) {
+	ctx, cancel := context.WithTimeout(context.Background(), InterruptGracePeriod)
+	defer cancel()
+
+	log := logrus.WithField("repository", redact.URL(dest.Repository))
+	if _, err := runOnce(ctx, dest, nil, "unlock"); err != nil {
+		log.WithError(err).Warn("failed to unlock repository after interrupting restic")
+		return
+	}
+	log.Info("unlocked repository after interrupting restic")
+}
+
+// isLockError checks restic's stderr for a failure to lock the repository.
+func isLockError(stderr string) bool {
+	return strings.Contains(stderr, "repository is already locked") ||
+		strings.Contains(stderr, "unable to create lock")
+}
+
+// lockAgePattern matches restic's "lock was created at ... (1h2m3.4s ago)".
+var lockAgePattern = regexp.MustCompile(`lock was created at .*\(([0-9a-zµ.]+) ago\)`)
+
+// lockAge extracts the age of the lock from restic's stderr, a lock whose age
+// can't be determined is treated as fresh.
+func lockAge(stderr string) time.Duration {
+	match := lockAgePattern.FindStringSubmatch(stderr)
+	if match == nil {
+		return 0
+	}
+	age, err := time.ParseDuration(match[1])
+	if err != nil {
+		return 0
+	}
+	return age
+}
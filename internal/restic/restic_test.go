@@ -0,0 +1,547 @@
+package restic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/ionice"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockCommandResult struct {
+	stdout   string
+	stderr   string
+	exitCode int
+	// delay makes the command take this long before exiting.
+	delay time.Duration
+}
+
+// mockResults are handed out to the faked commands in order, and
+// invocations records every command line that was run.
+var mockResults []mockCommandResult
+var invocations [][]string
+
+// mockedCommands are the commands handed out, to inspect their environment.
+var mockedCommands []*exec.Cmd
+
+// fakeExecCommand allows mocking of the exec.CommandContext function.
+func fakeExecCommand(ctx context.Context, command string, args ...string) *exec.Cmd {
+	invocations = append(invocations, append([]string{command}, args...))
+
+	result := mockCommandResult{stderr: "Command not mocked.", exitCode: 1}
+	if len(mockResults) > 0 {
+		result = mockResults[0]
+		mockResults = mockResults[1:]
+	}
+
+	// Run TestHelperProcess with the specified command and arguments after the -- flag.
+	cs := []string{"-test.run=TestHelperProcess", "--", command}
+	cs = append(cs, args...)
+	cmd := exec.CommandContext(ctx, os.Args[0], cs...)
+	cmd.Env = []string{
+		"GO_WANT_HELPER_PROCESS=1",
+		"GO_HELPER_PROCESS_STDOUT=" + result.stdout,
+		"GO_HELPER_PROCESS_STDERR=" + result.stderr,
+		"GO_HELPER_PROCESS_EXIT_CODE=" + strconv.Itoa(result.exitCode),
+		"GO_HELPER_PROCESS_DELAY=" + result.delay.String(),
+	}
+	mockedCommands = append(mockedCommands, cmd)
+	return cmd
+}
+
+// mockCommands swaps in fakeExecCommand with the results for the test.
+func mockCommands(t *testing.T, results ...mockCommandResult) {
+	execCommand = fakeExecCommand
+	mockResults = results
+	invocations = nil
+	mockedCommands = nil
+	t.Cleanup(func() {
+		execCommand = exec.CommandContext
+		mockResults = nil
+		invocations = nil
+		mockedCommands = nil
+	})
+}
+
+// TestHelperProcess simulates the behavior of the command being mocked.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	exitCode, _ := strconv.Atoi(os.Getenv("GO_HELPER_PROCESS_EXIT_CODE"))
+	if delay, err := time.ParseDuration(os.Getenv("GO_HELPER_PROCESS_DELAY")); err == nil {
+		time.Sleep(delay)
+	}
+	fmt.Fprint(os.Stderr, os.Getenv("GO_HELPER_PROCESS_STDERR"))
+	fmt.Fprint(os.Stdout, os.Getenv("GO_HELPER_PROCESS_STDOUT"))
+	os.Exit(exitCode)
+}
+
+var testDestination = config.Destination{
+	Repository:  "/mnt/backup/restic",
+	Environment: map[string]string{"RESTIC_PASSWORD": "password"},
+}
+
+const lockedStderr = `unable to create lock in backend: repository is already locked by PID 1234 on node-a by root (UID 0, GID 0)
+lock was created at 2023-12-01 10:00:00 (2m10.5s ago)
+storage ID 1a2b3c4d
+the ` + "`unlock`" + ` command can be used to remove stale locks
+`
+
+func TestApplyRetention(t *testing.T) {
+	mockCommands(t, mockCommandResult{
+		stdout: `[{"tags":null,"host":"node-a","paths":["/mnt/snapshot"],` +
+			`"keep":[{"id":"a"},{"id":"b"}],"remove":[{"id":"c"},{"id":"d"},{"id":"e"}]},` +
+			`{"tags":null,"host":"node-b","paths":["/mnt/snapshot"],"keep":[{"id":"f"}],"remove":null}]` +
+			"\nloading indexes...\n",
+	})
+
+	policy := config.RetentionPolicy{KeepDaily: 7, KeepWeekly: 4, KeepMonthly: 6, Prune: true}
+	removed, err := ApplyRetention(context.Background(), testDestination, policy)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, removed)
+	assert.Equal(t, [][]string{{"restic", "forget", "--json", "--keep-daily", "7", "--keep-weekly", "4", "--keep-monthly", "6", "--prune"}}, invocations)
+}
+
+func TestApplyRetentionKeepsTaggedSnapshots(t *testing.T) {
+	mockCommands(t, mockCommandResult{
+		stdout: `[{"tags":["csi-snapshot"],"keep":[{"id":"a"}],"remove":null},` +
+			`{"tags":null,"keep":[{"id":"b"}],"remove":[{"id":"c"}]}]`,
+	})
+
+	removed, err := ApplyRetention(context.Background(), testDestination, config.RetentionPolicy{KeepDaily: 1}, "csi-snapshot")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, [][]string{{"restic", "forget", "--json", "--keep-tag", "csi-snapshot", "--keep-daily", "1"}}, invocations)
+}
+
+func TestApplyRetentionWithoutPolicy(t *testing.T) {
+	mockCommands(t)
+
+	removed, err := ApplyRetention(context.Background(), testDestination, config.RetentionPolicy{Prune: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, removed)
+	assert.Len(t, invocations, 0)
+}
+
+func TestApplyRetentionLocked(t *testing.T) {
+	mockCommands(t, mockCommandResult{stderr: lockedStderr, exitCode: 1})
+
+	_, err := ApplyRetention(context.Background(), testDestination, config.RetentionPolicy{KeepDaily: 1})
+	assert.True(t, errors.Is(err, ErrRepositoryLocked))
+}
+
+func TestAppendOnlyRefusesRetention(t *testing.T) {
+	mockCommands(t)
+	dest := testDestination
+	dest.AppendOnly = true
+
+	_, err := ApplyRetention(context.Background(), dest, config.RetentionPolicy{KeepDaily: 7, Prune: true})
+	assert.True(t, errors.Is(err, ErrAppendOnly))
+	assert.True(t, errors.Is(Forget(context.Background(), dest, "4f3a2b1c"), ErrAppendOnly))
+	_, err = run(context.Background(), dest, "prune")
+	assert.True(t, errors.Is(err, ErrAppendOnly))
+	_, err = run(context.Background(), dest, "unlock", "--remove-all")
+	assert.True(t, errors.Is(err, ErrAppendOnly))
+	assert.Len(t, invocations, 0)
+}
+
+func TestAppendOnlyAllowsBackups(t *testing.T) {
+	mockCommands(t, mockCommandResult{stdout: `{"message_type":"summary","snapshot_id":"4f3a2b1c"}`}, mockCommandResult{})
+	dest := testDestination
+	dest.AppendOnly = true
+
+	_, err := Backup(context.Background(), dest, "/mnt/snapshot")
+	assert.Nil(t, err)
+	// Stale locks of dead processes may still be removed
+	_, err = run(context.Background(), dest, "unlock")
+	assert.Nil(t, err)
+	assert.Len(t, invocations, 2)
+}
+
+func TestStaleLockIsUnlockedAndRetriedOnce(t *testing.T) {
+	staleStderr := `unable to create lock in backend: repository is already locked by PID 1234 on node-a by root (UID 0, GID 0)
+lock was created at 2023-12-01 10:00:00 (1h2m3.5s ago)
+storage ID 1a2b3c4d
+`
+	mockCommands(t,
+		mockCommandResult{stderr: staleStderr, exitCode: 1},
+		mockCommandResult{stderr: "successfully removed 1 locks\n"},
+		mockCommandResult{stdout: "[]"},
+	)
+
+	dest := testDestination
+	dest.ForceUnlockAfter = 30 * time.Minute
+	_, err := ApplyRetention(context.Background(), dest, config.RetentionPolicy{KeepDaily: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{
+		{"restic", "forget", "--json", "--keep-daily", "1"},
+		{"restic", "unlock"},
+		{"restic", "forget", "--json", "--keep-daily", "1"},
+	}, invocations)
+}
+
+func TestStaleLockRetryIsNotRepeated(t *testing.T) {
+	staleStderr := "repository is already locked by PID 1234\nlock was created at 2023-12-01 10:00:00 (2h0m0s ago)\n"
+	mockCommands(t,
+		mockCommandResult{stderr: staleStderr, exitCode: 1},
+		mockCommandResult{},
+		mockCommandResult{stderr: staleStderr, exitCode: 1},
+	)
+
+	dest := testDestination
+	dest.ForceUnlockAfter = 30 * time.Minute
+	_, err := ApplyRetention(context.Background(), dest, config.RetentionPolicy{KeepDaily: 1})
+	assert.True(t, errors.Is(err, ErrRepositoryLocked))
+	assert.Len(t, invocations, 3)
+}
+
+func TestFreshLockIsNotUnlocked(t *testing.T) {
+	mockCommands(t, mockCommandResult{stderr: lockedStderr, exitCode: 1})
+
+	dest := testDestination
+	dest.ForceUnlockAfter = 30 * time.Minute
+	_, err := ApplyRetention(context.Background(), dest, config.RetentionPolicy{KeepDaily: 1})
+	assert.True(t, errors.Is(err, ErrRepositoryLocked))
+	assert.Len(t, invocations, 1)
+}
+
+func TestLockAge(t *testing.T) {
+	assert.Equal(t, 2*time.Minute+10500*time.Millisecond, lockAge(lockedStderr))
+	assert.Equal(t, time.Duration(0), lockAge("repository is already locked"))
+}
+
+func TestBackup(t *testing.T) {
+	mockCommands(t, mockCommandResult{
+		stdout: `{"message_type":"status","percent_done":0.5}` + "\n" +
+			`{"message_type":"summary","files_new":2,"snapshot_id":"4f3a2b1c"}` + "\n",
+	})
+
+	snapshotID, err := Backup(context.Background(), testDestination, "/mnt/snapshot")
+	assert.Nil(t, err)
+	assert.Equal(t, "4f3a2b1c", snapshotID)
+	assert.Equal(t, [][]string{{"restic", "backup", "--json", "/mnt/snapshot"}}, invocations)
+}
+
+func TestBackupFailure(t *testing.T) {
+	mockCommands(t, mockCommandResult{stderr: "Fatal: unable to open config file", exitCode: 1})
+
+	_, err := Backup(context.Background(), testDestination, "/mnt/snapshot")
+	assert.Contains(t, err.Error(), "unable to open config file")
+}
+
+func TestPriorityIsApplied(t *testing.T) {
+	mockCommands(t, mockCommandResult{stdout: `{"message_type":"summary","snapshot_id":"4f3a2b1c"}` + "\n"})
+	Priority = ionice.Priority{Class: ionice.ClassBestEffort, Level: 7}
+	t.Cleanup(func() { Priority = ionice.Priority{} })
+
+	_, err := Backup(context.Background(), testDestination, "/mnt/snapshot")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"ionice", "-c", "2", "-n", "7", "restic", "backup", "--json", "/mnt/snapshot"}}, invocations)
+}
+
+func TestConfiguredBinaryIsUsed(t *testing.T) {
+	mockCommands(t, mockCommandResult{stdout: `{"message_type":"summary","snapshot_id":"4f3a2b1c"}` + "\n"})
+	Binary = "/usr/local/bin/restic"
+	t.Cleanup(func() { Binary = "restic" })
+
+	_, err := Backup(context.Background(), testDestination, "/mnt/snapshot")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"/usr/local/bin/restic", "backup", "--json", "/mnt/snapshot"}}, invocations)
+}
+
+func TestSnapshots(t *testing.T) {
+	mockCommands(t, mockCommandResult{
+		stdout: `[{"time":"2024-03-01T10:00:00Z","paths":["/mnt/test"],"tags":["csi-snapshot","csi-volume=test-volume"],"id":"4f3a2b1c"}]`,
+	})
+
+	snapshots, err := Snapshots(context.Background(), testDestination, "csi-snapshot", "csi-volume=test-volume")
+	assert.Nil(t, err)
+	assert.Len(t, snapshots, 1)
+	assert.Equal(t, "4f3a2b1c", snapshots[0].ID)
+	assert.True(t, snapshots[0].HasTag("csi-volume=test-volume"))
+	assert.Equal(t, [][]string{{"restic", "snapshots", "--json", "--tag", "csi-snapshot,csi-volume=test-volume"}}, invocations)
+}
+
+func TestTag(t *testing.T) {
+	assert.Equal(t, "csi-pvc-name=data", Tag("csi-pvc-name", "data"))
+	// Commas would split the tag in --tag
+	assert.Equal(t, "csi-pvc-name=data_logs_1", Tag("csi-pvc-name", "data,logs 1"))
+}
+
+func TestForget(t *testing.T) {
+	mockCommands(t, mockCommandResult{})
+
+	assert.Nil(t, Forget(context.Background(), testDestination, "4f3a2b1c"))
+	assert.Equal(t, [][]string{{"restic", "forget", "4f3a2b1c"}}, invocations)
+}
+
+func TestForgetMissingSnapshot(t *testing.T) {
+	mockCommands(t, mockCommandResult{}, mockCommandResult{
+		stderr:   "Ignoring \"4f3a2b1c\": no matching ID found for prefix \"4f3a2b1c\"",
+		exitCode: 1,
+	})
+
+	assert.Nil(t, Forget(context.Background(), testDestination, "4f3a2b1c"))
+	assert.Nil(t, Forget(context.Background(), testDestination, "4f3a2b1c"))
+	assert.Len(t, invocations, 2)
+}
+
+func TestForgetTagged(t *testing.T) {
+	mockCommands(t, mockCommandResult{
+		stdout: `[{"id":"4f3a2b1c","tags":["csi-volume-id=pvc-1234"]},{"id":"9e8d7c6b","tags":["csi-volume-id=pvc-1234"]}]`,
+	}, mockCommandResult{}, mockCommandResult{stdout: `[]`})
+
+	removed, err := ForgetTagged(context.Background(), testDestination, "csi-volume-id=pvc-1234")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, removed)
+	assert.Equal(t, [][]string{
+		{"restic", "snapshots", "--json", "--tag", "csi-volume-id=pvc-1234"},
+		{"restic", "forget", "--prune", "4f3a2b1c", "9e8d7c6b"},
+	}, invocations)
+
+	// Without tagged snapshots nothing is forgotten
+	removed, err = ForgetTagged(context.Background(), testDestination, "csi-volume-id=pvc-1234")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, removed)
+	assert.Len(t, invocations, 3)
+
+	appendOnly := testDestination
+	appendOnly.AppendOnly = true
+	_, err = ForgetTagged(context.Background(), appendOnly, "csi-volume-id=pvc-1234")
+	assert.True(t, errors.Is(err, ErrAppendOnly), err)
+	assert.Len(t, invocations, 3)
+}
+
+func TestBackupProgress(t *testing.T) {
+	mockCommands(t, mockCommandResult{
+		stdout: `{"message_type":"status","percent_done":0.25,"total_files":4,"files_done":1,"total_bytes":4096,"bytes_done":1024}` + "\n" +
+			"unexpected warning line\n" +
+			`{"message_type":"status","percent_done":0.5,"total_files":4,"files_done":2,"total_bytes":4096,"bytes_done":2048}` + "\n" +
+			`{"message_type":"summary","files_new":4,"snapshot_id":"4f3a2b1c"}` + "\n" +
+			`{"message_type":"status","percent_done":1,"total_files":4,"files_done":4,"total_bytes":4096,"bytes_done":4096}`,
+	})
+	ProgressLogInterval = 0
+	t.Cleanup(func() { ProgressLogInterval = time.Minute })
+
+	var updates []Progress
+	snapshotID, err := BackupWithProgress(context.Background(), testDestination, "/mnt/snapshot", func(progress Progress) {
+		updates = append(updates, progress)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "4f3a2b1c", snapshotID)
+	assert.Equal(t, []Progress{
+		{PercentDone: 0.25, TotalFiles: 4, FilesDone: 1, TotalBytes: 4096, BytesDone: 1024},
+		{PercentDone: 0.5, TotalFiles: 4, FilesDone: 2, TotalBytes: 4096, BytesDone: 2048},
+		{PercentDone: 1, TotalFiles: 4, FilesDone: 4, TotalBytes: 4096, BytesDone: 4096},
+	}, updates)
+}
+
+func TestBackupOutputHandlesPartialWrites(t *testing.T) {
+	var updates int
+	output := &backupOutput{log: logrus.NewEntry(logrus.New()), progress: func(Progress) { updates++ }, lastLog: time.Now()}
+
+	line := `{"message_type":"status","percent_done":0.5}` + "\n" + `{"message_type":"summary","snapshot_id":"4f3a2b1c"}` + "\n"
+	for i := 0; i < len(line); i += 7 {
+		end := i + 7
+		if end > len(line) {
+			end = len(line)
+		}
+		output.Write([]byte(line[i:end]))
+	}
+	output.flush()
+	assert.Equal(t, 1, updates)
+	assert.Equal(t, "4f3a2b1c", output.snapshotID)
+}
+
+func TestRateLimitsArePassed(t *testing.T) {
+	mockCommands(t, mockCommandResult{stdout: `{"message_type":"summary","snapshot_id":"4f3a2b1c"}` + "\n"}, mockCommandResult{})
+	dest := testDestination
+	dest.LimitUpload = 1024
+	dest.LimitDownload = 2048
+
+	_, err := Backup(context.Background(), dest, "/mnt/snapshot")
+	assert.Nil(t, err)
+	dest.LimitDownload = 0
+	assert.Nil(t, Forget(context.Background(), dest, "4f3a2b1c"))
+
+	assert.Equal(t, [][]string{
+		{"restic", "--limit-upload", "1024", "--limit-download", "2048", "backup", "--json", "/mnt/snapshot"},
+		{"restic", "--limit-upload", "1024", "forget", "4f3a2b1c"},
+	}, invocations)
+}
+
+func TestBackupExcludes(t *testing.T) {
+	mockCommands(t, mockCommandResult{stdout: `{"message_type":"summary","snapshot_id":"4f3a2b1c"}` + "\n"})
+	dest := testDestination
+	dest.Exclude = []string{"cache", "*.tmp", "/lost+found"}
+	dest.ExcludeFile = "/etc/restic/excludes"
+	dest.OneFileSystem = true
+
+	_, err := Backup(context.Background(), dest, "/mnt/snapshot")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{
+		"restic", "backup", "--json",
+		"--exclude", "cache", "--exclude", "*.tmp", "--exclude", "/lost+found",
+		"--exclude-file", "/etc/restic/excludes",
+		"--one-file-system",
+		"/mnt/snapshot",
+	}}, invocations)
+}
+
+func TestCheck(t *testing.T) {
+	mockCommands(t, mockCommandResult{stdout: "using temporary cache in /tmp/restic-check-cache\nno errors were found\n"}, mockCommandResult{})
+	dest := testDestination
+
+	assert.Nil(t, Check(context.Background(), dest, false))
+	dest.Check.ReadDataSubset = "10%"
+	assert.Nil(t, Check(context.Background(), dest, true))
+	assert.Equal(t, [][]string{
+		{"restic", "check"},
+		{"restic", "check", "--read-data-subset", "10%"},
+	}, invocations)
+}
+
+func TestValidate(t *testing.T) {
+	mockCommands(t, mockCommandResult{stdout: `{"version":2,"id":"5ac1a0b3"}`}, mockCommandResult{
+		stderr:   "Fatal: wrong password or no key found",
+		exitCode: 1,
+	})
+
+	assert.Nil(t, Validate(context.Background(), testDestination))
+	err := Validate(context.Background(), testDestination)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "wrong password or no key found")
+	assert.Equal(t, [][]string{{"restic", "cat", "config"}, {"restic", "cat", "config"}}, invocations)
+}
+
+func TestCheckDamagedPack(t *testing.T) {
+	mockCommands(t, mockCommandResult{
+		stdout:   "check snapshots, trees and blobs\nread all data\n",
+		stderr:   "error: pack 5ac1a0b3 is damaged: hash mismatch\nFatal: repository contains errors",
+		exitCode: 1,
+	})
+
+	err := Check(context.Background(), testDestination, true)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "pack 5ac1a0b3 is damaged")
+	assert.Equal(t, [][]string{{"restic", "check", "--read-data"}}, invocations)
+	assert.Equal(t, []string{
+		"restic check failed: exit status 1, output: error: pack 5ac1a0b3 is damaged: hash mismatch",
+		"Fatal: repository contains errors",
+	}, checkProblems("read all data\nrestic check failed: exit status 1, output: error: pack 5ac1a0b3 is damaged: hash mismatch\nFatal: repository contains errors"))
+}
+
+func TestRestore(t *testing.T) {
+	mockCommands(t, mockCommandResult{})
+
+	assert.Nil(t, Restore(context.Background(), testDestination, "4f3a2b1c", "/mnt/restore"))
+	assert.Equal(t, [][]string{{"restic", "restore", "4f3a2b1c", "--target", "/mnt/restore"}}, invocations)
+}
+
+func TestInterruptedBackupIsUnlocked(t *testing.T) {
+	mockCommands(t, mockCommandResult{delay: time.Minute}, mockCommandResult{})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := Backup(ctx, testDestination, "/mnt/snapshot")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	assert.Less(t, time.Since(start), 10*time.Second)
+	assert.Equal(t, [][]string{
+		{"restic", "backup", "--json", "/mnt/snapshot"},
+		{"restic", "unlock"},
+	}, invocations)
+}
+
+func TestSlowBackupFinishesWithoutInterrupt(t *testing.T) {
+	mockCommands(t, mockCommandResult{
+		stdout: `{"message_type":"summary","snapshot_id":"4f3a2b1c"}` + "\n",
+		delay:  200 * time.Millisecond,
+	})
+
+	snapshotID, err := Backup(context.Background(), testDestination, "/mnt/snapshot")
+	assert.Nil(t, err)
+	assert.Equal(t, "4f3a2b1c", snapshotID)
+	assert.Len(t, invocations, 1)
+}
+
+func TestCopy(t *testing.T) {
+	mockCommands(t, mockCommandResult{})
+	from := config.Destination{
+		Repository:  "/mnt/backup/restic",
+		Environment: map[string]string{"RESTIC_PASSWORD": "primary-password", "AWS_ACCESS_KEY_ID": "primary-key"},
+	}
+	to := config.Destination{
+		Repository:  "s3:https://s3.example.com/offsite",
+		Environment: map[string]string{"RESTIC_PASSWORD": "offsite-password", "AWS_ACCESS_KEY_ID": "offsite-key"},
+	}
+
+	assert.Nil(t, Copy(context.Background(), from, to, "4f3a2b1c"))
+	assert.Equal(t, [][]string{{"restic", "copy", "--from-repo", "/mnt/backup/restic", "4f3a2b1c"}}, invocations)
+
+	env := mockedCommands[0].Env
+	assert.Contains(t, env, "RESTIC_REPOSITORY=s3:https://s3.example.com/offsite")
+	assert.Contains(t, env, "RESTIC_PASSWORD=offsite-password")
+	assert.Contains(t, env, "RESTIC_FROM_PASSWORD=primary-password")
+	// Variables set by both are the ones of the destination copied to
+	assert.Contains(t, env, "AWS_ACCESS_KEY_ID=offsite-key")
+	assert.NotContains(t, env, "AWS_ACCESS_KEY_ID=primary-key")
+}
+
+// mockConcurrency sets the concurrency limit for a test.
+func mockConcurrency(t *testing.T, limit int) {
+	SetConcurrency(limit)
+	t.Cleanup(func() { SetConcurrency(0) })
+}
+
+func TestConcurrencyLimitRunsBackupsSequentially(t *testing.T) {
+	summary := `{"message_type":"summary","snapshot_id":"4f3a2b1c"}`
+	mockCommands(t, mockCommandResult{stdout: summary, delay: 200 * time.Millisecond}, mockCommandResult{stdout: summary, delay: 200 * time.Millisecond})
+	mockConcurrency(t, 1)
+
+	var wg sync.WaitGroup
+	finished := make([]time.Time, 2)
+	for i := range finished {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := Backup(context.Background(), testDestination, "/mnt/snapshot")
+			assert.Nil(t, err)
+			finished[i] = time.Now()
+		}(i)
+	}
+	wg.Wait()
+
+	// The second backup only started once the first finished
+	gap := finished[0].Sub(finished[1])
+	if gap < 0 {
+		gap = -gap
+	}
+	assert.GreaterOrEqual(t, gap, 150*time.Millisecond)
+	assert.Len(t, invocations, 2)
+}
+
+func TestConcurrencyLimitWaitIsCancelled(t *testing.T) {
+	mockCommands(t)
+	mockConcurrency(t, 1)
+	release, err := acquireSlot(context.Background())
+	assert.Nil(t, err)
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = Backup(ctx, testDestination, "/mnt/snapshot")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	// Nothing was run, not even an unlock
+	assert.Empty(t, invocations)
+}
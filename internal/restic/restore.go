@@ -0,0 +1,26 @@
+package restic
+
+import (
+	"context"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/redact"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Restore restores a snapshot from the destination into target.
+func Restore(ctx context.Context, dest config.Destination, snapshotID string, target string) error {
+	log := logrus.WithFields(logrus.Fields{
+		"repository":  redact.URL(dest.Repository),
+		"snapshot_id": snapshotID,
+		"target":      target,
+		"method":      "restore",
+	})
+	log.Info("starting restore")
+
+	if _, err := run(ctx, dest, "restore", snapshotID, "--target", target); err != nil {
+		return err
+	}
+	log.Info("restore finished")
+	return nil
+}
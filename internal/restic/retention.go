@@ -0,0 +1,81 @@
+package restic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/redact"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// forgetGroup is one entry of the `restic forget --json` output.
+type forgetGroup struct {
+	Keep   []json.RawMessage `json:"keep"`
+	Remove []json.RawMessage `json:"remove"`
+}
+
+// retentionArgs translates the policy to restic forget arguments, the
+// snapshots carrying any of keepTags are always kept.
+func retentionArgs(policy config.RetentionPolicy, keepTags []string) []string {
+	args := []string{"forget", "--json"}
+	for _, tag := range keepTags {
+		args = append(args, "--keep-tag", tag)
+	}
+	if policy.KeepDaily > 0 {
+		args = append(args, "--keep-daily", strconv.Itoa(policy.KeepDaily))
+	}
+	if policy.KeepWeekly > 0 {
+		args = append(args, "--keep-weekly", strconv.Itoa(policy.KeepWeekly))
+	}
+	if policy.KeepMonthly > 0 {
+		args = append(args, "--keep-monthly", strconv.Itoa(policy.KeepMonthly))
+	}
+	if policy.Prune {
+		args = append(args, "--prune")
+	}
+	return args
+}
+
+// ApplyRetention forgets (and optionally prunes) the snapshots of the
+// destination which fall outside the policy. It returns the number of
+// snapshots removed. ErrRepositoryLocked is returned if another process holds
+// the repository lock, so the caller can retry later, and ErrAppendOnly for
+// append-only destinations. The snapshots carrying any of keepTags are left
+// alone, ie those something else still refers to.
+func ApplyRetention(ctx context.Context, dest config.Destination, policy config.RetentionPolicy, keepTags ...string) (int, error) {
+	log := logrus.WithFields(logrus.Fields{
+		"repository": redact.URL(dest.Repository),
+		"method":     "apply_retention",
+	})
+	if !policy.Enabled() {
+		log.Info("no retention policy configured, skipping")
+		return 0, nil
+	}
+	if dest.AppendOnly {
+		log.Warn("repository is append-only, retention must be run elsewhere")
+		return 0, ErrAppendOnly
+	}
+
+	output, err := run(ctx, dest, retentionArgs(policy, keepTags)...)
+	if err != nil {
+		return 0, err
+	}
+
+	// With --prune the prune report follows the JSON document, so only
+	// decode the first value.
+	var groups []forgetGroup
+	if err := json.NewDecoder(bytes.NewReader(output)).Decode(&groups); err != nil {
+		return 0, fmt.Errorf("failed to parse restic forget output: %w", err)
+	}
+
+	removed := 0
+	for _, group := range groups {
+		removed += len(group.Remove)
+	}
+	log.WithField("removed", removed).Info("retention policy applied")
+	return removed, nil
+}
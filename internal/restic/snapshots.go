@@ -0,0 +1,116 @@
+package restic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/redact"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Snapshot is a snapshot as listed by `restic snapshots --json`.
+type Snapshot struct {
+	ID    string    `json:"id"`
+	Time  time.Time `json:"time"`
+	Paths []string  `json:"paths"`
+	Tags  []string  `json:"tags"`
+}
+
+// HasTag reports whether the snapshot is tagged with tag.
+func (snapshot Snapshot) HasTag(tag string) bool {
+	for _, t := range snapshot.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Tag returns the "key=value" snapshot tag. Characters of the value restic
+// would split the tag at or which don't belong in a tag, ie commas and
+// whitespace, are replaced with '_'.
+func Tag(key string, value string) string {
+	valid := func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune("_+.-/=:@", r):
+			return r
+		}
+		return '_'
+	}
+	return key + "=" + strings.Map(valid, value)
+}
+
+// Snapshots lists the snapshots in the destination carrying all of tags.
+func Snapshots(ctx context.Context, dest config.Destination, tags ...string) ([]Snapshot, error) {
+	args := []string{"snapshots", "--json"}
+	if len(tags) > 0 {
+		// Repeated --tag flags match any of the tags, joined by a comma
+		// they must all be present.
+		args = append(args, "--tag", strings.Join(tags, ","))
+	}
+	output, err := run(ctx, dest, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []Snapshot
+	if err := json.Unmarshal(output, &snapshots); err != nil {
+		return nil, fmt.Errorf("failed to parse restic snapshots output: %v", err)
+	}
+	return snapshots, nil
+}
+
+// Forget removes a snapshot from the destination. The data is only freed by
+// a later prune. A snapshot which is already gone is forgotten, so forgetting
+// it again succeeds.
+func Forget(ctx context.Context, dest config.Destination, snapshotID string) error {
+	log := logrus.WithFields(logrus.Fields{
+		"repository":  redact.URL(dest.Repository),
+		"snapshot_id": snapshotID,
+	})
+	if _, err := run(ctx, dest, "forget", snapshotID); err != nil {
+		if strings.Contains(err.Error(), "no matching ID found") {
+			log.Info("snapshot is already forgotten")
+			return nil
+		}
+		return err
+	}
+	log.Info("forgot snapshot")
+	return nil
+}
+
+// ForgetTagged removes the snapshots carrying all of tags from the destination
+// and prunes the data only they referenced, returning the number of snapshots
+// removed. restic forget without a policy keeps every snapshot, so the tagged
+// snapshots are listed and forgotten by ID. ErrAppendOnly is returned for
+// append-only destinations.
+func ForgetTagged(ctx context.Context, dest config.Destination, tags ...string) (int, error) {
+	if dest.AppendOnly {
+		return 0, ErrAppendOnly
+	}
+	snapshots, err := Snapshots(ctx, dest, tags...)
+	if err != nil {
+		return 0, err
+	}
+	if len(snapshots) == 0 {
+		return 0, nil
+	}
+
+	args := []string{"forget", "--prune"}
+	for _, snapshot := range snapshots {
+		args = append(args, snapshot.ID)
+	}
+	if _, err := run(ctx, dest, args...); err != nil {
+		return 0, err
+	}
+	logrus.WithFields(logrus.Fields{
+		"repository": redact.URL(dest.Repository),
+		"tags":       strings.Join(tags, ","),
+		"removed":    len(snapshots),
+	}).Info("forgot tagged snapshots")
+	return len(snapshots), nil
+}
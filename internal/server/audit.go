@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// auditEvents are the audit events of the calls mutating volumes and
+// snapshots, by method name. Other calls aren't audited.
+var auditEvents = map[string]string{
+	"CreateVolume":              "volume_created",
+	"DeleteVolume":              "volume_deleted",
+	"ControllerExpandVolume":    "volume_expanded",
+	"ControllerPublishVolume":   "volume_attached",
+	"ControllerUnpublishVolume": "volume_detached",
+	"CreateSnapshot":            "snapshot_created",
+	"DeleteSnapshot":            "snapshot_deleted",
+	"NodeStageVolume":           "volume_staged",
+	"NodeUnstageVolume":         "volume_unstaged",
+	"NodePublishVolume":         "volume_published",
+	"NodeUnpublishVolume":       "volume_unpublished",
+	"NodeExpandVolume":          "volume_node_expanded",
+}
+
+// openAuditLog returns the logger writing audit events as JSON lines to path.
+func openAuditLog(path string) (*logrus.Entry, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	logger := logrus.New()
+	logger.SetOutput(file)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	return logrus.NewEntry(logger), nil
+}
+
+// auditVolumeID returns the volume a request is about.
+func auditVolumeID(req interface{}) string {
+	switch req := req.(type) {
+	case interface{ GetVolumeId() string }:
+		return req.GetVolumeId()
+	case interface{ GetSourceVolumeId() string }:
+		return req.GetSourceVolumeId()
+	case interface{ GetName() string }:
+		// CreateVolume, whose name is the volume ID
+		return req.GetName()
+	}
+	return ""
+}
+
+// auditSize returns the size of the volume or snapshot of a call, the
+// requested size if the call failed, and zero if it has none.
+func auditSize(req, resp interface{}) int64 {
+	switch resp := resp.(type) {
+	case *csi.CreateVolumeResponse:
+		return resp.GetVolume().GetCapacityBytes()
+	case *csi.ControllerExpandVolumeResponse:
+		return resp.GetCapacityBytes()
+	case *csi.NodeExpandVolumeResponse:
+		return resp.GetCapacityBytes()
+	case *csi.CreateSnapshotResponse:
+		return resp.GetSnapshot().GetSizeBytes()
+	}
+	if req, ok := req.(interface{ GetCapacityRange() *csi.CapacityRange }); ok {
+		return req.GetCapacityRange().GetRequiredBytes()
+	}
+	return 0
+}
+
+// auditSnapshotID returns the snapshot a call is about, empty if none.
+func auditSnapshotID(req, resp interface{}) string {
+	if resp, ok := resp.(*csi.CreateSnapshotResponse); ok {
+		return resp.GetSnapshot().GetSnapshotId()
+	}
+	if req, ok := req.(interface{ GetSnapshotId() string }); ok {
+		return req.GetSnapshotId()
+	}
+	return ""
+}
+
+// auditInterceptor writes an audit event with the outcome of every call
+// mutating a volume or snapshot.
+func (d *Driver) auditInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	event, ok := auditEvents[path.Base(info.FullMethod)]
+	if !ok {
+		return handler(ctx, req)
+	}
+
+	start := time.Now()
+	resp, err := handler(ctx, req)
+
+	fields := logrus.Fields{
+		"event":       event,
+		"volume_id":   auditVolumeID(req),
+		"result":      status.Code(err).String(),
+		"duration_ms": time.Since(start).Milliseconds(),
+	}
+	if size := auditSize(req, resp); size > 0 {
+		fields["size"] = size
+	}
+	if snapshotID := auditSnapshotID(req, resp); snapshotID != "" {
+		fields["snapshot_id"] = snapshotID
+	}
+
+	audit := d.audit
+	if audit == nil {
+		audit = d.log.WithField("audit", true)
+	}
+	audit.WithFields(fields).Info("audit")
+	return resp, err
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// auditCall calls the driver method through the audit interceptor.
+func auditCall(d *Driver, method string, req interface{}, handler grpc.UnaryHandler) (interface{}, error) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/" + method}
+	return d.auditInterceptor(context.Background(), req, info, handler)
+}
+
+func TestAuditCreateVolume(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{})
+	hook := test.NewLocal(d.log.Logger)
+
+	req := &csi.CreateVolumeRequest{
+		Name:               "test-volume",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1024 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	}
+	_, err := auditCall(d, "CreateVolume", req, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return d.CreateVolume(ctx, req.(*csi.CreateVolumeRequest))
+	})
+	assert.Nil(t, err)
+
+	entry := hook.LastEntry()
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, logrus.InfoLevel, entry.Level)
+		assert.Equal(t, "volume_created", entry.Data["event"])
+		assert.Equal(t, "test-volume", entry.Data["volume_id"])
+		assert.Equal(t, int64(1024*1024*1024), entry.Data["size"])
+		assert.Equal(t, "OK", entry.Data["result"])
+		assert.Contains(t, entry.Data, "duration_ms")
+		assert.Equal(t, true, entry.Data["audit"])
+	}
+
+	// Failures are audited with their code
+	hook.Reset()
+	_, err = auditCall(d, "DeleteVolume", &csi.DeleteVolumeRequest{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return d.DeleteVolume(ctx, req.(*csi.DeleteVolumeRequest))
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	if entry := hook.LastEntry(); assert.NotNil(t, entry) {
+		assert.Equal(t, "volume_deleted", entry.Data["event"])
+		assert.Equal(t, "InvalidArgument", entry.Data["result"])
+	}
+}
+
+func TestAuditSkipsReadOnlyCalls(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{})
+	hook := test.NewLocal(d.log.Logger)
+
+	_, err := auditCall(d, "ListVolumes", &csi.ListVolumesRequest{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return d.ListVolumes(ctx, req.(*csi.ListVolumesRequest))
+	})
+	assert.Nil(t, err)
+	for _, entry := range hook.AllEntries() {
+		assert.NotContains(t, entry.Data, "audit")
+	}
+}
+
+func TestOpenAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(path)
+	assert.Nil(t, err)
+	d := newTestDriver(&fakeThinPool{})
+	d.audit = audit
+	hook := test.NewLocal(d.log.Logger)
+
+	_, err = auditCall(d, "DeleteSnapshot", &csi.DeleteSnapshotRequest{SnapshotId: "abc123"}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &csi.DeleteSnapshotResponse{}, nil
+	})
+	assert.Nil(t, err)
+	assert.Empty(t, hook.AllEntries())
+
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Contains(t, string(content), `"event":"snapshot_deleted"`)
+	assert.Contains(t, string(content), `"snapshot_id":"abc123"`)
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"nodeto/restic-csi-plugin/internal/metrics"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultAutoExtendThreshold is the data or metadata percentage the thin pool
+// is extended at when pool_autoextend doesn't set a threshold.
+const DefaultAutoExtendThreshold = 80
+
+// DefaultMetadataWarningThreshold is the metadata percentage above which a
+// warning is logged when pool_autoextend doesn't set one.
+const DefaultMetadataWarningThreshold = 90
+
+var (
+	poolDataPercent      = metrics.NewGauge("restic_csi_pool_data_percent", "Percentage of the thin pool's data space in use.")
+	poolMetadataPercent  = metrics.NewGauge("restic_csi_pool_metadata_percent", "Percentage of the thin pool's metadata space in use.")
+	poolExtensions       = metrics.NewCounter("restic_csi_pool_extensions_total", "Number of times the thin pool was extended.")
+	poolExtendFailures   = metrics.NewCounter("restic_csi_pool_extend_failures_total", "Number of times the thin pool needed extending but couldn't be.")
+	poolVGFull           = metrics.NewGauge("restic_csi_pool_vg_full", "1 when the thin pool needs extending but its volume group has no free space.")
+	poolMetadataWarnings = metrics.NewCounter("restic_csi_pool_metadata_warnings_total", "Number of polls which found the thin pool's metadata above the warning threshold.")
+)
+
+// startPoolAutoExtend polls the fullness of the thin pool on the configured
+// interval and extends it, until the context is cancelled.
+func (d *Driver) startPoolAutoExtend(ctx context.Context) {
+	interval := d.config.VolumeInformation.PoolAutoExtend.Interval
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				d.autoExtendPool(ctx)
+			}
+		}
+	}()
+}
+
+// poolMetadataWarningInterval is how often the metadata of the thin pool is
+// checked while pool_autoextend, whose polls check it too, is disabled.
+var poolMetadataWarningInterval = time.Minute
+
+// startPoolMetadataWarning polls the metadata of the thin pool and warns when
+// it's close to exhaustion, until the context is cancelled. It only runs
+// without pool_autoextend, which warns on its own polls.
+func (d *Driver) startPoolMetadataWarning(ctx context.Context) {
+	if d.config.VolumeInformation.PoolAutoExtend.Interval > 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(poolMetadataWarningInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				d.checkPoolMetadata(ctx)
+			}
+		}
+	}()
+}
+
+// checkPoolMetadata records the fullness of the thin pool and warns if its
+// metadata is above the warning threshold.
+func (d *Driver) checkPoolMetadata(ctx context.Context) {
+	log := d.log.WithField("method", "check_pool_metadata")
+
+	status, err := d.thinPool.Status(ctx)
+	if err != nil {
+		log.WithError(err).Error("failed to get thin pool status")
+		return
+	}
+	poolDataPercent.Set(float64(status.DataPercent))
+	poolMetadataPercent.Set(float64(status.MetadataPercent))
+	warnMetadataPercent(log, d.config.VolumeInformation.PoolAutoExtend, status)
+}
+
+// poolIncrement returns how much to grow a part of the pool by, a fifth of
+// its size unless an increment is configured.
+func poolIncrement(increment lvm.ByteSize, size lvm.ByteSize) lvm.ByteSize {
+	if increment > 0 {
+		return increment
+	}
+	return size / 5
+}
+
+// warnMetadataPercent logs a warning when the metadata of the pool is above
+// the warning threshold. Thin pools whose metadata runs out go read-only or
+// worse, and unlike data the metadata isn't visible in the volumes' usage.
+func warnMetadataPercent(log *logrus.Entry, policy config.PoolAutoExtend, status lvm.PoolStatus) {
+	threshold := lvm.Percent(policy.MetadataWarningThreshold)
+	if threshold == 0 {
+		threshold = DefaultMetadataWarningThreshold
+	}
+	if status.MetadataPercent < threshold {
+		return
+	}
+	poolMetadataWarnings.Inc()
+	log.WithFields(logrus.Fields{
+		"metadata_percent": status.MetadataPercent,
+		"metadata_size":    status.MetadataSize,
+		"threshold":        threshold,
+	}).Warn("thin pool metadata is close to exhaustion")
+}
+
+// autoExtendPool extends the data and metadata of the thin pool which are
+// above the threshold, if the volume group has the space for it.
+func (d *Driver) autoExtendPool(ctx context.Context) {
+	policy := d.config.VolumeInformation.PoolAutoExtend
+	log := d.log.WithField("method", "auto_extend_pool")
+
+	status, err := d.thinPool.Status(ctx)
+	if err != nil {
+		log.WithError(err).Error("failed to get thin pool status")
+		return
+	}
+	poolDataPercent.Set(float64(status.DataPercent))
+	poolMetadataPercent.Set(float64(status.MetadataPercent))
+	warnMetadataPercent(log, policy, status)
+
+	threshold := lvm.Percent(policy.Threshold)
+	if threshold == 0 {
+		threshold = DefaultAutoExtendThreshold
+	}
+	var data, metadata lvm.ByteSize
+	if status.DataPercent >= threshold {
+		data = poolIncrement(policy.DataIncrement, status.Size)
+	}
+	if status.MetadataPercent >= threshold {
+		metadata = poolIncrement(policy.MetadataIncrement, status.MetadataSize)
+	}
+	if data == 0 && metadata == 0 {
+		poolVGFull.Set(0)
+		return
+	}
+
+	log = log.WithFields(logrus.Fields{
+		"data_percent":       status.DataPercent,
+		"metadata_percent":   status.MetadataPercent,
+		"data_increment":     data,
+		"metadata_increment": metadata,
+		"vg_free":            status.VGFree,
+	})
+	if data+metadata > status.VGFree {
+		err = lvm.ErrPoolFull
+	} else {
+		err = d.thinPool.ExtendPool(ctx, data, metadata)
+	}
+	if err != nil {
+		poolExtendFailures.Inc()
+		if errors.Is(err, lvm.ErrPoolFull) {
+			poolVGFull.Set(1)
+			log.WithError(err).Error("thin pool is filling up but the volume group has no free space to extend it")
+		} else {
+			log.WithError(err).Error("failed to extend thin pool")
+		}
+		return
+	}
+
+	poolExtensions.Inc()
+	poolVGFull.Set(0)
+	log.Info("thin pool extended")
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+const gib = 1024 * 1024 * 1024
+
+func TestAutoExtendPool(t *testing.T) {
+	thinPool := &fakeThinPool{PoolStatus: lvm.PoolStatus{
+		Size:            10 * gib,
+		DataPercent:     50,
+		MetadataSize:    gib / 8,
+		MetadataPercent: 10,
+		VGFree:          20 * gib,
+	}}
+	d := newTestDriver(thinPool)
+	d.config.VolumeInformation.PoolAutoExtend.DataIncrement = 5 * gib
+	ctx := context.Background()
+	extensions := poolExtensions.Value()
+
+	// Below the threshold nothing is done
+	d.autoExtendPool(ctx)
+	assert.Equal(t, lvm.ByteSize(10*gib), thinPool.PoolStatus.Size)
+	assert.Equal(t, float64(50), poolDataPercent.Value())
+
+	// The pool crosses the threshold and is extended by the increment
+	thinPool.PoolStatus.DataPercent = 90
+	d.autoExtendPool(ctx)
+	assert.Equal(t, lvm.ByteSize(15*gib), thinPool.PoolStatus.Size)
+	assert.Equal(t, lvm.ByteSize(15*gib), thinPool.PoolStatus.VGFree)
+	assert.Equal(t, lvm.ByteSize(gib/8), thinPool.PoolStatus.MetadataSize)
+	assert.Equal(t, extensions+1, poolExtensions.Value())
+	assert.Equal(t, float64(0), poolVGFull.Value())
+
+	// Metadata grows by a fifth without an increment
+	thinPool.PoolStatus.MetadataPercent = 85
+	d.config.VolumeInformation.PoolAutoExtend.Threshold = 70
+	d.autoExtendPool(ctx)
+	assert.Equal(t, lvm.ByteSize(gib/8+gib/40), thinPool.PoolStatus.MetadataSize)
+	assert.Equal(t, lvm.ByteSize(15*gib), thinPool.PoolStatus.Size)
+}
+
+func TestAutoExtendPoolWithFullVolumeGroup(t *testing.T) {
+	thinPool := &fakeThinPool{PoolStatus: lvm.PoolStatus{
+		Size:        10 * gib,
+		DataPercent: 95,
+		VGFree:      gib,
+	}}
+	d := newTestDriver(thinPool)
+	d.config.VolumeInformation.PoolAutoExtend.DataIncrement = 5 * gib
+	failures := poolExtendFailures.Value()
+
+	d.autoExtendPool(context.Background())
+	assert.Equal(t, lvm.ByteSize(10*gib), thinPool.PoolStatus.Size)
+	assert.Equal(t, failures+1, poolExtendFailures.Value())
+	assert.Equal(t, float64(1), poolVGFull.Value())
+}
+
+func TestAutoExtendPoolWarnsAboutMetadata(t *testing.T) {
+	thinPool := &fakeThinPool{PoolStatus: lvm.PoolStatus{
+		Size:            10 * gib,
+		DataPercent:     20,
+		MetadataSize:    gib / 8,
+		MetadataPercent: 50,
+		VGFree:          20 * gib,
+	}}
+	d := newTestDriver(thinPool)
+	hook := test.NewLocal(d.log.Logger)
+	warnings := poolMetadataWarnings.Value()
+
+	// Below the warning threshold nothing is logged
+	d.autoExtendPool(context.Background())
+	assert.Empty(t, hook.AllEntries())
+	assert.Equal(t, warnings, poolMetadataWarnings.Value())
+
+	// The metadata crosses the threshold, the warning fires while the pool
+	// is being extended
+	thinPool.PoolStatus.MetadataPercent = 97.5
+	d.config.VolumeInformation.PoolAutoExtend.MetadataWarningThreshold = 95
+	d.autoExtendPool(context.Background())
+	assert.Equal(t, warnings+1, poolMetadataWarnings.Value())
+	assert.Equal(t, float64(97.5), poolMetadataPercent.Value())
+	var warned bool
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.WarnLevel {
+			warned = true
+			assert.Equal(t, "thin pool metadata is close to exhaustion", entry.Message)
+			assert.Equal(t, lvm.Percent(97.5), entry.Data["metadata_percent"])
+		}
+	}
+	assert.True(t, warned)
+}
+
+func TestPoolMetadataWarningWithoutAutoExtend(t *testing.T) {
+	poolMetadataWarningInterval = 5 * time.Millisecond
+	t.Cleanup(func() { poolMetadataWarningInterval = time.Minute })
+	thinPool := &fakeThinPool{PoolStatus: lvm.PoolStatus{
+		Size:            10 * gib,
+		DataPercent:     20,
+		MetadataSize:    gib / 8,
+		MetadataPercent: 97.5,
+		VGFree:          20 * gib,
+	}}
+	d := newTestDriver(thinPool)
+	hook := test.NewLocal(d.log.Logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Without an autoextend interval the metadata is still checked, but the
+	// pool isn't extended
+	d.startPoolMetadataWarning(ctx)
+	assert.Eventually(t, func() bool {
+		for _, entry := range hook.AllEntries() {
+			if entry.Level == logrus.WarnLevel && entry.Message == "thin pool metadata is close to exhaustion" {
+				return true
+			}
+		}
+		return false
+	}, time.Second, time.Millisecond)
+	cancel()
+	assert.Equal(t, lvm.ByteSize(gib/8), thinPool.PoolStatus.MetadataSize)
+}
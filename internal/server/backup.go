@@ -0,0 +1,306 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"nodeto/restic-csi-plugin/internal/redact"
+	"nodeto/restic-csi-plugin/internal/restic"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+// forgetTagged allows mocking of the removal of a deleted volume's backups.
+var forgetTagged = restic.ForgetTagged
+
+// backupParameter is the StorageClass parameter opting a volume in or out of
+// backups, ie backup: "false" for scratch space.
+const backupParameter = "backup"
+
+// backupLocks serializes the backups of each volume: scheduled, pre-unstage
+// and manual backups all snapshot the volume under the same name. The zero
+// value is ready to use.
+type backupLocks struct {
+	mu    sync.Mutex // protects locks
+	locks map[string]*backupLock
+}
+
+// backupLock is held by the running backup of a volume, waiters counts the
+// backups holding or waiting for it so it's dropped once unused.
+type backupLock struct {
+	held    chan struct{}
+	waiters int
+}
+
+// lock waits until no other backup of the volume runs, or ctx is done. The
+// returned unlock must be called once the backup finished.
+func (l *backupLocks) lock(ctx context.Context, lvName string) (unlock func(), err error) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*backupLock{}
+	}
+	volumeLock, ok := l.locks[lvName]
+	if !ok {
+		volumeLock = &backupLock{held: make(chan struct{}, 1)}
+		l.locks[lvName] = volumeLock
+	}
+	volumeLock.waiters++
+	l.mu.Unlock()
+
+	release := func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if volumeLock.waiters--; volumeLock.waiters == 0 {
+			delete(l.locks, lvName)
+		}
+	}
+	select {
+	case volumeLock.held <- struct{}{}:
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+	return func() {
+		<-volumeLock.held
+		release()
+	}, nil
+}
+
+// backupEnabled reports whether a volume with the given volume context is
+// backed up, falling back to the configured default.
+func (d *Driver) backupEnabled(volumeContext map[string]string) (bool, error) {
+	value, ok := volumeContext[backupParameter]
+	if !ok {
+		return d.config.VolumeInformation.BackupEnabledByDefault(), nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("parameter %s must be true or false, got %q", backupParameter, value)
+	}
+	return enabled, nil
+}
+
+// backupVolume takes a point-in-time backup of the volume. The volume is
+// snapshotted and the snapshot is mounted read-only under the staging path
+// and backed up to each primary destination, then copied to the copy
+// destinations, so the application doesn't need to be quiesced. Volumes that opted out of backups are skipped.
+// A backup waits for the one already running for the volume, if any.
+func (d *Driver) backupVolume(ctx context.Context, volume *lvm.Volume, volumeContext map[string]string) error {
+	snapshotName := volume.LVName + "-backup"
+	mountPath := filepath.Join(d.config.VolumeInformation.StagingPath, "snapshots", snapshotName)
+
+	log := d.log.WithFields(logrus.Fields{
+		"volume_id": d.volumeID(volume.LVName),
+		"snapshot":  snapshotName,
+		"method":    "backup_volume",
+	})
+
+	enabled, err := d.backupEnabled(volumeContext)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		log.Info("backups are disabled for the volume, skipping")
+		return nil
+	}
+	// The snapshot of an encrypted volume is opened with the volume's key.
+	if volume.Encrypted, err = d.encryptionEnabled(volumeContext); err != nil {
+		return err
+	}
+
+	ctx, done, err := d.operations.start(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	unlock, err := d.backupLocks.lock(ctx, volume.LVName)
+	if err != nil {
+		return fmt.Errorf("waiting for the running backup of the volume: %w", err)
+	}
+	defer unlock()
+
+	var snapshotIDs []string
+	backupErr := volume.WithSnapshot(ctx, snapshotName, 0, mountPath, func(ctx context.Context, path string) error {
+		snapshotIDs, err = d.backupToDestinations(ctx, log, path, backupTags(d.volumeID(volume.LVName), volume, volumeContext)...)
+		return err
+	})
+
+	if err := d.recordBackup(d.volumeID(volume.LVName), snapshotIDs, backupErr); err != nil && backupErr == nil {
+		backupErr = err
+	}
+	return backupErr
+}
+
+// backupTags returns the restic tags of the backups of a volume, its ID and
+// the PVC it was provisioned for, so the snapshots of a workload can be found
+// with --tag. The PVC is taken from the volume context, falling back on the
+// LVM tags for backups without the PVC in their context.
+func backupTags(volumeID string, volume *lvm.Volume, volumeContext map[string]string) []string {
+	tags := []string{restic.Tag(volumeIDTag, volumeID)}
+	for _, pvc := range []struct{ tag, parameter string }{
+		{pvcNamespaceTag, pvcNamespaceParameter},
+		{pvcNameTag, pvcNameParameter},
+	} {
+		value, ok := volumeContext[pvc.parameter]
+		if !ok {
+			value, ok = volume.Tags.Value(pvc.tag)
+		}
+		if ok {
+			tags = append(tags, restic.Tag(pvc.tag, value))
+		}
+	}
+	return tags
+}
+
+// pruneVolumeBackups forgets the snapshots of a deleted volume from every
+// destination and prunes their data. Append-only destinations are skipped,
+// their snapshots must be removed elsewhere. A failure is only logged: the
+// volume is gone already and the snapshots can still be forgotten by hand.
+func (d *Driver) pruneVolumeBackups(ctx context.Context, log *logrus.Entry, volumeID string) {
+	tag := restic.Tag(volumeIDTag, volumeID)
+	for _, dest := range d.config.ResticRepo {
+		destLog := log.WithField("repository", redact.URL(dest.Repository))
+		if dest.AppendOnly {
+			destLog.Warn("repository is append-only, the backups of the volume must be removed elsewhere")
+			continue
+		}
+		removed, err := forgetTagged(ctx, dest, tag)
+		if err != nil {
+			destLog.WithError(err).Error("failed to remove the backups of the volume")
+			continue
+		}
+		destLog.WithField("removed", removed).Info("backups of the volume are removed")
+	}
+}
+
+// recordBackup records the outcome of a backup of the volume in its metadata.
+// The snapshot of the first destination backed up to is recorded, even if
+// other destinations failed. Failures are counted until a backup succeeds,
+// see volumeCondition.
+func (d *Driver) recordBackup(volumeID string, snapshotIDs []string, backupErr error) error {
+	volumeMetadata, ok := d.metadata.Get(volumeID)
+	if !ok {
+		return nil
+	}
+	for _, snapshotID := range snapshotIDs {
+		if snapshotID != "" {
+			volumeMetadata.LastSnapshotID = snapshotID
+			break
+		}
+	}
+	if backupErr != nil {
+		volumeMetadata.BackupFailures++
+		volumeMetadata.LastBackupError = redact.URL(backupErr.Error())
+	} else {
+		volumeMetadata.BackupFailures = 0
+		volumeMetadata.LastBackupError = ""
+	}
+	return d.metadata.Put(volumeID, volumeMetadata)
+}
+
+// DefaultBackupParallelism is how many destinations a volume is backed up to
+// at once when the configuration doesn't set backup_parallelism.
+const DefaultBackupParallelism = 2
+
+// destinationError is the failure of a backup to one destination.
+type destinationError struct {
+	repository string
+	err        error
+}
+
+// backupError reports the destinations a backup failed for, the backups to
+// the other destinations succeeded.
+type backupError struct {
+	failed []destinationError
+	total  int
+}
+
+func (e *backupError) Error() string {
+	failures := make([]string, len(e.failed))
+	for i, failure := range e.failed {
+		failures[i] = fmt.Sprintf("%s: %v", redact.URL(failure.repository), failure.err)
+	}
+	return fmt.Sprintf("backup failed for %d of %d destinations: %s", len(e.failed), e.total, strings.Join(failures, "; "))
+}
+
+// backupToDestinations backs up path to every primary destination, tagged
+// with tags, concurrently up to the configured parallelism, then copies each
+// primary's snapshot to the copy destinations of successful primaries. A
+// failing destination doesn't stop the others. The snapshot IDs are returned
+// in the order of the destinations, with an empty ID for failed and copy
+// destinations.
+func (d *Driver) backupToDestinations(ctx context.Context, log *logrus.Entry, path string, tags ...string) ([]string, error) {
+	parallelism := d.config.BackupParallelism
+	if parallelism <= 0 {
+		parallelism = DefaultBackupParallelism
+	}
+
+	snapshotIDs := make([]string, len(d.config.ResticRepo))
+	errs := make([]error, len(d.config.ResticRepo))
+	forEach := func(copies bool, fn func(i int, dest config.Destination) error) {
+		var eg errgroup.Group
+		eg.SetLimit(parallelism)
+		for i, dest := range d.config.ResticRepo {
+			i, dest := i, dest
+			if dest.IsCopy() != copies {
+				continue
+			}
+			eg.Go(func() error {
+				errs[i] = fn(i, dest)
+				if errs[i] != nil {
+					log.WithError(errs[i]).WithField("repository", redact.URL(dest.Repository)).Error("backup to destination failed")
+				}
+				return nil
+			})
+		}
+		eg.Wait()
+	}
+
+	forEach(false, func(i int, dest config.Destination) (err error) {
+		snapshotIDs[i], err = restic.Backup(ctx, dest, path, tags...)
+		if err == nil {
+			log.WithFields(logrus.Fields{
+				"repository":  redact.URL(dest.Repository),
+				"snapshot_id": snapshotIDs[i],
+			}).Info("volume backed up")
+		}
+		return err
+	})
+	forEach(true, func(i int, dest config.Destination) error {
+		source, ok := d.config.CopySource(dest)
+		if !ok {
+			return errors.New("no primary destination to copy from")
+		}
+		from := d.config.ResticRepo[source]
+		if errs[source] != nil {
+			return fmt.Errorf("not copied, backup to %s failed", redact.URL(from.Repository))
+		}
+		if err := restic.Copy(ctx, from, dest, snapshotIDs[source]); err != nil {
+			return err
+		}
+		log.WithFields(logrus.Fields{
+			"repository":  redact.URL(dest.Repository),
+			"snapshot_id": snapshotIDs[source],
+		}).Info("snapshot copied")
+		return nil
+	})
+
+	var failed []destinationError
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, destinationError{repository: d.config.ResticRepo[i].Repository, err: err})
+		}
+	}
+	if len(failed) > 0 {
+		return snapshotIDs, &backupError{failed: failed, total: len(errs)}
+	}
+	return snapshotIDs, nil
+}
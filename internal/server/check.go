@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/redact"
+	"nodeto/restic-csi-plugin/internal/restic"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// startChecks checks the integrity of every destination with a check interval
+// on that interval, until the context is cancelled.
+func (d *Driver) startChecks(ctx context.Context) {
+	for _, dest := range d.config.ResticRepo {
+		if dest.Check.Interval <= 0 {
+			continue
+		}
+		dest := dest
+		d.operations.runDetached(ctx, dest.Check.Interval, func(ctx context.Context, now time.Time) {
+			d.checkRepository(ctx, dest)
+		})
+	}
+}
+
+// checkRepository runs restic check against the destination, a locked
+// repository is left for the next run.
+func (d *Driver) checkRepository(ctx context.Context, dest config.Destination) {
+	log := d.log.WithFields(logrus.Fields{
+		"repository": redact.URL(dest.Repository),
+		"method":     "check_repository",
+	})
+
+	ctx, done, err := d.operations.start(ctx)
+	if err != nil {
+		log.WithError(err).Info("skipping check")
+		return
+	}
+	defer done()
+
+	err = restic.Check(ctx, dest, dest.Check.ReadData)
+	if errors.Is(err, restic.ErrRepositoryLocked) {
+		log.WithError(err).Warn("repository is locked, check will be retried")
+	} else if err != nil {
+		log.WithError(err).Error("repository check failed")
+	}
+}
+
+// ValidateDestinations checks that every destination can be opened with its
+// credentials, so a wrong password or unreachable repository fails the start
+// of the driver rather than its first backup. Every destination is checked,
+// the error names each of those which failed.
+func (d *Driver) ValidateDestinations(ctx context.Context) error {
+	var failures []string
+	for i, dest := range d.config.ResticRepo {
+		log := d.log.WithField("repository", redact.URL(dest.Repository))
+		if err := restic.Validate(ctx, dest); err != nil {
+			log.WithError(err).Error("destination failed validation")
+			failures = append(failures, fmt.Sprintf("destination %d (%s): %v", i+1, redact.URL(dest.Repository), err))
+			continue
+		}
+		log.Info("destination validated")
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d destinations failed validation: %s", len(failures), len(d.config.ResticRepo), strings.Join(failures, "; "))
+	}
+	return nil
+}
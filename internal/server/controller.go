@@ -0,0 +1,624 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"nodeto/restic-csi-plugin/internal/metadata"
+	"nodeto/restic-csi-plugin/internal/restic"
+	"strconv"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultVolumeSize is used when the request has no required capacity.
+const defaultVolumeSize lvm.ByteSize = 1024 * 1024 * 1024
+
+// criticalDataPercent is the data usage at which a volume is reported as abnormal.
+const criticalDataPercent lvm.Percent = 90
+
+// backupFailureThreshold is the number of consecutive failed backups at which
+// a volume is reported as abnormal.
+const backupFailureThreshold = 3
+
+// supportedAccessModes are the access modes of volumes local to a single node.
+var supportedAccessModes = map[csi.VolumeCapability_AccessMode_Mode]bool{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:      true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY: true,
+}
+
+// validateCapability returns why the capability isn't supported, or an empty
+// string if it is.
+func validateCapability(capability *csi.VolumeCapability) string {
+	mode := capability.GetAccessMode().GetMode()
+	if !supportedAccessModes[mode] {
+		return "access mode " + mode.String() + " is not supported, thin volumes are local to a single node and only support SINGLE_NODE_WRITER and SINGLE_NODE_READER_ONLY"
+	}
+	return ""
+}
+
+// blockRequested reports whether the capabilities ask for a raw block volume,
+// a volume can't be both a block device and a filesystem.
+func blockRequested(capabilities []*csi.VolumeCapability) (bool, error) {
+	block, mount := false, false
+	for _, capability := range capabilities {
+		if capability.GetBlock() != nil {
+			block = true
+		} else {
+			mount = true
+		}
+	}
+	if block && mount {
+		return false, errors.New("a volume can't have both block and mount capabilities")
+	}
+	return block, nil
+}
+
+// topologyKey returns the configured topology segment key.
+func (d *Driver) topologyKey() string {
+	if d.config.VolumeInformation.TopologyKey != "" {
+		return d.config.VolumeInformation.TopologyKey
+	}
+	return DefaultTopologyKey
+}
+
+// topology returns the topology of this node, volumes are only accessible
+// from the node owning the thin pool.
+func (d *Driver) topology() *csi.Topology {
+	return &csi.Topology{
+		Segments: map[string]string{d.topologyKey(): d.hostID},
+	}
+}
+
+// isAccessible checks whether this node satisfies the requisite topology of
+// the request, if any.
+func (d *Driver) isAccessible(requirements *csi.TopologyRequirement) bool {
+	if len(requirements.GetRequisite()) == 0 {
+		return true
+	}
+	for _, topology := range requirements.GetRequisite() {
+		if topology.GetSegments()[d.topologyKey()] == d.hostID {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateVolume creates a new volume from the given request. With a volume
+// content source the source volume is cloned, with a snapshot content source
+// the restic snapshot is restored into the new volume. The function is
+// idempotent.
+func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateVolume Name must be provided")
+	}
+
+	if len(req.VolumeCapabilities) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "CreateVolume Volume capabilities must be provided")
+	}
+
+	for _, capability := range req.VolumeCapabilities {
+		if message := validateCapability(capability); message != "" {
+			return nil, status.Error(codes.InvalidArgument, message)
+		}
+	}
+
+	block, err := blockRequested(req.VolumeCapabilities)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if !d.isAccessible(req.AccessibilityRequirements) {
+		return nil, status.Errorf(codes.ResourceExhausted, "volumes can only be created on node %s", d.hostID)
+	}
+
+	required := lvm.ByteSize(req.CapacityRange.GetRequiredBytes())
+	limit := lvm.ByteSize(req.CapacityRange.GetLimitBytes())
+	if required < 0 || limit < 0 {
+		return nil, status.Error(codes.InvalidArgument, "CreateVolume Capacity range must not be negative")
+	}
+	if limit != 0 && limit < required {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume Limit bytes %d is less than required bytes %d", limit, required)
+	}
+
+	size := required
+	if size == 0 {
+		size = defaultVolumeSize
+		if limit != 0 && limit < size {
+			size = limit
+		}
+	}
+
+	// A clone is at least as large as its source.
+	var source *lvm.Volume
+	if sourceVolume := req.VolumeContentSource.GetVolume(); sourceVolume != nil {
+		source = d.thinPool.GetVolume(ctx, d.lvName(sourceVolume.VolumeId))
+		if source == nil {
+			return nil, status.Errorf(codes.NotFound, "source volume %q not found", sourceVolume.VolumeId)
+		}
+		if required == 0 && size < source.LVSize {
+			size = source.LVSize
+		}
+		if size < source.LVSize || (limit != 0 && limit < source.LVSize) {
+			return nil, status.Errorf(codes.OutOfRange, "CreateVolume size %d is smaller than the %d bytes of source volume %q", size, source.LVSize, sourceVolume.VolumeId)
+		}
+		if sourceMetadata, _ := d.metadata.Get(sourceVolume.VolumeId); sourceMetadata.Block != block {
+			return nil, status.Errorf(codes.InvalidArgument, "CreateVolume source volume %q must have the same access type as the clone", sourceVolume.VolumeId)
+		}
+	}
+
+	// A volume restored from a snapshot is created from the restic snapshot.
+	var snapshot *restic.Snapshot
+	var snapshotDest config.Destination
+	if sourceSnapshot := req.VolumeContentSource.GetSnapshot(); sourceSnapshot != nil {
+		// Snapshots are restored file by file.
+		if block {
+			return nil, status.Error(codes.InvalidArgument, "CreateVolume can't restore a snapshot into a block volume")
+		}
+		var err error
+		if snapshotDest, err = d.snapshotDestination(); err != nil {
+			return nil, err
+		}
+		if snapshot, err = findSnapshot(ctx, snapshotDest, sourceSnapshot.SnapshotId); err != nil {
+			return nil, err
+		}
+	}
+
+	log := d.log.WithFields(logrus.Fields{
+		"volume_name": req.Name,
+		"size":        size,
+		"method":      "create_volume",
+	})
+	log.Info("create volume called")
+
+	// Record the backup decision so it doesn't change with the default.
+	// Backups are taken of the filesystem, block volumes have none.
+	backup, err := d.backupEnabled(req.Parameters)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if block {
+		backup = false
+	}
+	if _, err := d.discardEnabled(req.Parameters); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if value, ok := req.Parameters[backupIntervalParameter]; ok {
+		if _, err := parseBackupInterval(value); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	backupOnUnstage, err := parseBackupOnUnstage(req.Parameters)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := mountDirMode(req.Parameters); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	encrypted, err := d.encryptionEnabled(req.Parameters)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// A clone holds the LUKS device of its source, if any.
+	if source != nil {
+		sourceMetadata, _ := d.metadata.Get(req.VolumeContentSource.GetVolume().VolumeId)
+		encrypted = sourceMetadata.Encrypted
+	}
+	if block && encrypted {
+		return nil, status.Error(codes.InvalidArgument, "CreateVolume block volumes can't be encrypted")
+	}
+	volumeContext := map[string]string{}
+	for key, value := range req.Parameters {
+		volumeContext[key] = value
+	}
+	volumeContext[backupParameter] = strconv.FormatBool(backup)
+	volumeContext[encryptedParameter] = strconv.FormatBool(encrypted)
+
+	// A retried request succeeds as long as the existing volume fits the
+	// requested capacity range.
+	lvName := d.lvName(req.Name)
+	log = log.WithField("lv_name", lvName)
+	volume := d.thinPool.GetVolume(ctx, lvName)
+	if volume != nil {
+		if volume.LVSize < required || (limit != 0 && volume.LVSize > limit) {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %q already exists with an incompatible size of %d bytes", req.Name, volume.LVSize)
+		}
+		log.Info("volume already exists")
+	} else {
+		if err := d.poolFullError(); err != nil {
+			return nil, err
+		}
+		tags := volumeTags(req.Name, req.Parameters)
+		switch {
+		case source != nil:
+			err = lvmError(d.thinPool.CloneVolume(ctx, source.LVName, lvName, size, encrypted, block, tags...))
+		case snapshot != nil:
+			err = d.restoreVolume(ctx, log, lvName, size, encrypted, tags, snapshotDest, snapshot)
+		case block:
+			err = lvmError(d.thinPool.EnsureBlockVolumeIsPresent(ctx, lvName, size, tags...))
+		case encrypted:
+			err = lvmError(d.thinPool.EnsureEncryptedVolumeIsPresent(ctx, lvName, size, tags...))
+		default:
+			err = lvmError(d.thinPool.EnsureVolumeIsPresent(ctx, lvName, size, tags...))
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		volume = d.thinPool.GetVolume(ctx, lvName)
+		if volume == nil {
+			return nil, status.Errorf(codes.Internal, "volume %q was not found after creation", req.Name)
+		}
+	}
+
+	if _, ok := d.metadata.Get(req.Name); !ok {
+		volumeMetadata := metadata.Volume{FsType: lvm.DefaultFsType, Backup: backup, Encrypted: encrypted, Block: block, BackupInterval: req.Parameters[backupIntervalParameter], BackupOnUnstage: backupOnUnstage}
+		if block {
+			volumeMetadata.FsType = ""
+		}
+		if lvName != req.Name {
+			volumeMetadata.LVName = lvName
+		}
+		if err := d.metadata.Put(req.Name, volumeMetadata); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to record metadata of volume %q: %v", req.Name, err)
+		}
+	}
+
+	log.Info("volume created")
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:           req.Name,
+			CapacityBytes:      int64(volume.LVSize),
+			VolumeContext:      volumeContext,
+			ContentSource:      req.VolumeContentSource,
+			AccessibleTopology: []*csi.Topology{d.topology()},
+		},
+	}, nil
+}
+
+// DeleteVolume deletes the given volume. The function is idempotent.
+func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "DeleteVolume Volume ID must be provided")
+	}
+
+	log := d.log.WithFields(logrus.Fields{
+		"volume_id": req.VolumeId,
+		"method":    "delete_volume",
+	})
+	log.Info("delete volume called")
+
+	// A volume removed since it was looked up is already deleted.
+	if err := d.thinPool.EnsureVolumeIsAbsent(ctx, d.lvName(req.VolumeId)); err != nil && !errors.Is(err, lvm.ErrVolumeNotFound) {
+		return nil, lvmError(err)
+	}
+	if err := d.metadata.Delete(req.VolumeId); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to remove metadata of volume %q: %v", req.VolumeId, err)
+	}
+	if d.config.VolumeInformation.PruneBackupsOnDelete {
+		d.pruneVolumeBackups(ctx, log, req.VolumeId)
+	}
+
+	log.Info("volume is deleted")
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// ControllerPublishVolume attaches the given volume to the node. Volumes are
+// local to the node of their thin pool so there is nothing to attach, only
+// the node is checked to own the volume.
+func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Volume ID must be provided")
+	}
+	if req.NodeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Node ID must be provided")
+	}
+	if req.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Volume Capability must be provided")
+	}
+	if message := validateCapability(req.VolumeCapability); message != "" {
+		return nil, status.Error(codes.InvalidArgument, message)
+	}
+
+	log := d.log.WithFields(logrus.Fields{
+		"volume_id": req.VolumeId,
+		"node_id":   req.NodeId,
+		"method":    "controller_publish_volume",
+	})
+	log.Info("controller publish volume called")
+
+	lvName := d.lvName(req.VolumeId)
+	if volume := d.thinPool.GetVolume(ctx, lvName); volume == nil {
+		return nil, status.Errorf(codes.NotFound, "volume %q does not exist", req.VolumeId)
+	}
+	if req.NodeId != d.hostID {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %q is in the thin pool of node %q, it can't be published to node %q", req.VolumeId, d.hostID, req.NodeId)
+	}
+
+	log.Info("volume is published")
+	return &csi.ControllerPublishVolumeResponse{
+		PublishContext: map[string]string{d.publishInfoVolumeName: lvName},
+	}, nil
+}
+
+// ControllerUnpublishVolume detaches the given volume from the node. Like
+// ControllerPublishVolume there is nothing to detach, only the node is checked
+// to be the one of the thin pool. Without a node the volume is unpublished
+// from every node, and a volume that doesn't exist is already unpublished.
+func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerUnpublishVolume Volume ID must be provided")
+	}
+	if req.NodeId != "" && req.NodeId != d.hostID {
+		return nil, status.Errorf(codes.NotFound, "node %q not found, volumes are only published to node %q", req.NodeId, d.hostID)
+	}
+
+	d.log.WithFields(logrus.Fields{
+		"volume_id": req.VolumeId,
+		"node_id":   req.NodeId,
+		"method":    "controller_unpublish_volume",
+	}).Debug("volume is unpublished")
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+// ValidateVolumeCapabilities checks whether the volume capabilities requested
+// are supported.
+func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ValidateVolumeCapabilities Volume ID must be provided")
+	}
+
+	if len(req.VolumeCapabilities) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ValidateVolumeCapabilities Volume Capabilities must be provided")
+	}
+
+	log := d.log.WithFields(logrus.Fields{
+		"volume_id":              req.VolumeId,
+		"supported_capabilities": req.VolumeCapabilities,
+		"method":                 "validate_volume_capabilities",
+	})
+	log.Info("validate volume capabilities called")
+
+	if volume := d.thinPool.GetVolume(ctx, d.lvName(req.VolumeId)); volume == nil {
+		return nil, status.Errorf(codes.NotFound, "volume %q does not exist", req.VolumeId)
+	}
+
+	volumeMetadata, recorded := d.metadata.Get(req.VolumeId)
+	for _, capability := range req.VolumeCapabilities {
+		message := validateCapability(capability)
+		if message == "" && recorded && volumeMetadata.Block != (capability.GetBlock() != nil) {
+			message = "the access type doesn't match the volume, block volumes have no filesystem to mount and others can't be used as block devices"
+		}
+		if message != "" {
+			log.WithField("reason", message).Info("volume capabilities not supported")
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: message}, nil
+		}
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.VolumeContext,
+			VolumeCapabilities: req.VolumeCapabilities,
+			Parameters:         req.Parameters,
+		},
+	}, nil
+}
+
+// paginate returns the range of entries of a page and the token of the next
+// page, if any. Tokens are the index of the first entry of the page.
+func paginate(total int, maxEntries int32, startingToken string) (start int, end int, nextToken string, err error) {
+	if startingToken != "" {
+		start, err = strconv.Atoi(startingToken)
+		if err != nil || start < 0 || start > total {
+			return 0, 0, "", status.Errorf(codes.Aborted, "invalid starting token %q", startingToken)
+		}
+	}
+
+	end = total
+	if maxEntries > 0 && start+int(maxEntries) < end {
+		end = start + int(maxEntries)
+	}
+	if end < total {
+		nextToken = strconv.Itoa(end)
+	}
+	return start, end, nextToken, nil
+}
+
+// ListVolumes returns a list of all requested volumes. The starting token is
+// an index into the volumes sorted by name.
+func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if req.MaxEntries < 0 {
+		return nil, status.Error(codes.InvalidArgument, "ListVolumes Max entries must not be negative")
+	}
+
+	log := d.log.WithFields(logrus.Fields{
+		"max_entries":    req.MaxEntries,
+		"starting_token": req.StartingToken,
+		"method":         "list_volumes",
+	})
+	log.Info("list volumes called")
+
+	volumes := d.thinPool.ListVolumes(ctx)
+	start, end, nextToken, err := paginate(len(volumes), req.MaxEntries, req.StartingToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*csi.ListVolumesResponse_Entry
+	for _, volume := range volumes[start:end] {
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:           d.volumeID(volume.LVName),
+				CapacityBytes:      int64(volume.LVSize),
+				AccessibleTopology: []*csi.Topology{d.topology()},
+			},
+		})
+	}
+
+	log.WithField("entries", len(entries)).Info("volumes listed")
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+// GetCapacity returns the capacity of the storage pool
+func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "GetCapacity is not supported")
+}
+
+// ControllerGetCapabilities returns the capabilities of the controller service.
+func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	newCap := func(cap csi.ControllerServiceCapability_RPC_Type) *csi.ControllerServiceCapability {
+		return &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: cap,
+				},
+			},
+		}
+	}
+
+	caps := []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+	}
+	if d.resticSnapshots() {
+		caps = append(caps,
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		)
+	}
+
+	var cscaps []*csi.ControllerServiceCapability
+	for _, cap := range caps {
+		cscaps = append(cscaps, newCap(cap))
+	}
+
+	d.log.WithFields(logrus.Fields{
+		"controller_capabilities": cscaps,
+		"method":                  "controller_get_capabilities",
+	}).Info("controller get capabilities called")
+	return &csi.ControllerGetCapabilitiesResponse{
+		Capabilities: cscaps,
+	}, nil
+}
+
+// ControllerExpandVolume is called from the resizer to increase the volume size.
+// Volumes can't be shrunk.
+func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume Volume ID must be provided")
+	}
+
+	size := lvm.ByteSize(req.CapacityRange.GetRequiredBytes())
+	if size == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume Capacity range must be provided")
+	}
+
+	log := d.log.WithFields(logrus.Fields{
+		"volume_id": req.VolumeId,
+		"size":      size,
+		"method":    "controller_expand_volume",
+	})
+	log.Info("controller expand volume called")
+
+	lvName := d.lvName(req.VolumeId)
+	volume := d.thinPool.GetVolume(ctx, lvName)
+	if volume == nil {
+		return nil, status.Errorf(codes.NotFound, "volume %q not found", req.VolumeId)
+	}
+	if size < volume.LVSize {
+		return nil, status.Errorf(codes.OutOfRange, "volume %q is %d bytes and can't be shrunk to %d bytes", req.VolumeId, volume.LVSize, size)
+	}
+
+	// The LUKS device of an encrypted volume is grown with it, block volumes
+	// have no filesystem to grow, neither here nor on the node.
+	expand := d.thinPool.EnsureVolumeIsPresent
+	volumeMetadata, ok := d.metadata.Get(req.VolumeId)
+	if ok && volumeMetadata.Encrypted {
+		expand = d.thinPool.EnsureEncryptedVolumeIsPresent
+	} else if ok && volumeMetadata.Block {
+		expand = d.thinPool.EnsureBlockVolumeIsPresent
+	}
+	if err := expand(ctx, lvName, size); err != nil {
+		return nil, lvmError(err)
+	}
+
+	volume = d.thinPool.GetVolume(ctx, lvName)
+	if volume == nil {
+		return nil, status.Errorf(codes.Internal, "volume %q was not found after expansion", req.VolumeId)
+	}
+
+	log.Info("volume expanded")
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         int64(volume.LVSize),
+		NodeExpansionRequired: !volumeMetadata.Block,
+	}, nil
+}
+
+// ControllerGetVolume gets a specific volume with its capacity and condition.
+func (d *Driver) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerGetVolume Volume ID must be provided")
+	}
+
+	d.log.WithFields(logrus.Fields{
+		"volume_id": req.VolumeId,
+		"method":    "controller_get_volume",
+	}).Info("controller get volume called")
+
+	volume := d.thinPool.GetVolume(ctx, d.lvName(req.VolumeId))
+	if volume == nil {
+		return nil, status.Errorf(codes.NotFound, "volume %q not found", req.VolumeId)
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:           d.volumeID(volume.LVName),
+			CapacityBytes:      int64(volume.LVSize),
+			AccessibleTopology: []*csi.Topology{d.topology()},
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			VolumeCondition: d.volumeCondition(volume),
+		},
+	}, nil
+}
+
+// volumeCondition reports a volume as abnormal once its data usage reaches
+// criticalDataPercent, writes fail when it fills up, or once
+// backupFailureThreshold backups in a row failed. The next successful backup
+// clears the latter.
+func (d *Driver) volumeCondition(volume *lvm.Volume) *csi.VolumeCondition {
+	if volume.DataPercent >= criticalDataPercent {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("volume data usage is at %.2f%%", float64(volume.DataPercent)),
+		}
+	}
+	if volumeMetadata, ok := d.metadata.Get(d.volumeID(volume.LVName)); ok && volumeMetadata.BackupFailures >= backupFailureThreshold {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  "backups failing: " + volumeMetadata.LastBackupError,
+		}
+	}
+	return &csi.VolumeCondition{
+		Abnormal: false,
+		Message:  "volume is healthy",
+	}
+}
+
+// ControllerModifyVolume modifies the mutable parameters of a volume.
+func (d *Driver) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "ControllerModifyVolume is not supported")
+}
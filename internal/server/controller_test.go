@@ -0,0 +1,604 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"nodeto/restic-csi-plugin/internal/metadata"
+	"nodeto/restic-csi-plugin/internal/restic"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func mountCapability(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "xfs"}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func blockCapability(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "test-volume", LVSize: 1024 * 1024 * 1024}}})
+	ctx := context.Background()
+
+	// Supported access mode
+	resp, err := d.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "test-volume",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, resp.Confirmed)
+	assert.Len(t, resp.Confirmed.VolumeCapabilities, 1)
+
+	// Unsupported access mode
+	resp, err = d.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "test-volume",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, resp.Confirmed)
+	assert.Contains(t, resp.Message, "MULTI_NODE_MULTI_WRITER")
+
+	// Unknown volume
+	_, err = d.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "missing-volume",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// Missing capabilities
+	_, err = d.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{VolumeId: "test-volume"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestCreateVolumeRejectsMultiNodeAccessModes(t *testing.T) {
+	thinPool := &fakeThinPool{}
+	d := newTestDriver(thinPool)
+	ctx := context.Background()
+
+	for _, mode := range []csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+	} {
+		_, err := d.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "test-volume",
+			VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER), mountCapability(mode)},
+		})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.Contains(t, status.Convert(err).Message(), mode.String()+" is not supported")
+		assert.Contains(t, status.Convert(err).Message(), "only support SINGLE_NODE_WRITER and SINGLE_NODE_READER_ONLY")
+	}
+	assert.Empty(t, thinPool.Volumes)
+
+	_, err := d.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "test-volume",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY)},
+	})
+	assert.Nil(t, err)
+}
+
+func TestControllerPublishVolume(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "test-volume"}}})
+	d.publishInfoVolumeName = DefaultDriverName + "/volume-name"
+	ctx := context.Background()
+	capability := mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+
+	resp, err := d.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: "test-volume", NodeId: "test-node", VolumeCapability: capability})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{DefaultDriverName + "/volume-name": "test-volume"}, resp.PublishContext)
+
+	_, err = d.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: "missing-volume", NodeId: "test-node", VolumeCapability: capability})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = d.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: "test-volume", NodeId: "test-node"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestControllerPublishVolumeRejectsOtherNodes(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "test-volume"}}})
+	ctx := context.Background()
+
+	// The volume is in the thin pool of test-node
+	_, err := d.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "test-volume",
+		NodeId:           "other-node",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Only this node's volumes are unpublished
+	_, err = d.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: "test-volume", NodeId: "other-node"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	for _, nodeID := range []string{"test-node", ""} {
+		_, err = d.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: "test-volume", NodeId: nodeID})
+		assert.Nil(t, err)
+	}
+
+	_, err = d.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{NodeId: "test-node"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestCreateVolumeTopology(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{})
+	ctx := context.Background()
+
+	resp, err := d.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "test-volume",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1024 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "test-volume", resp.Volume.VolumeId)
+	assert.Equal(t, int64(1024*1024*1024), resp.Volume.CapacityBytes)
+	assert.Equal(t, []*csi.Topology{{Segments: map[string]string{DefaultTopologyKey: "test-node"}}}, resp.Volume.AccessibleTopology)
+
+	// Another node's topology can't be satisfied here
+	_, err = d.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "other-volume",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{{Segments: map[string]string{DefaultTopologyKey: "other-node"}}},
+		},
+	})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestDeleteVolume(t *testing.T) {
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "test-volume"}}}
+	d := newTestDriver(thinPool)
+
+	_, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "test-volume"})
+	assert.Nil(t, err)
+	assert.Len(t, thinPool.Volumes, 0)
+
+	// Deleting again succeeds
+	_, err = d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "test-volume"})
+	assert.Nil(t, err)
+}
+
+// mockForgetTagged records the destinations and tags of the removed backups.
+func mockForgetTagged(t *testing.T) *[]string {
+	var forgotten []string
+	forgetTagged = func(ctx context.Context, dest config.Destination, tags ...string) (int, error) {
+		forgotten = append(forgotten, dest.Repository+" "+strings.Join(tags, ","))
+		return 1, nil
+	}
+	t.Cleanup(func() { forgetTagged = restic.ForgetTagged })
+	return &forgotten
+}
+
+func TestDeleteVolumePrunesBackups(t *testing.T) {
+	forgotten := mockForgetTagged(t)
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "test-volume"}}}
+	d := newTestDriver(thinPool)
+	d.config.ResticRepo = []config.Destination{
+		{Repository: "/mnt/backup/restic"},
+		{Repository: "sftp:offsite:/srv/restic", AppendOnly: true},
+		{Repository: "s3:s3.example.com/restic", Role: config.RoleCopy},
+	}
+
+	// Nothing is removed unless enabled
+	_, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "test-volume"})
+	assert.Nil(t, err)
+	assert.Empty(t, *forgotten)
+
+	// The append-only destination is skipped
+	d.config.VolumeInformation.PruneBackupsOnDelete = true
+	_, err = d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "test-volume"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"/mnt/backup/restic csi-volume-id=test-volume",
+		"s3:s3.example.com/restic csi-volume-id=test-volume",
+	}, *forgotten)
+}
+
+func TestLVMErrorCodes(t *testing.T) {
+	tests := []struct {
+		err  error
+		code codes.Code
+	}{
+		{fmt.Errorf("failed to remove volume: %w", lvm.ErrVolumeNotFound), codes.NotFound},
+		{fmt.Errorf("failed to create volume: %w", lvm.ErrPoolFull), codes.ResourceExhausted},
+		{fmt.Errorf("failed to remove volume: %w", lvm.ErrDeviceBusy), codes.Aborted},
+		{fmt.Errorf("failed to create filesystem: %w", lvm.ErrMkfsTimeout), codes.DeadlineExceeded},
+		{errors.New("something else"), codes.Internal},
+		{status.Error(codes.InvalidArgument, "invalid name"), codes.InvalidArgument},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.code, status.Code(lvmError(test.err)), test.err.Error())
+	}
+}
+
+func TestCreateVolumePoolFull(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{Err: fmt.Errorf("failed to create volume: %w", lvm.ErrPoolFull)})
+
+	_, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "test-volume",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestDeleteVolumeErrors(t *testing.T) {
+	thinPool := &fakeThinPool{Err: fmt.Errorf("failed to remove volume: %w", lvm.ErrDeviceBusy)}
+	d := newTestDriver(thinPool)
+
+	_, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "test-volume"})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	// A volume that disappeared in the meantime is deleted
+	thinPool.Err = fmt.Errorf("failed to remove volume: %w", lvm.ErrVolumeNotFound)
+	_, err = d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "test-volume"})
+	assert.Nil(t, err)
+}
+
+func TestControllerExpandVolume(t *testing.T) {
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "test-volume", LVSize: 1024 * 1024 * 1024}}}
+	d := newTestDriver(thinPool)
+	ctx := context.Background()
+
+	resp, err := d.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      "test-volume",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 2 * 1024 * 1024 * 1024},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2*1024*1024*1024), resp.CapacityBytes)
+	assert.True(t, resp.NodeExpansionRequired)
+	assert.Equal(t, lvm.ByteSize(2*1024*1024*1024), thinPool.Volumes[0].LVSize)
+
+	// Shrinking is rejected
+	_, err = d.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      "test-volume",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024 * 1024},
+	})
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+	assert.Equal(t, lvm.ByteSize(2*1024*1024*1024), thinPool.Volumes[0].LVSize)
+
+	// Unknown volumes aren't created
+	_, err = d.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      "other-volume",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024 * 1024},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Len(t, thinPool.Volumes, 1)
+
+	// Block volumes have no filesystem for the node to grow
+	thinPool.Volumes = append(thinPool.Volumes, lvm.Volume{VGName: "vg0", LVName: "block-volume", LVSize: 1024 * 1024 * 1024})
+	assert.Nil(t, d.metadata.Put("block-volume", metadata.Volume{Block: true}))
+	resp, err = d.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      "block-volume",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 2 * 1024 * 1024 * 1024},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2*1024*1024*1024), resp.CapacityBytes)
+	assert.False(t, resp.NodeExpansionRequired)
+	assert.Equal(t, []string{"block-volume"}, thinPool.Block)
+}
+
+func TestListVolumesPagination(t *testing.T) {
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{
+		{VGName: "vg0", LVName: "volume-c", LVSize: 3},
+		{VGName: "vg0", LVName: "volume-a", LVSize: 1},
+		{VGName: "vg0", LVName: "volume-b", LVSize: 2},
+	}}
+	d := newTestDriver(thinPool)
+	ctx := context.Background()
+
+	var ids []string
+	var sizes []int64
+	token := ""
+	pages := 0
+	for {
+		resp, err := d.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: token})
+		assert.Nil(t, err)
+		assert.LessOrEqual(t, len(resp.Entries), 2)
+		for _, entry := range resp.Entries {
+			ids = append(ids, entry.Volume.VolumeId)
+			sizes = append(sizes, entry.Volume.CapacityBytes)
+		}
+		pages++
+		token = resp.NextToken
+		if token == "" {
+			break
+		}
+	}
+	assert.Equal(t, 2, pages)
+	assert.Equal(t, []string{"volume-a", "volume-b", "volume-c"}, ids)
+	assert.Equal(t, []int64{1, 2, 3}, sizes)
+
+	// Without a limit everything is returned at once
+	resp, err := d.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	assert.Nil(t, err)
+	assert.Len(t, resp.Entries, 3)
+	assert.Equal(t, "", resp.NextToken)
+}
+
+func TestListVolumesInvalidToken(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "volume-a"}}})
+
+	for _, token := range []string{"not-a-number", "-1", "2"} {
+		_, err := d.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: token})
+		assert.Equal(t, codes.Aborted, status.Code(err), token)
+	}
+}
+
+func TestControllerGetVolume(t *testing.T) {
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{
+		{VGName: "vg0", LVName: "healthy-volume", LVSize: 1024, DataPercent: 12.5},
+		{VGName: "vg0", LVName: "full-volume", LVSize: 2048, DataPercent: 97.25},
+	}}
+	d := newTestDriver(thinPool)
+	ctx := context.Background()
+
+	resp, err := d.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "healthy-volume"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1024), resp.Volume.CapacityBytes)
+	assert.False(t, resp.Status.VolumeCondition.Abnormal)
+
+	resp, err = d.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "full-volume"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2048), resp.Volume.CapacityBytes)
+	assert.True(t, resp.Status.VolumeCondition.Abnormal)
+	assert.Contains(t, resp.Status.VolumeCondition.Message, "97.25%")
+
+	_, err = d.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "other-volume"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestCreateVolumeRetry(t *testing.T) {
+	thinPool := &fakeThinPool{}
+	d := newTestDriver(thinPool)
+	ctx := context.Background()
+	request := func(capacity *csi.CapacityRange) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:               "test-volume",
+			CapacityRange:      capacity,
+			VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		}
+	}
+
+	_, err := d.CreateVolume(ctx, request(&csi.CapacityRange{RequiredBytes: 2 * 1024 * 1024 * 1024}))
+	assert.Nil(t, err)
+
+	// Retrying with a compatible range returns the existing volume
+	resp, err := d.CreateVolume(ctx, request(&csi.CapacityRange{RequiredBytes: 1024 * 1024 * 1024, LimitBytes: 4 * 1024 * 1024 * 1024}))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2*1024*1024*1024), resp.Volume.CapacityBytes)
+	assert.Len(t, thinPool.Volumes, 1)
+
+	// Neither a bigger required size nor a smaller limit fit the volume
+	_, err = d.CreateVolume(ctx, request(&csi.CapacityRange{RequiredBytes: 3 * 1024 * 1024 * 1024}))
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = d.CreateVolume(ctx, request(&csi.CapacityRange{LimitBytes: 1024 * 1024 * 1024}))
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	assert.Equal(t, lvm.ByteSize(2*1024*1024*1024), thinPool.Volumes[0].LVSize)
+}
+
+func TestCreateVolumeTagsVolume(t *testing.T) {
+	creationTime = func() time.Time { return time.Date(2024, 3, 1, 10, 0, 0, 0, time.FixedZone("CET", 3600)) }
+	t.Cleanup(func() { creationTime = time.Now })
+	thinPool := &fakeThinPool{}
+	d := newTestDriver(thinPool)
+
+	_, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-1234",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		Parameters: map[string]string{
+			"csi.storage.k8s.io/pvc/name":      "data",
+			"csi.storage.k8s.io/pvc/namespace": "default",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, lvm.Tags{"csi-volume-id=pvc-1234", "csi-pvc-name=data", "csi-pvc-namespace=default", "csi-created=2024-03-01T09:00:00Z"}, thinPool.Volumes[0].Tags)
+}
+
+func TestCreateVolumeInvalidCapacityRange(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{})
+
+	_, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "test-volume",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 2048, LimitBytes: 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestVolumeMetadataFollowsVolume(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{})
+	ctx := context.Background()
+
+	_, err := d.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "scratch-volume",
+		Parameters:         map[string]string{"backup": "false"},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	})
+	assert.Nil(t, err)
+	volumeMetadata, ok := d.metadata.Get("scratch-volume")
+	assert.True(t, ok)
+	assert.Equal(t, metadata.Volume{FsType: "xfs", Backup: false}, volumeMetadata)
+
+	_, err = d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "scratch-volume"})
+	assert.Nil(t, err)
+	_, ok = d.metadata.Get("scratch-volume")
+	assert.False(t, ok)
+}
+
+func TestLongVolumeNameRoundTrips(t *testing.T) {
+	thinPool := &fakeThinPool{}
+	d := newTestDriver(thinPool)
+	ctx := context.Background()
+	name := "pvc-" + strings.Repeat("my-very-long-application-name-", 6) + "data"
+
+	resp, err := d.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               name,
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, name, resp.Volume.VolumeId)
+
+	// The LV has a valid, shorter name recorded in the metadata
+	assert.Len(t, thinPool.Volumes, 1)
+	lvName := thinPool.Volumes[0].LVName
+	assert.Equal(t, lvm.VolumeNameFor(name), lvName)
+	assert.Less(t, len(lvName), len(name))
+	volumeMetadata, ok := d.metadata.Get(name)
+	assert.True(t, ok)
+	assert.Equal(t, lvName, volumeMetadata.LVName)
+
+	// A retry finds the same LV
+	_, err = d.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               name,
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, thinPool.Volumes, 1)
+
+	// The other calls resolve the ID to the LV and back
+	getResp, err := d.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: name})
+	assert.Nil(t, err)
+	assert.Equal(t, name, getResp.Volume.VolumeId)
+	listResp, err := d.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, name, listResp.Entries[0].Volume.VolumeId)
+
+	_, err = d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: name})
+	assert.Nil(t, err)
+	assert.Empty(t, thinPool.Volumes)
+	_, ok = d.metadata.Get(name)
+	assert.False(t, ok)
+}
+
+func cloneRequest(name string, source string, required int64) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name:               name,
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: required},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: source}},
+		},
+	}
+}
+
+func TestCreateBlockVolume(t *testing.T) {
+	thinPool := &fakeThinPool{}
+	d := newTestDriver(thinPool)
+	ctx := context.Background()
+
+	resp, err := d.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "block-volume",
+		VolumeCapabilities: []*csi.VolumeCapability{blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	})
+	assert.Nil(t, err)
+	// The volume is created without a filesystem, which also rules out
+	// file level backups
+	assert.Equal(t, []string{"block-volume"}, thinPool.Block)
+	assert.Equal(t, "false", resp.Volume.VolumeContext["backup"])
+	volumeMetadata, _ := d.metadata.Get("block-volume")
+	assert.True(t, volumeMetadata.Block)
+	assert.Empty(t, volumeMetadata.FsType)
+
+	// Its LV is grown without a filesystem too
+	_, err = d.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      "block-volume",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 2 * 1024 * 1024 * 1024},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"block-volume", "block-volume"}, thinPool.Block)
+
+	// Block volumes are only confirmed as block devices
+	validated, err := d.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "block-volume",
+		VolumeCapabilities: []*csi.VolumeCapability{blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, validated.Confirmed)
+	validated, err = d.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "block-volume",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, validated.Confirmed)
+}
+
+func TestCreateBlockVolumeValidation(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{})
+	d.config.VolumeInformation.EncryptionKey = "correct horse battery staple"
+	block := blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+
+	for _, req := range []*csi.CreateVolumeRequest{
+		{Name: "mixed-volume", VolumeCapabilities: []*csi.VolumeCapability{block, mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)}},
+		{Name: "encrypted-volume", VolumeCapabilities: []*csi.VolumeCapability{block}, Parameters: map[string]string{"encrypted": "true"}},
+		{Name: "restored-volume", VolumeCapabilities: []*csi.VolumeCapability{block}, VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "4f3a2b1c"}},
+		}},
+	} {
+		_, err := d.CreateVolume(context.Background(), req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), req.Name)
+	}
+}
+
+func TestCreateVolumeClone(t *testing.T) {
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "source-volume", LVSize: 2 * 1024 * 1024 * 1024}}}
+	d := newTestDriver(thinPool)
+	ctx := context.Background()
+
+	resp, err := d.CreateVolume(ctx, cloneRequest("clone-volume", "source-volume", 0))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"source-volume clone-volume"}, thinPool.Cloned)
+	// Without a requested size the clone has the size of the source
+	assert.Equal(t, int64(2*1024*1024*1024), resp.Volume.CapacityBytes)
+	assert.Equal(t, "source-volume", resp.Volume.ContentSource.GetVolume().VolumeId)
+
+	// A retried request doesn't clone again
+	_, err = d.CreateVolume(ctx, cloneRequest("clone-volume", "source-volume", 0))
+	assert.Nil(t, err)
+	assert.Len(t, thinPool.Cloned, 1)
+
+	resp, err = d.CreateVolume(ctx, cloneRequest("larger-clone", "source-volume", 4*1024*1024*1024))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4*1024*1024*1024), resp.Volume.CapacityBytes)
+}
+
+func TestCreateBlockVolumeClone(t *testing.T) {
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "source-volume", LVSize: 2 * 1024 * 1024 * 1024}}}
+	d := newTestDriver(thinPool)
+	assert.Nil(t, d.metadata.Put("source-volume", metadata.Volume{Block: true}))
+
+	req := cloneRequest("clone-volume", "source-volume", 0)
+	req.VolumeCapabilities = []*csi.VolumeCapability{blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)}
+	_, err := d.CreateVolume(context.Background(), req)
+	assert.Nil(t, err)
+	// The clone is made as a block volume, so its data is left as is
+	assert.Equal(t, []string{"source-volume clone-volume"}, thinPool.Cloned)
+	assert.Equal(t, []string{"clone-volume"}, thinPool.Block)
+	volumeMetadata, _ := d.metadata.Get("clone-volume")
+	assert.True(t, volumeMetadata.Block)
+}
+
+func TestCreateVolumeCloneRejectsSmallerSize(t *testing.T) {
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "source-volume", LVSize: 2 * 1024 * 1024 * 1024}}}
+	d := newTestDriver(thinPool)
+
+	_, err := d.CreateVolume(context.Background(), cloneRequest("clone-volume", "source-volume", 1024*1024*1024))
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+	assert.Empty(t, thinPool.Cloned)
+
+	_, err = d.CreateVolume(context.Background(), cloneRequest("clone-volume", "missing-volume", 0))
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
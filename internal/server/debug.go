@@ -0,0 +1,47 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"nodeto/restic-csi-plugin/internal/lvm"
+)
+
+// debugVolume is a volume of the thin pool as dumped by /debug/volumes.
+type debugVolume struct {
+	Name              string       `json:"name"`
+	VGName            string       `json:"vg_name"`
+	LVAttr            string       `json:"lv_attr"`
+	LVSize            lvm.ByteSize `json:"lv_size"`
+	DataPercent       lvm.Percent  `json:"data_percent"`
+	MetadataPercent   lvm.Percent  `json:"metadata_percent"`
+	Origin            string       `json:"origin,omitempty"`
+	Mounted           bool         `json:"mounted"`
+	Target            string       `json:"target,omitempty"`
+	AdditionalTargets []string     `json:"additional_targets,omitempty"`
+}
+
+// debugVolumesHandler dumps the volumes of the thin pool as LVM and the
+// mount table see them, for troubleshooting a node without a shell on it.
+func (d *Driver) debugVolumesHandler(w http.ResponseWriter, r *http.Request) {
+	volumes := d.thinPool.ListVolumes(r.Context())
+	dump := make([]debugVolume, 0, len(volumes))
+	for _, volume := range volumes {
+		dump = append(dump, debugVolume{
+			Name:              volume.LVName,
+			VGName:            volume.VGName,
+			LVAttr:            volume.LVAttr,
+			LVSize:            volume.LVSize,
+			DataPercent:       volume.DataPercent,
+			MetadataPercent:   volume.MetadataPercent,
+			Origin:            volume.Origin,
+			Mounted:           volume.Mounted,
+			Target:            volume.Target,
+			AdditionalTargets: volume.AdditionalTargets,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"volumes": dump}); err != nil {
+		d.log.WithError(err).Error("failed to write debug volumes")
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugVolumes(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{Volumes: []lvm.Volume{
+		{VGName: "vg0", LVName: "csi-b", LVAttr: "Vwi-a-tz--", LVSize: 1024 * 1024 * 1024, DataPercent: 12.5, MetadataPercent: 1},
+		{VGName: "vg0", LVName: "csi-a", LVSize: 2 * 1024 * 1024 * 1024, Mounted: true, Target: "/var/lib/kubelet/staging/csi-a", AdditionalTargets: []string{"/var/lib/kubelet/pods/1/volumes/csi-a"}},
+	}})
+	d.debug = true
+
+	rec := httptest.NewRecorder()
+	d.healthMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/volumes", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var dump map[string][]map[string]interface{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &dump))
+	assert.Equal(t, []map[string]interface{}{
+		{
+			"name":               "csi-a",
+			"vg_name":            "vg0",
+			"lv_attr":            "",
+			"lv_size":            "2Gi",
+			"data_percent":       float64(0),
+			"metadata_percent":   float64(0),
+			"mounted":            true,
+			"target":             "/var/lib/kubelet/staging/csi-a",
+			"additional_targets": []interface{}{"/var/lib/kubelet/pods/1/volumes/csi-a"},
+		},
+		{
+			"name":             "csi-b",
+			"vg_name":          "vg0",
+			"lv_attr":          "Vwi-a-tz--",
+			"lv_size":          "1Gi",
+			"data_percent":     12.5,
+			"metadata_percent": float64(1),
+			"mounted":          false,
+		},
+	}, dump["volumes"])
+}
+
+func TestDebugVolumesNeedsDebug(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "csi-a"}}})
+
+	rec := httptest.NewRecorder()
+	d.healthMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/volumes", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
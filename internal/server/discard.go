@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"strconv"
+	"time"
+)
+
+// discardParameter is the StorageClass parameter mounting a volume with online
+// discard, ie discard: "true" to return freed blocks to the thin pool.
+const discardParameter = "discard"
+
+// fstrim allows mocking of trimming mounted volumes.
+var fstrim = lvm.Fstrim
+
+// discardEnabled reports whether a volume with the given volume context is
+// mounted with discard, falling back to the configured default.
+func (d *Driver) discardEnabled(volumeContext map[string]string) (bool, error) {
+	value, ok := volumeContext[discardParameter]
+	if !ok {
+		return d.config.VolumeInformation.Discard, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("parameter %s must be true or false, got %q", discardParameter, value)
+	}
+	return enabled, nil
+}
+
+// mountOptions returns the options a volume with the given volume context is
+// mounted with.
+func (d *Driver) mountOptions(volumeContext map[string]string) ([]string, error) {
+	discard, err := d.discardEnabled(volumeContext)
+	if err != nil {
+		return nil, err
+	}
+	var options []string
+	if discard {
+		options = append(options, "discard")
+	}
+	return options, nil
+}
+
+// startFstrim trims the mounted volumes on the configured interval, until the
+// context is cancelled.
+func (d *Driver) startFstrim(ctx context.Context) {
+	interval := d.config.VolumeInformation.FstrimInterval
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				d.trimVolumes(ctx)
+			}
+		}
+	}()
+}
+
+// trimVolumes runs fstrim on every mounted volume, backup snapshots are
+// mounted read-only and skipped while clones are trimmed like any other
+// volume. A failing volume doesn't stop the others.
+func (d *Driver) trimVolumes(ctx context.Context) {
+	log := d.log.WithField("method", "trim_volumes")
+	for _, volume := range d.thinPool.ListVolumes(ctx) {
+		if !volume.Mounted || volume.IsSnapshot() {
+			continue
+		}
+		if err := fstrim(ctx, d.thinPool.CommandRunner(), volume.Target); err != nil {
+			log.WithError(err).WithField("volume_id", d.volumeID(volume.LVName)).Error("failed to trim volume")
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMountOptions(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{})
+
+	options, err := d.mountOptions(map[string]string{})
+	assert.Nil(t, err)
+	assert.Empty(t, options)
+
+	options, err = d.mountOptions(map[string]string{"discard": "true"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"discard"}, options)
+
+	// The parameter overrides the configured default
+	d.config.VolumeInformation.Discard = true
+	options, err = d.mountOptions(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"discard"}, options)
+	options, err = d.mountOptions(map[string]string{"discard": "false"})
+	assert.Nil(t, err)
+	assert.Empty(t, options)
+
+	_, err = d.mountOptions(map[string]string{"discard": "sometimes"})
+	assert.NotNil(t, err)
+}
+
+func TestCreateVolumeRejectsInvalidDiscard(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{})
+
+	_, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "test-volume",
+		Parameters:         map[string]string{"discard": "sometimes"},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestTrimVolumes(t *testing.T) {
+	var trimmed []string
+	fstrim = func(ctx context.Context, runner lvm.CommandRunner, mountPoint string) error {
+		trimmed = append(trimmed, mountPoint)
+		if mountPoint == "/mnt/broken" {
+			return errors.New("fstrim failed")
+		}
+		return nil
+	}
+	t.Cleanup(func() { fstrim = lvm.Fstrim })
+
+	d := newTestDriver(&fakeThinPool{Volumes: []lvm.Volume{
+		{VGName: "vg0", LVName: "a-volume", Mounted: true, Target: "/mnt/broken"},
+		{VGName: "vg0", LVName: "b-volume", Mounted: true, Target: "/mnt/b"},
+		{VGName: "vg0", LVName: "b-volume-backup", LVAttr: "swi-aos---", Origin: "b-volume", Mounted: true, Target: "/mnt/snapshot"},
+		{VGName: "vg0", LVName: "b-volume-clone", LVAttr: "Vwi-aotz--", Origin: "b-volume", Mounted: true, Target: "/mnt/clone"},
+		{VGName: "vg0", LVName: "c-volume"},
+	}})
+
+	d.trimVolumes(context.Background())
+	assert.Equal(t, []string{"/mnt/broken", "/mnt/b", "/mnt/clone"}, trimmed)
+}
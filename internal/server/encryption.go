@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"strconv"
+)
+
+// encryptedParameter is the StorageClass parameter creating a volume with a
+// LUKS device under its filesystem, ie encrypted: "true" for sensitive data.
+const encryptedParameter = "encrypted"
+
+// These allow mocking of opening and closing the LUKS devices of encrypted
+// volumes.
+var (
+	openLUKS  = (*lvm.Volume).OpenLUKS
+	closeLUKS = (*lvm.Volume).CloseLUKS
+)
+
+// encryptionEnabled reports whether a volume with the given volume context is
+// encrypted, falling back to the configured default.
+func (d *Driver) encryptionEnabled(volumeContext map[string]string) (bool, error) {
+	value, ok := volumeContext[encryptedParameter]
+	if !ok {
+		return d.config.VolumeInformation.Encrypted, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("parameter %s must be true or false, got %q", encryptedParameter, value)
+	}
+	if enabled && d.config.VolumeInformation.EncryptionKey == "" {
+		return false, fmt.Errorf("parameter %s needs an encryption_key in the configuration", encryptedParameter)
+	}
+	return enabled, nil
+}
+
+// openEncryptedVolume marks the volume as encrypted and opens its LUKS
+// device, so its filesystem can be mounted.
+func openEncryptedVolume(ctx context.Context, volume *lvm.Volume) error {
+	volume.Encrypted = true
+	return openLUKS(volume, ctx)
+}
+
+// closeEncryptedVolume closes the LUKS device of the volume of volumeID once
+// its filesystem is unmounted, volumes which aren't encrypted are left as is.
+func (d *Driver) closeEncryptedVolume(ctx context.Context, volumeID string) error {
+	if volumeMetadata, ok := d.metadata.Get(volumeID); !ok || !volumeMetadata.Encrypted {
+		return nil
+	}
+	volume := d.thinPool.GetVolume(ctx, d.lvName(volumeID))
+	if volume == nil {
+		return nil
+	}
+	volume.Encrypted = true
+	return closeLUKS(volume, ctx)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// mockLUKS records the LUKS devices opened and closed, as "open volume" and
+// "close volume".
+func mockLUKS(t *testing.T) *[]string {
+	var calls []string
+	openLUKS = func(volume *lvm.Volume, ctx context.Context) error {
+		calls = append(calls, "open "+volume.LVName)
+		return nil
+	}
+	closeLUKS = func(volume *lvm.Volume, ctx context.Context) error {
+		calls = append(calls, "close "+volume.LVName)
+		return nil
+	}
+	t.Cleanup(func() {
+		openLUKS = (*lvm.Volume).OpenLUKS
+		closeLUKS = (*lvm.Volume).CloseLUKS
+	})
+	return &calls
+}
+
+func TestCreateEncryptedVolume(t *testing.T) {
+	thinPool := &fakeThinPool{}
+	d := newTestDriver(thinPool)
+	d.config.VolumeInformation.EncryptionKey = "correct horse battery staple"
+
+	resp, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "test-volume",
+		Parameters:         map[string]string{"encrypted": "true"},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"test-volume"}, thinPool.Encrypted)
+	assert.Equal(t, "true", resp.Volume.VolumeContext["encrypted"])
+	volumeMetadata, _ := d.metadata.Get("test-volume")
+	assert.True(t, volumeMetadata.Encrypted)
+}
+
+func TestCreateEncryptedVolumeNeedsKey(t *testing.T) {
+	thinPool := &fakeThinPool{}
+	d := newTestDriver(thinPool)
+
+	_, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "test-volume",
+		Parameters:         map[string]string{"encrypted": "true"},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Empty(t, thinPool.Volumes)
+}
+
+func TestStageEncryptedVolumeOpensAndClosesLUKS(t *testing.T) {
+	calls := mockLUKS(t)
+	mounts := mockStageMounts(t)
+	unmount = func(ctx context.Context, runner lvm.CommandRunner, target string) error { return nil }
+	t.Cleanup(func() { unmount = lvm.Unmount })
+
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "test-volume"}}}
+	d := newTestDriver(thinPool)
+	d.config.VolumeInformation.EncryptionKey = "correct horse battery staple"
+	d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "test-volume",
+		Parameters:         map[string]string{"encrypted": "true"},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	})
+
+	req := stageRequest("/mnt/staging/test-volume")
+	req.VolumeContext["encrypted"] = "true"
+	_, err := d.NodeStageVolume(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/mnt/staging/test-volume discard"}, *mounts)
+	// The filesystem is mounted from the opened LUKS device
+	assert.True(t, thinPool.Volumes[0].Encrypted)
+	assert.Equal(t, []string{"open test-volume"}, *calls)
+
+	_, err = d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          "test-volume",
+		StagingTargetPath: "/mnt/staging/test-volume",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"open test-volume", "close test-volume"}, *calls)
+}
+
+func TestUnstageUnencryptedVolumeDoesNotCloseLUKS(t *testing.T) {
+	calls := mockLUKS(t)
+	unmount = func(ctx context.Context, runner lvm.CommandRunner, target string) error { return nil }
+	t.Cleanup(func() { unmount = lvm.Unmount })
+	d := newTestDriver(&fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "test-volume"}}})
+
+	_, err := d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          "test-volume",
+		StagingTargetPath: "/mnt/staging/test-volume",
+	})
+	assert.Nil(t, err)
+	assert.Empty(t, *calls)
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"errors"
+	"nodeto/restic-csi-plugin/internal/lvm"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// lvmError converts an error from the lvm package to a gRPC status error.
+// Errors that already carry a status, ie invalid names, are returned as is.
+func lvmError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case errors.Is(err, lvm.ErrVolumeNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, lvm.ErrPoolFull):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, lvm.ErrDeviceBusy):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, lvm.ErrThinPoolMissing), errors.Is(err, lvm.ErrWrongPoolType):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, lvm.ErrMkfsTimeout):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
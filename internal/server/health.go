@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"nodeto/restic-csi-plugin/internal/metrics"
+	"nodeto/restic-csi-plugin/internal/restic"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// lookPath and openThinPool allow mocking of the startup health checks.
+var (
+	lookPath     = exec.LookPath
+	openThinPool = lvm.NewThinPool
+)
+
+// thinPoolRetryDelay and maxThinPoolRetryDelay bound the backoff between
+// attempts of waitForThinPool.
+var (
+	thinPoolRetryDelay    = time.Second
+	maxThinPoolRetryDelay = 30 * time.Second
+)
+
+// waitForThinPool opens the thin pool, retrying with backoff for up to
+// timeout. On boot the driver can start before LVM and udev have activated
+// the volume group, a zero timeout makes a single attempt.
+func waitForThinPool(ctx context.Context, log *logrus.Entry, name string, timeout time.Duration) (*lvm.ThinPool, error) {
+	deadline := time.Now().Add(timeout)
+	delay := thinPoolRetryDelay
+	for attempt := 1; ; attempt++ {
+		thinPool, err := openThinPool(ctx, name)
+		if err == nil {
+			return thinPool, nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return nil, err
+		}
+		log.WithError(err).WithFields(logrus.Fields{
+			"thin_pool": name,
+			"attempt":   attempt,
+			"retry_in":  delay,
+		}).Warn("thin pool is not available yet")
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxThinPoolRetryDelay {
+			delay = maxThinPoolRetryDelay
+		}
+	}
+}
+
+// requiredTools returns the paths of the commands the driver can't serve
+// volumes without.
+func (d *Driver) requiredTools() []string {
+	tools := []string{"lvs", "lvcreate", "lvextend", "lvremove", "mkfs." + lvm.DefaultFsType, "mount", "umount"}
+	if d.config.VolumeInformation.FstrimInterval > 0 {
+		tools = append(tools, "fstrim")
+	}
+	if d.config.VolumeInformation.LayoutBackupInterval > 0 {
+		tools = append(tools, "vgcfgbackup")
+	}
+	paths := make([]string, len(tools))
+	for i, tool := range tools {
+		paths[i] = lvm.ToolPath(tool)
+	}
+	if len(d.config.ResticRepo) > 0 {
+		paths = append(paths, restic.Binary)
+	}
+	return paths
+}
+
+// checkHealth checks that the required tools are installed and the
+// configured thin pool can be opened.
+func (d *Driver) checkHealth(ctx context.Context) error {
+	var missing []string
+	for _, path := range d.requiredTools() {
+		if _, err := lookPath(path); err != nil {
+			missing = append(missing, path)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("required tools are missing: %s", strings.Join(missing, ", "))
+	}
+
+	if _, err := openThinPool(ctx, d.config.VolumeInformation.ThinPoolName); err != nil {
+		return fmt.Errorf("failed to open thin pool %s: %w", d.config.VolumeInformation.ThinPoolName, err)
+	}
+	return nil
+}
+
+// updateHealth runs the health checks and sets the driver ready if they
+// pass, recording the failure for Probe otherwise.
+func (d *Driver) updateHealth(ctx context.Context) {
+	err := d.checkHealth(ctx)
+	if err != nil {
+		d.log.WithError(err).Error("driver is unhealthy")
+	}
+
+	d.readyMu.Lock()
+	defer d.readyMu.Unlock()
+	d.healthErr = err
+	d.ready = err == nil
+}
+
+// recheckHealth runs the health checks again if they failed, so a thin pool
+// which shows up after startup makes the driver ready.
+func (d *Driver) recheckHealth(ctx context.Context) {
+	d.readyMu.Lock()
+	unhealthy := d.healthErr != nil
+	d.readyMu.Unlock()
+	if unhealthy {
+		d.updateHealth(ctx)
+	}
+}
+
+// healthHandler answers Kubernetes liveness and readiness probes with the
+// same state the CSI Probe RPC reports, checking again like Probe does.
+func (d *Driver) healthHandler(w http.ResponseWriter, r *http.Request) {
+	d.recheckHealth(r.Context())
+
+	d.readyMu.Lock()
+	ready := d.ready
+	d.readyMu.Unlock()
+
+	if !ready {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// healthMux routes the health endpoints and metrics, and the debug endpoints
+// when debugging is enabled.
+func (d *Driver) healthMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", d.healthHandler)
+	mux.HandleFunc("/readyz", d.healthHandler)
+	mux.Handle("/metrics", metrics.Handler())
+	if d.debug {
+		mux.HandleFunc("/debug/volumes", d.debugVolumesHandler)
+	}
+	return mux
+}
+
+// serveHealth serves the health endpoints and metrics on listener until ctx
+// is cancelled.
+func (d *Driver) serveHealth(ctx context.Context, listener net.Listener) error {
+	srv := &http.Server{Handler: d.healthMux()}
+
+	go func() {
+		<-ctx.Done()
+		d.log.Info("health server stopped")
+		srv.Close()
+	}()
+
+	if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// mockHealthChecks stubs out the tool lookup and the opening of the thin
+// pool, which fails with poolErr.
+func mockHealthChecks(t *testing.T, poolErr *error) {
+	lookPath = func(file string) (string, error) { return file, nil }
+	openThinPool = func(ctx context.Context, longName string) (*lvm.ThinPool, error) {
+		if *poolErr != nil {
+			return nil, *poolErr
+		}
+		return &lvm.ThinPool{LongName: longName}, nil
+	}
+	t.Cleanup(func() {
+		lookPath = exec.LookPath
+		openThinPool = lvm.NewThinPool
+	})
+}
+
+// mockHealthyNode makes the health checks pass.
+func mockHealthyNode(t *testing.T) {
+	var poolErr error
+	mockHealthChecks(t, &poolErr)
+}
+
+func TestHealthHandler(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{})
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		rec := httptest.NewRecorder()
+		d.healthHandler(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+		d.ready = true
+		rec = httptest.NewRecorder()
+		d.healthHandler(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		d.ready = false
+	}
+}
+
+func TestServeHealthStopsOnCancel(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{})
+	d.ready = true
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.serveHealth(ctx, listener) }()
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/healthz")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	cancel()
+	assert.Nil(t, <-done)
+}
+
+func TestMissingThinPoolKeepsDriverNotReady(t *testing.T) {
+	poolErr := lvm.ErrThinPoolMissing
+	mockHealthChecks(t, &poolErr)
+	d := newTestDriver(&fakeThinPool{})
+	d.config.VolumeInformation.ThinPoolName = "/dev/vg0/thinpool"
+	ctx := context.Background()
+
+	d.updateHealth(ctx)
+	assert.False(t, d.ready)
+	_, err := d.Probe(ctx, &csi.ProbeRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "thin pool does not exist")
+	rec := httptest.NewRecorder()
+	d.healthHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	// Probe checks again, the driver is ready once the pool exists
+	poolErr = nil
+	resp, err := d.Probe(ctx, &csi.ProbeRequest{})
+	assert.Nil(t, err)
+	assert.True(t, resp.Ready.Value)
+}
+
+func TestHealthHandlerChecksAgain(t *testing.T) {
+	poolErr := lvm.ErrThinPoolMissing
+	mockHealthChecks(t, &poolErr)
+	d := newTestDriver(&fakeThinPool{})
+	d.config.VolumeInformation.ThinPoolName = "/dev/vg0/thinpool"
+
+	d.updateHealth(context.Background())
+	rec := httptest.NewRecorder()
+	d.healthHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	// The probe finds the pool once it has been activated
+	poolErr = nil
+	rec = httptest.NewRecorder()
+	d.healthHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, d.ready)
+}
+
+func TestMissingToolsKeepDriverNotReady(t *testing.T) {
+	mockHealthyNode(t)
+	lookPath = func(file string) (string, error) {
+		if file == "/usr/sbin/mkfs.xfs" {
+			return "", errors.New("not found")
+		}
+		return file, nil
+	}
+	d := newTestDriver(&fakeThinPool{})
+
+	d.updateHealth(context.Background())
+	assert.False(t, d.ready)
+	assert.EqualError(t, d.healthErr, "required tools are missing: /usr/sbin/mkfs.xfs")
+}
+
+func TestRequiredTools(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{})
+	assert.NotContains(t, d.requiredTools(), "restic")
+
+	d.config.ResticRepo = []config.Destination{{Repository: "/mnt/backup/restic"}}
+	d.config.VolumeInformation.FstrimInterval = time.Hour
+	assert.Contains(t, d.requiredTools(), "restic")
+	assert.Contains(t, d.requiredTools(), "/usr/sbin/fstrim")
+}
+
+// mockThinPoolRetryDelay shortens the backoff of waitForThinPool.
+func mockThinPoolRetryDelay(t *testing.T) {
+	thinPoolRetryDelay, maxThinPoolRetryDelay = time.Millisecond, 4*time.Millisecond
+	t.Cleanup(func() { thinPoolRetryDelay, maxThinPoolRetryDelay = time.Second, 30*time.Second })
+}
+
+func TestWaitForThinPoolRetriesUntilAvailable(t *testing.T) {
+	mockThinPoolRetryDelay(t)
+	attempts := 0
+	openThinPool = func(ctx context.Context, longName string) (*lvm.ThinPool, error) {
+		if attempts++; attempts < 3 {
+			return nil, errors.New("volume group vg0 not found")
+		}
+		return &lvm.ThinPool{LongName: longName}, nil
+	}
+	t.Cleanup(func() { openThinPool = lvm.NewThinPool })
+	d := newTestDriver(&fakeThinPool{})
+	hook := test.NewLocal(d.log.Logger)
+
+	thinPool, err := waitForThinPool(context.Background(), d.log, "/dev/vg0/thinpool", time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, "/dev/vg0/thinpool", thinPool.LongName)
+	assert.Equal(t, 3, attempts)
+	// Each failed attempt is logged
+	assert.Len(t, hook.AllEntries(), 2)
+	assert.Equal(t, 2, hook.LastEntry().Data["attempt"])
+}
+
+func TestWaitForThinPoolGivesUp(t *testing.T) {
+	mockThinPoolRetryDelay(t)
+	poolErr := errors.New("volume group vg0 not found")
+	mockHealthChecks(t, &poolErr)
+	d := newTestDriver(&fakeThinPool{})
+
+	_, err := waitForThinPool(context.Background(), d.log, "/dev/vg0/thinpool", 20*time.Millisecond)
+	assert.Equal(t, poolErr, err)
+
+	// Without a timeout a single attempt is made
+	attempts := 0
+	openThinPool = func(ctx context.Context, longName string) (*lvm.ThinPool, error) {
+		attempts++
+		return nil, poolErr
+	}
+	_, err = waitForThinPool(context.Background(), d.log, "/dev/vg0/thinpool", 0)
+	assert.Equal(t, poolErr, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestNewDriverStartsWithoutThinPool(t *testing.T) {
+	poolErr := lvm.ErrThinPoolMissing
+	mockHealthChecks(t, &poolErr)
+	cfg := &config.Config{}
+	cfg.VolumeInformation.ThinPoolName = "/dev/vg0/thinpool"
+	ctx := context.Background()
+
+	d, err := NewDriver("unix:///tmp/csi.sock", "", "test-node", 0, SocketPermissions{}, false, cfg)
+	assert.Nil(t, err)
+	assert.False(t, d.ready)
+	_, err = d.Probe(ctx, &csi.ProbeRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "failed to open thin pool /dev/vg0/thinpool")
+	rec := httptest.NewRecorder()
+	d.healthHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	// The driver becomes ready once the pool exists
+	poolErr = nil
+	resp, err := d.Probe(ctx, &csi.ProbeRequest{})
+	assert.Nil(t, err)
+	assert.True(t, resp.Ready.Value)
+
+	// An invalid pool path is still a configuration error
+	poolErr = lvm.ErrThinPoolMissing
+	cfg = &config.Config{}
+	cfg.VolumeInformation.ThinPoolName = "thinpool"
+	_, err = NewDriver("unix:///tmp/csi.sock", "", "test-node", 0, SocketPermissions{}, false, cfg)
+	assert.NotNil(t, err)
+}
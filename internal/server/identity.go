@@ -6,13 +6,24 @@ import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-// GetPluginInfo returns metadata of the plugin
+// csiSpecVersion is the version of the CSI spec the driver implements.
+const csiSpecVersion = "1.9.0"
+
+// GetPluginInfo returns metadata of the plugin, the manifest holds the build
+// the driver was made from and the CSI spec it implements.
 func (d *Driver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
 	resp := &csi.GetPluginInfoResponse{
 		Name:          d.name,
-		VendorVersion: version,
+		VendorVersion: GetVersion(),
+		Manifest: map[string]string{
+			"commit":           GetCommit(),
+			"tree_state":       GetTreeState(),
+			"csi_spec_version": csiSpecVersion,
+		},
 	}
 
 	d.log.WithFields(logrus.Fields{
@@ -25,7 +36,22 @@ func (d *Driver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoReques
 // GetPluginCapabilities returns available capabilities of the plugin
 func (d *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
 	resp := &csi.GetPluginCapabilitiesResponse{
-		Capabilities: []*csi.PluginCapability{},
+		Capabilities: []*csi.PluginCapability{
+			{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{
+						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+					},
+				},
+			},
+			{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{
+						Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+					},
+				},
+			},
+		},
 	}
 
 	d.log.WithFields(logrus.Fields{
@@ -35,12 +61,19 @@ func (d *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCa
 	return resp, nil
 }
 
-// Probe returns the health and readiness of the plugin
+// Probe returns the health and readiness of the plugin. A driver whose
+// startup health checks failed is checked again, so it becomes ready once
+// the thin pool or tools are fixed.
 func (d *Driver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
 	d.log.WithField("method", "probe").Info("probe called")
+	d.recheckHealth(ctx)
+
 	d.readyMu.Lock()
 	defer d.readyMu.Unlock()
 
+	if d.healthErr != nil {
+		return nil, status.Error(codes.FailedPrecondition, d.healthErr.Error())
+	}
 	return &csi.ProbeResponse{
 		Ready: &wrappers.BoolValue{
 			Value: d.ready,
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetPluginInfoManifest(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{})
+
+	resp, err := d.GetPluginInfo(context.Background(), &csi.GetPluginInfoRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"commit":           GetCommit(),
+		"tree_state":       GetTreeState(),
+		"csi_spec_version": "1.9.0",
+	}, resp.Manifest)
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"nodeto/restic-csi-plugin/internal/restic"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Tags of the restic snapshots holding the LVM layout of a node, the node is
+// recorded as a "key=value" tag to find its latest layout again.
+const (
+	layoutTag     = "csi-lvm-layout"
+	layoutNodeTag = "csi-node"
+)
+
+// layoutFile is the vgcfgbackup file in the layout directory.
+const layoutFile = "layout.vg"
+
+// startLayoutBackup backs up the LVM layout on its configured interval, until
+// the context is cancelled.
+func (d *Driver) startLayoutBackup(ctx context.Context) {
+	interval := d.config.VolumeInformation.LayoutBackupInterval
+	if interval <= 0 || len(d.config.ResticRepo) == 0 {
+		return
+	}
+	d.operations.runDetached(ctx, interval, func(ctx context.Context, now time.Time) {
+		if err := d.backupLayout(ctx); err != nil {
+			d.log.WithError(err).Error("backing up the LVM layout failed")
+		}
+	})
+}
+
+// backupLayout writes the LVM layout of the thin pool's volume group under
+// the staging path and backs it up to the destinations, tagged with
+// layoutTag and the node. Restoring a node starts by recreating its volumes
+// with vgcfgrestore from the latest layout, then restores their data.
+func (d *Driver) backupLayout(ctx context.Context) error {
+	log := d.log.WithField("method", "backup_layout")
+
+	ctx, done, err := d.operations.start(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	dir := filepath.Join(d.config.VolumeInformation.StagingPath, "layout")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("error creating layout directory: %w", err)
+	}
+	if err := d.thinPool.BackupLayout(ctx, filepath.Join(dir, layoutFile)); err != nil {
+		return err
+	}
+	if _, err := d.backupToDestinations(ctx, log, dir, layoutTag, restic.Tag(layoutNodeTag, d.hostID)); err != nil {
+		return err
+	}
+	log.Info("LVM layout backed up")
+	return nil
+}
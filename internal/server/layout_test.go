@@ -0,0 +1,36 @@
+package server
+
+import (
+	"context"
+	"nodeto/restic-csi-plugin/config"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupLayout(t *testing.T) {
+	invocations := mockResticRecordingEnvironment(t, "/mnt/broken/restic")
+	d := newTestDriver(&fakeThinPool{Layout: "vg0 {\n\tid = \"abc\"\n}\n"})
+	d.config.VolumeInformation.StagingPath = t.TempDir()
+	d.config.ResticRepo = []config.Destination{{Repository: "/mnt/backup/restic", Environment: map[string]string{"RESTIC_PASSWORD": "primary-password"}}}
+
+	assert.Nil(t, d.backupLayout(context.Background()))
+	dir := filepath.Join(d.config.VolumeInformation.StagingPath, "layout")
+	layout, err := os.ReadFile(filepath.Join(dir, "layout.vg"))
+	assert.Nil(t, err)
+	assert.Equal(t, "vg0 {\n\tid = \"abc\"\n}\n", string(layout))
+	assert.Equal(t, []string{
+		"/mnt/backup/restic primary-password : backup --json --tag csi-lvm-layout --tag csi-node=test-node " + dir,
+	}, invocations())
+}
+
+func TestBackupLayoutFailure(t *testing.T) {
+	mockResticRecordingEnvironment(t, "/mnt/broken/restic")
+	d := newTestDriver(&fakeThinPool{})
+	d.config.VolumeInformation.StagingPath = t.TempDir()
+	d.config.ResticRepo = []config.Destination{{Repository: "/mnt/broken/restic"}}
+
+	assert.NotNil(t, d.backupLayout(context.Background()))
+}
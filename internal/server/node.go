@@ -2,6 +2,12 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"nodeto/restic-csi-plugin/internal/redact"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/sirupsen/logrus"
@@ -9,16 +15,292 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+// These allow mocking of the mounts and filesystems of staged and published
+// volumes.
+var (
+	updateMountStatus = (*lvm.Volume).UpdateMountStatus
+	mountVolume       = (*lvm.Volume).EnsureVolumeIsMounted
+	bindMount         = lvm.BindMount
+	bindMountDevice   = lvm.BindMountDevice
+	unmount           = lvm.Unmount
+	growFilesystem    = lvm.GrowFilesystem
+	statFilesystem    = lvm.StatFilesystem
+	setPropagation    = lvm.SetMountPropagation
+	createMountPoint  = lvm.CreateMountPoint
+	isMountPoint      = lvm.IsMountPoint
+)
+
+// NodeStageVolume mounts the volume to the staging path. A volume already
+// mounted at the staging path is left as is, so retries don't mount it again.
+// Block volumes are only looked up, there's nothing to mount.
 func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "NodeStageVolume not supported")
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Volume ID must be provided")
+	}
+
+	if req.StagingTargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Staging Target Path must be provided")
+	}
+
+	if req.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Volume Capability must be provided")
+	}
+
+	block := req.VolumeCapability.GetBlock() != nil
+	if err := d.checkAccessType(req.VolumeId, block); err != nil {
+		return nil, err
+	}
+
+	// Block volumes are published straight from their device.
+	if block {
+		if volume := d.thinPool.GetVolume(ctx, d.lvName(req.VolumeId)); volume == nil {
+			return nil, status.Errorf(codes.NotFound, "volume %q not found", req.VolumeId)
+		}
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	mount := req.VolumeCapability.GetMount()
+	if mount == nil {
+		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume only supports mount and block volumes")
+	}
+	if mount.FsType != "" && mount.FsType != lvm.DefaultFsType {
+		return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume fs type %q is not supported, volumes are formatted with %s", mount.FsType, lvm.DefaultFsType)
+	}
+
+	options, err := d.mountOptions(req.VolumeContext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	options = append(options, mount.MountFlags...)
+	encrypted, err := d.encryptionEnabled(req.VolumeContext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	dirMode, err := mountDirMode(req.VolumeContext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	log := d.log.WithFields(logrus.Fields{
+		"volume_id":           req.VolumeId,
+		"staging_target_path": req.StagingTargetPath,
+		"method":              "node_stage_volume",
+	})
+	log.WithField("req", redact.Request(req)).Info("node stage volume called")
+
+	volume := d.thinPool.GetVolume(ctx, d.lvName(req.VolumeId))
+	if volume == nil {
+		return nil, status.Errorf(codes.NotFound, "volume %q not found", req.VolumeId)
+	}
+	// The filesystem of an encrypted volume is on its opened LUKS device.
+	if encrypted {
+		if err := openEncryptedVolume(ctx, volume); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if err := updateMountStatus(volume, ctx); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// Bind mounts of published volumes are targets too, so the volume is
+	// staged if any of them is the staging path.
+	for _, target := range volume.Targets() {
+		if target == req.StagingTargetPath {
+			if err := d.checkStagedMount(req.VolumeId, options); err != nil {
+				return nil, err
+			}
+			log.Info("volume is already staged")
+			return &csi.NodeStageVolumeResponse{}, nil
+		}
+	}
+	if volume.Mounted {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %q is mounted at %s, not the staging path", req.VolumeId, volume.Target)
+	}
+	if err := d.poolFullError(); err != nil {
+		return nil, err
+	}
+
+	if err := createMountPoint(req.StagingTargetPath, dirMode); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := mountVolume(volume, ctx, req.StagingTargetPath, options...); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := d.recordStageOptions(req.VolumeId, append([]string{}, options...)); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	log.Info("volume is staged")
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// checkStagedMount returns AlreadyExists when a staged volume is staged again
+// with other mount options, which would otherwise be ignored. Volumes staged
+// without recording their options pass. The fs type needn't be compared,
+// every volume is formatted with DefaultFsType and NodeStageVolume rejects
+// any other.
+func (d *Driver) checkStagedMount(volumeID string, options []string) error {
+	volumeMetadata, recorded := d.metadata.Get(volumeID)
+	if !recorded {
+		return nil
+	}
+	if volumeMetadata.StageOptions != nil && !sameOptions(volumeMetadata.StageOptions, options) {
+		return status.Errorf(codes.AlreadyExists, "volume %q is staged with mount options %q, not %q", volumeID, strings.Join(volumeMetadata.StageOptions, ","), strings.Join(options, ","))
+	}
+	return nil
+}
+
+// recordStageOptions records the mount options of a volume staged with
+// them, nil once it's unstaged. Volumes without metadata are left alone.
+func (d *Driver) recordStageOptions(volumeID string, options []string) error {
+	volumeMetadata, recorded := d.metadata.Get(volumeID)
+	if !recorded {
+		return nil
+	}
+	if options == nil && volumeMetadata.StageOptions == nil {
+		return nil
+	}
+	volumeMetadata.StageOptions = options
+	return d.metadata.Put(volumeID, volumeMetadata)
+}
+
+// sameOptions reports whether both lists hold the same mount options, in any
+// order.
+func sameOptions(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := map[string]int{}
+	for _, option := range a {
+		counts[option]++
+	}
+	for _, option := range b {
+		if counts[option]--; counts[option] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// checkAccessType returns InvalidArgument when the access type of a capability
+// isn't the one the volume was created with, ie staging a block volume as a
+// filesystem would mount a device without one. Volumes without metadata have
+// no recorded access type and pass.
+func (d *Driver) checkAccessType(volumeID string, block bool) error {
+	volumeMetadata, recorded := d.metadata.Get(volumeID)
+	if !recorded || volumeMetadata.Block == block {
+		return nil
+	}
+	if volumeMetadata.Block {
+		return status.Errorf(codes.InvalidArgument, "volume %q is a block volume and can't be staged with a mount capability", volumeID)
+	}
+	return status.Errorf(codes.InvalidArgument, "volume %q has a filesystem and can't be staged with a block capability", volumeID)
 }
 
 // NodeUnstageVolume unstages the volume from the staging path
 func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "NodeUnstageVolume not supported")
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeUnstageVolume Volume ID must be provided")
+	}
+
+	if req.StagingTargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeUnstageVolume Staging Target Path must be provided")
+	}
+
+	log := d.log.WithFields(logrus.Fields{
+		"volume_id":           req.VolumeId,
+		"staging_target_path": req.StagingTargetPath,
+		"method":              "node_unstage_volume",
+	})
+	log.WithField("req", redact.Request(req)).Info("node unstage volume called")
+
+	if err := d.backupBeforeUnstage(ctx, log, req.VolumeId); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := unmount(ctx, d.thinPool.CommandRunner(), req.StagingTargetPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := d.recordStageOptions(req.VolumeId, nil); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := d.closeEncryptedVolume(ctx, req.VolumeId); err != nil {
+		return nil, lvmError(err)
+	}
+
+	log.Info("volume is unstaged")
+	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
-// NodePublishVolume mounts the volume mounted to the staging path to the target path
+// subPathAttribute is the volume context attribute publishing a subdirectory
+// of the volume instead of its root, like a Kubernetes subPath.
+const subPathAttribute = "subPath"
+
+// propagationAttribute is the volume context attribute setting the mount
+// propagation of the published volume, "rshared" or "rslave". Published
+// volumes are private by default.
+const propagationAttribute = "mountPropagation"
+
+// dirModeAttribute is the volume context attribute overriding the mode of the
+// staging and target directories created for the volume, ie "0700".
+const dirModeAttribute = "mountDirMode"
+
+// mountDirMode returns the mode of the directories created to mount the
+// volume at, the configured mode unless the volume context overrides it.
+func mountDirMode(volumeContext map[string]string) (os.FileMode, error) {
+	value, ok := volumeContext[dirModeAttribute]
+	if !ok {
+		return lvm.MountDirMode, nil
+	}
+	mode, err := lvm.ParseDirMode(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", dirModeAttribute, err)
+	}
+	return mode, nil
+}
+
+// validateSubPath checks that subPath stays within the volume, it must be
+// relative and must not contain '..' elements.
+func validateSubPath(subPath string) error {
+	if filepath.IsAbs(subPath) {
+		return fmt.Errorf("%s %q must be a relative path", subPathAttribute, subPath)
+	}
+	for _, element := range strings.Split(filepath.ToSlash(subPath), "/") {
+		if element == ".." {
+			return fmt.Errorf("%s %q must not contain '..'", subPathAttribute, subPath)
+		}
+	}
+	return nil
+}
+
+// subPathSource creates the subPath directory in the staged volume and
+// returns it. Symlinks in the volume must not lead outside of it.
+func subPathSource(staging string, subPath string) (string, error) {
+	source := filepath.Join(staging, subPath)
+	if err := os.MkdirAll(source, 0755); err != nil {
+		return "", fmt.Errorf("error creating %s directory: %w", subPathAttribute, err)
+	}
+
+	root, err := filepath.EvalSymlinks(staging)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return "", err
+	}
+	if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s %q resolves outside of the volume", subPathAttribute, subPath)
+	}
+	return resolved, nil
+}
+
+// NodePublishVolume bind mounts the staged volume to the target path, or the
+// device of a block volume to the target file. The
+// volume is mounted under the staging path if the CO didn't stage it. With the
+// subPath volume context attribute only that subdirectory is published. The
+// published directory is owned by the VolumeMountGroup or fsGroup if given. A
+// target which is already mounted is left as is, so retries don't mount it
+// again.
 func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Volume ID must be provided")
@@ -28,30 +310,122 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Target Path must be provided")
 	}
 
+	if req.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Volume Capability must be provided")
+	}
+
+	subPath := req.VolumeContext[subPathAttribute]
+	if err := validateSubPath(subPath); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	propagation := req.VolumeContext[propagationAttribute]
+	if err := lvm.ValidatePropagation(propagation); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	gid, setGroup, err := volumeMountGroup(req.VolumeCapability, req.VolumeContext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	options, err := d.mountOptions(req.VolumeContext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	encrypted, err := d.encryptionEnabled(req.VolumeContext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	dirMode, err := mountDirMode(req.VolumeContext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	log := d.log.WithFields(logrus.Fields{
 		"volume_id":   req.VolumeId,
 		"target_path": req.TargetPath,
 		"method":      "node_publish_volume",
 	})
-	log.WithField("req", req).Info("node publish volume called")
-
-	log.Printf(d.config.ResticRepo[0].Repository)
-	// out, err := exec.Command(mountCmd, mountArgs...).Output()
-	// if err != nil {
-	// 	return nil, status.Error(
-	// 		codes.Unknown,
-	// 		fmt.Sprintf(
-	// 			"mounting failed: %v cmd: '%s %s' output: %q",
-	// 			err, mountCmd, strings.Join(mountArgs, " "), string(out),
-	// 		),
-	// 	)
-	// }
-
-	// log.WithField("out", string(out)).Info("bind mounting the volume is finished")
+	log.WithField("req", redact.Request(req)).Info("node publish volume called")
+
+	lvName := d.lvName(req.VolumeId)
+	volume := d.thinPool.GetVolume(ctx, lvName)
+	if volume == nil {
+		return nil, status.Errorf(codes.NotFound, "volume %q not found", req.VolumeId)
+	}
+	mounted, err := isMountPoint(req.TargetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if mounted {
+		log.Info("volume is already published")
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	// Volumes are published read-only for the reader-only access mode too.
+	readOnly := req.Readonly || req.VolumeCapability.GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY
+	// Read-only publishes don't write to a full pool.
+	if !readOnly {
+		if err := d.poolFullError(); err != nil {
+			return nil, err
+		}
+	}
+
+	// The device of a block volume is bind mounted as a device file.
+	if req.VolumeCapability.GetBlock() != nil {
+		if err := bindMountDevice(ctx, d.thinPool.CommandRunner(), volume.DeviceName(), req.TargetPath, readOnly); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		log.WithField("device", volume.DeviceName()).Info("bind mounting the block device is finished")
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	staging := req.StagingTargetPath
+	if staging == "" {
+		if encrypted {
+			if err := openEncryptedVolume(ctx, volume); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+		mountPath := filepath.Join(d.config.VolumeInformation.StagingPath, "volumes", lvName)
+		if err := createMountPoint(mountPath, dirMode); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if err := mountVolume(volume, ctx, mountPath, options...); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		staging = volume.Target
+	}
+
+	source := staging
+	if subPath != "" {
+		if source, err = subPathSource(staging, subPath); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	if setGroup {
+		if err := d.applyFSGroup(source, gid); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if err := createMountPoint(req.TargetPath, dirMode); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := bindMount(ctx, d.thinPool.CommandRunner(), source, req.TargetPath, readOnly); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := setPropagation(ctx, d.thinPool.CommandRunner(), req.TargetPath, propagation); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	log.WithField("source", source).Info("bind mounting the volume is finished")
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
-// NodeUnpublishVolume unmounts the volume from the target path
+// NodeUnpublishVolume unmounts the volume from the target path and removes
+// the target.
 func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "NodeUnpublishVolume Volume ID must be provided")
@@ -66,15 +440,60 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublish
 		"target_path": req.TargetPath,
 		"method":      "node_unpublish_volume",
 	})
-	log.WithField("req", req).Info("node unpublish volume called")
+	log.WithField("req", redact.Request(req)).Info("node unpublish volume called")
 
-	// log.WithField("out", string(out)).Info("unmounting volume is finished")
+	if err := unmount(ctx, d.thinPool.CommandRunner(), req.TargetPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	// The target is created by NodePublishVolume, so it's removed again.
+	// os.Remove leaves directories which still have contents alone.
+	if err := os.Remove(req.TargetPath); err != nil && !os.IsNotExist(err) {
+		return nil, status.Errorf(codes.Internal, "failed to remove target path %s: %v", req.TargetPath, err)
+	}
+
+	log.Info("unmounting volume is finished")
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
 // NodeGetCapabilities returns the supported capabilities of the node server
 func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	nscaps := []*csi.NodeServiceCapability{}
+	nscaps := []*csi.NodeServiceCapability{
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+				},
+			},
+		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+				},
+			},
+		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+				},
+			},
+		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+				},
+			},
+		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+				},
+			},
+		},
+	}
 	d.log.WithFields(logrus.Fields{
 		"node_capabilities": nscaps,
 		"method":            "node_get_capabilities",
@@ -90,16 +509,109 @@ func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabi
 func (d *Driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
 	d.log.WithField("method", "node_get_info").Info("node get info called")
 	return &csi.NodeGetInfoResponse{
-		NodeId: d.hostID,
+		NodeId:             d.hostID,
+		AccessibleTopology: d.topology(),
+		MaxVolumesPerNode:  d.config.VolumeInformation.MaxVolumesPerNode,
 	}, nil
 }
 
-// NodeGetVolumeStats returns the volume capacity statistics available for the
-// the given volume.
+// NodeGetVolumeStats returns the usage of the filesystem of the volume
+// published or staged at the volume path, with the condition of the volume.
 func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "NodeGetVolumeStats is not supported")
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats Volume ID must be provided")
+	}
+	if req.VolumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats Volume Path must be provided")
+	}
+
+	d.log.WithFields(logrus.Fields{
+		"volume_id":   req.VolumeId,
+		"volume_path": req.VolumePath,
+		"method":      "node_get_volume_stats",
+	}).Info("node get volume stats called")
+
+	volume := d.thinPool.GetVolume(ctx, d.lvName(req.VolumeId))
+	if volume == nil {
+		return nil, status.Errorf(codes.NotFound, "volume %q not found", req.VolumeId)
+	}
+	if _, err := os.Stat(req.VolumePath); os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "volume path %s does not exist", req.VolumePath)
+	}
+
+	// A block volume has no filesystem to stat, only the size of its device
+	// is known.
+	if volumeMetadata, _ := d.metadata.Get(req.VolumeId); volumeMetadata.Block {
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{
+				{Unit: csi.VolumeUsage_BYTES, Total: int64(volume.LVSize)},
+			},
+			VolumeCondition: d.volumeCondition(volume),
+		}, nil
+	}
+
+	stats, err := statFilesystem(req.VolumePath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     stats.TotalBytes,
+				Available: stats.AvailableBytes,
+				Used:      stats.UsedBytes,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Total:     stats.TotalInodes,
+				Available: stats.FreeInodes,
+				Used:      stats.UsedInodes,
+			},
+		},
+		VolumeCondition: d.volumeCondition(volume),
+	}, nil
 }
 
+// NodeExpandVolume grows the filesystem of a volume expanded by
+// ControllerExpandVolume, block volumes only have their size confirmed.
 func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "NodeExpandVolume is not supported")
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeExpandVolume Volume ID must be provided")
+	}
+	if req.VolumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeExpandVolume Volume Path must be provided")
+	}
+
+	log := d.log.WithFields(logrus.Fields{
+		"volume_id":   req.VolumeId,
+		"volume_path": req.VolumePath,
+		"method":      "node_expand_volume",
+	})
+	log.WithField("req", redact.Request(req)).Info("node expand volume called")
+
+	volume := d.thinPool.GetVolume(ctx, d.lvName(req.VolumeId))
+	if volume == nil {
+		return nil, status.Errorf(codes.NotFound, "volume %q not found", req.VolumeId)
+	}
+	// The LV was grown by ControllerExpandVolume, confirm it's large enough.
+	if required := lvm.ByteSize(req.CapacityRange.GetRequiredBytes()); volume.LVSize < required {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %q is %d bytes, smaller than the requested %d bytes, it must be expanded by ControllerExpandVolume first", req.VolumeId, volume.LVSize, required)
+	}
+
+	// Block volumes have no filesystem to grow. The capability is optional,
+	// without it the access type recorded at creation tells.
+	block := req.VolumeCapability.GetBlock() != nil
+	if req.VolumeCapability == nil {
+		volumeMetadata, _ := d.metadata.Get(req.VolumeId)
+		block = volumeMetadata.Block
+	}
+	if !block {
+		if err := growFilesystem(ctx, d.thinPool.CommandRunner(), req.VolumePath); err != nil {
+			return nil, lvmError(err)
+		}
+	}
+
+	log.WithField("size", volume.LVSize).Info("volume is expanded")
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: int64(volume.LVSize)}, nil
 }
@@ -0,0 +1,700 @@
+package server
+
+import (
+	"context"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"nodeto/restic-csi-plugin/internal/metadata"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNodeGetInfoTopology(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{})
+
+	resp, err := d.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, "test-node", resp.NodeId)
+	assert.Equal(t, map[string]string{DefaultTopologyKey: "test-node"}, resp.AccessibleTopology.Segments)
+
+	d.config.VolumeInformation.TopologyKey = "topology.kubernetes.io/hostname"
+	resp, err = d.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"topology.kubernetes.io/hostname": "test-node"}, resp.AccessibleTopology.Segments)
+}
+
+func TestNodeGetInfoMaxVolumesPerNode(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{})
+
+	resp, err := d.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), resp.MaxVolumesPerNode)
+
+	d.config.VolumeInformation.MaxVolumesPerNode = 250
+	resp, err = d.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(250), resp.MaxVolumesPerNode)
+}
+
+// mockBindMount records the bind mounts of published volumes as
+// "source target" instead of mounting them. Nothing is mounted at the targets
+// beforehand.
+func mockBindMount(t *testing.T) *[]string {
+	var mounts []string
+	bindMount = func(ctx context.Context, runner lvm.CommandRunner, source string, target string, readOnly bool) error {
+		mounts = append(mounts, source+" "+target)
+		return nil
+	}
+	isMountPoint = func(target string) (bool, error) { return false, nil }
+	createMountPoint = func(path string, mode os.FileMode) error { return nil }
+	t.Cleanup(func() {
+		bindMount = lvm.BindMount
+		isMountPoint = lvm.IsMountPoint
+		createMountPoint = lvm.CreateMountPoint
+	})
+	return &mounts
+}
+
+// mockStageMounts leaves the mount status of volumes as set by the test and
+// records the mounts of staged volumes as "path options".
+func mockStageMounts(t *testing.T) *[]string {
+	var mounts []string
+	updateMountStatus = func(volume *lvm.Volume, ctx context.Context) error { return nil }
+	mountVolume = func(volume *lvm.Volume, ctx context.Context, mountPath string, options ...string) error {
+		mounts = append(mounts, mountPath+" "+strings.Join(options, ","))
+		volume.Mounted = true
+		volume.Target = mountPath
+		return nil
+	}
+	createMountPoint = func(path string, mode os.FileMode) error { return nil }
+	t.Cleanup(func() {
+		updateMountStatus = (*lvm.Volume).UpdateMountStatus
+		mountVolume = (*lvm.Volume).EnsureVolumeIsMounted
+		createMountPoint = lvm.CreateMountPoint
+	})
+	return &mounts
+}
+
+func stageRequest(stagingPath string) *csi.NodeStageVolumeRequest {
+	return &csi.NodeStageVolumeRequest{
+		VolumeId:          "test-volume",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:     map[string]string{"discard": "true"},
+	}
+}
+
+func TestNodeStageVolume(t *testing.T) {
+	mounts := mockStageMounts(t)
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "test-volume"}}}
+	d := newTestDriver(thinPool)
+
+	_, err := d.NodeStageVolume(context.Background(), stageRequest("/mnt/staging/test-volume"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/mnt/staging/test-volume discard"}, *mounts)
+	assert.Equal(t, "/mnt/staging/test-volume", thinPool.Volumes[0].Target)
+}
+
+func TestNodeStageVolumeCreatesDirectoryWithMode(t *testing.T) {
+	mockStageMounts(t)
+	createMountPoint = lvm.CreateMountPoint
+	lvm.MountDirMode = 0750
+	t.Cleanup(func() { lvm.MountDirMode = 0755 })
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "test-volume"}}}
+	d := newTestDriver(thinPool)
+	mode := func(path string) os.FileMode {
+		info, err := os.Stat(path)
+		assert.Nil(t, err)
+		return info.Mode().Perm()
+	}
+
+	staging := filepath.Join(t.TempDir(), "staging", "test-volume")
+	_, err := d.NodeStageVolume(context.Background(), stageRequest(staging))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0750), mode(staging))
+
+	// The volume context overrides the configured mode
+	thinPool.Volumes[0].Mounted = false
+	staging = filepath.Join(t.TempDir(), "staging", "test-volume")
+	req := stageRequest(staging)
+	req.VolumeContext[dirModeAttribute] = "0700"
+	_, err = d.NodeStageVolume(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0700), mode(staging))
+
+	req.VolumeContext[dirModeAttribute] = "rwx"
+	_, err = d.NodeStageVolume(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestNodeStageVolumeAlreadyStaged(t *testing.T) {
+	mounts := mockStageMounts(t)
+	d := newTestDriver(&fakeThinPool{Volumes: []lvm.Volume{
+		{VGName: "vg0", LVName: "test-volume", Mounted: true, Target: "/mnt/staging/test-volume", AdditionalTargets: []string{"/mnt/target"}},
+	}})
+
+	_, err := d.NodeStageVolume(context.Background(), stageRequest("/mnt/staging/test-volume"))
+	assert.Nil(t, err)
+	assert.Empty(t, *mounts)
+
+	// The staging path may be listed after the bind mount of a published volume
+	d = newTestDriver(&fakeThinPool{Volumes: []lvm.Volume{
+		{VGName: "vg0", LVName: "test-volume", Mounted: true, Target: "/mnt/target", AdditionalTargets: []string{"/mnt/staging/test-volume"}},
+	}})
+	_, err = d.NodeStageVolume(context.Background(), stageRequest("/mnt/staging/test-volume"))
+	assert.Nil(t, err)
+	assert.Empty(t, *mounts)
+}
+
+func TestNodeStageVolumeAlreadyStagedWithOtherOptions(t *testing.T) {
+	mounts := mockStageMounts(t)
+	unmount = func(ctx context.Context, runner lvm.CommandRunner, target string) error { return nil }
+	t.Cleanup(func() { unmount = lvm.Unmount })
+	d := newTestDriver(&fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "test-volume"}}})
+	assert.Nil(t, d.metadata.Put("test-volume", metadata.Volume{FsType: lvm.DefaultFsType}))
+	ctx := context.Background()
+
+	_, err := d.NodeStageVolume(ctx, stageRequest("/mnt/staging/test-volume"))
+	assert.Nil(t, err)
+	volumeMetadata, _ := d.metadata.Get("test-volume")
+	assert.Equal(t, []string{"discard"}, volumeMetadata.StageOptions)
+
+	// Staging again with the same options succeeds without mounting
+	_, err = d.NodeStageVolume(ctx, stageRequest("/mnt/staging/test-volume"))
+	assert.Nil(t, err)
+	assert.Len(t, *mounts, 1)
+
+	// Other mount flags or options aren't silently ignored
+	req := stageRequest("/mnt/staging/test-volume")
+	req.VolumeCapability.GetMount().MountFlags = []string{"ro"}
+	_, err = d.NodeStageVolume(ctx, req)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	req = stageRequest("/mnt/staging/test-volume")
+	req.VolumeContext = nil
+	_, err = d.NodeStageVolume(ctx, req)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	req = stageRequest("/mnt/staging/test-volume")
+	req.VolumeCapability.GetMount().FsType = "ext4"
+	_, err = d.NodeStageVolume(ctx, req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Len(t, *mounts, 1)
+
+	// The options are forgotten once the volume is unstaged
+	_, err = d.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: "test-volume", StagingTargetPath: "/mnt/staging/test-volume"})
+	assert.Nil(t, err)
+	volumeMetadata, _ = d.metadata.Get("test-volume")
+	assert.Nil(t, volumeMetadata.StageOptions)
+	assert.Equal(t, lvm.DefaultFsType, volumeMetadata.FsType)
+}
+
+func TestNodeUnstageVolumeUnmountsWithPoolRunner(t *testing.T) {
+	var runners []lvm.CommandRunner
+	unmount = func(ctx context.Context, runner lvm.CommandRunner, target string) error {
+		runners = append(runners, runner)
+		return nil
+	}
+	t.Cleanup(func() { unmount = lvm.Unmount })
+	runner := unexpectedRunner{t}
+	d := newTestDriver(&fakeThinPool{Runner: runner})
+
+	_, err := d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "test-volume", StagingTargetPath: "/mnt/staging/test-volume"})
+	assert.Nil(t, err)
+	assert.Equal(t, []lvm.CommandRunner{runner}, runners)
+}
+
+func TestNodeStageVolumeStagedElsewhere(t *testing.T) {
+	mounts := mockStageMounts(t)
+	d := newTestDriver(&fakeThinPool{Volumes: []lvm.Volume{
+		{VGName: "vg0", LVName: "test-volume", Mounted: true, Target: "/mnt/elsewhere"},
+	}})
+
+	_, err := d.NodeStageVolume(context.Background(), stageRequest("/mnt/staging/test-volume"))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Empty(t, *mounts)
+}
+
+func TestNodeStageVolumeValidation(t *testing.T) {
+	mockStageMounts(t)
+	d := newTestDriver(&fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "test-volume"}}})
+
+	req := stageRequest("/mnt/staging/test-volume")
+	req.VolumeCapability = nil
+	_, err := d.NodeStageVolume(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	req = stageRequest("/mnt/staging/test-volume")
+	req.VolumeCapability.GetMount().FsType = "ext4"
+	_, err = d.NodeStageVolume(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	req = stageRequest("/mnt/staging/test-volume")
+	req.VolumeId = "missing-volume"
+	_, err = d.NodeStageVolume(context.Background(), req)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestNodeUnstageVolume(t *testing.T) {
+	var unmounted []string
+	unmount = func(ctx context.Context, runner lvm.CommandRunner, target string) error {
+		unmounted = append(unmounted, target)
+		return nil
+	}
+	t.Cleanup(func() { unmount = lvm.Unmount })
+	d := newTestDriver(&fakeThinPool{})
+
+	_, err := d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          "test-volume",
+		StagingTargetPath: "/mnt/staging/test-volume",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/mnt/staging/test-volume"}, unmounted)
+}
+
+// stagedThinPool returns a pool with test-volume mounted at staging.
+func stagedThinPool(staging string) *fakeThinPool {
+	return &fakeThinPool{Volumes: []lvm.Volume{
+		{VGName: "vg0", LVName: "test-volume", Mounted: true, Target: staging},
+	}}
+}
+
+func TestNodePublishVolumeMasksSecrets(t *testing.T) {
+	mockBindMount(t)
+	d := newTestDriver(stagedThinPool(t.TempDir()))
+	hook := test.NewLocal(d.log.Logger)
+
+	_, err := d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "test-volume",
+		TargetPath:       "/mnt/test",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		Secrets:          map[string]string{"RESTIC_PASSWORD": "hunter2"},
+	})
+	assert.Nil(t, err)
+	line, err := hook.LastEntry().String()
+	assert.Nil(t, err)
+	assert.NotContains(t, line, "hunter2")
+}
+
+func TestNodePublishVolumeWithMountPropagation(t *testing.T) {
+	mounts := mockBindMount(t)
+	setPropagation = func(ctx context.Context, runner lvm.CommandRunner, target string, mode string) error {
+		*mounts = append(*mounts, "--make-"+mode+" "+target)
+		return nil
+	}
+	t.Cleanup(func() { setPropagation = lvm.SetMountPropagation })
+	staging := t.TempDir()
+	d := newTestDriver(stagedThinPool(staging))
+
+	_, err := d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "test-volume",
+		TargetPath:       "/mnt/target",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:    map[string]string{propagationAttribute: "rshared"},
+	})
+	assert.Nil(t, err)
+	// The propagation is changed once the volume is bind mounted
+	assert.Equal(t, []string{staging + " /mnt/target", "--make-rshared /mnt/target"}, *mounts)
+
+	_, err = d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "test-volume",
+		TargetPath:       "/mnt/target",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:    map[string]string{propagationAttribute: "bidirectional"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestNodePublishVolume(t *testing.T) {
+	mounts := mockBindMount(t)
+	staging := t.TempDir()
+	d := newTestDriver(stagedThinPool(staging))
+
+	_, err := d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "test-volume",
+		TargetPath:       "/mnt/target",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{staging + " /mnt/target"}, *mounts)
+
+	// A retried publish finds the target mounted and doesn't bind mount again
+	isMountPoint = func(target string) (bool, error) { return target == "/mnt/target", nil }
+	_, err = d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "test-volume",
+		TargetPath:       "/mnt/target",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+	})
+	assert.Nil(t, err)
+	assert.Len(t, *mounts, 1)
+
+	_, err = d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "missing-volume",
+		TargetPath:       "/mnt/target",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestNodePublishVolumeReaderOnly(t *testing.T) {
+	mockBindMount(t)
+	var readOnly bool
+	bindMount = func(ctx context.Context, runner lvm.CommandRunner, source string, target string, ro bool) error {
+		readOnly = ro
+		return nil
+	}
+	d := newTestDriver(stagedThinPool(t.TempDir()))
+
+	_, err := d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "test-volume",
+		TargetPath:       "/mnt/target",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY),
+	})
+	assert.Nil(t, err)
+	assert.True(t, readOnly)
+}
+
+func TestNodePublishVolumeSubPath(t *testing.T) {
+	mounts := mockBindMount(t)
+	staging := t.TempDir()
+	d := newTestDriver(stagedThinPool(staging))
+
+	_, err := d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "test-volume",
+		TargetPath:       "/mnt/target",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:    map[string]string{"subPath": "app/data"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join(staging, "app", "data") + " /mnt/target"}, *mounts)
+	assert.DirExists(t, filepath.Join(staging, "app", "data"))
+
+	for _, subPath := range []string{"../escape", "app/../../escape", "/etc"} {
+		_, err = d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         "test-volume",
+			TargetPath:       "/mnt/target",
+			VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			VolumeContext:    map[string]string{"subPath": subPath},
+		})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), subPath)
+	}
+
+	// A symlink in the volume can't lead out of it either
+	assert.Nil(t, os.Symlink(t.TempDir(), filepath.Join(staging, "link")))
+	_, err = d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "test-volume",
+		TargetPath:       "/mnt/target",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:    map[string]string{"subPath": "link"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Len(t, *mounts, 1)
+}
+
+// testGroup returns a group the test may chown files to.
+func testGroup() int {
+	if os.Geteuid() == 0 {
+		return 1234
+	}
+	return os.Getgid()
+}
+
+// fileGroup returns the group owning path.
+func fileGroup(t *testing.T, path string) int {
+	info, err := os.Lstat(path)
+	assert.Nil(t, err)
+	return int(info.Sys().(*syscall.Stat_t).Gid)
+}
+
+func TestNodePublishVolumeAppliesFSGroup(t *testing.T) {
+	mockBindMount(t)
+	staging := t.TempDir()
+	assert.Nil(t, os.Chmod(staging, 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(staging, "data"), nil, 0600))
+	d := newTestDriver(stagedThinPool(staging))
+	gid := testGroup()
+
+	_, err := d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:   "test-volume",
+		TargetPath: "/mnt/target",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{VolumeMountGroup: strconv.Itoa(gid)}},
+		},
+	})
+	assert.Nil(t, err)
+	info, err := os.Stat(staging)
+	assert.Nil(t, err)
+	assert.Equal(t, gid, fileGroup(t, staging))
+	assert.Equal(t, os.ModeDir|os.ModeSetgid|0775, info.Mode())
+	// Only the root is changed by default
+	assert.NotEqual(t, gid, fileGroup(t, filepath.Join(staging, "data")))
+
+	d.config.VolumeInformation.FSGroupPolicy = config.FSGroupPolicyRecursive
+	_, err = d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "test-volume",
+		TargetPath:       "/mnt/target",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:    map[string]string{"fsGroup": strconv.Itoa(gid)},
+	})
+	assert.Nil(t, err)
+	info, err = os.Stat(filepath.Join(staging, "data"))
+	assert.Nil(t, err)
+	assert.Equal(t, gid, fileGroup(t, filepath.Join(staging, "data")))
+	assert.Equal(t, os.FileMode(0660), info.Mode())
+
+	_, err = d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "test-volume",
+		TargetPath:       "/mnt/target",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:    map[string]string{"fsGroup": "wheel"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestNodeUnpublishVolume(t *testing.T) {
+	var unmounted []string
+	unmount = func(ctx context.Context, runner lvm.CommandRunner, target string) error {
+		unmounted = append(unmounted, target)
+		return nil
+	}
+	t.Cleanup(func() { unmount = lvm.Unmount })
+	d := newTestDriver(&fakeThinPool{})
+	target := filepath.Join(t.TempDir(), "target")
+	assert.Nil(t, os.Mkdir(target, 0750))
+
+	_, err := d.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "test-volume",
+		TargetPath: target,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{target}, unmounted)
+	// The target created by NodePublishVolume is removed
+	assert.NoDirExists(t, target)
+}
+
+// mockGrowFilesystem records the paths of grown filesystems.
+func mockGrowFilesystem(t *testing.T) *[]string {
+	var grown []string
+	growFilesystem = func(ctx context.Context, runner lvm.CommandRunner, mountPoint string) error {
+		grown = append(grown, mountPoint)
+		return nil
+	}
+	t.Cleanup(func() { growFilesystem = lvm.GrowFilesystem })
+	return &grown
+}
+
+func expandRequest(capability *csi.VolumeCapability) *csi.NodeExpandVolumeRequest {
+	return &csi.NodeExpandVolumeRequest{
+		VolumeId:         "test-volume",
+		VolumePath:       "/mnt/target",
+		CapacityRange:    &csi.CapacityRange{RequiredBytes: 2 * 1024 * 1024 * 1024},
+		VolumeCapability: capability,
+	}
+}
+
+func TestNodeExpandVolume(t *testing.T) {
+	grown := mockGrowFilesystem(t)
+	d := newTestDriver(&fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "test-volume", LVSize: 2 * 1024 * 1024 * 1024}}})
+
+	resp, err := d.NodeExpandVolume(context.Background(), expandRequest(mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2*1024*1024*1024), resp.CapacityBytes)
+	assert.Equal(t, []string{"/mnt/target"}, *grown)
+}
+
+func TestNodeExpandBlockVolumeDoesNotGrowFilesystem(t *testing.T) {
+	grown := mockGrowFilesystem(t)
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "test-volume", LVSize: 2 * 1024 * 1024 * 1024}}}
+	d := newTestDriver(thinPool)
+	block := blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+
+	resp, err := d.NodeExpandVolume(context.Background(), expandRequest(block))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2*1024*1024*1024), resp.CapacityBytes)
+	assert.Empty(t, *grown)
+
+	// The LV must have been grown by the controller already
+	thinPool.Volumes[0].LVSize = 1024 * 1024 * 1024
+	_, err = d.NodeExpandVolume(context.Background(), expandRequest(block))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Empty(t, *grown)
+}
+
+func TestNodeExpandBlockVolumeWithoutCapability(t *testing.T) {
+	grown := mockGrowFilesystem(t)
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "test-volume", LVSize: 2 * 1024 * 1024 * 1024}}}
+	d := newTestDriver(thinPool)
+
+	// The access type recorded at creation is used instead
+	assert.Nil(t, d.metadata.Put("test-volume", metadata.Volume{Block: true}))
+	resp, err := d.NodeExpandVolume(context.Background(), expandRequest(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2*1024*1024*1024), resp.CapacityBytes)
+	assert.Empty(t, *grown)
+
+	assert.Nil(t, d.metadata.Put("test-volume", metadata.Volume{FsType: lvm.DefaultFsType}))
+	_, err = d.NodeExpandVolume(context.Background(), expandRequest(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/mnt/target"}, *grown)
+}
+
+func TestNodeExpandVolumeValidation(t *testing.T) {
+	mockGrowFilesystem(t)
+	d := newTestDriver(&fakeThinPool{})
+
+	_, err := d.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{VolumePath: "/mnt/target"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = d.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{VolumeId: "test-volume"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = d.NodeExpandVolume(context.Background(), expandRequest(nil))
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestNodeStageAndPublishBlockVolume(t *testing.T) {
+	mounts := mockStageMounts(t)
+	binds := mockBindMount(t)
+	var devices []string
+	bindMountDevice = func(ctx context.Context, runner lvm.CommandRunner, device string, target string, readOnly bool) error {
+		devices = append(devices, device+" "+target)
+		return nil
+	}
+	t.Cleanup(func() { bindMountDevice = lvm.BindMountDevice })
+	d := newTestDriver(&fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "block-volume"}}})
+	block := blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+
+	// Nothing is mounted to stage a block volume
+	_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "block-volume",
+		StagingTargetPath: "/mnt/staging/block-volume",
+		VolumeCapability:  block,
+	})
+	assert.Nil(t, err)
+	assert.Empty(t, *mounts)
+
+	// The device itself is published at the target
+	_, err = d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "block-volume",
+		StagingTargetPath: "/mnt/staging/block-volume",
+		TargetPath:        "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/block-volume/pod",
+		VolumeCapability:  block,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/dev/vg0/block-volume /var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/block-volume/pod"}, devices)
+	assert.Empty(t, *mounts)
+	assert.Empty(t, *binds)
+
+	// and only once
+	isMountPoint = func(target string) (bool, error) {
+		return target == "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/block-volume/pod", nil
+	}
+	_, err = d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "block-volume",
+		StagingTargetPath: "/mnt/staging/block-volume",
+		TargetPath:        "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/block-volume/pod",
+		VolumeCapability:  block,
+	})
+	assert.Nil(t, err)
+	assert.Len(t, devices, 1)
+
+	_, err = d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "missing-volume",
+		StagingTargetPath: "/mnt/staging/missing-volume",
+		VolumeCapability:  block,
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+// mockStatFilesystem reports the stats for every filesystem.
+func mockStatFilesystem(t *testing.T, stats lvm.FilesystemStats) {
+	statFilesystem = func(path string) (lvm.FilesystemStats, error) { return stats, nil }
+	t.Cleanup(func() { statFilesystem = lvm.StatFilesystem })
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	mockStatFilesystem(t, lvm.FilesystemStats{TotalBytes: 1000, AvailableBytes: 600, UsedBytes: 400, TotalInodes: 50, FreeInodes: 45, UsedInodes: 5})
+	d := newTestDriver(&fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "test-volume"}}})
+	assert.Nil(t, d.metadata.Put("test-volume", metadata.Volume{Backup: true, BackupFailures: backupFailureThreshold, LastBackupError: "repository is unreachable"}))
+	ctx := context.Background()
+	path := t.TempDir()
+
+	resp, err := d.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: "test-volume", VolumePath: path})
+	assert.Nil(t, err)
+	assert.Equal(t, []*csi.VolumeUsage{
+		{Unit: csi.VolumeUsage_BYTES, Total: 1000, Available: 600, Used: 400},
+		{Unit: csi.VolumeUsage_INODES, Total: 50, Available: 45, Used: 5},
+	}, resp.Usage)
+	assert.True(t, resp.VolumeCondition.Abnormal)
+	assert.Equal(t, "backups failing: repository is unreachable", resp.VolumeCondition.Message)
+
+	_, err = d.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: "other-volume", VolumePath: path})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = d.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: "test-volume", VolumePath: filepath.Join(path, "missing")})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = d.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: "test-volume"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestNodeGetVolumeStatsOfBlockVolume(t *testing.T) {
+	statFilesystem = func(path string) (lvm.FilesystemStats, error) {
+		t.Errorf("statfs of block volume at %s", path)
+		return lvm.FilesystemStats{}, nil
+	}
+	t.Cleanup(func() { statFilesystem = lvm.StatFilesystem })
+	d := newTestDriver(&fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "block-volume", LVSize: 2 * 1024 * 1024 * 1024}}})
+	assert.Nil(t, d.metadata.Put("block-volume", metadata.Volume{Block: true}))
+
+	resp, err := d.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "block-volume", VolumePath: t.TempDir()})
+	assert.Nil(t, err)
+	assert.Equal(t, []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: 2 * 1024 * 1024 * 1024}}, resp.Usage)
+	assert.False(t, resp.VolumeCondition.Abnormal)
+}
+
+func TestNodeStageVolumeRoutesByAccessType(t *testing.T) {
+	mounts := mockStageMounts(t)
+	d := newTestDriver(&fakeThinPool{Volumes: []lvm.Volume{
+		{VGName: "vg0", LVName: "test-volume"},
+		{VGName: "vg0", LVName: "block-volume"},
+	}})
+	assert.Nil(t, d.metadata.Put("test-volume", metadata.Volume{FsType: lvm.DefaultFsType}))
+	assert.Nil(t, d.metadata.Put("block-volume", metadata.Volume{Block: true}))
+	block := blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+
+	// A mount capability mounts the filesystem at the staging path
+	_, err := d.NodeStageVolume(context.Background(), stageRequest("/mnt/staging/test-volume"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/mnt/staging/test-volume discard"}, *mounts)
+
+	// A block capability mounts nothing
+	_, err = d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "block-volume",
+		StagingTargetPath: "/mnt/staging/block-volume",
+		VolumeCapability:  block,
+	})
+	assert.Nil(t, err)
+	assert.Len(t, *mounts, 1)
+
+	// Each access type is refused for a volume of the other
+	request := stageRequest("/mnt/staging/block-volume")
+	request.VolumeId = "block-volume"
+	_, err = d.NodeStageVolume(context.Background(), request)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	request = stageRequest("/mnt/staging/test-volume")
+	request.VolumeCapability = block
+	_, err = d.NodeStageVolume(context.Background(), request)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Len(t, *mounts, 1)
+
+	// A capability must be passed
+	request = stageRequest("/mnt/staging/test-volume")
+	request.VolumeCapability = nil
+	_, err = d.NodeStageVolume(context.Background(), request)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultShutdownTimeout is how long shutdown waits for in-flight operations
+// when the configuration doesn't set shutdown_timeout.
+const DefaultShutdownTimeout = 30 * time.Second
+
+// errShuttingDown is returned when an operation is started during shutdown.
+var errShuttingDown = errors.New("driver is shutting down")
+
+// operations tracks the backups and other restic operations in flight, so
+// shutdown can wait for them instead of orphaning restic and its locks.
+type operations struct {
+	mu     sync.Mutex // protects closed
+	closed bool
+	wg     sync.WaitGroup
+
+	// ctx is cancelled once shutdown stops waiting for operations.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newOperations() *operations {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &operations{ctx: ctx, cancel: cancel}
+}
+
+// start registers an operation. The returned context is cancelled when parent
+// is, or when shutdown gives up waiting. done must be called once the
+// operation finished.
+func (o *operations) start(parent context.Context) (ctx context.Context, done func(), err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return nil, nil, errShuttingDown
+	}
+	o.wg.Add(1)
+
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-o.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		cancel()
+		o.wg.Done()
+	}, nil
+}
+
+// runDetached calls fn on every tick of interval in the background, until ctx
+// is cancelled. fn isn't given ctx: shutdown cancels it straight away, while
+// the operations fn starts are waited for by drain and only interrupted once
+// it gives up waiting.
+func (o *operations) runDetached(ctx context.Context, interval time.Duration, fn func(ctx context.Context, now time.Time)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				fn(o.ctx, now)
+			}
+		}
+	}()
+}
+
+// drain refuses new operations and waits up to timeout for the ones in flight.
+// Operations still running after that are cancelled, which interrupts restic
+// and unlocks the repository, and waited for. drain reports whether every
+// operation finished on its own.
+func (o *operations) drain(timeout time.Duration) bool {
+	o.mu.Lock()
+	o.closed = true
+	o.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		o.wg.Wait()
+		close(finished)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-finished:
+		return true
+	case <-timer.C:
+	}
+	o.cancel()
+	<-finished
+	return false
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"nodeto/restic-csi-plugin/internal/restic"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// mockSlowBackup points restic at a script whose backup takes delay unless it
+// is interrupted, and returns a function listing the recorded invocations.
+func mockSlowBackup(t *testing.T, delay time.Duration) func() []string {
+	dir := t.TempDir()
+	script := "#!/bin/sh\n" +
+		"echo \"$*\" >> " + dir + "/invocations\n" +
+		"case $1 in\n" +
+		"snapshots) echo '[]' ;;\n" +
+		"backup)\n" +
+		"  trap 'kill $!; exit 130' INT\n" +
+		"  sleep " + strconv.Itoa(int(delay.Seconds())) + " >/dev/null &\n" +
+		"  wait\n" +
+		"  echo '{\"message_type\":\"summary\",\"snapshot_id\":\"4f3a2b1c\"}' ;;\n" +
+		"esac\n"
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "restic"), []byte(script), 0755))
+
+	restic.Binary = filepath.Join(dir, "restic")
+	t.Cleanup(func() { restic.Binary = "restic" })
+
+	return func() []string {
+		data, _ := os.ReadFile(filepath.Join(dir, "invocations"))
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+}
+
+// startSlowSnapshot creates a snapshot in the background and waits until its
+// backup is running.
+func startSlowSnapshot(t *testing.T, d *Driver, invocations func() []string) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		_, err := d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snapshot-1", SourceVolumeId: "test-volume"})
+		result <- err
+	}()
+	assert.Eventually(t, func() bool {
+		return len(invocations()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	return result
+}
+
+func TestShutdownWaitsForBackup(t *testing.T) {
+	invocations := mockSlowBackup(t, time.Second)
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "test-volume", Mounted: true, Target: "/mnt/test"}}}
+	d := newResticSnapshotDriver(thinPool)
+	d.config.ShutdownTimeout = time.Minute
+
+	result := startSlowSnapshot(t, d, invocations)
+	d.drainOperations()
+
+	// The backup finished before drainOperations returned
+	select {
+	case err := <-result:
+		assert.Nil(t, err)
+	default:
+		t.Fatal("backup still running after shutdown")
+	}
+	assert.Len(t, invocations(), 2)
+
+	// No operations are started once shut down
+	_, err := d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snapshot-2", SourceVolumeId: "test-volume"})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestShutdownInterruptsSlowBackup(t *testing.T) {
+	invocations := mockSlowBackup(t, time.Minute)
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "test-volume", Mounted: true, Target: "/mnt/test"}}}
+	d := newResticSnapshotDriver(thinPool)
+	d.config.ShutdownTimeout = 100 * time.Millisecond
+
+	result := startSlowSnapshot(t, d, invocations)
+	start := time.Now()
+	d.drainOperations()
+	assert.Less(t, time.Since(start), 10*time.Second)
+
+	select {
+	case err := <-result:
+		assert.NotNil(t, err)
+	default:
+		t.Fatal("backup still running after shutdown")
+	}
+	// The repository is unlocked after interrupting the backup
+	assert.Equal(t, "unlock", invocations()[2])
+}
+
+func TestRunDetachedOutlivesItsContext(t *testing.T) {
+	o := newOperations()
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	o.runDetached(ctx, 10*time.Millisecond, func(ctx context.Context, now time.Time) {
+		ctx, done, err := o.start(ctx)
+		if err != nil {
+			return
+		}
+		defer done()
+		select {
+		case started <- struct{}{}:
+		default:
+			return
+		}
+		select {
+		case <-release:
+			interrupted <- false
+		case <-ctx.Done():
+			interrupted <- true
+		}
+	})
+	<-started
+
+	// Cancelling the loop's context leaves the run in flight to finish
+	cancel()
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	assert.True(t, o.drain(time.Minute))
+	assert.False(t, <-interrupted)
+}
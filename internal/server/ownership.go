@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+	"io/fs"
+	"nodeto/restic-csi-plugin/config"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// fsGroupAttribute is the volume context attribute with the group owning a
+// published volume, used when the CO doesn't pass a VolumeMountGroup.
+const fsGroupAttribute = "fsGroup"
+
+// volumeMountGroup returns the group the published volume is owned by, the
+// VolumeMountGroup of the capability takes precedence over the fsGroup
+// attribute. False is returned when neither is set.
+func volumeMountGroup(capability *csi.VolumeCapability, volumeContext map[string]string) (int, bool, error) {
+	group := capability.GetMount().GetVolumeMountGroup()
+	if group == "" {
+		group = volumeContext[fsGroupAttribute]
+	}
+	if group == "" {
+		return 0, false, nil
+	}
+	gid, err := strconv.Atoi(group)
+	if err != nil || gid < 0 {
+		return 0, false, fmt.Errorf("volume mount group must be a group ID, got %q", group)
+	}
+	return gid, true, nil
+}
+
+// applyFSGroup makes root owned by the group the way kubelet applies an
+// fsGroup: group read-write, group executable where the owner is, and setgid
+// on directories so new files inherit the group. With the recursive policy
+// every file below root is changed too.
+func (d *Driver) applyFSGroup(root string, gid int) error {
+	if d.config.VolumeInformation.FSGroupPolicy != config.FSGroupPolicyRecursive {
+		info, err := os.Lstat(root)
+		if err != nil {
+			return err
+		}
+		return chownToGroup(root, info.Mode(), gid)
+	}
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		return chownToGroup(path, info.Mode(), gid)
+	})
+}
+
+// chownToGroup changes the group and group permissions of one file.
+// Symlinks are chowned themselves and keep their permissions.
+func chownToGroup(path string, mode fs.FileMode, gid int) error {
+	if err := os.Lchown(path, -1, gid); err != nil {
+		return fmt.Errorf("error changing group of %s: %w", path, err)
+	}
+	if mode&fs.ModeSymlink != 0 {
+		return nil
+	}
+
+	perm := mode & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+	perm |= 0060
+	if mode&0100 != 0 || mode.IsDir() {
+		perm |= 0010
+	}
+	if mode.IsDir() {
+		perm |= fs.ModeSetgid
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		return fmt.Errorf("error changing permissions of %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"nodeto/restic-csi-plugin/internal/metrics"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultPoolCriticalThreshold is the data percentage above which the thin
+// pool is protected when pool_full doesn't set a critical threshold.
+const DefaultPoolCriticalThreshold = 95
+
+// DefaultPoolFullInterval is how often the thin pool's fullness is polled
+// when pool_full doesn't set an interval.
+const DefaultPoolFullInterval = 30 * time.Second
+
+var poolCritical = metrics.NewGauge("restic_csi_pool_critical", "1 when the thin pool is above the critical threshold and new volumes and mounts are refused.")
+
+// remountReadOnly allows mocking of the read-only remounts of the volumes of
+// a full pool.
+var remountReadOnly = lvm.RemountReadOnly
+
+// poolCriticalThreshold returns the data percentage above which the pool is
+// protected.
+func (d *Driver) poolCriticalThreshold() lvm.Percent {
+	if threshold := d.config.VolumeInformation.PoolFull.CriticalThreshold; threshold > 0 {
+		return lvm.Percent(threshold)
+	}
+	return DefaultPoolCriticalThreshold
+}
+
+// startPoolFullPolicy polls the fullness of the thin pool with the protect
+// policy, until the context is cancelled.
+func (d *Driver) startPoolFullPolicy(ctx context.Context) {
+	if d.config.VolumeInformation.PoolFull.Policy != config.PoolFullProtect {
+		return
+	}
+	interval := d.config.VolumeInformation.PoolFull.Interval
+	if interval <= 0 {
+		interval = DefaultPoolFullInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				d.checkPoolFull(ctx)
+			}
+		}
+	}()
+}
+
+// checkPoolFull records whether the thin pool is above the critical
+// threshold. Once the pool crosses it, the mounted volumes are remounted
+// read-only if configured, they stay read-only after the pool recovers until
+// they're mounted again.
+func (d *Driver) checkPoolFull(ctx context.Context) {
+	log := d.log.WithField("method", "check_pool_full")
+
+	poolStatus, err := d.thinPool.Status(ctx)
+	if err != nil {
+		log.WithError(err).Error("failed to get thin pool status")
+		return
+	}
+	threshold := d.poolCriticalThreshold()
+	critical := poolStatus.DataPercent >= threshold
+
+	d.poolMu.Lock()
+	crossed := critical && !d.poolCritical
+	recovered := !critical && d.poolCritical
+	d.poolCritical = critical
+	d.poolDataPercent = poolStatus.DataPercent
+	d.poolMu.Unlock()
+
+	log = log.WithFields(logrus.Fields{"data_percent": poolStatus.DataPercent, "threshold": threshold})
+	switch {
+	case crossed:
+		poolCritical.Set(1)
+		log.Error("thin pool is above the critical threshold, refusing new volumes and mounts")
+		if d.config.VolumeInformation.PoolFull.RemountReadOnly {
+			d.remountVolumesReadOnly(ctx, log)
+		}
+	case recovered:
+		poolCritical.Set(0)
+		log.Info("thin pool is below the critical threshold again")
+	}
+}
+
+// remountVolumesReadOnly remounts the filesystem of every mounted volume
+// read-only. Remounting the filesystem makes its bind mounts read-only too.
+func (d *Driver) remountVolumesReadOnly(ctx context.Context, log *logrus.Entry) {
+	for _, volume := range d.thinPool.ListVolumes(ctx) {
+		if !volume.Mounted {
+			continue
+		}
+		volumeLog := log.WithFields(logrus.Fields{"volume_id": d.volumeID(volume.LVName), "target": volume.Target})
+		if err := remountReadOnly(ctx, d.thinPool.CommandRunner(), volume.Target); err != nil {
+			volumeLog.WithError(err).Error("failed to remount volume read-only")
+			continue
+		}
+		volumeLog.Warn("volume is remounted read-only")
+	}
+}
+
+// poolFullError returns ResourceExhausted while the thin pool is above the
+// critical threshold, so no new volume or mount adds writes to it.
+func (d *Driver) poolFullError() error {
+	d.poolMu.Lock()
+	defer d.poolMu.Unlock()
+	if !d.poolCritical {
+		return nil
+	}
+	return status.Errorf(codes.ResourceExhausted, "thin pool is %.1f%% full, above the critical threshold of %.1f%%, new volumes and mounts are refused", float64(d.poolDataPercent), float64(d.poolCriticalThreshold()))
+}
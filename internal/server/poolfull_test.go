@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// mockRemountReadOnly records the targets remounted read-only.
+func mockRemountReadOnly(t *testing.T) *[]string {
+	var remounted []string
+	remountReadOnly = func(ctx context.Context, runner lvm.CommandRunner, target string) error {
+		remounted = append(remounted, target)
+		return nil
+	}
+	t.Cleanup(func() { remountReadOnly = lvm.RemountReadOnly })
+	return &remounted
+}
+
+func createRequest(name string) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name:               name,
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	}
+}
+
+func TestCheckPoolFullRemountsVolumesReadOnly(t *testing.T) {
+	remounted := mockRemountReadOnly(t)
+	mockStageMounts(t)
+	thinPool := &fakeThinPool{
+		Volumes: []lvm.Volume{
+			{VGName: "vg0", LVName: "mounted-volume", Mounted: true, Target: "/mnt/staging/mounted-volume"},
+			{VGName: "vg0", LVName: "test-volume"},
+		},
+		PoolStatus: lvm.PoolStatus{DataPercent: 50},
+	}
+	d := newTestDriver(thinPool)
+	d.config.VolumeInformation.PoolFull = config.PoolFull{Policy: config.PoolFullProtect, RemountReadOnly: true}
+	ctx := context.Background()
+
+	// Below the threshold nothing is done
+	d.checkPoolFull(ctx)
+	assert.Empty(t, *remounted)
+	assert.Nil(t, d.poolFullError())
+
+	// The pool crosses the threshold, the mounted volumes are remounted
+	// read-only and new volumes and mounts are refused
+	thinPool.PoolStatus.DataPercent = 97
+	d.checkPoolFull(ctx)
+	assert.Equal(t, []string{"/mnt/staging/mounted-volume"}, *remounted)
+	assert.Equal(t, float64(1), poolCritical.Value())
+
+	_, err := d.CreateVolume(ctx, createRequest("new-volume"))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	_, err = d.NodeStageVolume(ctx, stageRequest("/mnt/staging/test-volume"))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// Staying above the threshold doesn't remount again
+	d.checkPoolFull(ctx)
+	assert.Len(t, *remounted, 1)
+
+	// Once the pool recovers volumes are created again
+	thinPool.PoolStatus.DataPercent = 80
+	d.checkPoolFull(ctx)
+	assert.Equal(t, float64(0), poolCritical.Value())
+	_, err = d.CreateVolume(ctx, createRequest("new-volume"))
+	assert.Nil(t, err)
+	assert.Len(t, *remounted, 1)
+}
+
+func TestCheckPoolFullAtConfiguredThreshold(t *testing.T) {
+	remounted := mockRemountReadOnly(t)
+	thinPool := &fakeThinPool{
+		Volumes:    []lvm.Volume{{VGName: "vg0", LVName: "mounted-volume", Mounted: true, Target: "/mnt/staging/mounted-volume"}},
+		PoolStatus: lvm.PoolStatus{DataPercent: 85},
+	}
+	d := newTestDriver(thinPool)
+	d.config.VolumeInformation.PoolFull = config.PoolFull{Policy: config.PoolFullProtect, CriticalThreshold: 85}
+
+	// Without remount_read_only the volumes stay writable
+	d.checkPoolFull(context.Background())
+	assert.Empty(t, *remounted)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(d.poolFullError()))
+}
+
+func TestFailPolicyDoesNotPollThePool(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{PoolStatus: lvm.PoolStatus{DataPercent: 99}})
+	d.config.VolumeInformation.PoolFull.Policy = config.PoolFullFail
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.startPoolFullPolicy(ctx)
+	_, err := d.CreateVolume(ctx, createRequest("new-volume"))
+	assert.Nil(t, err)
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultKubeletPath is kubelet's root directory when the configuration
+// doesn't set kubelet_path.
+const DefaultKubeletPath = "/var/lib/kubelet"
+
+// kubeletVolumeData is the part of the vol_data.json kubelet keeps next to
+// the CSI target and staging paths while they are in use.
+type kubeletVolumeData struct {
+	DriverName   string `json:"driverName"`
+	VolumeHandle string `json:"volumeHandle"`
+}
+
+// Reconcile unmounts volumes left mounted at CSI target or staging paths
+// that kubelet no longer uses, ie after the node crashed. Only the paths
+// kubelet creates for this driver's volumes are considered, any other mount
+// is left alone, as is a path whose state can't be determined.
+func (d *Driver) Reconcile(ctx context.Context) error {
+	log := d.log.WithField("method", "reconcile")
+
+	var failed []string
+	for _, volume := range d.thinPool.ListVolumes(ctx) {
+		volumeID := d.volumeID(volume.LVName)
+		for _, target := range volume.Targets() {
+			targetLog := log.WithFields(logrus.Fields{
+				"volume_id": volumeID,
+				"target":    target,
+			})
+
+			dir, ok := d.kubeletVolumeDir(volumeID, target)
+			if !ok {
+				targetLog.Debug("mount isn't managed by the driver, leaving it alone")
+				continue
+			}
+			live, err := d.kubeletUsesVolume(dir, volumeID)
+			if err != nil {
+				targetLog.WithError(err).Warn("can't determine whether the mount is in use, leaving it alone")
+				continue
+			}
+			if live {
+				continue
+			}
+
+			targetLog.Info("unmounting orphaned mount")
+			if err := d.thinPool.UnmountVolumeTarget(ctx, volume.LVName, target); err != nil {
+				targetLog.WithError(err).Error("failed to unmount orphaned mount")
+				failed = append(failed, target)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to unmount %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// kubeletVolumeDir checks whether target is a path kubelet publishes or
+// stages the volume of this driver at, ie
+// "<kubelet>/pods/<pod>/volumes/kubernetes.io~csi/<volume>/mount" or
+// "<kubelet>/plugins/kubernetes.io/csi/<driver>/<hash>/globalmount", and
+// returns the directory holding its vol_data.json.
+func (d *Driver) kubeletVolumeDir(volumeID string, target string) (string, bool) {
+	kubeletPath := d.config.VolumeInformation.KubeletPath
+	if kubeletPath == "" {
+		kubeletPath = DefaultKubeletPath
+	}
+	rel, err := filepath.Rel(kubeletPath, filepath.Clean(target))
+	if err != nil {
+		return "", false
+	}
+
+	parts := strings.Split(rel, string(filepath.Separator))
+	if len(parts) != 6 {
+		return "", false
+	}
+	published := parts[0] == "pods" && parts[2] == "volumes" && parts[3] == "kubernetes.io~csi" && parts[4] == volumeID && parts[5] == "mount"
+	staged := parts[0] == "plugins" && parts[1] == "kubernetes.io" && parts[2] == "csi" && parts[3] == d.name && parts[5] == "globalmount"
+	if !published && !staged {
+		return "", false
+	}
+	return filepath.Dir(filepath.Clean(target)), true
+}
+
+// kubeletUsesVolume reports whether kubelet still tracks the volume in dir,
+// which it does as long as the vol_data.json it writes there exists.
+func (d *Driver) kubeletUsesVolume(dir string, volumeID string) (bool, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "vol_data.json"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var volumeData kubeletVolumeData
+	if err := json.Unmarshal(data, &volumeData); err != nil {
+		return false, fmt.Errorf("failed to parse vol_data.json: %v", err)
+	}
+	if volumeData.DriverName != d.name || volumeData.VolumeHandle != volumeID {
+		return false, fmt.Errorf("vol_data.json is for volume %q of driver %q", volumeData.VolumeHandle, volumeData.DriverName)
+	}
+	return true, nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// kubeletTargetPath creates the target path kubelet publishes the volume of
+// the pod at, with its vol_data.json if live.
+func kubeletTargetPath(t *testing.T, kubeletPath string, pod string, volumeID string, live bool) string {
+	dir := filepath.Join(kubeletPath, "pods", pod, "volumes", "kubernetes.io~csi", volumeID)
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "mount"), 0755))
+	if live {
+		volumeData := `{"driverName":"` + DefaultDriverName + `","volumeHandle":"` + volumeID + `"}`
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, "vol_data.json"), []byte(volumeData), 0644))
+	}
+	return filepath.Join(dir, "mount")
+}
+
+func TestReconcileUnmountsOrphanedMounts(t *testing.T) {
+	kubeletPath := t.TempDir()
+	live := kubeletTargetPath(t, kubeletPath, "pod-1", "test-volume", true)
+	orphaned := kubeletTargetPath(t, kubeletPath, "pod-2", "other-volume", false)
+
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{
+		{VGName: "vg0", LVName: "test-volume", Mounted: true, Target: live},
+		{VGName: "vg0", LVName: "other-volume", Mounted: true, Target: orphaned, AdditionalTargets: []string{"/mnt/other"}},
+		{VGName: "vg0", LVName: "unmounted-volume"},
+	}}
+	d := newTestDriver(thinPool)
+	d.config.VolumeInformation.KubeletPath = kubeletPath
+
+	assert.Nil(t, d.Reconcile(context.Background()))
+	// The mount outside kubelet's paths isn't driver-managed
+	assert.Equal(t, []string{orphaned}, thinPool.Unmounted)
+}
+
+func TestReconcileLeavesUnidentifiedMounts(t *testing.T) {
+	kubeletPath := t.TempDir()
+	// The target is of another volume
+	mismatched := kubeletTargetPath(t, kubeletPath, "pod-1", "other-volume", false)
+	// vol_data.json can't be parsed
+	unreadable := kubeletTargetPath(t, kubeletPath, "pod-2", "test-volume", false)
+	assert.Nil(t, os.WriteFile(filepath.Join(filepath.Dir(unreadable), "vol_data.json"), []byte("{"), 0644))
+
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{
+		{VGName: "vg0", LVName: "test-volume", Mounted: true, Target: mismatched, AdditionalTargets: []string{unreadable, filepath.Join(kubeletPath, "pods", "pod-3", "mount")}},
+	}}
+	d := newTestDriver(thinPool)
+	d.config.VolumeInformation.KubeletPath = kubeletPath
+
+	assert.Nil(t, d.Reconcile(context.Background()))
+	assert.Empty(t, thinPool.Unmounted)
+}
+
+func TestKubeletVolumeDir(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{})
+
+	dir, ok := d.kubeletVolumeDir("test-volume", "/var/lib/kubelet/pods/2f1e/volumes/kubernetes.io~csi/test-volume/mount")
+	assert.True(t, ok)
+	assert.Equal(t, "/var/lib/kubelet/pods/2f1e/volumes/kubernetes.io~csi/test-volume", dir)
+
+	dir, ok = d.kubeletVolumeDir("test-volume", "/var/lib/kubelet/plugins/kubernetes.io/csi/"+DefaultDriverName+"/9a8b/globalmount")
+	assert.True(t, ok)
+	assert.Equal(t, "/var/lib/kubelet/plugins/kubernetes.io/csi/"+DefaultDriverName+"/9a8b", dir)
+
+	for _, target := range []string{
+		"/mnt/test",
+		"/var/lib/kubelet/pods/2f1e/volumes/kubernetes.io~csi/other-volume/mount",
+		"/var/lib/kubelet/pods/2f1e/volumes/kubernetes.io~empty-dir/test-volume/mount",
+		"/var/lib/kubelet/plugins/kubernetes.io/csi/other.csi.example.com/9a8b/globalmount",
+		"/var/lib/kubelet/pods/../../../../mnt/test/volumes/kubernetes.io~csi/test-volume/mount",
+	} {
+		_, ok = d.kubeletVolumeDir("test-volume", target)
+		assert.False(t, ok, target)
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"nodeto/restic-csi-plugin/internal/restic"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// findSnapshot returns the restic snapshot with the ID in the destination.
+func findSnapshot(ctx context.Context, dest config.Destination, snapshotID string) (*restic.Snapshot, error) {
+	snapshots, err := restic.Snapshots(ctx, dest)
+	if err != nil {
+		return nil, resticError(err)
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.ID == snapshotID {
+			return &snapshot, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "snapshot %q not found", snapshotID)
+}
+
+// restoreVolume creates the volume with the tags and restores the restic
+// snapshot into it. The volume is removed again if the restore fails, so a
+// retry starts over.
+func (d *Driver) restoreVolume(ctx context.Context, log *logrus.Entry, lvName string, size lvm.ByteSize, encrypted bool, tags []string, dest config.Destination, snapshot *restic.Snapshot) (err error) {
+	ctx, done, err := d.operations.start(ctx)
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	defer done()
+
+	create := d.thinPool.EnsureVolumeIsPresent
+	if encrypted {
+		create = d.thinPool.EnsureEncryptedVolumeIsPresent
+	}
+	if err := create(ctx, lvName, size, tags...); err != nil {
+		return lvmError(err)
+	}
+	mountPath := filepath.Join(d.config.VolumeInformation.StagingPath, "restores", lvName)
+	mounted := false
+	var volume *lvm.Volume
+	defer func() {
+		if err == nil {
+			return
+		}
+		if mounted {
+			if unmountErr := unmount(ctx, d.thinPool.CommandRunner(), mountPath); unmountErr != nil {
+				log.WithError(unmountErr).Error("failed to unmount volume of failed restore")
+			}
+		}
+		if volume != nil && volume.Encrypted {
+			if closeErr := closeLUKS(volume, ctx); closeErr != nil {
+				log.WithError(closeErr).Error("failed to close LUKS device of failed restore")
+			}
+		}
+		if removeErr := d.thinPool.EnsureVolumeIsAbsent(ctx, lvName); removeErr != nil {
+			log.WithError(removeErr).Error("failed to remove volume of failed restore")
+		}
+	}()
+
+	volume = d.thinPool.GetVolume(ctx, lvName)
+	if volume == nil {
+		return status.Errorf(codes.Internal, "volume %q was not found after creation", lvName)
+	}
+	if encrypted {
+		if err := openEncryptedVolume(ctx, volume); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+	if err := mountVolume(volume, ctx, mountPath); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	mounted = true
+
+	// The snapshot holds the path the volume was backed up from, only its
+	// contents are restored to the root of the volume.
+	source := snapshot.ID
+	if len(snapshot.Paths) == 1 {
+		source += ":" + snapshot.Paths[0]
+	}
+	if err := restic.Restore(ctx, dest, source, mountPath); err != nil {
+		return resticError(err)
+	}
+
+	if err := unmount(ctx, d.thinPool.CommandRunner(), mountPath); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	mounted = false
+	if encrypted {
+		if err := closeLUKS(volume, ctx); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+	log.WithField("snapshot_id", snapshot.ID).Info("snapshot restored")
+	return nil
+}
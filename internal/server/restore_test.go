@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"nodeto/restic-csi-plugin/internal/restic"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// mockResticRestore points restic at a script listing one snapshot of
+// /mnt/staging/test-volume, whose restores fail with failRestore. It returns
+// a function listing the recorded invocations.
+func mockResticRestore(t *testing.T, failRestore bool) func() []string {
+	dir := t.TempDir()
+	script := "#!/bin/sh\n" +
+		"echo \"$*\" >> " + dir + "/invocations\n" +
+		"if [ $1 = snapshots ]; then echo '[{\"id\":\"4f3a2b1c\",\"paths\":[\"/mnt/staging/test-volume\"]}]'; fi\n"
+	if failRestore {
+		script += "if [ $1 = restore ]; then echo 'Fatal: unable to restore' >&2; exit 1; fi\n"
+	}
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "restic"), []byte(script), 0755))
+
+	restic.Binary = filepath.Join(dir, "restic")
+	t.Cleanup(func() { restic.Binary = "restic" })
+
+	return func() []string {
+		data, _ := os.ReadFile(filepath.Join(dir, "invocations"))
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+}
+
+// mockUnmount records the unmounted targets instead of unmounting them.
+func mockUnmount(t *testing.T) *[]string {
+	var unmounted []string
+	unmount = func(ctx context.Context, runner lvm.CommandRunner, target string) error {
+		unmounted = append(unmounted, target)
+		return nil
+	}
+	t.Cleanup(func() { unmount = lvm.Unmount })
+	return &unmounted
+}
+
+func restoreRequest(snapshotID string) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name:               "restored-volume",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotID}},
+		},
+	}
+}
+
+func TestCreateVolumeFromSnapshot(t *testing.T) {
+	invocations := mockResticRestore(t, false)
+	mounts := mockStageMounts(t)
+	unmounted := mockUnmount(t)
+	thinPool := &fakeThinPool{}
+	d := newResticSnapshotDriver(thinPool)
+	d.config.VolumeInformation.StagingPath = "/mnt/staging"
+
+	resp, err := d.CreateVolume(context.Background(), restoreRequest("4f3a2b1c"))
+	assert.Nil(t, err)
+	assert.Equal(t, "4f3a2b1c", resp.Volume.ContentSource.GetSnapshot().SnapshotId)
+	assert.Equal(t, []string{"/mnt/staging/restores/restored-volume "}, *mounts)
+	assert.Equal(t, "restore 4f3a2b1c:/mnt/staging/test-volume --target /mnt/staging/restores/restored-volume", invocations()[1])
+	assert.Equal(t, []string{"/mnt/staging/restores/restored-volume"}, *unmounted)
+	assert.NotNil(t, thinPool.GetVolume(context.Background(), "restored-volume"))
+	_, ok := d.metadata.Get("restored-volume")
+	assert.True(t, ok)
+}
+
+func TestCreateVolumeFromSnapshotRemovesVolumeOnFailure(t *testing.T) {
+	mockResticRestore(t, true)
+	mockStageMounts(t)
+	unmounted := mockUnmount(t)
+	thinPool := &fakeThinPool{}
+	d := newResticSnapshotDriver(thinPool)
+
+	_, err := d.CreateVolume(context.Background(), restoreRequest("4f3a2b1c"))
+	assert.Equal(t, codes.Internal, status.Code(err))
+	// The partially restored volume is unmounted and removed
+	assert.Equal(t, []string{"restores/restored-volume"}, *unmounted)
+	assert.Nil(t, thinPool.GetVolume(context.Background(), "restored-volume"))
+	_, ok := d.metadata.Get("restored-volume")
+	assert.False(t, ok)
+}
+
+func TestCreateVolumeFromMissingSnapshot(t *testing.T) {
+	mockResticRestore(t, false)
+	thinPool := &fakeThinPool{}
+	d := newResticSnapshotDriver(thinPool)
+
+	_, err := d.CreateVolume(context.Background(), restoreRequest("deadbeef"))
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Empty(t, thinPool.Volumes)
+
+	// Snapshots can only be restored with the restic snapshot backend
+	d = newTestDriver(thinPool)
+	_, err = d.CreateVolume(context.Background(), restoreRequest("4f3a2b1c"))
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/redact"
+	"nodeto/restic-csi-plugin/internal/restic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// startRetention applies the retention policy of every destination which has
+// one on its configured interval, until the context is cancelled.
+func (d *Driver) startRetention(ctx context.Context) {
+	for _, dest := range d.config.ResticRepo {
+		if !dest.Retention.Enabled() || dest.Retention.Interval <= 0 {
+			continue
+		}
+		if dest.AppendOnly {
+			d.log.WithField("repository", redact.URL(dest.Repository)).Warn("repository is append-only, retention must be run elsewhere")
+			continue
+		}
+		dest := dest
+		d.operations.runDetached(ctx, dest.Retention.Interval, func(ctx context.Context, now time.Time) {
+			d.applyRetention(ctx, dest)
+		})
+	}
+}
+
+// applyRetention runs the destination's retention policy, a locked
+// repository is left for the next run.
+func (d *Driver) applyRetention(ctx context.Context, dest config.Destination) {
+	log := d.log.WithFields(logrus.Fields{
+		"repository": redact.URL(dest.Repository),
+		"method":     "apply_retention",
+	})
+
+	ctx, done, err := d.operations.start(ctx)
+	if err != nil {
+		log.WithError(err).Info("skipping retention")
+		return
+	}
+	defer done()
+
+	// The restic snapshots of CSI snapshots are referred to by their
+	// VolumeSnapshots, they're only removed by DeleteSnapshot.
+	_, err = restic.ApplyRetention(ctx, dest, dest.Retention, csiSnapshotTag)
+	if errors.Is(err, restic.ErrRepositoryLocked) {
+		log.WithError(err).Warn("repository is locked, retention will be retried")
+	} else if err != nil {
+		log.WithError(err).Error("applying retention failed")
+	}
+}
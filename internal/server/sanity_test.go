@@ -0,0 +1,316 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// sanityClients are the CSI services of a driver served over its socket.
+type sanityClients struct {
+	identity   csi.IdentityClient
+	controller csi.ControllerClient
+	node       csi.NodeClient
+}
+
+// startSanityDriver serves a driver backed by the in-memory thin pool on a
+// unix socket, with the mounts of the node recorded instead of done, and
+// connects to it like a CO would.
+func startSanityDriver(t *testing.T) sanityClients {
+	// Socket paths are limited to about 100 bytes, the test's temporary
+	// directory can be longer.
+	dir, err := os.MkdirTemp("", "csi-sanity-")
+	assert.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	mockStageMounts(t)
+	mockBindMount(t)
+	// Published targets are tracked so that a retry which mounts a target
+	// twice fails, like stacking a second mount would on a node.
+	var mu sync.Mutex
+	published := map[string]bool{}
+	bindMount = func(ctx context.Context, runner lvm.CommandRunner, source string, target string, readOnly bool) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if published[target] {
+			return fmt.Errorf("%s is already mounted", target)
+		}
+		published[target] = true
+		return nil
+	}
+	isMountPoint = func(target string) (bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return published[target], nil
+	}
+	unmount = func(ctx context.Context, runner lvm.CommandRunner, target string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(published, target)
+		return nil
+	}
+	t.Cleanup(func() { unmount = lvm.Unmount })
+
+	d := newTestDriver(&fakeThinPool{})
+	d.config.VolumeInformation.StagingPath = filepath.Join(dir, "staging")
+	listener, err := net.Listen("unix", filepath.Join(dir, "csi.sock"))
+	assert.Nil(t, err)
+	srv := d.newGRPCServer()
+	go srv.Serve(listener)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("unix://"+filepath.Join(dir, "csi.sock"), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return sanityClients{
+		identity:   csi.NewIdentityClient(conn),
+		controller: csi.NewControllerClient(conn),
+		node:       csi.NewNodeClient(conn),
+	}
+}
+
+// assertCode checks that err is a status error with the code.
+func assertCode(t *testing.T, code codes.Code, err error) {
+	t.Helper()
+	assert.Equal(t, code, status.Code(err), "error: %v", err)
+}
+
+// hasControllerCapability reports whether the controller advertises rpc,
+// the checks of RPCs which aren't advertised are skipped.
+func hasControllerCapability(t *testing.T, c sanityClients, rpc csi.ControllerServiceCapability_RPC_Type) bool {
+	resp, err := c.controller.ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+	assert.Nil(t, err)
+	for _, capability := range resp.Capabilities {
+		if capability.GetRpc().GetType() == rpc {
+			return true
+		}
+	}
+	return false
+}
+
+func sanityCreateRequest(name string) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name:               name,
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1024 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	}
+}
+
+// The sanity checks follow the ones of the csi-sanity suite of
+// kubernetes-csi/csi-test for the services and capabilities the driver has.
+
+func TestSanityIdentity(t *testing.T) {
+	c := startSanityDriver(t)
+	ctx := context.Background()
+
+	info, err := c.identity.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, info.Name)
+	assert.NotEmpty(t, info.VendorVersion)
+
+	capabilities, err := c.identity.GetPluginCapabilities(ctx, &csi.GetPluginCapabilitiesRequest{})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, capabilities.Capabilities)
+
+	_, err = c.identity.Probe(ctx, &csi.ProbeRequest{})
+	assert.Nil(t, err)
+}
+
+func TestSanityCreateDeleteVolume(t *testing.T) {
+	c := startSanityDriver(t)
+	ctx := context.Background()
+
+	_, err := c.controller.CreateVolume(ctx, &csi.CreateVolumeRequest{VolumeCapabilities: sanityCreateRequest("").VolumeCapabilities})
+	assertCode(t, codes.InvalidArgument, err)
+	_, err = c.controller.CreateVolume(ctx, &csi.CreateVolumeRequest{Name: "sanity"})
+	assertCode(t, codes.InvalidArgument, err)
+
+	// Creating the same volume again returns it
+	created, err := c.controller.CreateVolume(ctx, sanityCreateRequest("sanity"))
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, created.Volume.CapacityBytes, int64(1024*1024*1024))
+	again, err := c.controller.CreateVolume(ctx, sanityCreateRequest("sanity"))
+	assert.Nil(t, err)
+	assert.Equal(t, created.Volume.VolumeId, again.Volume.VolumeId)
+
+	// but not with an incompatible size
+	larger := sanityCreateRequest("sanity")
+	larger.CapacityRange.RequiredBytes *= 2
+	_, err = c.controller.CreateVolume(ctx, larger)
+	assertCode(t, codes.AlreadyExists, err)
+
+	_, err = c.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{})
+	assertCode(t, codes.InvalidArgument, err)
+	for i := 0; i < 2; i++ {
+		_, err = c.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: created.Volume.VolumeId})
+		assert.Nil(t, err)
+	}
+	_, err = c.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "does-not-exist"})
+	assert.Nil(t, err)
+}
+
+func TestSanityControllerVolumes(t *testing.T) {
+	c := startSanityDriver(t)
+	ctx := context.Background()
+	capabilities := sanityCreateRequest("").VolumeCapabilities
+
+	created, err := c.controller.CreateVolume(ctx, sanityCreateRequest("sanity"))
+	assert.Nil(t, err)
+	volumeID := created.Volume.VolumeId
+
+	_, err = c.controller.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{VolumeCapabilities: capabilities})
+	assertCode(t, codes.InvalidArgument, err)
+	_, err = c.controller.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{VolumeId: volumeID})
+	assertCode(t, codes.InvalidArgument, err)
+	_, err = c.controller.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{VolumeId: "does-not-exist", VolumeCapabilities: capabilities})
+	assertCode(t, codes.NotFound, err)
+	validated, err := c.controller.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{VolumeId: volumeID, VolumeCapabilities: capabilities})
+	assert.Nil(t, err)
+	assert.NotNil(t, validated.Confirmed)
+
+	if hasControllerCapability(t, c, csi.ControllerServiceCapability_RPC_LIST_VOLUMES) {
+		listed, err := c.controller.ListVolumes(ctx, &csi.ListVolumesRequest{})
+		assert.Nil(t, err)
+		assert.Len(t, listed.Entries, 1)
+		assert.Equal(t, volumeID, listed.Entries[0].Volume.VolumeId)
+		_, err = c.controller.ListVolumes(ctx, &csi.ListVolumesRequest{StartingToken: "invalid-token"})
+		assertCode(t, codes.Aborted, err)
+	}
+
+	if hasControllerCapability(t, c, csi.ControllerServiceCapability_RPC_GET_VOLUME) {
+		_, err = c.controller.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{})
+		assertCode(t, codes.InvalidArgument, err)
+		_, err = c.controller.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "does-not-exist"})
+		assertCode(t, codes.NotFound, err)
+		got, err := c.controller.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+		assert.Nil(t, err)
+		assert.Equal(t, volumeID, got.Volume.VolumeId)
+	}
+
+	if hasControllerCapability(t, c, csi.ControllerServiceCapability_RPC_EXPAND_VOLUME) {
+		capacity := &csi.CapacityRange{RequiredBytes: 2 * 1024 * 1024 * 1024}
+		_, err = c.controller.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{CapacityRange: capacity})
+		assertCode(t, codes.InvalidArgument, err)
+		_, err = c.controller.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{VolumeId: volumeID})
+		assertCode(t, codes.InvalidArgument, err)
+		_, err = c.controller.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{VolumeId: "does-not-exist", CapacityRange: capacity})
+		assertCode(t, codes.NotFound, err)
+		expanded, err := c.controller.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{VolumeId: volumeID, CapacityRange: capacity})
+		assert.Nil(t, err)
+		assert.GreaterOrEqual(t, expanded.CapacityBytes, capacity.RequiredBytes)
+	}
+
+	// GetCapacity isn't advertised and must say so
+	if !hasControllerCapability(t, c, csi.ControllerServiceCapability_RPC_GET_CAPACITY) {
+		_, err = c.controller.GetCapacity(ctx, &csi.GetCapacityRequest{})
+		assertCode(t, codes.Unimplemented, err)
+	}
+}
+
+func TestSanityControllerPublish(t *testing.T) {
+	c := startSanityDriver(t)
+	ctx := context.Background()
+	if !hasControllerCapability(t, c, csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME) {
+		t.Skip("ControllerPublishVolume is not advertised")
+	}
+	created, err := c.controller.CreateVolume(ctx, sanityCreateRequest("sanity"))
+	assert.Nil(t, err)
+	info, err := c.node.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	assert.Nil(t, err)
+	capability := sanityCreateRequest("").VolumeCapabilities[0]
+
+	for _, req := range []*csi.ControllerPublishVolumeRequest{
+		{NodeId: info.NodeId, VolumeCapability: capability},
+		{VolumeId: created.Volume.VolumeId, VolumeCapability: capability},
+		{VolumeId: created.Volume.VolumeId, NodeId: info.NodeId},
+	} {
+		_, err = c.controller.ControllerPublishVolume(ctx, req)
+		assertCode(t, codes.InvalidArgument, err)
+	}
+	_, err = c.controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: "does-not-exist", NodeId: info.NodeId, VolumeCapability: capability})
+	assertCode(t, codes.NotFound, err)
+
+	_, err = c.controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: created.Volume.VolumeId, NodeId: info.NodeId, VolumeCapability: capability})
+	assert.Nil(t, err)
+	_, err = c.controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{NodeId: info.NodeId})
+	assertCode(t, codes.InvalidArgument, err)
+	_, err = c.controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: created.Volume.VolumeId, NodeId: info.NodeId})
+	assert.Nil(t, err)
+}
+
+func TestSanityNode(t *testing.T) {
+	c := startSanityDriver(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	staging, target := filepath.Join(dir, "staging"), filepath.Join(dir, "target")
+	capability := sanityCreateRequest("").VolumeCapabilities[0]
+
+	info, err := c.node.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, info.NodeId)
+	capabilities, err := c.node.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, capabilities.Capabilities)
+
+	for _, req := range []*csi.NodeStageVolumeRequest{
+		{StagingTargetPath: staging, VolumeCapability: capability},
+		{VolumeId: "sanity", VolumeCapability: capability},
+		{VolumeId: "sanity", StagingTargetPath: staging},
+	} {
+		_, err = c.node.NodeStageVolume(ctx, req)
+		assertCode(t, codes.InvalidArgument, err)
+	}
+	for _, req := range []*csi.NodeUnstageVolumeRequest{{StagingTargetPath: staging}, {VolumeId: "sanity"}} {
+		_, err = c.node.NodeUnstageVolume(ctx, req)
+		assertCode(t, codes.InvalidArgument, err)
+	}
+	for _, req := range []*csi.NodePublishVolumeRequest{
+		{TargetPath: target, StagingTargetPath: staging, VolumeCapability: capability},
+		{VolumeId: "sanity", StagingTargetPath: staging, VolumeCapability: capability},
+		{VolumeId: "sanity", TargetPath: target, StagingTargetPath: staging},
+	} {
+		_, err = c.node.NodePublishVolume(ctx, req)
+		assertCode(t, codes.InvalidArgument, err)
+	}
+	for _, req := range []*csi.NodeUnpublishVolumeRequest{{TargetPath: target}, {VolumeId: "sanity"}} {
+		_, err = c.node.NodeUnpublishVolume(ctx, req)
+		assertCode(t, codes.InvalidArgument, err)
+	}
+	_, err = c.node.NodeExpandVolume(ctx, &csi.NodeExpandVolumeRequest{VolumeId: "does-not-exist", VolumePath: target})
+	assertCode(t, codes.NotFound, err)
+
+	// A volume goes through its whole life cycle on the node
+	created, err := c.controller.CreateVolume(ctx, sanityCreateRequest("sanity"))
+	assert.Nil(t, err)
+	volumeID := created.Volume.VolumeId
+	_, err = c.node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{VolumeId: volumeID, StagingTargetPath: staging, VolumeCapability: capability, VolumeContext: created.Volume.VolumeContext})
+	assert.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = c.node.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{VolumeId: volumeID, StagingTargetPath: staging, TargetPath: target, VolumeCapability: capability, VolumeContext: created.Volume.VolumeContext})
+		assert.Nil(t, err)
+	}
+	// The CO creates the target's parent, the target is the plugin's to
+	// remove again
+	assert.Nil(t, os.MkdirAll(target, 0750))
+	for i := 0; i < 2; i++ {
+		_, err = c.node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: target})
+		assert.Nil(t, err)
+		assert.NoDirExists(t, target)
+	}
+	_, err = c.node.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: volumeID, StagingTargetPath: staging})
+	assert.Nil(t, err)
+	_, err = c.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	assert.Nil(t, err)
+}
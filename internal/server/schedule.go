@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"nodeto/restic-csi-plugin/internal/metadata"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// backupIntervalParameter is the StorageClass parameter overriding how often
+// a volume is backed up, ie backup_interval: "1h", "0" never backs it up on a
+// schedule.
+const backupIntervalParameter = "backup_interval"
+
+// backupScheduleTick is how often the schedule looks for volumes due a backup.
+var backupScheduleTick = time.Minute
+
+// scheduledBackup allows mocking of the backups taken on the schedule.
+var scheduledBackup = (*Driver).backupVolume
+
+// parseBackupInterval parses the backup_interval parameter.
+func parseBackupInterval(value string) (time.Duration, error) {
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval < 0 {
+		return 0, fmt.Errorf("parameter %s must be a positive duration like 1h or 0, got %q", backupIntervalParameter, value)
+	}
+	return interval, nil
+}
+
+// backupInterval returns how often the volume is backed up, zero is never.
+func (d *Driver) backupInterval(volumeMetadata metadata.Volume) time.Duration {
+	if volumeMetadata.BackupInterval != "" {
+		if interval, err := parseBackupInterval(volumeMetadata.BackupInterval); err == nil {
+			return interval
+		}
+	}
+	return d.config.VolumeInformation.BackupInterval
+}
+
+// recordedVolumeContext is the volume context of a backup taken outside of a
+// CSI call, from the recorded metadata. Volumes without metadata get the
+// configured defaults.
+func recordedVolumeContext(volumeMetadata metadata.Volume, recorded bool) map[string]string {
+	if !recorded {
+		return nil
+	}
+	return map[string]string{
+		backupParameter:    strconv.FormatBool(volumeMetadata.Backup),
+		encryptedParameter: strconv.FormatBool(volumeMetadata.Encrypted),
+	}
+}
+
+// backupSchedule is when each volume is backed up next, by LV name, and which
+// of them are being backed up right now.
+type backupSchedule struct {
+	mu      sync.Mutex // protects due and running
+	due     map[string]time.Time
+	running map[string]bool
+	// wg waits for the backups started by the schedule.
+	wg sync.WaitGroup
+}
+
+func newBackupSchedule() *backupSchedule {
+	return &backupSchedule{due: map[string]time.Time{}, running: map[string]bool{}}
+}
+
+// startBackupSchedule backs up the mounted volumes on their interval, until
+// the context is cancelled.
+func (d *Driver) startBackupSchedule(ctx context.Context) {
+	if len(d.config.ResticRepo) == 0 {
+		return
+	}
+	schedule := newBackupSchedule()
+	d.operations.runDetached(ctx, backupScheduleTick, func(ctx context.Context, now time.Time) {
+		d.runScheduledBackups(ctx, schedule, now)
+	})
+}
+
+// runScheduledBackups starts the backups of the mounted volumes which are due
+// at now. A volume is first backed up an interval after it was first seen
+// mounted, and isn't backed up again while its last backup still runs.
+// Volumes which went away are dropped from the schedule.
+func (d *Driver) runScheduledBackups(ctx context.Context, schedule *backupSchedule, now time.Time) {
+	log := d.log.WithField("method", "scheduled_backup")
+
+	schedule.mu.Lock()
+	defer schedule.mu.Unlock()
+
+	seen := map[string]bool{}
+	for _, volume := range d.thinPool.ListVolumes(ctx) {
+		// Snapshots are backed up as part of their origin, clones are
+		// volumes of their own.
+		if !volume.Mounted || volume.IsSnapshot() {
+			continue
+		}
+		// Block volumes have no filesystem to back up.
+		volumeID := d.volumeID(volume.LVName)
+		volumeMetadata, recorded := d.metadata.Get(volumeID)
+		if volumeMetadata.Block {
+			continue
+		}
+		interval := d.backupInterval(volumeMetadata)
+		if interval <= 0 {
+			continue
+		}
+		seen[volume.LVName] = true
+
+		due, scheduled := schedule.due[volume.LVName]
+		if !scheduled {
+			schedule.due[volume.LVName] = now.Add(interval)
+			continue
+		}
+		if now.Before(due) {
+			continue
+		}
+		schedule.due[volume.LVName] = now.Add(interval)
+
+		volumeLog := log.WithFields(logrus.Fields{"volume_id": volumeID, "interval": interval})
+		if schedule.running[volume.LVName] {
+			volumeLog.Warn("previous backup of the volume is still running, skipping")
+			continue
+		}
+		volumeContext := recordedVolumeContext(volumeMetadata, recorded)
+
+		schedule.running[volume.LVName] = true
+		schedule.wg.Add(1)
+		go func(volume lvm.Volume) {
+			defer schedule.wg.Done()
+			if err := scheduledBackup(d, ctx, &volume, volumeContext); err != nil {
+				volumeLog.WithError(err).Error("scheduled backup failed")
+			}
+			schedule.mu.Lock()
+			delete(schedule.running, volume.LVName)
+			schedule.mu.Unlock()
+		}(volume)
+	}
+
+	for lvName := range schedule.due {
+		if !seen[lvName] {
+			delete(schedule.due, lvName)
+		}
+	}
+}
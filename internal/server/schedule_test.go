@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"nodeto/restic-csi-plugin/internal/metadata"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// mockScheduledBackup records the volumes backed up on the schedule, each
+// backup blocks until release is closed when it isn't nil.
+func mockScheduledBackup(t *testing.T, release chan struct{}) func() []string {
+	var mu sync.Mutex
+	var backedUp []string
+	scheduledBackup = func(d *Driver, ctx context.Context, volume *lvm.Volume, volumeContext map[string]string) error {
+		mu.Lock()
+		backedUp = append(backedUp, volume.LVName)
+		mu.Unlock()
+		if release != nil {
+			<-release
+		}
+		return nil
+	}
+	t.Cleanup(func() { scheduledBackup = (*Driver).backupVolume })
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, backedUp...)
+	}
+}
+
+func newScheduleDriver(thinPool *fakeThinPool) *Driver {
+	d := newTestDriver(thinPool)
+	d.config.ResticRepo = []config.Destination{{Repository: "/mnt/backup/restic"}}
+	d.config.VolumeInformation.BackupInterval = time.Hour
+	return d
+}
+
+func TestScheduledBackupOncePerInterval(t *testing.T) {
+	backedUp := mockScheduledBackup(t, nil)
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{
+		{VGName: "vg0", LVName: "csi-hourly", Mounted: true, Target: "/mnt/hourly"},
+		{VGName: "vg0", LVName: "csi-unmounted"},
+		{VGName: "vg0", LVName: "csi-hourly-backup", LVAttr: "swi-aos---", Mounted: true, Origin: "csi-hourly"},
+	}}
+	d := newScheduleDriver(thinPool)
+	schedule := newBackupSchedule()
+	ctx := context.Background()
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	// Checked every minute for two and a half hours, the volume is backed
+	// up an hour after it was first seen and every hour after
+	for minute := 0; minute <= 150; minute++ {
+		d.runScheduledBackups(ctx, schedule, start.Add(time.Duration(minute)*time.Minute))
+		schedule.wg.Wait()
+	}
+	assert.Equal(t, []string{"csi-hourly", "csi-hourly"}, backedUp())
+}
+
+func TestScheduledBackupOfMountedClone(t *testing.T) {
+	backedUp := mockScheduledBackup(t, nil)
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{
+		{VGName: "vg0", LVName: "csi-clone", LVAttr: "Vwi-aotz--", Mounted: true, Origin: "csi-source", Target: "/mnt/clone"},
+	}}
+	d := newScheduleDriver(thinPool)
+	schedule := newBackupSchedule()
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	// A clone has an origin but is a volume of its own, so it is backed up
+	// like any other
+	d.runScheduledBackups(context.Background(), schedule, start)
+	schedule.wg.Wait()
+	d.runScheduledBackups(context.Background(), schedule, start.Add(time.Hour))
+	schedule.wg.Wait()
+	assert.Equal(t, []string{"csi-clone"}, backedUp())
+}
+
+func TestScheduledBackupPerVolumeInterval(t *testing.T) {
+	backedUp := mockScheduledBackup(t, nil)
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{
+		{VGName: "vg0", LVName: "frequent", Mounted: true},
+		{VGName: "vg0", LVName: "never", Mounted: true},
+		{VGName: "vg0", LVName: "default", Mounted: true},
+	}}
+	d := newScheduleDriver(thinPool)
+	assert.Nil(t, d.metadata.Put("frequent", metadata.Volume{Backup: true, BackupInterval: "10m"}))
+	assert.Nil(t, d.metadata.Put("never", metadata.Volume{Backup: true, BackupInterval: "0"}))
+	schedule := newBackupSchedule()
+	start := time.Now()
+
+	for minute := 0; minute <= 30; minute += 10 {
+		d.runScheduledBackups(context.Background(), schedule, start.Add(time.Duration(minute)*time.Minute))
+		schedule.wg.Wait()
+	}
+	assert.Equal(t, []string{"frequent", "frequent", "frequent"}, backedUp())
+}
+
+func TestScheduledBackupSkipsRunningBackup(t *testing.T) {
+	release := make(chan struct{})
+	backedUp := mockScheduledBackup(t, release)
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "csi-slow", Mounted: true}}}
+	d := newScheduleDriver(thinPool)
+	schedule := newBackupSchedule()
+	ctx := context.Background()
+	start := time.Now()
+
+	d.runScheduledBackups(ctx, schedule, start)
+	d.runScheduledBackups(ctx, schedule, start.Add(time.Hour))
+	// The backup takes longer than the interval, the next one is skipped
+	d.runScheduledBackups(ctx, schedule, start.Add(2*time.Hour))
+	close(release)
+	schedule.wg.Wait()
+	assert.Equal(t, []string{"csi-slow"}, backedUp())
+
+	// and the volume is backed up again on the interval after
+	d.runScheduledBackups(ctx, schedule, start.Add(3*time.Hour))
+	schedule.wg.Wait()
+	assert.Equal(t, []string{"csi-slow", "csi-slow"}, backedUp())
+}
+
+func TestScheduledBackupFollowsVolumeChurn(t *testing.T) {
+	backedUp := mockScheduledBackup(t, nil)
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "csi-a", Mounted: true}}}
+	d := newScheduleDriver(thinPool)
+	schedule := newBackupSchedule()
+	ctx := context.Background()
+	start := time.Now()
+
+	d.runScheduledBackups(ctx, schedule, start)
+	// csi-a goes away and csi-b shows up between ticks
+	thinPool.Volumes = []lvm.Volume{{VGName: "vg0", LVName: "csi-b", Mounted: true}}
+	d.runScheduledBackups(ctx, schedule, start.Add(30*time.Minute))
+	assert.NotContains(t, schedule.due, "csi-a")
+
+	// A volume coming back starts over
+	thinPool.Volumes = append(thinPool.Volumes, lvm.Volume{VGName: "vg0", LVName: "csi-a", Mounted: true})
+	d.runScheduledBackups(ctx, schedule, start.Add(time.Hour))
+	d.runScheduledBackups(ctx, schedule, start.Add(90*time.Minute))
+	schedule.wg.Wait()
+	assert.Equal(t, []string{"csi-b"}, backedUp())
+}
+
+func TestCreateVolumeRecordsBackupInterval(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{})
+	req := &csi.CreateVolumeRequest{
+		Name:               "test-volume",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		Parameters:         map[string]string{backupIntervalParameter: "6h"},
+	}
+	_, err := d.CreateVolume(context.Background(), req)
+	assert.Nil(t, err)
+	volumeMetadata, _ := d.metadata.Get("test-volume")
+	assert.Equal(t, 6*time.Hour, d.backupInterval(volumeMetadata))
+
+	req.Name = "other-volume"
+	req.Parameters[backupIntervalParameter] = "daily"
+	_, err = d.CreateVolume(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestScheduledBackupFinishesOnShutdown(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	// Registered as an operation like backupVolume
+	scheduledBackup = func(d *Driver, ctx context.Context, volume *lvm.Volume, volumeContext map[string]string) error {
+		ctx, done, err := d.operations.start(ctx)
+		if err != nil {
+			return err
+		}
+		defer done()
+		select {
+		case started <- struct{}{}:
+		default:
+			return nil
+		}
+		select {
+		case <-release:
+			interrupted <- false
+		case <-ctx.Done():
+			interrupted <- true
+		}
+		return nil
+	}
+	t.Cleanup(func() { scheduledBackup = (*Driver).backupVolume })
+	tick := backupScheduleTick
+	backupScheduleTick = 5 * time.Millisecond
+	t.Cleanup(func() { backupScheduleTick = tick })
+
+	d := newScheduleDriver(&fakeThinPool{Volumes: []lvm.Volume{
+		{VGName: "vg0", LVName: "csi-hourly", Mounted: true, Target: "/mnt/hourly"},
+	}})
+	d.config.VolumeInformation.BackupInterval = 10 * time.Millisecond
+	d.config.ShutdownTimeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	d.startBackupSchedule(ctx)
+	<-started
+
+	// Stopping Run leaves the backup in flight to finish within the
+	// shutdown timeout
+	cancel()
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	d.drainOperations()
+	assert.False(t, <-interrupted)
+}
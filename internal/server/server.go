@@ -6,6 +6,11 @@ import (
 	"net"
 	"net/url"
 	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/ionice"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"nodeto/restic-csi-plugin/internal/metadata"
+	"nodeto/restic-csi-plugin/internal/redact"
+	"nodeto/restic-csi-plugin/internal/restic"
 	"os"
 	"path"
 	"path/filepath"
@@ -22,6 +27,10 @@ const (
 	// DefaultDriverName defines the name that is used in Kubernetes and the CSI
 	// system for the canonical, official name of this plugin
 	DefaultDriverName = "restic.csi.nodeto.com"
+
+	// DefaultTopologyKey is the topology segment identifying the node a
+	// volume's thin pool lives on.
+	DefaultTopologyKey = DefaultDriverName + "/node"
 )
 
 var (
@@ -33,6 +42,7 @@ var (
 // Driver implements the following CSI interfaces:
 //
 //	csi.IdentityServer
+//	csi.ControllerServer
 //	csi.NodeServer
 type Driver struct {
 	name string
@@ -42,18 +52,46 @@ type Driver struct {
 
 	endpoint string
 	hostID   string
+	// healthPort is the port of the HTTP health server, zero disables it.
+	healthPort int
+	// socketPermissions are applied to the gRPC socket before serving.
+	socketPermissions SocketPermissions
+	// debug serves the /debug endpoints on the health server.
+	debug bool
 
 	srv *grpc.Server
 	log *logrus.Entry
+	// audit receives the audit events, nil logs them to log.
+	audit  *logrus.Entry
 	config *config.Config
 
+	thinPool lvm.ThinPoolInterface
+	metadata *metadata.Store
+	// operations tracks in-flight backups, which shutdown waits for.
+	operations *operations
+	// backupLocks keeps backups of the same volume from running at once.
+	backupLocks backupLocks
+
 	// ready defines whether the driver is ready to function. This value will
 	// be used by the `Identity` service via the `Probe()` method.
-	readyMu sync.Mutex // protects ready
+	readyMu sync.Mutex // protects ready and healthErr
 	ready   bool
+	// healthErr is why the startup health checks failed, nil if they passed.
+	healthErr error
+
+	// poolCritical is whether the thin pool was above the critical threshold
+	// at the last poll of the pool_full protect policy.
+	poolMu          sync.Mutex // protects poolCritical and poolDataPercent
+	poolCritical    bool
+	poolDataPercent lvm.Percent
 }
 
+// GetVersion returns the version the driver was built as, "dev" for builds
+// without one.
 func GetVersion() string {
+	if version == "" {
+		return "dev"
+	}
 	return version
 }
 
@@ -65,27 +103,120 @@ func GetTreeState() string {
 	return gitTreeState
 }
 
-func NewDriver(ep string, driverName string, nodeId string, cfg *config.Config) (*Driver, error) {
+func NewDriver(ep string, driverName string, nodeId string, healthPort int, socketPermissions SocketPermissions, debug bool, cfg *config.Config) (*Driver, error) {
 	if driverName == "" {
 		driverName = DefaultDriverName
 	}
 
-	if version == "" {
-		version = "dev"
+	for name, path := range cfg.Tools {
+		if err := lvm.SetToolPath(name, path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := lvm.SetVolumeNamePrefix(cfg.VolumeInformation.LVNamePrefix); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.VolumeInformation.ResolveStagingPath(nodeId); err != nil {
+		return nil, err
 	}
 
 	log := logrus.New().WithFields(logrus.Fields{
-		"version": version,
+		"version": GetVersion(),
 	})
 
+	// A missing pool doesn't stop the driver from starting, it reports the
+	// pool through Probe and /readyz until the pool shows up.
+	var healthErr error
+	thinPool, err := waitForThinPool(context.Background(), log, cfg.VolumeInformation.ThinPoolName, cfg.VolumeInformation.PoolWaitTimeout)
+	if err != nil {
+		healthErr = fmt.Errorf("failed to open thin pool %s: %w", cfg.VolumeInformation.ThinPoolName, err)
+		log.WithError(healthErr).Error("starting without the thin pool")
+		if thinPool, err = lvm.NewUncheckedThinPool(cfg.VolumeInformation.ThinPoolName, nil); err != nil {
+			return nil, err
+		}
+	}
+	thinPool.MkfsOptions = cfg.VolumeInformation.MkfsOptions
+
+	// Without a staging path the metadata is kept in memory only.
+	metadataPath := ""
+	if cfg.VolumeInformation.StagingPath != "" {
+		metadataPath = filepath.Join(cfg.VolumeInformation.StagingPath, "metadata.json")
+	}
+	store, err := metadata.Open(metadataPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ResticBinary != "" {
+		restic.Binary = cfg.ResticBinary
+	}
+
+	restic.Priority = ionice.Priority(cfg.IOPriority)
+	restic.SetConcurrency(cfg.ResticConcurrency)
+	lvm.MkfsPriority = ionice.Priority(cfg.IOPriority)
+
+	if cfg.VolumeInformation.EncryptionKey != "" {
+		lvm.EncryptionKey = []byte(cfg.VolumeInformation.EncryptionKey)
+	}
+
+	if cfg.VolumeInformation.CloneUUID != "" {
+		lvm.CloneUUIDMode = cfg.VolumeInformation.CloneUUID
+	}
+
+	if cfg.VolumeInformation.DevicePath != "" {
+		lvm.DevicePath = cfg.VolumeInformation.DevicePath
+	}
+
+	if cfg.VolumeInformation.MkfsTimeout > 0 {
+		lvm.MkfsTimeout = cfg.VolumeInformation.MkfsTimeout
+	}
+
+	lvm.DisableZeroing = cfg.VolumeInformation.DisableZeroing
+
+	if cfg.VolumeInformation.MountDirMode != "" {
+		if lvm.MountDirMode, err = lvm.ParseDirMode(cfg.VolumeInformation.MountDirMode); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.VolumeInformation.SnapshotSizePercent > 0 {
+		lvm.SnapshotSizePercent = cfg.VolumeInformation.SnapshotSizePercent
+	}
+	autoExtend := cfg.VolumeInformation.SnapshotAutoExtend
+	lvm.SnapshotAutoExtend = lvm.SnapshotAutoExtendPolicy{
+		Interval:  autoExtend.Interval,
+		Threshold: lvm.Percent(autoExtend.Threshold),
+		Increment: autoExtend.Increment,
+		MaxSize:   autoExtend.MaxSize,
+	}
+
+	var audit *logrus.Entry
+	if cfg.AuditLog != "" {
+		if audit, err = openAuditLog(cfg.AuditLog); err != nil {
+			return nil, err
+		}
+	}
+
 	return &Driver{
 		name:                  driverName,
 		publishInfoVolumeName: driverName + "/volume-name",
 		hostID:                nodeId,
+		healthPort:            healthPort,
+		socketPermissions:     socketPermissions,
+		debug:                 debug,
 
 		endpoint: ep,
 		log:      log,
+		audit:    audit,
 		config:   cfg,
+		thinPool: thinPool,
+		metadata: store,
+
+		healthErr: healthErr,
+
+		operations: newOperations(),
 	}, nil
 }
 
@@ -117,26 +248,40 @@ func (d *Driver) Run(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to listen: %v", err)
 	}
+	if err := d.socketPermissions.apply(grpcAddr); err != nil {
+		grpcListener.Close()
+		return err
+	}
 
-	// log response errors for better observability
-	errHandler := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-		resp, err := handler(ctx, req)
+	var healthListener net.Listener
+	if d.healthPort > 0 {
+		healthListener, err = net.Listen("tcp", fmt.Sprintf(":%d", d.healthPort))
 		if err != nil {
-			d.log.WithError(err).WithField("method", info.FullMethod).Error("method failed")
+			return fmt.Errorf("failed to listen for health checks: %v", err)
 		}
-		return resp, err
 	}
 
-	d.srv = grpc.NewServer(grpc.UnaryInterceptor(errHandler))
-	reflection.Register(d.srv)
-	csi.RegisterIdentityServer(d.srv, d)
-	csi.RegisterNodeServer(d.srv, d)
+	d.srv = d.newGRPCServer()
+
+	if err := d.Reconcile(ctx); err != nil {
+		d.log.WithError(err).Warn("failed to clean up some orphaned mounts")
+	}
 
-	d.ready = true // we're now ready to go!
+	// We're ready to go once the tools and thin pool check out.
+	d.updateHealth(ctx)
 	d.log.WithFields(logrus.Fields{
 		"grpc_addr": grpcAddr,
 	}).Info("starting server")
 
+	d.startRetention(ctx)
+	d.startChecks(ctx)
+	d.startPoolAutoExtend(ctx)
+	d.startPoolMetadataWarning(ctx)
+	d.startPoolFullPolicy(ctx)
+	d.startFstrim(ctx)
+	d.startBackupSchedule(ctx)
+	d.startLayoutBackup(ctx)
+
 	var eg errgroup.Group
 	eg.Go(func() error {
 		go func() {
@@ -145,10 +290,53 @@ func (d *Driver) Run(ctx context.Context) error {
 			d.readyMu.Lock()
 			d.ready = false
 			d.readyMu.Unlock()
+			d.drainOperations()
 			d.srv.GracefulStop()
 		}()
 		return d.srv.Serve(grpcListener)
 	})
+	if healthListener != nil {
+		d.log.WithField("health_port", d.healthPort).Info("starting health server")
+		eg.Go(func() error {
+			return d.serveHealth(ctx, healthListener)
+		})
+	}
 
 	return eg.Wait()
 }
+
+// newGRPCServer returns a gRPC server serving the CSI services of the driver.
+func (d *Driver) newGRPCServer() *grpc.Server {
+	// log response errors for better observability
+	errHandler := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		if err != nil {
+			d.log.WithFields(logrus.Fields{
+				"error":  redact.URL(err.Error()),
+				"method": info.FullMethod,
+				"req":    redact.Request(req),
+			}).Error("method failed")
+		}
+		return resp, err
+	}
+
+	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(errHandler, d.auditInterceptor, d.timeoutInterceptor))
+	reflection.Register(srv)
+	csi.RegisterIdentityServer(srv, d)
+	csi.RegisterControllerServer(srv, d)
+	csi.RegisterNodeServer(srv, d)
+	return srv
+}
+
+// drainOperations waits for in-flight backups for up to the configured
+// shutdown timeout, interrupting the ones that don't finish in time.
+func (d *Driver) drainOperations() {
+	timeout := d.config.ShutdownTimeout
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	d.log.WithField("timeout", timeout).Info("waiting for in-flight operations")
+	if !d.operations.drain(timeout) {
+		d.log.Warn("in-flight operations were interrupted")
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"io"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"nodeto/restic-csi-plugin/internal/metadata"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fakeThinPool keeps its volumes in memory instead of running LVM commands.
+type fakeThinPool struct {
+	sync.Mutex
+	Volumes []lvm.Volume
+	// Err is returned by EnsureVolumeIsPresent and EnsureVolumeIsAbsent when set.
+	Err error
+	// Unmounted records the targets passed to UnmountVolumeTarget.
+	Unmounted []string
+	// PoolStatus is returned by Status, ExtendPool grows it.
+	PoolStatus lvm.PoolStatus
+	// Cloned records the clones as "source volume".
+	Cloned []string
+	// Encrypted records the volumes created with a LUKS device.
+	Encrypted []string
+	// Block records the volumes created or grown without a filesystem.
+	Block []string
+	// Layout is written by BackupLayout.
+	Layout string
+	// Runner is returned by CommandRunner.
+	Runner lvm.CommandRunner
+}
+
+func (tp *fakeThinPool) EnsureVolumeIsPresent(ctx context.Context, volumeName string, size lvm.ByteSize, tags ...string) error {
+	tp.Lock()
+	defer tp.Unlock()
+
+	if tp.Err != nil {
+		return tp.Err
+	}
+	for i := range tp.Volumes {
+		if tp.Volumes[i].LVName == volumeName {
+			if size != 0 && tp.Volumes[i].LVSize < size {
+				tp.Volumes[i].LVSize = size
+			}
+			return nil
+		}
+	}
+	tp.Volumes = append(tp.Volumes, lvm.Volume{VGName: "vg0", LVName: volumeName, LVAttr: "Vwi-a-tz--", LVSize: size, Tags: tags})
+	return nil
+}
+
+func (tp *fakeThinPool) EnsureEncryptedVolumeIsPresent(ctx context.Context, volumeName string, size lvm.ByteSize, tags ...string) error {
+	if err := tp.EnsureVolumeIsPresent(ctx, volumeName, size, tags...); err != nil {
+		return err
+	}
+	tp.Lock()
+	defer tp.Unlock()
+	tp.Encrypted = append(tp.Encrypted, volumeName)
+	return nil
+}
+
+func (tp *fakeThinPool) EnsureBlockVolumeIsPresent(ctx context.Context, volumeName string, size lvm.ByteSize, tags ...string) error {
+	if err := tp.EnsureVolumeIsPresent(ctx, volumeName, size, tags...); err != nil {
+		return err
+	}
+	tp.Lock()
+	defer tp.Unlock()
+	tp.Block = append(tp.Block, volumeName)
+	return nil
+}
+
+func (tp *fakeThinPool) EnsureVolumeIsAbsent(ctx context.Context, volumeName string) error {
+	tp.Lock()
+	defer tp.Unlock()
+
+	if tp.Err != nil {
+		return tp.Err
+	}
+	for i := range tp.Volumes {
+		if tp.Volumes[i].LVName == volumeName {
+			tp.Volumes = append(tp.Volumes[:i], tp.Volumes[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (tp *fakeThinPool) GetVolume(ctx context.Context, volumeName string) *lvm.Volume {
+	tp.Lock()
+	defer tp.Unlock()
+
+	for i := range tp.Volumes {
+		if tp.Volumes[i].LVName == volumeName {
+			return &tp.Volumes[i]
+		}
+	}
+	return nil
+}
+
+func (tp *fakeThinPool) ListVolumes(ctx context.Context) []lvm.Volume {
+	tp.Lock()
+	defer tp.Unlock()
+
+	volumes := append([]lvm.Volume{}, tp.Volumes...)
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].LVName < volumes[j].LVName
+	})
+	return volumes
+}
+
+func (tp *fakeThinPool) UnmountVolumeTarget(ctx context.Context, volumeName string, target string) error {
+	tp.Lock()
+	defer tp.Unlock()
+
+	tp.Unmounted = append(tp.Unmounted, target)
+	return nil
+}
+
+func (tp *fakeThinPool) CloneVolume(ctx context.Context, sourceName string, volumeName string, size lvm.ByteSize, encrypted bool, block bool, tags ...string) error {
+	tp.Lock()
+	defer tp.Unlock()
+
+	if tp.Err != nil {
+		return tp.Err
+	}
+	for _, source := range tp.Volumes {
+		if source.LVName == sourceName {
+			if size < source.LVSize {
+				size = source.LVSize
+			}
+			tp.Cloned = append(tp.Cloned, sourceName+" "+volumeName)
+			if block {
+				tp.Block = append(tp.Block, volumeName)
+			}
+			tp.Volumes = append(tp.Volumes, lvm.Volume{VGName: "vg0", LVName: volumeName, LVAttr: "Vwi-a-tz--", LVSize: size, Origin: sourceName, Tags: tags})
+			return nil
+		}
+	}
+	return lvm.ErrVolumeNotFound
+}
+
+func (tp *fakeThinPool) Status(ctx context.Context) (lvm.PoolStatus, error) {
+	tp.Lock()
+	defer tp.Unlock()
+
+	return tp.PoolStatus, nil
+}
+
+func (tp *fakeThinPool) CommandRunner() lvm.CommandRunner {
+	return tp.Runner
+}
+
+func (tp *fakeThinPool) BackupLayout(ctx context.Context, path string) error {
+	tp.Lock()
+	defer tp.Unlock()
+
+	return os.WriteFile(path, []byte(tp.Layout), 0600)
+}
+
+func (tp *fakeThinPool) ExtendPool(ctx context.Context, data lvm.ByteSize, metadata lvm.ByteSize) error {
+	tp.Lock()
+	defer tp.Unlock()
+
+	if data+metadata > tp.PoolStatus.VGFree {
+		return lvm.ErrPoolFull
+	}
+	status := &tp.PoolStatus
+	if data > 0 {
+		status.DataPercent = lvm.Percent(float64(status.DataPercent) * float64(status.Size) / float64(status.Size+data))
+		status.Size += data
+	}
+	if metadata > 0 {
+		status.MetadataPercent = lvm.Percent(float64(status.MetadataPercent) * float64(status.MetadataSize) / float64(status.MetadataSize+metadata))
+		status.MetadataSize += metadata
+	}
+	status.VGFree -= data + metadata
+	return nil
+}
+
+// newTestDriver returns a driver using the fake thin pool with logging discarded.
+func newTestDriver(thinPool *fakeThinPool) *Driver {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	store, _ := metadata.Open("")
+
+	return &Driver{
+		name:     DefaultDriverName,
+		hostID:   "test-node",
+		log:      logger.WithField("test", true),
+		config:   &config.Config{},
+		thinPool: thinPool,
+		metadata: store,
+
+		operations: newOperations(),
+	}
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/restic"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Tags of restic snapshots taken for CSI snapshots. The name and source
+// volume are recorded as "key=value" tags, see restic.Tag, to find the
+// snapshots again.
+const (
+	csiSnapshotTag       = "csi-snapshot"
+	csiSnapshotNameTag   = "csi-snapshot-name"
+	csiSnapshotVolumeTag = "csi-volume"
+)
+
+// resticSnapshots reports whether CSI snapshots are taken with restic.
+func (d *Driver) resticSnapshots() bool {
+	return d.config.VolumeInformation.SnapshotBackend == config.SnapshotBackendRestic
+}
+
+// snapshotDestination returns the restic repository CSI snapshots are kept in.
+func (d *Driver) snapshotDestination() (config.Destination, error) {
+	if !d.resticSnapshots() {
+		return config.Destination{}, status.Error(codes.Unimplemented, "snapshots are only supported with the restic snapshot backend")
+	}
+	if len(d.config.ResticRepo) == 0 {
+		return config.Destination{}, status.Error(codes.FailedPrecondition, "no restic repository is configured")
+	}
+	return d.config.ResticRepo[0], nil
+}
+
+// resticError converts an error from the restic package to a gRPC status error.
+func resticError(err error) error {
+	if errors.Is(err, restic.ErrRepositoryLocked) {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	if errors.Is(err, restic.ErrAppendOnly) {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// tagValue returns the value of the first "key=value" tag with key.
+func tagValue(snapshot restic.Snapshot, key string) string {
+	prefix := key + "="
+	for _, tag := range snapshot.Tags {
+		if strings.HasPrefix(tag, prefix) {
+			return strings.TrimPrefix(tag, prefix)
+		}
+	}
+	return ""
+}
+
+// csiSnapshot converts a restic snapshot to a CSI snapshot.
+func csiSnapshot(snapshot restic.Snapshot) *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:     snapshot.ID,
+		SourceVolumeId: tagValue(snapshot, csiSnapshotVolumeTag),
+		CreationTime:   timestamppb.New(snapshot.Time),
+		ReadyToUse:     true,
+	}
+}
+
+// CreateSnapshot will be called by the CO to create a new snapshot from a
+// source volume on behalf of a user. The mounted volume is backed up with
+// restic and the restic snapshot ID is the snapshot ID.
+func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot Name must be provided")
+	}
+	if req.SourceVolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot Source Volume ID must be provided")
+	}
+
+	dest, err := d.snapshotDestination()
+	if err != nil {
+		return nil, err
+	}
+
+	log := d.log.WithFields(logrus.Fields{
+		"snapshot_name":    req.Name,
+		"source_volume_id": req.SourceVolumeId,
+		"method":           "create_snapshot",
+	})
+	log.Info("create snapshot called")
+
+	// A retried request returns the snapshot taken the first time.
+	existing, err := restic.Snapshots(ctx, dest, csiSnapshotTag, restic.Tag(csiSnapshotNameTag, req.Name))
+	if err != nil {
+		return nil, resticError(err)
+	}
+	if len(existing) > 0 {
+		snapshot := csiSnapshot(existing[0])
+		if snapshot.SourceVolumeId != req.SourceVolumeId {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot %q already exists for volume %q", req.Name, snapshot.SourceVolumeId)
+		}
+		log.WithField("snapshot_id", snapshot.SnapshotId).Info("snapshot already exists")
+		return &csi.CreateSnapshotResponse{Snapshot: snapshot}, nil
+	}
+
+	volume := d.thinPool.GetVolume(ctx, d.lvName(req.SourceVolumeId))
+	if volume == nil {
+		return nil, status.Errorf(codes.NotFound, "volume %q not found", req.SourceVolumeId)
+	}
+	if !volume.Mounted {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %q must be mounted to be snapshotted", req.SourceVolumeId)
+	}
+
+	ctx, done, err := d.operations.start(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	defer done()
+
+	snapshotID, err := restic.Backup(ctx, dest, volume.Target, csiSnapshotTag, restic.Tag(csiSnapshotNameTag, req.Name), restic.Tag(csiSnapshotVolumeTag, req.SourceVolumeId))
+	if err != nil {
+		return nil, resticError(err)
+	}
+
+	log.WithField("snapshot_id", snapshotID).Info("snapshot created")
+	return &csi.CreateSnapshotResponse{
+		Snapshot: &csi.Snapshot{
+			SnapshotId:     snapshotID,
+			SourceVolumeId: req.SourceVolumeId,
+			CreationTime:   timestamppb.Now(),
+			ReadyToUse:     true,
+		},
+	}, nil
+}
+
+// DeleteSnapshot will be called by the CO to delete a snapshot. The restic
+// snapshot is forgotten, its data is freed by the next prune.
+func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	if req.SnapshotId == "" {
+		return nil, status.Error(codes.InvalidArgument, "DeleteSnapshot Snapshot ID must be provided")
+	}
+
+	dest, err := d.snapshotDestination()
+	if err != nil {
+		return nil, err
+	}
+
+	log := d.log.WithFields(logrus.Fields{
+		"snapshot_id": req.SnapshotId,
+		"method":      "delete_snapshot",
+	})
+	log.Info("delete snapshot called")
+
+	snapshots, err := restic.Snapshots(ctx, dest, csiSnapshotTag)
+	if err != nil {
+		return nil, resticError(err)
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.ID == req.SnapshotId {
+			if err := restic.Forget(ctx, dest, snapshot.ID); err != nil {
+				return nil, resticError(err)
+			}
+			log.Info("snapshot is deleted")
+			return &csi.DeleteSnapshotResponse{}, nil
+		}
+	}
+
+	log.Info("snapshot is already deleted")
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// ListSnapshots returns the information about all snapshots on the storage
+// system within the given parameters regardless of how they were created.
+func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	if req.MaxEntries < 0 {
+		return nil, status.Error(codes.InvalidArgument, "ListSnapshots Max entries must not be negative")
+	}
+
+	dest, err := d.snapshotDestination()
+	if err != nil {
+		return nil, err
+	}
+
+	log := d.log.WithFields(logrus.Fields{
+		"snapshot_id":      req.SnapshotId,
+		"source_volume_id": req.SourceVolumeId,
+		"max_entries":      req.MaxEntries,
+		"starting_token":   req.StartingToken,
+		"method":           "list_snapshots",
+	})
+	log.Info("list snapshots called")
+
+	tags := []string{csiSnapshotTag}
+	if req.SourceVolumeId != "" {
+		tags = append(tags, restic.Tag(csiSnapshotVolumeTag, req.SourceVolumeId))
+	}
+	snapshots, err := restic.Snapshots(ctx, dest, tags...)
+	if err != nil {
+		return nil, resticError(err)
+	}
+
+	var matching []*csi.Snapshot
+	for _, snapshot := range snapshots {
+		if req.SnapshotId == "" || snapshot.ID == req.SnapshotId {
+			matching = append(matching, csiSnapshot(snapshot))
+		}
+	}
+
+	start, end, nextToken, err := paginate(len(matching), req.MaxEntries, req.StartingToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*csi.ListSnapshotsResponse_Entry
+	for _, snapshot := range matching[start:end] {
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: snapshot})
+	}
+
+	log.WithField("entries", len(entries)).Info("snapshots listed")
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"nodeto/restic-csi-plugin/internal/restic"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const resticSnapshotsOutput = `[
+  {"time":"2024-03-01T10:00:00Z","paths":["/mnt/test"],"tags":["csi-snapshot","csi-snapshot-name=snapshot-1","csi-volume=test-volume"],"id":"4f3a2b1c"},
+  {"time":"2024-03-02T10:00:00Z","paths":["/mnt/other"],"tags":["csi-snapshot","csi-snapshot-name=snapshot-2","csi-volume=other-volume"],"id":"9e8d7c6b"}
+]`
+
+// mockRestic points restic at a script printing the output for each
+// subcommand, and returns a function listing the recorded invocations.
+func mockRestic(t *testing.T, outputs map[string]string) func() []string {
+	dir := t.TempDir()
+	for subcommand, output := range outputs {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, subcommand+".out"), []byte(output), 0644))
+	}
+	script := "#!/bin/sh\n" +
+		"echo \"$*\" >> " + dir + "/invocations\n" +
+		"if [ -f " + dir + "/$1.out ]; then cat " + dir + "/$1.out; fi\n"
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "restic"), []byte(script), 0755))
+
+	restic.Binary = filepath.Join(dir, "restic")
+	t.Cleanup(func() { restic.Binary = "restic" })
+
+	return func() []string {
+		data, _ := os.ReadFile(filepath.Join(dir, "invocations"))
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+}
+
+func newResticSnapshotDriver(thinPool *fakeThinPool) *Driver {
+	d := newTestDriver(thinPool)
+	d.config.VolumeInformation.SnapshotBackend = config.SnapshotBackendRestic
+	d.config.ResticRepo = []config.Destination{{Repository: "/mnt/backup/restic"}}
+	return d
+}
+
+func TestCreateResticSnapshot(t *testing.T) {
+	invocations := mockRestic(t, map[string]string{
+		"snapshots": "[]",
+		"backup":    `{"message_type":"summary","snapshot_id":"4f3a2b1c"}` + "\n",
+	})
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "test-volume", Mounted: true, Target: "/mnt/test"}}}
+	d := newResticSnapshotDriver(thinPool)
+
+	resp, err := d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snapshot-1", SourceVolumeId: "test-volume"})
+	assert.Nil(t, err)
+	assert.Equal(t, "4f3a2b1c", resp.Snapshot.SnapshotId)
+	assert.Equal(t, "test-volume", resp.Snapshot.SourceVolumeId)
+	assert.True(t, resp.Snapshot.ReadyToUse)
+	assert.Equal(t, []string{
+		"snapshots --json --tag csi-snapshot,csi-snapshot-name=snapshot-1",
+		"backup --json --tag csi-snapshot --tag csi-snapshot-name=snapshot-1 --tag csi-volume=test-volume /mnt/test",
+	}, invocations())
+}
+
+func TestCreateResticSnapshotSanitizesTags(t *testing.T) {
+	invocations := mockRestic(t, map[string]string{
+		"snapshots": "[]",
+		"backup":    `{"message_type":"summary","snapshot_id":"4f3a2b1c"}` + "\n",
+	})
+	thinPool := &fakeThinPool{Volumes: []lvm.Volume{{VGName: "vg0", LVName: "test-volume", Mounted: true, Target: "/mnt/test"}}}
+	d := newResticSnapshotDriver(thinPool)
+
+	// A comma would split the tag in two
+	_, err := d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "nightly,keep", SourceVolumeId: "test-volume"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"snapshots --json --tag csi-snapshot,csi-snapshot-name=nightly_keep",
+		"backup --json --tag csi-snapshot --tag csi-snapshot-name=nightly_keep --tag csi-volume=test-volume /mnt/test",
+	}, invocations())
+}
+
+func TestCreateResticSnapshotRetry(t *testing.T) {
+	invocations := mockRestic(t, map[string]string{"snapshots": resticSnapshotsOutput})
+	d := newResticSnapshotDriver(&fakeThinPool{})
+
+	// The existing snapshot is returned without a backup
+	resp, err := d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snapshot-1", SourceVolumeId: "test-volume"})
+	assert.Nil(t, err)
+	assert.Equal(t, "4f3a2b1c", resp.Snapshot.SnapshotId)
+	assert.Len(t, invocations(), 1)
+
+	// Our fake restic ignores the tag filter, the first snapshot is for test-volume
+	_, err = d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snapshot-1", SourceVolumeId: "other-volume"})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+}
+
+func TestListResticSnapshots(t *testing.T) {
+	invocations := mockRestic(t, map[string]string{"snapshots": resticSnapshotsOutput})
+	d := newResticSnapshotDriver(&fakeThinPool{})
+	ctx := context.Background()
+
+	resp, err := d.ListSnapshots(ctx, &csi.ListSnapshotsRequest{MaxEntries: 1})
+	assert.Nil(t, err)
+	assert.Len(t, resp.Entries, 1)
+	assert.Equal(t, "4f3a2b1c", resp.Entries[0].Snapshot.SnapshotId)
+	assert.Equal(t, "test-volume", resp.Entries[0].Snapshot.SourceVolumeId)
+	assert.Equal(t, int64(1709287200), resp.Entries[0].Snapshot.CreationTime.Seconds)
+	assert.Equal(t, "1", resp.NextToken)
+
+	resp, err = d.ListSnapshots(ctx, &csi.ListSnapshotsRequest{MaxEntries: 1, StartingToken: resp.NextToken})
+	assert.Nil(t, err)
+	assert.Equal(t, "9e8d7c6b", resp.Entries[0].Snapshot.SnapshotId)
+	assert.Equal(t, "", resp.NextToken)
+
+	resp, err = d.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SnapshotId: "9e8d7c6b"})
+	assert.Nil(t, err)
+	assert.Len(t, resp.Entries, 1)
+
+	_, err = d.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SourceVolumeId: "test-volume"})
+	assert.Nil(t, err)
+	assert.Equal(t, "snapshots --json --tag csi-snapshot,csi-volume=test-volume", invocations()[3])
+}
+
+func TestDeleteResticSnapshot(t *testing.T) {
+	invocations := mockRestic(t, map[string]string{"snapshots": resticSnapshotsOutput})
+	d := newResticSnapshotDriver(&fakeThinPool{})
+	ctx := context.Background()
+
+	_, err := d.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: "9e8d7c6b"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"snapshots --json --tag csi-snapshot", "forget 9e8d7c6b"}, invocations())
+
+	// Deleting a missing snapshot succeeds without forgetting anything
+	_, err = d.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: "00000000"})
+	assert.Nil(t, err)
+	assert.Len(t, invocations(), 3)
+}
+
+func TestDeleteResticSnapshotForgottenConcurrently(t *testing.T) {
+	// The snapshot is still listed but was forgotten by the time it's
+	// forgotten again
+	invocations := mockRestic(t, map[string]string{"snapshots": resticSnapshotsOutput})
+	script := filepath.Join(filepath.Dir(restic.Binary), "restic")
+	data, err := os.ReadFile(script)
+	assert.Nil(t, err)
+	data = append(data, "if [ $1 = forget ]; then echo \"Ignoring \\\"$2\\\": no matching ID found for prefix \\\"$2\\\"\" >&2; exit 1; fi\n"...)
+	assert.Nil(t, os.WriteFile(script, data, 0755))
+	d := newResticSnapshotDriver(&fakeThinPool{})
+
+	for i := 0; i < 2; i++ {
+		_, err := d.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: "9e8d7c6b"})
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []string{"snapshots --json --tag csi-snapshot", "forget 9e8d7c6b", "snapshots --json --tag csi-snapshot", "forget 9e8d7c6b"}, invocations())
+}
+
+func TestSnapshotsRequireResticBackend(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{})
+
+	_, err := d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snapshot-1", SourceVolumeId: "test-volume"})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+
+	resp, err := d.ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+	assert.Nil(t, err)
+	for _, capability := range resp.Capabilities {
+		assert.NotEqual(t, csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT, capability.GetRpc().GetType())
+	}
+}
+
+func TestRetentionLeavesCSISnapshotsAlone(t *testing.T) {
+	invocations := mockRestic(t, map[string]string{"forget": `[]`})
+	d := newResticSnapshotDriver(&fakeThinPool{})
+	dest := d.config.ResticRepo[0]
+	dest.Retention = config.RetentionPolicy{KeepDaily: 7}
+
+	d.applyRetention(context.Background(), dest)
+	assert.Equal(t, []string{"forget --json --keep-tag csi-snapshot --keep-daily 7"}, invocations())
+}
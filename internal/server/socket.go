@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"nodeto/restic-csi-plugin/internal/filemode"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// SocketPermissions are the mode and group applied to the gRPC socket once
+// it is created, so a kubelet running as a non-root group can connect. The
+// zero value keeps the defaults of net.Listen.
+type SocketPermissions struct {
+	mode os.FileMode
+	// gid is only applied when setGroup is set, as 0 is the root group.
+	gid      int
+	setGroup bool
+}
+
+// ParseSocketPermissions parses an octal mode, ie "0660", and a group name or
+// ID. Empty values keep the defaults.
+func ParseSocketPermissions(mode, group string) (SocketPermissions, error) {
+	var perms SocketPermissions
+	if mode != "" {
+		val, err := filemode.Parse("socket mode", mode)
+		if err != nil {
+			return perms, err
+		}
+		perms.mode = val
+	}
+	if group != "" {
+		gid, err := lookupGroup(group)
+		if err != nil {
+			return perms, err
+		}
+		perms.gid = gid
+		perms.setGroup = true
+	}
+	return perms, nil
+}
+
+// lookupGroup resolves a group name or numeric ID to an existing group's ID.
+func lookupGroup(group string) (int, error) {
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		var idErr error
+		g, idErr = user.LookupGroupId(group)
+		if idErr != nil {
+			return 0, fmt.Errorf("socket group %q not found: %v", group, err)
+		}
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// apply sets the permissions on the socket at path.
+func (perms SocketPermissions) apply(path string) error {
+	if perms.mode != 0 {
+		if err := os.Chmod(path, perms.mode); err != nil {
+			return fmt.Errorf("failed to set socket mode: %v", err)
+		}
+	}
+	if perms.setGroup {
+		if err := os.Chown(path, -1, perms.gid); err != nil {
+			return fmt.Errorf("failed to set socket group: %v", err)
+		}
+	}
+	return nil
+}
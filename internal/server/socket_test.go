@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSocketPermissions(t *testing.T) {
+	perms, err := ParseSocketPermissions("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, SocketPermissions{}, perms)
+
+	perms, err = ParseSocketPermissions("0660", strconv.Itoa(os.Getgid()))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0660), perms.mode)
+	assert.Equal(t, os.Getgid(), perms.gid)
+	assert.True(t, perms.setGroup)
+
+	for _, mode := range []string{"rw-rw----", "0999", "1777"} {
+		_, err = ParseSocketPermissions(mode, "")
+		assert.NotNil(t, err, mode)
+	}
+	_, err = ParseSocketPermissions("", "no-such-group")
+	assert.NotNil(t, err)
+}
+
+func TestRunAppliesSocketPermissions(t *testing.T) {
+	mockHealthyNode(t)
+	group, err := user.LookupGroupId(strconv.Itoa(os.Getgid()))
+	assert.Nil(t, err)
+	perms, err := ParseSocketPermissions("0660", group.Name)
+	assert.Nil(t, err)
+
+	socket := filepath.Join(t.TempDir(), "csi.sock")
+	d := newTestDriver(&fakeThinPool{})
+	d.endpoint = "unix://" + socket
+	d.socketPermissions = perms
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Run(ctx) }()
+
+	// The permissions are set before the driver reports ready
+	assert.Eventually(t, func() bool {
+		d.readyMu.Lock()
+		defer d.readyMu.Unlock()
+		return d.ready
+	}, 5*time.Second, 10*time.Millisecond)
+	info, err := os.Stat(socket)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0660), info.Mode().Perm())
+	assert.Equal(t, uint32(os.Getgid()), info.Sys().(*syscall.Stat_t).Gid)
+
+	cancel()
+	assert.Nil(t, <-done)
+}
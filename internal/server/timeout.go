@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"path"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultRPCTimeout bounds CSI calls without a deadline when the
+// configuration doesn't set rpc_timeout.
+const DefaultRPCTimeout = 2 * time.Minute
+
+// defaultRPCTimeouts are the timeouts of calls which take longer than
+// DefaultRPCTimeout, unless overridden by rpc_timeouts.
+var defaultRPCTimeouts = map[string]time.Duration{
+	// Backs up the whole volume to restic.
+	"CreateSnapshot": time.Hour,
+}
+
+// rpcTimeout returns the timeout of the method, ie "CreateSnapshot".
+func (d *Driver) rpcTimeout(method string) time.Duration {
+	if timeout, ok := d.config.RPCTimeouts[method]; ok {
+		return timeout
+	}
+	if timeout, ok := defaultRPCTimeouts[method]; ok {
+		return timeout
+	}
+	// Unstaging may back up the volume first, which has its own timeout,
+	// and then unmounts it within the usual one.
+	if method == "NodeUnstageVolume" {
+		return d.unstageBackupTimeout() + d.defaultRPCTimeout()
+	}
+	return d.defaultRPCTimeout()
+}
+
+// defaultRPCTimeout returns the timeout of calls without one of their own.
+func (d *Driver) defaultRPCTimeout() time.Duration {
+	if d.config.RPCTimeout > 0 {
+		return d.config.RPCTimeout
+	}
+	return DefaultRPCTimeout
+}
+
+// timeoutInterceptor gives calls arriving without a deadline the method's
+// timeout, so a hung LVM or restic command can't block a handler forever.
+func (d *Driver) timeoutInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if _, ok := ctx.Deadline(); ok {
+		return handler(ctx, req)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.rpcTimeout(path.Base(info.FullMethod)))
+	defer cancel()
+	resp, err := handler(ctx, req)
+	if _, ok := status.FromError(err); !ok && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = status.Errorf(codes.DeadlineExceeded, "%s timed out: %v", info.FullMethod, err)
+	}
+	return resp, err
+}
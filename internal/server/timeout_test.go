@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// slowHandler blocks until its context is done.
+func slowHandler(ctx context.Context, req interface{}) (interface{}, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestTimeoutInterceptorCancelsSlowHandler(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{})
+	d.config.RPCTimeout = 50 * time.Millisecond
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+
+	start := time.Now()
+	_, err := d.timeoutInterceptor(context.Background(), nil, info, slowHandler)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestTimeoutInterceptorKeepsDeadline(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{})
+	d.config.RPCTimeout = time.Hour
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := d.timeoutInterceptor(ctx, nil, info, slowHandler)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestRPCTimeout(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{})
+	assert.Equal(t, DefaultRPCTimeout, d.rpcTimeout("Probe"))
+	assert.Equal(t, time.Hour, d.rpcTimeout("CreateSnapshot"))
+
+	d.config.RPCTimeout = 10 * time.Second
+	d.config.RPCTimeouts = map[string]time.Duration{"CreateSnapshot": 3 * time.Hour}
+	assert.Equal(t, 10*time.Second, d.rpcTimeout("Probe"))
+	assert.Equal(t, 3*time.Hour, d.rpcTimeout("CreateSnapshot"))
+}
+
+func TestTimeoutInterceptorUnstageOutlastsBackup(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{})
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeUnstageVolume"}
+	var deadline time.Time
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		deadline, _ = ctx.Deadline()
+		return nil, nil
+	}
+
+	start := time.Now()
+	_, err := d.timeoutInterceptor(context.Background(), nil, info, handler)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, start.Add(DefaultUnstageBackupTimeout+DefaultRPCTimeout), deadline, time.Minute)
+
+	// The unmount after a backup taking all of its timeout still has the
+	// usual one
+	d.config.RPCTimeout = 30 * time.Second
+	d.config.VolumeInformation.UnstageBackupTimeout = time.Hour
+	assert.Equal(t, time.Hour+30*time.Second, d.rpcTimeout("NodeUnstageVolume"))
+	d.config.RPCTimeouts = map[string]time.Duration{"NodeUnstageVolume": 5 * time.Minute}
+	assert.Equal(t, 5*time.Minute, d.rpcTimeout("NodeUnstageVolume"))
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// backupOnUnstageParameter is the StorageClass parameter overriding whether a
+// volume is backed up before it's unstaged, ie backup_on_unstage: "true".
+const backupOnUnstageParameter = "backup_on_unstage"
+
+// DefaultUnstageBackupTimeout is how long the backup before unstaging may
+// take by default.
+const DefaultUnstageBackupTimeout = 10 * time.Minute
+
+// unstageBackup allows mocking of the backups taken before unstaging.
+var unstageBackup = (*Driver).backupVolume
+
+// parseBackupOnUnstage parses the backup_on_unstage parameter, nil when it's
+// not set.
+func parseBackupOnUnstage(parameters map[string]string) (*bool, error) {
+	value, ok := parameters[backupOnUnstageParameter]
+	if !ok {
+		return nil, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("parameter %s must be true or false, got %q", backupOnUnstageParameter, value)
+	}
+	return &enabled, nil
+}
+
+// unstageBackupTimeout returns how long the backup before unstaging may take.
+func (d *Driver) unstageBackupTimeout() time.Duration {
+	if d.config.VolumeInformation.UnstageBackupTimeout > 0 {
+		return d.config.VolumeInformation.UnstageBackupTimeout
+	}
+	return DefaultUnstageBackupTimeout
+}
+
+// backupBeforeUnstage takes a last backup of a staged volume before it's
+// unmounted, when enabled for the volume. The backup is given up on after
+// the unstage backup timeout so unstaging isn't blocked indefinitely. A failed
+// backup is only logged unless backups before unstaging are required.
+func (d *Driver) backupBeforeUnstage(ctx context.Context, log *logrus.Entry, volumeID string) error {
+	if len(d.config.ResticRepo) == 0 {
+		return nil
+	}
+	volumeMetadata, recorded := d.metadata.Get(volumeID)
+	enabled := d.config.VolumeInformation.BackupOnUnstage
+	if volumeMetadata.BackupOnUnstage != nil {
+		enabled = *volumeMetadata.BackupOnUnstage
+	}
+	// Block volumes have no filesystem to back up.
+	if !enabled || volumeMetadata.Block {
+		return nil
+	}
+	// A volume which is no longer mounted was unstaged by an earlier attempt.
+	volume := d.thinPool.GetVolume(ctx, d.lvName(volumeID))
+	if volume == nil || !volume.Mounted {
+		return nil
+	}
+
+	timeout := d.unstageBackupTimeout()
+	backupCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	log.Info("backing up the volume before unstaging it")
+	err := unstageBackup(d, backupCtx, volume, recordedVolumeContext(volumeMetadata, recorded))
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("backup did not finish within %s: %w", timeout, err)
+	}
+	if d.config.VolumeInformation.UnstageBackupRequired {
+		return fmt.Errorf("backup before unstaging failed: %w", err)
+	}
+	log.WithError(err).Error("backup before unstaging failed, unstaging the volume anyway")
+	return nil
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"nodeto/restic-csi-plugin/config"
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"nodeto/restic-csi-plugin/internal/metadata"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// mockUnstageBackup records the volumes backed up before unstaging, failing
+// with err, and the unmounts which followed.
+func mockUnstageBackup(t *testing.T, err error) *[]string {
+	var calls []string
+	unstageBackup = func(d *Driver, ctx context.Context, volume *lvm.Volume, volumeContext map[string]string) error {
+		_, hasDeadline := ctx.Deadline()
+		assert.True(t, hasDeadline)
+		calls = append(calls, "backup "+volume.LVName)
+		return err
+	}
+	unmount = func(ctx context.Context, runner lvm.CommandRunner, target string) error {
+		calls = append(calls, "unmount "+target)
+		return nil
+	}
+	t.Cleanup(func() {
+		unstageBackup = (*Driver).backupVolume
+		unmount = lvm.Unmount
+	})
+	return &calls
+}
+
+func newUnstageDriver() *Driver {
+	d := newTestDriver(stagedThinPool("/mnt/staging/test-volume"))
+	d.config.ResticRepo = []config.Destination{{Repository: "/mnt/backup/restic"}}
+	d.config.VolumeInformation.BackupOnUnstage = true
+	return d
+}
+
+func unstageTestVolume(d *Driver) error {
+	_, err := d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          "test-volume",
+		StagingTargetPath: "/mnt/staging/test-volume",
+	})
+	return err
+}
+
+func TestNodeUnstageVolumeBacksUpFirst(t *testing.T) {
+	calls := mockUnstageBackup(t, nil)
+	d := newUnstageDriver()
+
+	assert.Nil(t, unstageTestVolume(d))
+	assert.Equal(t, []string{"backup test-volume", "unmount /mnt/staging/test-volume"}, *calls)
+}
+
+func TestNodeUnstageVolumeBackupCanBeDisabled(t *testing.T) {
+	calls := mockUnstageBackup(t, nil)
+	d := newUnstageDriver()
+	disabled := false
+	assert.Nil(t, d.metadata.Put("test-volume", metadata.Volume{Backup: true, BackupOnUnstage: &disabled}))
+
+	assert.Nil(t, unstageTestVolume(d))
+	assert.Equal(t, []string{"unmount /mnt/staging/test-volume"}, *calls)
+}
+
+func TestNodeUnstageVolumeAfterFailedBackup(t *testing.T) {
+	calls := mockUnstageBackup(t, errors.New("repository is unreachable"))
+	d := newUnstageDriver()
+	d.config.VolumeInformation.UnstageBackupTimeout = time.Minute
+
+	// The failure is logged and the volume unstaged anyway
+	assert.Nil(t, unstageTestVolume(d))
+	assert.Equal(t, []string{"backup test-volume", "unmount /mnt/staging/test-volume"}, *calls)
+
+	// Unless the backup is required, then the CO retries
+	*calls = nil
+	d.config.VolumeInformation.UnstageBackupRequired = true
+	err := unstageTestVolume(d)
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Contains(t, err.Error(), "repository is unreachable")
+	assert.Equal(t, []string{"backup test-volume"}, *calls)
+}
+
+func TestCreateVolumeValidatesBackupOnUnstage(t *testing.T) {
+	d := newTestDriver(&fakeThinPool{})
+
+	_, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "test-volume",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		Parameters:         map[string]string{backupOnUnstageParameter: "sometimes"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
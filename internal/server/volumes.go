@@ -0,0 +1,57 @@
+package server
+
+import (
+	"nodeto/restic-csi-plugin/internal/lvm"
+	"strings"
+	"time"
+)
+
+// Keys of the LVM tags tracing a volume back to its CSI volume and the PVC it
+// was provisioned for.
+const (
+	volumeIDTag     = "csi-volume-id"
+	pvcNameTag      = "csi-pvc-name"
+	pvcNamespaceTag = "csi-pvc-namespace"
+	createdTag      = "csi-created"
+)
+
+// The CreateVolume parameters of the PVC, passed by the external-provisioner
+// with --extra-create-metadata.
+const (
+	pvcNameParameter      = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceParameter = "csi.storage.k8s.io/pvc/namespace"
+)
+
+// creationTime allows mocking of the creation time tagged on new volumes.
+var creationTime = time.Now
+
+// volumeTags returns the LVM tags of a new volume: its ID, the PVC if the
+// parameters name it and when it was created.
+func volumeTags(volumeID string, parameters map[string]string) []string {
+	tags := []string{lvm.NewTag(volumeIDTag, volumeID)}
+	if name, ok := parameters[pvcNameParameter]; ok {
+		tags = append(tags, lvm.NewTag(pvcNameTag, name))
+	}
+	if namespace, ok := parameters[pvcNamespaceParameter]; ok {
+		tags = append(tags, lvm.NewTag(pvcNamespaceTag, namespace))
+	}
+	return append(tags, lvm.NewTag(createdTag, creationTime().UTC().Format(time.RFC3339)))
+}
+
+// lvName returns the LV of the volume ID, as recorded when the volume was
+// created. Volumes created without a mapping are named after their ID.
+func (d *Driver) lvName(volumeID string) string {
+	if volume, ok := d.metadata.Get(volumeID); ok && volume.LVName != "" {
+		return volume.LVName
+	}
+	return lvm.VolumeNameFor(volumeID)
+}
+
+// volumeID returns the ID of the volume stored in the LV, the reverse of
+// lvName. LVs without a recorded ID are named after it after the prefix.
+func (d *Driver) volumeID(lvName string) string {
+	if volumeID, ok := d.metadata.VolumeIDOf(lvName); ok {
+		return volumeID
+	}
+	return strings.TrimPrefix(lvName, lvm.VolumeNamePrefix)
+}